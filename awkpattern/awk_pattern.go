@@ -0,0 +1,906 @@
+// Package awkpattern implements a parser for awk patterns, i.e. the
+// expressions which nerdlog users type in the query input, like
+// `/foo/ && $5 ~ /bar/`. It supports the subset of awk which makes sense in a
+// pattern: regex, string and numeric literals, fields, variables, function
+// calls, arithmetic, comparisons, regex matching and boolean operators.
+//
+// It's used to validate the patterns before sending them to the hosts, and
+// to edit them structurally, e.g. to add or remove a term from the top-level
+// "&&" chain; see AddTerm, RemoveTerm and ToggleTerm.
+package awkpattern
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxError is returned when the pattern can't be parsed.
+type SyntaxError struct {
+	// Pos is the position in the pattern where the error occurred, as a
+	// 1-based character (not byte) number.
+	Pos int
+
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// Position returns the same as Pos; it exists so that the callers can get the
+// error position without depending on this particular error type.
+func (e *SyntaxError) Position() int {
+	return e.Pos
+}
+
+// NodeKind is the kind of the AST node.
+type NodeKind int
+
+const (
+	// NodeNumber is a numeric literal; Value is the literal as written.
+	NodeNumber NodeKind = iota
+	// NodeString is a string literal; Value is the literal as written,
+	// including the quotes.
+	NodeString
+	// NodeRegex is a regex literal; Value is the regex without the slashes.
+	NodeRegex
+	// NodeVar is a variable like NF; Value is its name.
+	NodeVar
+	// NodeField is a field like $5; Args[0] is the field number expression.
+	NodeField
+	// NodeIndex is an array element like arr[1]; Value is the array name,
+	// Args are subscripts.
+	NodeIndex
+	// NodeCall is a function call like substr($5, 2); Value is the function
+	// name, Args are the arguments.
+	NodeCall
+	// NodeGroup is an expression in parens; Args[0] is the expression.
+	NodeGroup
+	// NodeUnary is a unary prefix operator, including pre-increment and
+	// pre-decrement; Op is the operator, Args[0] is the operand.
+	NodeUnary
+	// NodePostfix is a post-increment or post-decrement; Op is the operator,
+	// Args[0] is the operand.
+	NodePostfix
+	// NodeBinary is a binary operator, including assignments and "in"; Op is
+	// the operator (empty for string concatenation), Args are the operands.
+	NodeBinary
+	// NodeTernary is the "cond ? a : b" operator; Args are cond, a and b.
+	NodeTernary
+)
+
+// Node is a node of the parsed pattern.
+type Node struct {
+	Kind  NodeKind
+	Op    string
+	Value string
+	Args  []*Node
+
+	// Start and End are the byte offsets of the node in the original pattern,
+	// so pattern[Start:End] is the source text of the node.
+	Start int
+	End   int
+}
+
+// String returns the canonical representation of the node: whitespace is
+// normalized, so two nodes which only differ in formatting have the same
+// string representation.
+func (n *Node) String() string {
+	switch n.Kind {
+	case NodeRegex:
+		return "/" + n.Value + "/"
+	case NodeField:
+		return "$" + n.Args[0].String()
+	case NodeIndex:
+		return n.Value + "[" + joinNodes(n.Args) + "]"
+	case NodeCall:
+		return n.Value + "(" + joinNodes(n.Args) + ")"
+	case NodeGroup:
+		return "(" + n.Args[0].String() + ")"
+	case NodeUnary:
+		return n.Op + n.Args[0].String()
+	case NodePostfix:
+		return n.Args[0].String() + n.Op
+	case NodeBinary:
+		if n.Op == "" {
+			return n.Args[0].String() + " " + n.Args[1].String()
+		}
+		return n.Args[0].String() + " " + n.Op + " " + n.Args[1].String()
+	case NodeTernary:
+		return n.Args[0].String() + " ? " + n.Args[1].String() + " : " + n.Args[2].String()
+	default:
+		return n.Value
+	}
+}
+
+func joinNodes(nodes []*Node) string {
+	strs := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		strs = append(strs, n.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Parse parses the awk pattern. If the pattern is empty (or contains only
+// whitespace), the returned node is nil. If the pattern is invalid, the
+// returned error is a *SyntaxError.
+func Parse(pattern string) (*Node, error) {
+	p := &parser{pattern: pattern}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokEOF {
+		return nil, nil
+	}
+
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, p.unexpected()
+	}
+
+	return node, nil
+}
+
+// Validate returns a *SyntaxError if the pattern is invalid.
+func Validate(pattern string) error {
+	_, err := Parse(pattern)
+	return err
+}
+
+// QuoteRegex escapes all regex metacharacters in s, as well as the slashes,
+// so that it can be used in a regex literal like /foo/ and match the string s
+// literally.
+func QuoteRegex(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\.+*?()|[]{}^$/`, r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// QuoteString returns s as an awk string literal, in double quotes.
+func QuoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokRegex
+	tokName
+	// tokFuncName is a name immediately followed by "(", without spaces; the
+	// "(" itself is not part of the token.
+	tokFuncName
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+
+	// pos and end are byte offsets in the pattern.
+	pos int
+	end int
+}
+
+func (t token) descr() string {
+	if t.kind == tokEOF {
+		return "end of pattern"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// ops contains all the operators, the longer ones first so that e.g. "&&"
+// takes precedence over "&".
+var ops = []string{
+	"**=",
+	"&&", "||", "!~", "==", "!=", "<=", ">=", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "^=", "**",
+	"!", "~", "(", ")", "[", "]", ",", "?", ":", "=",
+	"+", "-", "*", "/", "%", "^", "<", ">", "$",
+}
+
+var assignOps = []string{"=", "+=", "-=", "*=", "/=", "%=", "^=", "**="}
+
+// builtinFuncs are the functions which can be called with spaces between the
+// name and the opening paren; user-defined functions can't.
+var builtinFuncs = map[string]struct{}{
+	"length": {}, "substr": {}, "index": {}, "split": {}, "sub": {},
+	"gsub": {}, "gensub": {}, "match": {}, "sprintf": {}, "tolower": {},
+	"toupper": {}, "int": {}, "sqrt": {}, "exp": {}, "log": {}, "sin": {},
+	"cos": {}, "atan2": {}, "rand": {}, "srand": {}, "systime": {},
+	"strftime": {}, "mktime": {}, "strtonum": {}, "and": {}, "or": {},
+	"xor": {}, "lshift": {}, "rshift": {}, "compl": {},
+}
+
+type parser struct {
+	pattern string
+
+	// pos is the byte offset in the pattern where the lexer is at.
+	pos int
+
+	// tok is the current token, and prev is the previous one.
+	tok  token
+	prev token
+}
+
+// errorf returns a *SyntaxError at the given byte offset.
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{
+		Pos: utf8.RuneCountInString(p.pattern[:pos]) + 1,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *parser) unexpected() error {
+	return p.errorf(p.tok.pos, "unexpected %s", p.tok.descr())
+}
+
+func (p *parser) isOp(opsToCheck ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+
+	for _, op := range opsToCheck {
+		if p.tok.text == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return p.errorf(p.tok.pos, "expected %q, got %s", op, p.tok.descr())
+	}
+
+	return p.next()
+}
+
+// regexAllowed returns whether a slash at the current position starts a
+// regex literal, as opposed to being a division operator: that's the case
+// unless the previous token ends an operand.
+func (p *parser) regexAllowed() bool {
+	switch p.prev.kind {
+	case tokNumber, tokString, tokRegex, tokName:
+		return false
+	case tokOp:
+		switch p.prev.text {
+		case ")", "]", "$", "++", "--":
+			return false
+		}
+	}
+
+	return true
+}
+
+// next advances the lexer to the next token.
+func (p *parser) next() error {
+	p.prev = p.tok
+
+	for p.pos < len(p.pattern) {
+		c := p.pattern[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			p.pos++
+		} else if c == '\\' && p.pos+1 < len(p.pattern) && p.pattern[p.pos+1] == '\n' {
+			p.pos += 2
+		} else {
+			break
+		}
+	}
+
+	start := p.pos
+
+	if p.pos >= len(p.pattern) {
+		p.tok = token{kind: tokEOF, pos: start, end: start}
+		return nil
+	}
+
+	c := p.pattern[p.pos]
+
+	switch {
+	case c == '"':
+		if err := p.readString(); err != nil {
+			return err
+		}
+		p.tok = token{kind: tokString}
+
+	case c == '/' && p.regexAllowed():
+		if err := p.readRegex(); err != nil {
+			return err
+		}
+		p.tok = token{kind: tokRegex}
+
+	case isDigit(c) || (c == '.' && p.pos+1 < len(p.pattern) && isDigit(p.pattern[p.pos+1])):
+		p.readNumber()
+		p.tok = token{kind: tokNumber}
+
+	case isNameStart(c):
+		for p.pos < len(p.pattern) && isNameChar(p.pattern[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokName}
+		if p.pos < len(p.pattern) && p.pattern[p.pos] == '(' {
+			p.tok.kind = tokFuncName
+		}
+
+	default:
+		found := false
+		for _, op := range ops {
+			if strings.HasPrefix(p.pattern[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = token{kind: tokOp}
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			r, _ := utf8.DecodeRuneInString(p.pattern[p.pos:])
+			return p.errorf(start, "unexpected character %q", r)
+		}
+	}
+
+	p.tok.pos = start
+	p.tok.end = p.pos
+	p.tok.text = p.pattern[start:p.pos]
+
+	return nil
+}
+
+func (p *parser) readString() error {
+	start := p.pos
+	p.pos++
+
+	for p.pos < len(p.pattern) {
+		switch p.pattern[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '"':
+			p.pos++
+			return nil
+		case '\n':
+			return p.errorf(start, "unterminated string")
+		default:
+			p.pos++
+		}
+	}
+
+	return p.errorf(start, "unterminated string")
+}
+
+// readRegex reads a regex literal; unescaped slashes are allowed inside of
+// bracket expressions like [^/], same as in gawk.
+func (p *parser) readRegex() error {
+	start := p.pos
+	p.pos++
+
+	inBrackets := false
+
+	for p.pos < len(p.pattern) {
+		c := p.pattern[p.pos]
+
+		switch {
+		case c == '\\':
+			p.pos += 2
+			continue
+
+		case c == '\n':
+			return p.errorf(start, "unterminated regex")
+
+		case inBrackets:
+			if strings.HasPrefix(p.pattern[p.pos:], "[:") {
+				if idx := strings.Index(p.pattern[p.pos+2:], ":]"); idx >= 0 {
+					p.pos += idx + 4
+					continue
+				}
+			}
+
+			if c == ']' {
+				inBrackets = false
+			}
+
+		case c == '[':
+			inBrackets = true
+
+			// Closing bracket right after the opening one (or after the "^") is
+			// a literal one.
+			if strings.HasPrefix(p.pattern[p.pos:], "[^]") {
+				p.pos += 2
+			} else if strings.HasPrefix(p.pattern[p.pos:], "[]") {
+				p.pos++
+			}
+
+		case c == '/':
+			p.pos++
+			return nil
+		}
+
+		p.pos++
+	}
+
+	if inBrackets {
+		return p.errorf(start, "unterminated regex: unclosed \"[\"")
+	}
+
+	return p.errorf(start, "unterminated regex")
+}
+
+func (p *parser) readNumber() {
+	for p.pos < len(p.pattern) && (isDigit(p.pattern[p.pos]) || p.pattern[p.pos] == '.') {
+		p.pos++
+	}
+
+	if p.pos < len(p.pattern) && (p.pattern[p.pos] == 'e' || p.pattern[p.pos] == 'E') {
+		expPos := p.pos + 1
+		if expPos < len(p.pattern) && (p.pattern[expPos] == '+' || p.pattern[expPos] == '-') {
+			expPos++
+		}
+
+		if expPos < len(p.pattern) && isDigit(p.pattern[expPos]) {
+			p.pos = expPos
+			for p.pos < len(p.pattern) && isDigit(p.pattern[p.pos]) {
+				p.pos++
+			}
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isLvalue(n *Node) bool {
+	return n.Kind == NodeVar || n.Kind == NodeField || n.Kind == NodeIndex
+}
+
+func newBinary(op string, left, right *Node) *Node {
+	return &Node{
+		Kind:  NodeBinary,
+		Op:    op,
+		Args:  []*Node{left, right},
+		Start: left.Start,
+		End:   right.End,
+	}
+}
+
+// The parse* functions below implement the awk operators, from the lowest
+// precedence to the highest one, as per POSIX.
+
+func (p *parser) parseExpr() (*Node, error) {
+	return p.parseTernary()
+}
+
+func (p *parser) parseTernary() (*Node, error) {
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOp(assignOps...) && isLvalue(cond) {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		rhs, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+
+		return newBinary(op, cond, rhs), nil
+	}
+
+	if !p.isOp("?") {
+		return cond, nil
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	a, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expectOp(":"); err != nil {
+		return nil, err
+	}
+
+	b, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Kind:  NodeTernary,
+		Args:  []*Node{cond, a, b},
+		Start: cond.Start,
+		End:   b.End,
+	}, nil
+}
+
+// parseBinary parses a left-associative chain of the given binary operators.
+func (p *parser) parseBinary(
+	binOps []string, parseOperand func() (*Node, error),
+) (*Node, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp(binOps...) {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		left = newBinary(op, left, right)
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseOr() (*Node, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Node, error) {
+	return p.parseBinary([]string{"&&"}, p.parseIn)
+}
+
+func (p *parser) parseIn() (*Node, error) {
+	left, err := p.parseMatch()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokName && p.tok.text == "in" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokName {
+			return nil, p.errorf(p.tok.pos, "expected array name, got %s", p.tok.descr())
+		}
+
+		arr := &Node{Kind: NodeVar, Value: p.tok.text, Start: p.tok.pos, End: p.tok.end}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		left = newBinary("in", left, arr)
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseMatch() (*Node, error) {
+	return p.parseBinary([]string{"~", "!~"}, p.parseRelational)
+}
+
+func (p *parser) parseRelational() (*Node, error) {
+	return p.parseBinary([]string{"<", "<=", ">", ">=", "==", "!="}, p.parseConcat)
+}
+
+func (p *parser) parseConcat() (*Node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.startsConcatOperand() {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+
+		left = newBinary("", left, right)
+	}
+
+	return left, nil
+}
+
+// startsConcatOperand returns whether the current token can start the right
+// operand of a string concatenation.
+func (p *parser) startsConcatOperand() bool {
+	switch p.tok.kind {
+	case tokNumber, tokString, tokFuncName:
+		return true
+	case tokName:
+		return p.tok.text != "in"
+	case tokOp:
+		return p.isOp("$", "(")
+	}
+
+	return false
+}
+
+func (p *parser) parseAdditive() (*Node, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative() (*Node, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *parser) parseUnary() (*Node, error) {
+	if !p.isOp("!", "-", "+") {
+		return p.parseExponent()
+	}
+
+	op := p.tok
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Kind:  NodeUnary,
+		Op:    op.text,
+		Args:  []*Node{x},
+		Start: op.pos,
+		End:   x.End,
+	}, nil
+}
+
+func (p *parser) parseExponent() (*Node, error) {
+	base, err := p.parseIncDec()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.isOp("^", "**") {
+		return base, nil
+	}
+
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	// Exponentiation is right-associative, and the exponent can be negative.
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return newBinary(op, base, exp), nil
+}
+
+func (p *parser) parseIncDec() (*Node, error) {
+	if p.isOp("++", "--") {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		x, err := p.parseIncDec()
+		if err != nil {
+			return nil, err
+		}
+
+		if !isLvalue(x) {
+			return nil, p.errorf(x.Start, "%q needs a variable, field or array element", op.text)
+		}
+
+		return &Node{
+			Kind:  NodeUnary,
+			Op:    op.text,
+			Args:  []*Node{x},
+			Start: op.pos,
+			End:   x.End,
+		}, nil
+	}
+
+	x, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOp("++", "--") && isLvalue(x) {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		return &Node{
+			Kind:  NodePostfix,
+			Op:    op.text,
+			Args:  []*Node{x},
+			Start: x.Start,
+			End:   op.end,
+		}, nil
+	}
+
+	return x, nil
+}
+
+func (p *parser) parseField() (*Node, error) {
+	if !p.isOp("$") {
+		return p.parsePrimary()
+	}
+
+	start := p.tok.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var x *Node
+	var err error
+	if p.isOp("$", "++", "--", "-") {
+		x, err = p.parseUnary()
+	} else {
+		x, err = p.parsePrimary()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Kind:  NodeField,
+		Args:  []*Node{x},
+		Start: start,
+		End:   x.End,
+	}, nil
+}
+
+func (p *parser) parsePrimary() (*Node, error) {
+	tok := p.tok
+
+	switch tok.kind {
+	case tokNumber, tokString, tokRegex:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		node := &Node{Value: tok.text, Start: tok.pos, End: tok.end}
+		switch tok.kind {
+		case tokNumber:
+			node.Kind = NodeNumber
+		case tokString:
+			node.Kind = NodeString
+		default:
+			node.Kind = NodeRegex
+			node.Value = tok.text[1 : len(tok.text)-1]
+		}
+
+		return node, nil
+
+	case tokName, tokFuncName:
+		if tok.text == "in" || tok.text == "getline" || tok.text == "function" {
+			return nil, p.unexpected()
+		}
+
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		_, isBuiltin := builtinFuncs[tok.text]
+
+		if tok.kind == tokFuncName || (isBuiltin && p.isOp("(")) {
+			args, end, err := p.parseList("(", ")")
+			if err != nil {
+				return nil, err
+			}
+
+			return &Node{Kind: NodeCall, Value: tok.text, Args: args, Start: tok.pos, End: end}, nil
+		}
+
+		if p.isOp("[") {
+			args, end, err := p.parseList("[", "]")
+			if err != nil {
+				return nil, err
+			}
+
+			if len(args) == 0 {
+				return nil, p.errorf(tok.end, "array subscript is empty")
+			}
+
+			return &Node{Kind: NodeIndex, Value: tok.text, Args: args, Start: tok.pos, End: end}, nil
+		}
+
+		return &Node{Kind: NodeVar, Value: tok.text, Start: tok.pos, End: tok.end}, nil
+
+	case tokOp:
+		if tok.text == "(" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			if !p.isOp(")") {
+				return nil, p.errorf(p.tok.pos, "expected \")\" to match \"(\" at position %d, got %s",
+					utf8.RuneCountInString(p.pattern[:tok.pos])+1, p.tok.descr())
+			}
+
+			end := p.tok.end
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			return &Node{Kind: NodeGroup, Args: []*Node{x}, Start: tok.pos, End: end}, nil
+		}
+	}
+
+	return nil, p.unexpected()
+}
+
+// parseList parses a comma-separated list of expressions enclosed in the given
+// delimiters, like function arguments or array subscripts. It returns the
+// expressions and the byte offset right after the closing delimiter.
+func (p *parser) parseList(open, close string) ([]*Node, int, error) {
+	if err := p.expectOp(open); err != nil {
+		return nil, 0, err
+	}
+
+	var ret []*Node
+
+	if !p.isOp(close) {
+		for {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			ret = append(ret, x)
+
+			if !p.isOp(",") {
+				break
+			}
+
+			if err := p.next(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if !p.isOp(close) {
+		return nil, 0, p.errorf(p.tok.pos, "expected %q or \",\", got %s", close, p.tok.descr())
+	}
+
+	end := p.tok.end
+	if err := p.next(); err != nil {
+		return nil, 0, err
+	}
+
+	return ret, end, nil
+}
@@ -0,0 +1,85 @@
+package awkpattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parseTC struct {
+	pattern string
+
+	// want is the canonical representation of the parsed pattern.
+	want    string
+	wantErr string
+}
+
+func TestParse(t *testing.T) {
+	testCases := []parseTC{
+		{pattern: ``, want: ``},
+		{pattern: `   `, want: ``},
+		{pattern: `/foo/`, want: `/foo/`},
+		{pattern: `/foo/&&/bar/`, want: `/foo/ && /bar/`},
+		{pattern: `/foo/ || /bar/ && !/baz/`, want: `/foo/ || /bar/ && !/baz/`},
+		{pattern: `$5 ~ /a\/b[/]c/`, want: `$5 ~ /a\/b[/]c/`},
+		{pattern: `/[[:alpha:]/]+/`, want: `/[[:alpha:]/]+/`},
+		{pattern: `/[]/]/`, want: `/[]/]/`},
+		{pattern: `$NF-1 > 3`, want: `$NF - 1 > 3`},
+		{pattern: `$(NF-1) == "x"`, want: `$(NF - 1) == "x"`},
+		{pattern: `10/2 > 1`, want: `10 / 2 > 1`},
+		{pattern: `$1 " " $2 == "a b"`, want: `$1 " " $2 == "a b"`},
+		{pattern: `length > 10`, want: `length > 10`},
+		{pattern: `substr($0, 1, 3) == "abc"`, want: `substr($0, 1, 3) == "abc"`},
+		{pattern: `tolower ($5) !~ /x/`, want: `tolower($5) !~ /x/`},
+		{pattern: `NR % 2 == 0 ? /a/ : /b/`, want: `NR % 2 == 0 ? /a/ : /b/`},
+		{pattern: `($5 in seen) || seen[$5]++`, want: `($5 in seen) || seen[$5]++`},
+		{pattern: `-2^-2 < 1.5e3`, want: `-2 ^ -2 < 1.5e3`},
+		{pattern: `"a \"quoted\" /str/" == $3`, want: `"a \"quoted\" /str/" == $3`},
+
+		{pattern: `/foo/ &&`, wantErr: `position 9: unexpected end of pattern`},
+		{pattern: `(/foo/ || /bar/`, wantErr: `position 16: expected ")" to match "(" at position 1, got end of pattern`},
+		{pattern: `/foo/ /bar/`, wantErr: `position 12: unexpected end of pattern`},
+		{pattern: `/foo/ | /bar/`, wantErr: `position 7: unexpected character '|'`},
+		{pattern: `$3 ~ "x" { print }`, wantErr: `position 10: unexpected character '{'`},
+		{pattern: `$3 == "foo`, wantErr: `position 7: unterminated string`},
+		{pattern: `/foo && $3 == 1`, wantErr: `position 1: unterminated regex`},
+		{pattern: `/foo[/`, wantErr: `position 1: unterminated regex: unclosed "["`},
+		{pattern: `/ä/ && ) `, wantErr: `position 8: unexpected ")"`},
+		{pattern: `substr($0, 1`, wantErr: `position 13: expected ")" or ",", got end of pattern`},
+		{pattern: `++3`, wantErr: `position 3: "++" needs a variable, field or array element`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			node, err := Parse(tc.pattern)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got := ""
+			if node != nil {
+				got = node.String()
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestQuoteRegex(t *testing.T) {
+	assert.Equal(t, `foo\.bar`, QuoteRegex(`foo.bar`))
+	assert.Equal(t, `\/api\/v1\?a=\[1\]`, QuoteRegex(`/api/v1?a=[1]`))
+	assert.Equal(t, `a<b>:c`, QuoteRegex(`a<b>:c`))
+
+	// Make sure the result is a valid regex literal.
+	assert.NoError(t, Validate("/"+QuoteRegex(`x/\y/`)+"/"))
+}
+
+func TestQuoteString(t *testing.T) {
+	assert.Equal(t, `"foo"`, QuoteString(`foo`))
+	assert.Equal(t, `"a \"b\" \\c"`, QuoteString(`a "b" \c`))
+}
@@ -0,0 +1,229 @@
+package awkpattern
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// conjuncts returns the operands of the top-level "&&" chain; if the root
+// isn't "&&", then it's the only conjunct. Parens are not looked into, so
+// e.g. for "(a && b) && c" the conjuncts are "(a && b)" and "c".
+func conjuncts(n *Node) []*Node {
+	if n.Kind == NodeBinary && n.Op == "&&" {
+		return append(conjuncts(n.Args[0]), conjuncts(n.Args[1])...)
+	}
+
+	return []*Node{n}
+}
+
+// bindsWeakerThanAnd returns whether the node needs to be wrapped in parens
+// to become an operand of "&&".
+func bindsWeakerThanAnd(n *Node) bool {
+	switch n.Kind {
+	case NodeTernary:
+		return true
+	case NodeBinary:
+		switch n.Op {
+		case "||", "=", "+=", "-=", "*=", "/=", "%=", "^=", "**=":
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseTerm(term string) (*Node, error) {
+	termNode, err := Parse(term)
+	if err != nil {
+		return nil, errors.Annotatef(err, "term %q", term)
+	}
+
+	if termNode == nil {
+		return nil, errors.Errorf("term is empty")
+	}
+
+	return termNode, nil
+}
+
+// HasTerm returns whether the term is one of the operands of the top-level
+// "&&" chain of the pattern (or the whole pattern, if it has no top-level
+// "&&"). The terms are compared structurally, so the formatting doesn't
+// matter. If either the pattern or the term is invalid, it returns false.
+func HasTerm(pattern, term string) bool {
+	node, err := Parse(pattern)
+	if err != nil || node == nil {
+		return false
+	}
+
+	termNode, err := parseTerm(term)
+	if err != nil {
+		return false
+	}
+
+	termStr := termNode.String()
+	for _, c := range conjuncts(node) {
+		if c.String() == termStr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddTerm adds the term to the pattern with "&&", unless it's already there
+// (see HasTerm). If the pattern has top-level "||" or other operators
+// which bind weaker than "&&", then it's wrapped in parens first, so e.g.
+// adding "/baz/" to "/foo/ || /bar/" results in "(/foo/ || /bar/) && /baz/".
+func AddTerm(pattern, term string) (string, error) {
+	node, err := Parse(pattern)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	termNode, err := parseTerm(term)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	termStr := strings.TrimSpace(term)
+	if bindsWeakerThanAnd(termNode) {
+		termStr = "(" + termStr + ")"
+	}
+
+	if node == nil {
+		return termStr, nil
+	}
+
+	if HasTerm(pattern, term) {
+		return pattern, nil
+	}
+
+	patternStr := strings.TrimSpace(pattern)
+	if bindsWeakerThanAnd(node) {
+		patternStr = "(" + patternStr + ")"
+	}
+
+	return patternStr + " && " + termStr, nil
+}
+
+// RemoveTerm removes all the occurrences of the term from the top-level "&&"
+// chain of the pattern (see HasTerm); the rest of the conjuncts are kept as
+// they were written. If the term isn't there, the pattern is returned as is.
+func RemoveTerm(pattern, term string) (string, error) {
+	node, err := Parse(pattern)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	termNode, err := parseTerm(term)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if node == nil {
+		return pattern, nil
+	}
+
+	termStr := termNode.String()
+
+	var kept []*Node
+	for _, c := range conjuncts(node) {
+		if c.String() != termStr {
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == len(conjuncts(node)) {
+		return pattern, nil
+	}
+
+	// If the only remaining conjunct is in parens, then those parens are most
+	// likely added by AddTerm, and aren't needed anymore.
+	if len(kept) == 1 && kept[0].Kind == NodeGroup {
+		kept[0] = kept[0].Args[0]
+	}
+
+	parts := make([]string, 0, len(kept))
+	for _, c := range kept {
+		parts = append(parts, pattern[c.Start:c.End])
+	}
+
+	return strings.Join(parts, " && "), nil
+}
+
+// ToggleTerm removes the term from the pattern if it's there, or adds it
+// otherwise; see AddTerm and RemoveTerm.
+func ToggleTerm(pattern, term string) (string, error) {
+	if HasTerm(pattern, term) {
+		return RemoveTerm(pattern, term)
+	}
+
+	return AddTerm(pattern, term)
+}
+
+// Literals returns the strings which every line matching the pattern must
+// contain, if the pattern is simple enough: either a single regex without any
+// metacharacters, like `/foo bar/`, or a top-level "&&" chain of those, like
+// `/foo/ && /bar\.baz/`. For any other pattern (or an invalid one), it
+// returns nil.
+//
+// It's used to prefilter the lines with "grep -F" before they hit awk, so the
+// returned literals are only a necessary condition: the lines still need to
+// be checked against the whole pattern.
+func Literals(pattern string) []string {
+	node, err := Parse(pattern)
+	if err != nil || node == nil {
+		return nil
+	}
+
+	var ret []string
+	for _, c := range conjuncts(node) {
+		if c.Kind != NodeRegex {
+			return nil
+		}
+
+		lit, ok := regexLiteral(c.Value)
+		if !ok {
+			return nil
+		}
+
+		ret = append(ret, lit)
+	}
+
+	return ret
+}
+
+// regexLiteral returns the string which the regex matches literally, if the
+// regex doesn't have any metacharacters (escaped ones are fine, like `\.`).
+// The second return value is false otherwise, or if the regex is empty.
+func regexLiteral(regex string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+
+		switch {
+		case c == '\\':
+			// Only escaped punctuation is literal; things like `\n` or `\y` are
+			// not, so we don't bother.
+			if i+1 >= len(regex) || isNameChar(regex[i+1]) || regex[i+1] < 0x20 || regex[i+1] >= 0x7f {
+				return "", false
+			}
+
+			i++
+			sb.WriteByte(regex[i])
+
+		case strings.IndexByte(`.+*?()|[]{}^$/`, c) >= 0:
+			return "", false
+
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return "", false
+	}
+
+	return sb.String(), true
+}
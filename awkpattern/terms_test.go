@@ -0,0 +1,92 @@
+package awkpattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type termTC struct {
+	pattern string
+	term    string
+
+	want    string
+	wantErr string
+}
+
+func TestHasTerm(t *testing.T) {
+	assert.True(t, HasTerm(`/foo/`, `/foo/`))
+	assert.True(t, HasTerm(`/foo/ && $5=="x"`, `$5 == "x"`))
+	assert.True(t, HasTerm(`/a/ && /b/ && /c/`, `/b/`))
+	assert.False(t, HasTerm(`/a/ || /b/`, `/b/`))
+	assert.False(t, HasTerm(`(/a/ && /b/) && /c/`, `/b/`))
+	assert.False(t, HasTerm(`/foo\/bar/`, `/foo/`))
+	assert.False(t, HasTerm(`/foo/ &&`, `/foo/`))
+	assert.False(t, HasTerm(``, `/foo/`))
+}
+
+func TestToggleTerm(t *testing.T) {
+	testCases := []termTC{
+		{pattern: ``, term: `/foo/`, want: `/foo/`},
+		{pattern: `/foo/`, term: `/foo/`, want: ``},
+		{pattern: `/foo/`, term: `/bar/`, want: `/foo/ && /bar/`},
+		{pattern: ` /foo/  `, term: ` /bar/ `, want: `/foo/ && /bar/`},
+		{pattern: `/foo/ && /bar/`, term: `/foo/`, want: `/bar/`},
+		{pattern: `/foo/ && /bar/ && /baz/`, term: `/bar/`, want: `/foo/ && /baz/`},
+		{pattern: `/foo/&&/bar/`, term: `/bar/`, want: `/foo/`},
+		{pattern: `/foo/ || /bar/`, term: `/baz/`, want: `(/foo/ || /bar/) && /baz/`},
+		{pattern: `(/foo/ || /bar/) && /baz/`, term: `/baz/`, want: `/foo/ || /bar/`},
+		{pattern: `/foo/ || /bar/`, term: `/bar/`, want: `(/foo/ || /bar/) && /bar/`},
+		{pattern: `/foo/`, term: `/a/ || /b/`, want: `/foo/ && (/a/ || /b/)`},
+		{pattern: `/a|b/ && /c/`, term: `/a|b/`, want: `/c/`},
+		{pattern: `/x/ && (/a/ || /b/)`, term: `/x/`, want: `/a/ || /b/`},
+
+		{pattern: `/foo/ &&`, term: `/foo/`, wantErr: `position 9: unexpected end of pattern`},
+		{pattern: `/foo/`, term: `/bar`, wantErr: `term "/bar": position 1: unterminated regex`},
+		{pattern: `/foo/`, term: ` `, wantErr: `term is empty`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern+" | "+tc.term, func(t *testing.T) {
+			got, err := ToggleTerm(tc.pattern, tc.term)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: `/foo/`, want: []string{"foo"}},
+		{pattern: ` /foo bar/ `, want: []string{"foo bar"}},
+		{pattern: `/foo/ && /bar/`, want: []string{"foo", "bar"}},
+		{pattern: `/a\.b/ && /c\/d/`, want: []string{"a.b", "c/d"}},
+		{pattern: `/привет/`, want: []string{"привет"}},
+
+		{pattern: ``, want: nil},
+		{pattern: `/foo/ &&`, want: nil},
+		{pattern: `/foo.bar/`, want: nil},
+		{pattern: `/^foo/`, want: nil},
+		{pattern: `/a|b/`, want: nil},
+		{pattern: `/foo\n/`, want: nil},
+		{pattern: `/foo/ || /bar/`, want: nil},
+		{pattern: `/foo/ && !/bar/`, want: nil},
+		{pattern: `/foo/ && $5 == "x"`, want: nil},
+		{pattern: `(/foo/ && /bar/)`, want: nil},
+		{pattern: `$0 ~ /foo/`, want: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			assert.Equal(t, tc.want, Literals(tc.pattern))
+		})
+	}
+}
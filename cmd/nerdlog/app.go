@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"strings"
@@ -12,7 +11,6 @@ import (
 	"github.com/dimonomid/nerdlog/clhistory"
 	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/log"
-	"github.com/dimonomid/ssh_config"
 	"github.com/juju/errors"
 	"github.com/rivo/tview"
 )
@@ -58,6 +56,9 @@ type nerdlogAppParams struct {
 	logLevel          log.LogLevel
 	sshConfigPath     string
 	sshKeys           []string
+	sshPasswordAuth   bool
+	sshCachePassword  bool
+	sshAskpassBinary  string
 
 	logstreamsConfigPath string
 	cmdHistoryFile       string
@@ -91,9 +92,12 @@ func newNerdlogApp(
 		params: params,
 
 		options: NewOptionsShared(Options{
-			Timezone:      time.Local,
-			MaxNumLines:   250,
-			TransportMode: TransportModeSSHLib,
+			Timezone:        time.Local,
+			MaxNumLines:     250,
+			TransportMode:   TransportModeSSHLib,
+			HistogramMetric: HistogramMetricCount,
+			LogsOrder:       core.LogsOrderDesc,
+			ConnectTimeout:  core.DefaultConnectTimeout,
 		}),
 
 		tviewApp: tview.NewApplication(),
@@ -110,6 +114,7 @@ func newNerdlogApp(
 		Options: app.options,
 		OnLogQuery: func(params core.QueryLogsParams) {
 			params.MaxNumLines = app.options.GetMaxNumLines()
+			params.Order = app.options.GetLogsOrder()
 
 			// Get the current QueryFull and marshal it to a shell command.
 			qf := app.mainView.getQueryFull()
@@ -142,6 +147,34 @@ func newNerdlogApp(
 		OnReconnectRequest: func() {
 			app.lsman.Reconnect()
 		},
+		OnContextQuery: func(params core.QueryContextParams, cb func(resp *core.LogResp, err error)) {
+			// QueryContext blocks until the lines are received, so we can't call it
+			// from the UI goroutine.
+			go func() {
+				resp, err := app.lsman.QueryContext(params)
+				if app.tviewApp == nil {
+					return
+				}
+
+				app.tviewApp.QueueUpdateDraw(func() {
+					cb(resp, err)
+				})
+			}()
+		},
+		OnCleanupRemote: func(params core.CleanupRemoteParams, cb func(res map[string]*core.CleanupRemoteResp)) {
+			// CleanupRemote blocks until all the logstreams respond, so we can't
+			// call it from the UI goroutine.
+			go func() {
+				res := app.lsman.CleanupRemote(params)
+				if app.tviewApp == nil {
+					return
+				}
+
+				app.tviewApp.QueueUpdateDraw(func() {
+					cb(res)
+				})
+			}()
+		},
 		OnCmd: func(cmd string, opts CmdOpts) {
 			cmdCh <- cmdWithOpts{
 				cmd:  cmd,
@@ -287,6 +320,12 @@ func (app *nerdlogApp) initLStreamsManager(
 								return
 							}
 
+							if logResp.CountBy != nil {
+								// Count-by results don't replace the logs we already have.
+								app.mainView.applyCountBy(logResp)
+								continue
+							}
+
 							app.mainView.applyLogs(logResp)
 							app.lastLogResp = logResp
 						}
@@ -338,45 +377,18 @@ func (app *nerdlogApp) initLStreamsManager(
 		}
 	}
 
-	var sshConfig *ssh_config.Config
+	var sshConfig *core.SSHConfig
 	if params.sshConfigPath != "" {
-		sshConfigFile, err := os.Open(params.sshConfigPath)
+		var err error
+		sshConfig, err = core.ParseSSHConfigFile(params.sshConfigPath, homeDir)
 		if err != nil {
-			if !os.IsNotExist(err) {
+			if !os.IsNotExist(errors.Cause(err)) {
 				return errors.Annotatef(
 					err,
 					"reading ssh config from %s (path is configurable via --ssh-config)",
 					params.sshConfigPath,
 				)
 			}
-		} else {
-			defer sshConfigFile.Close()
-			var err error
-			sshConfig, err = ssh_config.Decode(sshConfigFile, false)
-			if err != nil {
-				// Try again but ignoring Match
-				sshConfigFile, _ := os.Open(params.sshConfigPath)
-				defer sshConfigFile.Close()
-				var err error
-				sshConfig, err = ssh_config.Decode(sshConfigFile, true)
-				if err != nil {
-					return errors.Annotatef(
-						err,
-						"parsing ssh config from %s (path is configurable via --ssh-config)",
-						params.sshConfigPath,
-					)
-				}
-
-				if os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
-					// Apparently there is a Match directive. Let's warn the user about it,
-					// but still continue.
-					fmt.Printf("Your SSH config %s has a Match directive, fyi it'll be ignored, since Nerdlog can't parse this directive yet (see https://github.com/kevinburke/ssh_config/issues/6).\n", params.sshConfigPath)
-					fmt.Printf("Fyi you can provide a different ssh config with the --ssh-config flag.\n")
-					fmt.Printf("To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n")
-					fmt.Printf("Press Enter to continue.\n")
-					bufio.NewReader(os.Stdin).ReadBytes('\n')
-				}
-			}
 		}
 	}
 
@@ -386,10 +398,15 @@ func (app *nerdlogApp) initLStreamsManager(
 		ConfigLogStreams: logstreamsCfg,
 		SSHConfig:        sshConfig,
 		SSHKeys:          params.sshKeys,
+		SSHPasswordAuth:  params.sshPasswordAuth,
+		SSHCachePassword: params.sshCachePassword,
+		SSHAskpassBinary: params.sshAskpassBinary,
 
 		InitialLStreams:       initialLStreams,
 		InitialUseExternalSSH: useExternalSSH,
 
+		InitialConnectQueueParams: app.getConnectQueueParams(),
+
 		ClientID: envUser,
 
 		UpdatesCh: updatesCh,
@@ -421,6 +438,14 @@ func (app *nerdlogApp) afterUserCmdOrOptionChange() {
 	app.mainView.formatTimeRange()
 	app.mainView.formatLogs()
 	app.lsman.SetUseExternalSSH(app.options.GetTransportMode() == TransportModeSSHBin)
+	app.lsman.SetConnectQueueParams(app.getConnectQueueParams())
+}
+
+func (app *nerdlogApp) getConnectQueueParams() core.ConnectQueueParams {
+	return core.ConnectQueueParams{
+		MaxParallel: app.options.GetMaxParallelConnections(),
+		Timeout:     app.options.GetConnectTimeout(),
+	}
 }
 
 // printError lets user know that there is an error by printing a simple error
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/gdamore/tcell/v2"
+)
+
+// cleanupRemote finds the stale nerdlog files (agent scripts and index files
+// which are not used by the current session) on all the connected
+// logstreams, shows them to the user, and removes them if the user confirms.
+func (mv *MainView) cleanupRemote() {
+	mv.printMsg("Looking for stale nerdlog files on the logstreams...", nlMsgLevelInfo)
+
+	mv.params.OnCleanupRemote(
+		core.CleanupRemoteParams{DryRun: true},
+		func(res map[string]*core.CleanupRemoteResp) {
+			mv.printMsg("", nlMsgLevelInfo)
+
+			text, numFiles := formatCleanupRemoteResult(res, true)
+			if numFiles == 0 {
+				mv.showMessagebox("cleanup_remote", "Remote cleanup", text, &MessageboxParams{
+					BackgroundColor: tcell.ColorDarkBlue,
+				})
+				return
+			}
+
+			var msgv *MessageView
+			msgv = mv.showMessagebox("cleanup_remote", "Remote cleanup", text, &MessageboxParams{
+				Buttons: []string{"Remove", "Cancel"},
+				OnButtonPressed: func(label string, idx int) {
+					msgv.Hide()
+
+					if label == "Remove" {
+						mv.doCleanupRemote()
+					}
+				},
+
+				BackgroundColor: tcell.ColorDarkBlue,
+			})
+		},
+	)
+}
+
+// doCleanupRemote actually removes the stale nerdlog files, and shows the
+// results.
+func (mv *MainView) doCleanupRemote() {
+	mv.printMsg("Removing stale nerdlog files on the logstreams...", nlMsgLevelInfo)
+
+	mv.params.OnCleanupRemote(
+		core.CleanupRemoteParams{},
+		func(res map[string]*core.CleanupRemoteResp) {
+			mv.printMsg("", nlMsgLevelInfo)
+
+			text, _ := formatCleanupRemoteResult(res, false)
+			mv.showMessagebox("cleanup_remote", "Remote cleanup", text, &MessageboxParams{
+				BackgroundColor: tcell.ColorDarkBlue,
+				CopyButton:      true,
+			})
+		},
+	)
+}
+
+// formatCleanupRemoteResult returns the human-readable text describing the
+// results of the remote cleanup, and the total number of stale files found.
+// If dryRun is true, the files are described as the ones to be removed,
+// otherwise as removed.
+func formatCleanupRemoteResult(res map[string]*core.CleanupRemoteResp, dryRun bool) (string, int) {
+	if len(res) == 0 {
+		return "No connected logstreams", 0
+	}
+
+	names := make([]string, 0, len(res))
+	for name := range res {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sb strings.Builder
+	var numFiles, numFailed int
+	var totalSize int64
+
+	for _, name := range names {
+		resp := res[name]
+
+		switch {
+		case resp.Err != nil:
+			sb.WriteString(fmt.Sprintf("%s: error: %s\n", name, resp.Err.Error()))
+			continue
+		case len(resp.Files) == 0:
+			sb.WriteString(fmt.Sprintf("%s: no stale files\n", name))
+			continue
+		}
+
+		sb.WriteString(fmt.Sprintf("%s:\n", name))
+		for _, f := range resp.Files {
+			sb.WriteString(fmt.Sprintf("  %s (%s)", f.Path, formatFileSize(f.Size)))
+			if f.Err != "" {
+				sb.WriteString(fmt.Sprintf(": %s", f.Err))
+				numFailed++
+			} else {
+				totalSize += f.Size
+			}
+			sb.WriteString("\n")
+
+			numFiles++
+		}
+	}
+
+	sb.WriteString("\n")
+
+	if dryRun {
+		sb.WriteString(fmt.Sprintf("Total: %d stale files, %s; remove them?", numFiles, formatFileSize(totalSize)))
+	} else {
+		sb.WriteString(fmt.Sprintf("Removed %d files, %s", numFiles-numFailed, formatFileSize(totalSize)))
+		if numFailed > 0 {
+			sb.WriteString(fmt.Sprintf("; failed to remove %d files", numFailed))
+		}
+	}
+
+	return sb.String(), numFiles
+}
+
+// formatFileSize returns a human-readable file size, like "1.5 MiB".
+func formatFileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
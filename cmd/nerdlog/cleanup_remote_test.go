@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFileSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{size: 0, want: "0 B"},
+		{size: 1023, want: "1023 B"},
+		{size: 1024, want: "1.0 KiB"},
+		{size: 1536, want: "1.5 KiB"},
+		{size: 10 * 1024 * 1024, want: "10.0 MiB"},
+		{size: 3 * 1024 * 1024 * 1024, want: "3.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatFileSize(tt.size), "size %d", tt.size)
+	}
+}
+
+func TestFormatCleanupRemoteResult(t *testing.T) {
+	res := map[string]*core.CleanupRemoteResp{
+		"host-b": {
+			Files: []core.RemoteFile{
+				{Path: "/tmp/nerdlog_agent_index_me_old", Size: 2048},
+				{Path: "/tmp/nerdlog_agent_me_old.sh", Size: 100, Err: "failed to remove"},
+			},
+		},
+		"host-a": {},
+		"host-c": {Err: errors.New("boom")},
+	}
+
+	text, numFiles := formatCleanupRemoteResult(res, true)
+	assert.Equal(t, 2, numFiles)
+	assert.Equal(t, `host-a: no stale files
+host-b:
+  /tmp/nerdlog_agent_index_me_old (2.0 KiB)
+  /tmp/nerdlog_agent_me_old.sh (100 B): failed to remove
+host-c: error: boom
+
+Total: 2 stale files, 2.0 KiB; remove them?`, text)
+
+	text, _ = formatCleanupRemoteResult(res, false)
+	assert.Contains(t, text, "Removed 1 files, 2.0 KiB; failed to remove 1 files")
+
+	text, numFiles = formatCleanupRemoteResult(nil, true)
+	assert.Equal(t, 0, numFiles)
+	assert.Equal(t, "No connected logstreams", text)
+}
@@ -8,6 +8,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/dimonomid/nerdlog/clipboard"
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/version"
 	"github.com/gdamore/tcell/v2"
 	"github.com/juju/errors"
@@ -176,6 +177,73 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	case "querydebug", "qdebug", "debug":
 		app.mainView.showLastQueryDebugInfo()
 
+	case "heatmap", "hm":
+		app.mainView.showLStreamsHeatmap()
+
+	case "cleanup-remote":
+		app.mainView.cleanupRemote()
+
+	case "numagg", "na":
+		spec := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), parts[0]))
+		switch spec {
+		case "":
+			if app.mainView.numAgg == nil {
+				app.printMsg("Numeric aggregation is off")
+			} else {
+				app.printMsg(fmt.Sprintf("Numeric aggregation: %s", formatNumAggSpec(app.mainView.numAgg)))
+			}
+
+		case "off":
+			app.mainView.setNumAgg(nil)
+
+		default:
+			numAgg, err := parseNumAggSpec(spec)
+			if err != nil {
+				app.printError(err.Error())
+				return
+			}
+
+			app.mainView.setNumAgg(numAgg)
+		}
+
+	case "overlay", "ov":
+		spec := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), parts[0]))
+		switch spec {
+		case "":
+			if len(app.mainView.overlays) == 0 {
+				app.printMsg("No overlays")
+			} else {
+				app.printMsg(fmt.Sprintf("Overlays: %s", strings.Join(app.mainView.overlays, ", ")))
+			}
+
+		case "off":
+			app.mainView.setOverlays(nil)
+
+		default:
+			if len(app.mainView.overlays) >= len(histogramOverlayColors) {
+				app.printError(fmt.Sprintf("can't have more than %d overlays", len(histogramOverlayColors)))
+				return
+			}
+
+			if err := core.ValidateQuery(spec); err != nil {
+				app.printError(err.Error())
+				return
+			}
+
+			overlays := append([]string{}, app.mainView.overlays...)
+			app.mainView.setOverlays(append(overlays, spec))
+		}
+
+	case "countby", "cb":
+		spec := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmd), parts[0]))
+		countBy, err := parseCountBySpec(spec)
+		if err != nil {
+			app.printError(err.Error())
+			return
+		}
+
+		app.mainView.doCountByQuery(countBy)
+
 	case "version", "about":
 		app.mainView.showMessagebox("version", "Version", version.VersionFullDescr(), &MessageboxParams{
 			BackgroundColor: tcell.ColorDarkBlue,
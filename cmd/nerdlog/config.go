@@ -48,11 +48,56 @@ func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
 			)
 		}
 
+		_, ok = core.ValidSudoMethods[cls.Options.SudoMethod]
+		if cls.Options.SudoMethod != "" && !ok {
+			validMethods := make([]string, 0, len(core.ValidSudoMethods))
+			for method := range core.ValidSudoMethods {
+				validMethods = append(validMethods, string(method))
+			}
+
+			sort.Strings(validMethods)
+
+			return nil, errors.Errorf(
+				"%s: invalid sudo_method %q; valid options are: %s",
+				k, cls.Options.SudoMethod, validMethods,
+			)
+		}
+
 		if cls.Options.SudoMode != "" && cls.Options.Sudo {
 			return nil, errors.Errorf(
 				"%s: both sudo and sudo_mode are set; please only use one of them", k,
 			)
 		}
+
+		if _, err := core.ParseIndexResolution(cls.Options.IndexResolution); err != nil {
+			return nil, errors.Annotatef(err, "%s", k)
+		}
+
+		if cls.Options.MaxCPUs < 0 {
+			return nil, errors.Errorf(
+				"%s: invalid max_cpus %d; it must be non-negative", k, cls.Options.MaxCPUs,
+			)
+		}
+
+		if cls.Options.Nice < 0 || cls.Options.Nice > 19 {
+			return nil, errors.Errorf(
+				"%s: invalid nice %d; it must be from 0 to 19", k, cls.Options.Nice,
+			)
+		}
+
+		if _, err := core.ParseIONice(cls.Options.IONice); err != nil {
+			return nil, errors.Annotatef(err, "%s", k)
+		}
+
+		if _, err := core.ParseReadRate(cls.Options.MaxReadRate); err != nil {
+			return nil, errors.Annotatef(err, "%s", k)
+		}
+
+		for jh := cls.Jumphost; jh != nil; jh = jh.Jumphost {
+			if jh.Hostname == "" {
+				return nil, errors.Errorf("%s: jumphost hostname is required", k)
+			}
+		}
 	}
 
 	return &cfg, nil
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	ctxvColIdxTime = 0
+	ctxvColIdxLine = 1
+)
+
+const (
+	// contextNumLinesDefault is how many lines before and after the message
+	// the ContextView shows initially.
+	contextNumLinesDefault = 10
+
+	// contextNumLinesMax is the limit for expanding the context with "+".
+	contextNumLinesMax = 5000
+)
+
+type ContextViewParams struct {
+	// Msg is the message to show the context of.
+	Msg core.LogMsg
+}
+
+// ContextView shows the raw (unfiltered) lines which the logstream logged
+// right before and after a particular message, with that message highlighted.
+// The context can be expanded further, in which case the lines are queried
+// from the logstream again.
+type ContextView struct {
+	params   ContextViewParams
+	mainView *MainView
+
+	tbl   *tview.Table
+	frame *tview.Frame
+
+	numLines int
+
+	// querySeq is incremented on every query, so that if the user expands the
+	// context quickly, the responses for the older queries are ignored.
+	querySeq int
+}
+
+func NewContextView(
+	mainView *MainView, params *ContextViewParams,
+) *ContextView {
+	ctxv := &ContextView{
+		params:   *params,
+		mainView: mainView,
+		numLines: contextNumLinesDefault,
+	}
+
+	ctxv.tbl = tview.NewTable()
+	ctxv.tbl.SetSelectable(true, false)
+	ctxv.tbl.SetSelectedStyle(menuSelected)
+
+	ctxv.tbl.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEnter:
+			nRow, _ := ctxv.tbl.GetSelection()
+			cell := ctxv.tbl.GetCell(nRow, ctxvColIdxTime)
+			if msg, ok := cell.GetReference().(core.LogMsg); ok {
+				mtv := NewMyTextView(ctxv.mainView, &MyTextViewParams{
+					Title: "Line",
+					Text:  msg.OrigLine,
+				})
+				mtv.Show()
+			}
+			return nil
+
+		case tcell.KeyEsc:
+			ctxv.Hide()
+			return nil
+
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case '+':
+				if ctxv.numLines < contextNumLinesMax {
+					ctxv.numLines *= 2
+					if ctxv.numLines > contextNumLinesMax {
+						ctxv.numLines = contextNumLinesMax
+					}
+					ctxv.query()
+				}
+				return nil
+
+			case '-':
+				if ctxv.numLines > 1 {
+					ctxv.numLines /= 2
+					ctxv.query()
+				}
+				return nil
+
+			case 'q':
+				ctxv.Hide()
+				return nil
+			}
+		}
+
+		return event
+	})
+
+	ctxv.frame = tview.NewFrame(ctxv.tbl).SetBorders(0, 0, 0, 0, 0, 0)
+	ctxv.frame.SetBorder(true).SetBorderPadding(0, 0, 1, 1)
+
+	ctxv.query()
+
+	return ctxv
+}
+
+// query requests the context lines from the logstream, and updates the UI
+// once they are received.
+func (ctxv *ContextView) query() {
+	ctxv.querySeq++
+	seq := ctxv.querySeq
+
+	ctxv.setTitle("loading...")
+
+	ctxv.mainView.params.OnContextQuery(
+		core.QueryContextParams{
+			Msg:      ctxv.params.Msg,
+			NumLines: ctxv.numLines,
+		},
+		func(resp *core.LogResp, err error) {
+			if seq != ctxv.querySeq {
+				// There is a newer query already.
+				return
+			}
+
+			if err != nil {
+				ctxv.setTitle("error")
+				ctxv.mainView.showMessagebox("err", "Error", "Can't get the context: "+err.Error(), nil)
+				return
+			}
+
+			ctxv.setTitle(fmt.Sprintf("±%d lines", ctxv.numLines))
+			ctxv.updateUI(resp.Logs)
+		},
+	)
+}
+
+func (ctxv *ContextView) setTitle(status string) {
+	ctxv.frame.SetTitle(fmt.Sprintf(
+		"Context of the message on %s (%s)", ctxv.params.Msg.Context["lstream"], status,
+	))
+
+	ctxv.frame.Clear()
+	ctxv.frame.AddText(
+		"<+>: more lines, <->: fewer lines, <Enter>: show full line, <Esc>: close",
+		false, tview.AlignLeft, tcell.ColorLightGray,
+	)
+}
+
+func (ctxv *ContextView) updateUI(logs []core.LogMsg) {
+	ctxv.tbl.Clear()
+
+	tz := ctxv.mainView.params.Options.GetTimezone()
+	targetIdx := getContextTargetIdx(logs, ctxv.params.Msg)
+
+	for i, msg := range logs {
+		timeCell := newTableCellLogmsg(msg.Time.In(tz).Format(logsTableTimeLayout)).
+			SetTextColor(tcell.ColorLightGray).
+			SetReference(msg)
+		lineCell := newTableCellLogmsg(tview.Escape(msg.OrigLine))
+
+		if i == targetIdx {
+			timeCell.SetTextColor(tcell.ColorYellow).SetAttributes(tcell.AttrBold)
+			lineCell.SetTextColor(tcell.ColorYellow).SetAttributes(tcell.AttrBold)
+		}
+
+		ctxv.tbl.SetCell(i, ctxvColIdxTime, timeCell)
+		ctxv.tbl.SetCell(i, ctxvColIdxLine, lineCell)
+	}
+
+	if targetIdx >= 0 {
+		ctxv.tbl.Select(targetIdx, 0)
+	} else if len(logs) > 0 {
+		ctxv.tbl.Select(0, 0)
+	}
+}
+
+func (ctxv *ContextView) Show() {
+	ctxv.mainView.showModal(
+		pageNameContext, ctxv.frame,
+		ctxv.mainView.screenWidth-4,
+		ctxv.mainView.screenHeight-4,
+		true,
+	)
+}
+
+func (ctxv *ContextView) Hide() {
+	ctxv.mainView.hideModal(pageNameContext, true)
+}
+
+// getContextTargetIdx returns the index of the msg in the context logs, or
+// -1 if it's not there. For log files, the msg is found by the line number,
+// and for journalctl, where there are no line numbers, by the time and the
+// line itself.
+func getContextTargetIdx(logs []core.LogMsg, msg core.LogMsg) int {
+	for i, cur := range logs {
+		if msg.LogFilename != core.SpecialFilenameJournalctl {
+			if cur.CombinedLinenumber == msg.CombinedLinenumber {
+				return i
+			}
+
+			continue
+		}
+
+		if cur.Time.Equal(msg.Time) && cur.OrigLine == msg.OrigLine {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetContextTargetIdx(t *testing.T) {
+	t1 := time.Date(2025, 3, 12, 10, 10, 5, 608677000, time.UTC)
+	t2 := time.Date(2025, 3, 12, 10, 10, 10, 799867000, time.UTC)
+
+	fileLogs := []core.LogMsg{
+		{LogFilename: "/var/log/syslog.1", CombinedLinenumber: 286, Time: t1, OrigLine: "foo"},
+		{LogFilename: "/var/log/syslog.1", CombinedLinenumber: 287, Time: t1, OrigLine: "foo"},
+		{LogFilename: "/var/log/syslog", CombinedLinenumber: 288, Time: t2, OrigLine: "bar"},
+	}
+
+	journalctlLogs := []core.LogMsg{
+		{LogFilename: core.SpecialFilenameJournalctl, Time: t1, OrigLine: "foo"},
+		{LogFilename: core.SpecialFilenameJournalctl, Time: t2, OrigLine: "bar"},
+		{LogFilename: core.SpecialFilenameJournalctl, Time: t2, OrigLine: "baz"},
+	}
+
+	tests := []struct {
+		descr string
+		logs  []core.LogMsg
+		msg   core.LogMsg
+		want  int
+	}{
+		{
+			descr: "log files, found by line number",
+			logs:  fileLogs,
+			msg:   core.LogMsg{LogFilename: "/var/log/syslog.1", CombinedLinenumber: 287, Time: t1, OrigLine: "foo"},
+			want:  1,
+		},
+		{
+			descr: "log files, not found",
+			logs:  fileLogs,
+			msg:   core.LogMsg{LogFilename: "/var/log/syslog", CombinedLinenumber: 300, Time: t2, OrigLine: "bar"},
+			want:  -1,
+		},
+		{
+			descr: "journalctl, found by time and line",
+			logs:  journalctlLogs,
+			msg:   core.LogMsg{LogFilename: core.SpecialFilenameJournalctl, Time: t2, OrigLine: "baz"},
+			want:  2,
+		},
+		{
+			descr: "journalctl, not found",
+			logs:  journalctlLogs,
+			msg:   core.LogMsg{LogFilename: core.SpecialFilenameJournalctl, Time: t1, OrigLine: "baz"},
+			want:  -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.descr, func(t *testing.T) {
+			assert.Equal(t, tt.want, getContextTargetIdx(tt.logs, tt.msg))
+		})
+	}
+}
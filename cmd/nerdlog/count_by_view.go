@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/awkpattern"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/gdamore/tcell/v2"
+	"github.com/juju/errors"
+	"github.com/rivo/tview"
+)
+
+const (
+	cbvColIdxCount    = 0
+	cbvColIdxValue    = 1
+	cbvColIdxLStreams = 2
+)
+
+// cbvMaxLStreamsInRow is how many logstreams at most we show for every value
+// in the table; if there are more, the rest is shown as "...".
+const cbvMaxLStreamsInRow = 5
+
+type CountByViewParams struct {
+	// CountBy is the count-by query params which the Resp was produced with.
+	CountBy core.CountByParams
+
+	// Resp is the response of a count-by query. It must be non-nil.
+	Resp *core.LogRespTotal
+
+	// OnDrillDown is called when the user presses Enter on some value; the
+	// pattern is an awk pattern matching the lines with that value.
+	OnDrillDown func(pattern string)
+}
+
+// CountByView shows the results of a count-by query: every row is a value
+// and the number of matching lines with that value, most frequent first.
+type CountByView struct {
+	params   CountByViewParams
+	mainView *MainView
+
+	tbl   *tview.Table
+	frame *tview.Frame
+}
+
+func NewCountByView(
+	mainView *MainView, params *CountByViewParams,
+) *CountByView {
+	cbv := &CountByView{
+		params:   *params,
+		mainView: mainView,
+	}
+
+	cbv.tbl = tview.NewTable()
+	cbv.tbl.SetFixed(1, 0)
+	cbv.tbl.SetSelectable(true, false)
+	cbv.tbl.SetSelectedStyle(menuSelected)
+
+	cbv.tbl.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEnter:
+			nRow, _ := cbv.tbl.GetSelection()
+			cell := cbv.tbl.GetCell(nRow, cbvColIdxCount)
+			if cell == nil {
+				return nil
+			}
+
+			if value, ok := cell.GetReference().(string); ok {
+				cbv.Hide()
+				cbv.params.OnDrillDown(getCountByDrillDownPattern(&cbv.params.CountBy, value))
+			}
+			return nil
+
+		case tcell.KeyEsc:
+			cbv.Hide()
+			return nil
+
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case 'q':
+				cbv.Hide()
+				return nil
+			}
+		}
+
+		return event
+	})
+
+	cbv.frame = tview.NewFrame(cbv.tbl).SetBorders(0, 0, 0, 0, 0, 0)
+	cbv.frame.SetBorder(true).SetBorderPadding(0, 0, 1, 1)
+	cbv.frame.SetTitle("Count by " + formatCountBySpec(&params.CountBy))
+
+	footer := "<Enter>: filter logs by this value, <Esc>: close"
+	if params.Resp.CountByRest > 0 {
+		footer = fmt.Sprintf(
+			"%d more lines with values outside of top %d; %s",
+			params.Resp.CountByRest, params.CountBy.GetTopK(), footer,
+		)
+	}
+	cbv.frame.AddText(footer, false, tview.AlignLeft, tcell.ColorLightGray)
+
+	cbv.updateUI()
+
+	return cbv
+}
+
+func (cbv *CountByView) updateUI() {
+	cbv.tbl.Clear()
+
+	cbv.tbl.SetCell(0, cbvColIdxCount, newTableCellHeader("count"))
+	cbv.tbl.SetCell(0, cbvColIdxValue, newTableCellHeader("value"))
+	cbv.tbl.SetCell(0, cbvColIdxLStreams, newTableCellHeader("logstreams"))
+
+	for i, item := range cbv.params.Resp.CountBy {
+		nRow := i + 1
+
+		cbv.tbl.SetCell(
+			nRow, cbvColIdxCount,
+			newTableCellLogmsg(strconv.Itoa(item.Count)).
+				SetAlign(tview.AlignRight).
+				SetReference(item.Value),
+		)
+		cbv.tbl.SetCell(
+			nRow, cbvColIdxValue,
+			newTableCellLogmsg(tview.Escape(item.Value)).SetTextColor(tcell.ColorLightGreen),
+		)
+		cbv.tbl.SetCell(
+			nRow, cbvColIdxLStreams,
+			newTableCellLogmsg(tview.Escape(formatCountByLStreams(item.CountByLStream))).
+				SetTextColor(tcell.ColorLightGray),
+		)
+	}
+
+	if len(cbv.params.Resp.CountBy) > 0 {
+		cbv.tbl.Select(1, 0)
+	}
+}
+
+func (cbv *CountByView) Show() {
+	height := len(cbv.params.Resp.CountBy) + 4
+	if height > cbv.mainView.screenHeight-4 {
+		height = cbv.mainView.screenHeight - 4
+	}
+
+	cbv.mainView.showModal(
+		pageNameCountBy, cbv.frame,
+		121,
+		height,
+		true,
+	)
+}
+
+func (cbv *CountByView) Hide() {
+	cbv.mainView.hideModal(pageNameCountBy, true)
+}
+
+// formatCountByLStreams formats the per-logstream counts like
+// "host1: 10, host2: 7", the largest counts first.
+func formatCountByLStreams(countByLStream map[string]int) string {
+	names := make([]string, 0, len(countByLStream))
+	for name := range countByLStream {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := countByLStream[names[i]], countByLStream[names[j]]
+		if ci != cj {
+			return ci > cj
+		}
+
+		return names[i] < names[j]
+	})
+
+	var sb strings.Builder
+	for i, name := range names {
+		if i >= cbvMaxLStreamsInRow {
+			sb.WriteString(", ...")
+			break
+		}
+
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+
+		sb.WriteString(fmt.Sprintf("%s: %d", name, countByLStream[name]))
+	}
+
+	return sb.String()
+}
+
+// parseCountBySpec parses the count-by spec as given to the :countby command,
+// which is one of:
+//
+//   - "program": group by the syslog program;
+//   - "field N" or "$N": group by the awk field $N;
+//   - "regex REGEX": group by the first capture group of the REGEX, or the
+//     whole match if there are no capture groups.
+//
+// Optionally, it can be prefixed with "top=K" to override the number of top
+// values to get from every logstream.
+func parseCountBySpec(spec string) (*core.CountByParams, error) {
+	ret := &core.CountByParams{}
+
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "top=") {
+		parts := strings.SplitN(spec, " ", 2)
+		topK, err := strconv.Atoi(strings.TrimPrefix(parts[0], "top="))
+		if err != nil || topK <= 0 {
+			return nil, errors.Errorf("invalid %q: top should be a positive integer", parts[0])
+		}
+
+		ret.TopK = topK
+
+		spec = ""
+		if len(parts) > 1 {
+			spec = strings.TrimSpace(parts[1])
+		}
+	}
+
+	kind, arg := spec, ""
+	if idx := strings.IndexRune(spec, ' '); idx >= 0 {
+		kind, arg = spec[:idx], strings.TrimSpace(spec[idx+1:])
+	}
+
+	switch {
+	case kind == "program":
+		if arg != "" {
+			return nil, errors.Errorf("program doesn't take any arguments")
+		}
+
+		ret.Kind = core.CountByKindProgram
+
+	case kind == "field":
+		ret.Kind = core.CountByKindAwkField
+		ret.Arg = arg
+
+	case strings.HasPrefix(kind, "$") && arg == "":
+		ret.Kind = core.CountByKindAwkField
+		ret.Arg = strings.TrimPrefix(kind, "$")
+
+	case kind == "regex":
+		ret.Kind = core.CountByKindRegex
+		ret.Arg = arg
+
+	case kind == "":
+		return nil, errors.Errorf("count-by spec is required: program, field N or regex REGEX")
+
+	default:
+		return nil, errors.Errorf("invalid count-by spec %q: expected program, field N or regex REGEX", spec)
+	}
+
+	if err := ret.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ret, nil
+}
+
+// formatCountBySpec is the opposite of parseCountBySpec, minus the top=K part.
+func formatCountBySpec(params *core.CountByParams) string {
+	switch params.Kind {
+	case core.CountByKindAwkField:
+		return "$" + params.Arg
+	case core.CountByKindRegex:
+		return "regex " + params.Arg
+	default:
+		return string(params.Kind)
+	}
+}
+
+// getCountByDrillDownPattern returns an awk pattern matching the lines which
+// have the given value, as per the count-by params.
+func getCountByDrillDownPattern(params *core.CountByParams, value string) string {
+	switch params.Kind {
+	case core.CountByKindProgram:
+		return fmt.Sprintf(`/ %s(\[[0-9]+\])?: /`, awkpattern.QuoteRegex(value))
+
+	case core.CountByKindAwkField:
+		return fmt.Sprintf(`$%s == %s`, params.Arg, awkpattern.QuoteString(value))
+
+	default:
+		return fmt.Sprintf(`/%s/`, awkpattern.QuoteRegex(value))
+	}
+}
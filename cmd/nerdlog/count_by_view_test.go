@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCountBySpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    *core.CountByParams
+		wantErr string
+	}{
+		{
+			spec: "program",
+			want: &core.CountByParams{Kind: core.CountByKindProgram},
+		},
+		{
+			spec: "field 7",
+			want: &core.CountByParams{Kind: core.CountByKindAwkField, Arg: "7"},
+		},
+		{
+			spec: "$7",
+			want: &core.CountByParams{Kind: core.CountByKindAwkField, Arg: "7"},
+		},
+		{
+			spec: "top=10 regex status=([0-9]+) foo",
+			want: &core.CountByParams{Kind: core.CountByKindRegex, Arg: "status=([0-9]+) foo", TopK: 10},
+		},
+		{
+			spec:    "",
+			wantErr: "count-by spec is required: program, field N or regex REGEX",
+		},
+		{
+			spec:    "top=0 program",
+			wantErr: `invalid "top=0": top should be a positive integer`,
+		},
+		{
+			spec:    "program foo",
+			wantErr: "program doesn't take any arguments",
+		},
+		{
+			spec:    "regex foo(",
+			wantErr: "invalid regex: error parsing regexp: missing closing ): `foo(`",
+		},
+		{
+			spec:    "foo",
+			wantErr: `invalid count-by spec "foo": expected program, field N or regex REGEX`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseCountBySpec(tt.spec)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetCountByDrillDownPattern(t *testing.T) {
+	assert.Equal(t,
+		`/ systemd-logind(\[[0-9]+\])?: /`,
+		getCountByDrillDownPattern(&core.CountByParams{Kind: core.CountByKindProgram}, "systemd-logind"),
+	)
+	assert.Equal(t,
+		`$7 == "say \"hi\""`,
+		getCountByDrillDownPattern(&core.CountByParams{Kind: core.CountByKindAwkField, Arg: "7"}, `say "hi"`),
+	)
+	assert.Equal(t,
+		`/GET \/api\/v1\.0/`,
+		getCountByDrillDownPattern(&core.CountByParams{Kind: core.CountByKindRegex, Arg: "GET [^ ]+"}, "GET /api/v1.0"),
+	)
+}
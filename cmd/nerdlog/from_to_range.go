@@ -24,7 +24,7 @@ func ParseFromToRange(timezone *time.Location, s string) (FromToRange, error) {
 
 	fromStr := flds[0]
 
-	from, err = parseAndInferTimeOrDur(timezone, inputTimeLayout, fromStr)
+	from, err = parseAndInferTimeOrDur(timezone, fromStr)
 	if err != nil {
 		return FromToRange{}, errors.Annotatef(err, "invalid 'from' duration")
 	}
@@ -35,12 +35,14 @@ func ParseFromToRange(timezone *time.Location, s string) (FromToRange, error) {
 		toStr := flds[1]
 
 		// If there's no date, prepend date
-		if len(toStr) <= 5 && len(fromStr) > 5 {
-			toStr = fromStr[:5] + " " + toStr
+		if !strings.Contains(toStr, " ") && strings.Contains(toStr, ":") {
+			if idx := strings.Index(fromStr, " "); idx > 0 {
+				toStr = fromStr[:idx] + " " + toStr
+			}
 		}
 
 		var err error
-		to, err = parseAndInferTimeOrDur(timezone, inputTimeLayout, toStr)
+		to, err = parseAndInferTimeOrDur(timezone, toStr)
 		if err != nil {
 			return FromToRange{}, errors.Annotatef(err, "invalid 'to' duration")
 		}
@@ -53,7 +55,7 @@ func ParseFromToRange(timezone *time.Location, s string) (FromToRange, error) {
 }
 
 func (ftr *FromToRange) String() string {
-	fromStr := ftr.From.Format(inputTimeLayout)
+	fromStr := ftr.From.Format(withSecondsIfNeeded(inputTimeLayout, ftr.From.Time))
 
 	if ftr.To.IsZero() {
 		return fromStr
@@ -68,13 +70,36 @@ func (ftr *FromToRange) String() string {
 		format = inputTimeLayoutMMHH
 	}
 
-	return fromStr + " to " + ftr.To.Format(format)
+	return fromStr + " to " + ftr.To.Format(withSecondsIfNeeded(format, ftr.To.Time))
 }
 
-func parseAndInferTimeOrDur(timezone *time.Location, layout, s string) (TimeOrDur, error) {
-	t, err := ParseTimeOrDur(timezone, layout, s)
+// withSecondsIfNeeded returns the given input time layout, but if the time
+// has non-zero seconds, the layout is replaced with the one which includes
+// seconds, so that formatting the time doesn't lose precision.
+func withSecondsIfNeeded(layout string, t time.Time) string {
+	if t.Second() == 0 {
+		return layout
+	}
+
+	switch layout {
+	case inputTimeLayout:
+		return inputTimeLayoutSeconds
+	case inputTimeLayoutMMHH:
+		return inputTimeLayoutMMHHSS
+	}
+
+	return layout
+}
+
+func parseAndInferTimeOrDur(timezone *time.Location, s string) (TimeOrDur, error) {
+	t, err := ParseTimeOrDur(timezone, inputTimeLayout, s)
 	if err != nil {
-		return TimeOrDur{}, err
+		// Maybe the time has seconds.
+		var err2 error
+		t, err2 = ParseTimeOrDur(timezone, inputTimeLayoutSeconds, s)
+		if err2 != nil {
+			return TimeOrDur{}, err
+		}
 	}
 
 	if t.IsAbsolute() {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFromToRange(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+
+		wantFrom string
+		wantTo   string // Empty if To must be zero
+		wantStr  string
+		wantErr  bool
+	}{
+		{
+			name:     "relative",
+			in:       "-5h",
+			wantFrom: "-5h0m0s",
+			wantStr:  "-5h",
+		},
+		{
+			name:     "absolute minutes, to without date",
+			in:       "Mar10 10:00 to 11:30",
+			wantFrom: "Mar10 10:00:00",
+			wantTo:   "Mar10 11:30:00",
+			wantStr:  "Mar10 10:00 to 11:30",
+		},
+		{
+			name:     "absolute seconds, to without date",
+			in:       "Mar10 10:00:15 to 10:00:45",
+			wantFrom: "Mar10 10:00:15",
+			wantTo:   "Mar10 10:00:45",
+			wantStr:  "Mar10 10:00:15 to 10:00:45",
+		},
+		{
+			name:     "seconds only in to",
+			in:       "Mar10 10:00 to Mar11 10:00:30",
+			wantFrom: "Mar10 10:00:00",
+			wantTo:   "Mar11 10:00:30",
+			wantStr:  "Mar10 10:00 to Mar11 10:00:30",
+		},
+		{
+			name:    "invalid",
+			in:      "Mar10 10:00:1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ftr, err := ParseFromToRange(time.UTC, tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tt.wantFrom, formatTimeOrDurForTest(ftr.From))
+			if tt.wantTo == "" {
+				assert.True(t, ftr.To.IsZero())
+			} else {
+				assert.Equal(t, tt.wantTo, formatTimeOrDurForTest(ftr.To))
+			}
+
+			assert.Equal(t, tt.wantStr, ftr.String())
+		})
+	}
+}
+
+func formatTimeOrDurForTest(t TimeOrDur) string {
+	if !t.IsAbsolute() {
+		return t.Dur.String()
+	}
+
+	return t.Time.Format("Jan2 15:04:05")
+}
@@ -49,6 +49,16 @@ type Histogram struct {
 	// bin.
 	data map[int]int
 
+	// binsVal, if not nil, returns the value for the bins in the range
+	// [from, to), which is used instead of summing up the values from data. It
+	// is needed when the values are not additive, like percentiles.
+	binsVal func(from, to int) int
+
+	// overlays are the extra data series which are drawn on top of the main
+	// data as colored markers: one marker per chart bar, at the height of the
+	// overlay value. They're ignored if binsVal is set.
+	overlays []HistogramOverlay
+
 	// getXMarks returns where to put marks on X axis
 	getXMarks func(from, to int, numChars int) []int
 
@@ -128,6 +138,34 @@ func (h *Histogram) SetData(data map[int]int) *Histogram {
 	return h
 }
 
+// HistogramOverlay is an extra data series drawn on top of the histogram.
+type HistogramOverlay struct {
+	// Label is shown in the legend.
+	Label string
+	// Data has the same format as the main histogram data.
+	Data map[int]int
+}
+
+// histogramOverlayColors are the colors of the overlays, in order; there can't
+// be more overlays than the colors here.
+var histogramOverlayColors = []string{"red", "aqua", "fuchsia", "lime"}
+
+func (h *Histogram) SetOverlays(overlays []HistogramOverlay) *Histogram {
+	if len(overlays) > len(histogramOverlayColors) {
+		overlays = overlays[:len(histogramOverlayColors)]
+	}
+
+	h.overlays = overlays
+
+	return h
+}
+
+func (h *Histogram) SetBinsValFunc(binsVal func(from, to int) int) *Histogram {
+	h.binsVal = binsVal
+
+	return h
+}
+
 func (h *Histogram) SetXFormatter(xFormat func(v int) string) *Histogram {
 	h.xFormat = xFormat
 
@@ -212,6 +250,46 @@ func (h *Histogram) Draw(screen tcell.Screen) {
 	}
 	tview.Print(screen, maxLabel, x+maxLabelOffset, y, width-maxLabelOffset, tview.AlignLeft, tcell.ColorWhite)
 
+	// Print overlay markers on top of the bars, and the legend for them in the
+	// top right corner (unless we're focused, since then the cursor value is
+	// printed there).
+	if h.binsVal == nil && len(h.overlays) > 0 {
+		legend := strings.Builder{}
+		legendLen := 0
+
+		for i, overlay := range h.overlays {
+			color := histogramOverlayColors[i]
+
+			for bar, topDot := range fldData.overlayTopDots[i] {
+				if topDot < 0 {
+					continue
+				}
+
+				marker := "▀"
+				if (topDot & 0x01) != 0 {
+					marker = "▄"
+				}
+
+				tview.Print(
+					screen, fmt.Sprintf("[%s]%s[-]", color, marker),
+					x+fldMarginLeft+bar*fldData.chartBarWidth/2, y+topDot/2,
+					1, tview.AlignLeft, tcell.ColorWhite,
+				)
+			}
+
+			if legendLen > 0 {
+				legend.WriteString("  ")
+				legendLen += 2
+			}
+			legend.WriteString(fmt.Sprintf("[%s]▀[-] %s", color, tview.Escape(overlay.Label)))
+			legendLen += 2 + len([]rune(overlay.Label))
+		}
+
+		if !h.HasFocus() && legendLen < width {
+			tview.Print(screen, legend.String(), x+width-legendLen, y, legendLen, tview.AlignLeft, tcell.ColorWhite)
+		}
+	}
+
 	// Print the ruler background under the histogram, to make it clear
 	// where the bounds of the working area are.
 	//
@@ -303,6 +381,11 @@ func (h *Histogram) Draw(screen tcell.Screen) {
 		var valToPrint string
 		if !h.IsSelectionActive() {
 			valToPrint = fmt.Sprintf("(%d)", fldData.cursorVal)
+		} else if h.binsVal != nil {
+			// Values are not additive, so calculate the value for the whole
+			// selection instead of the sum.
+			selStart, selEnd := h.GetSelection()
+			valToPrint = fmt.Sprintf("(%d)", h.binsVal(selStart, selEnd))
 		} else {
 			valToPrint = fmt.Sprintf("(total %d)", fldData.selectedValsSum)
 		}
@@ -571,6 +654,10 @@ type fieldData struct {
 	// selectedValsSum is the sum of all bars selected currently (if selection is
 	// in progress)
 	selectedValsSum int
+
+	// overlayTopDots contains, for every overlay, the Y coord of the top dot
+	// for every chart bar, or -1 if the overlay value for the bar is 0.
+	overlayTopDots [][]int
 }
 
 // genFieldData returns a 2-dimensional field as nested slices: [y][x].
@@ -590,6 +677,10 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 	chartBarWidth := scale.chartBarWidth
 
 	valAt := func(idx, n int) int {
+		if h.binsVal != nil {
+			return h.binsVal(h.from+idx*h.binSize, h.from+(idx+n)*h.binSize)
+		}
+
 		var val int
 		for i := 0; i < n; i++ {
 			val += h.data[h.from+(idx+i)*h.binSize]
@@ -597,6 +688,19 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 		return val
 	}
 
+	var overlays []HistogramOverlay
+	if h.binsVal == nil {
+		overlays = h.overlays
+	}
+
+	overlayValAt := func(overlayIdx, idx, n int) int {
+		var val int
+		for i := 0; i < n; i++ {
+			val += overlays[overlayIdx].Data[h.from+(idx+i)*h.binSize]
+		}
+		return val
+	}
+
 	isCursorAt := func(idx, n int) bool {
 		for i := 0; i < n; i++ {
 			if h.cursor == h.from+(idx+i)*h.binSize {
@@ -634,6 +738,12 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 		if max < val {
 			max = val
 		}
+
+		for i := range overlays {
+			if v := overlayValAt(i, xData, dataBinsInChartBar); max < v {
+				max = v
+			}
+		}
 	}
 
 	dotYScale := (max + height - 1) / height
@@ -731,6 +841,14 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 		selScaleDots[i] = selScaleDots[i][selOffsetStart:]
 	}
 
+	overlayTopDots := make([][]int, len(overlays))
+	for i := range overlays {
+		for xData := 0; xData < numDataBins; xData = xData + dataBinsInChartBar {
+			val := overlayValAt(i, xData, dataBinsInChartBar)
+			overlayTopDots[i] = append(overlayTopDots[i], getTopDot(val, dotYScale, height))
+		}
+	}
+
 	effectiveWidthDots := numDataBins / dataBinsInChartBar * chartBarWidth
 	effectiveWidthRunes := effectiveWidthDots / 2
 	if (effectiveWidthDots & 0x01) > 0 {
@@ -754,6 +872,8 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 
 		cursorVal:       cursorVal,
 		selectedValsSum: selectedValsSum,
+
+		overlayTopDots: overlayTopDots,
 	}
 
 	/*
@@ -779,6 +899,22 @@ func (h *Histogram) genFieldData(width, height int) *fieldData {
 	//}
 }
 
+// getTopDot returns the Y coord (from the top of the field with the given
+// height) of the top dot of a bar with the given value, or -1 if the bar is
+// empty. It matches the way genFieldData fills the bars.
+func getTopDot(val, dotYScale, height int) int {
+	if val <= 0 || dotYScale <= 0 {
+		return -1
+	}
+
+	numDots := (val + dotYScale - 1) / dotYScale
+	if numDots > height {
+		numDots = height
+	}
+
+	return height - numDots
+}
+
 // histogramScale represents key parameters about drawing a histogram.
 // See getOptimalScale.
 type histogramScale struct {
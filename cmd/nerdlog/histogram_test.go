@@ -46,6 +46,30 @@ func TestClearTviewFormatting(t *testing.T) {
 	}
 }
 
+func TestGetTopDot(t *testing.T) {
+	tests := []struct {
+		name      string
+		val       int
+		dotYScale int
+		height    int
+		expected  int
+	}{
+		{"Zero value", 0, 10, 8, -1},
+		{"Zero scale", 5, 0, 8, -1},
+		{"Single dot", 1, 10, 8, 7},
+		{"Exactly two dots", 20, 10, 8, 6},
+		{"Partial third dot", 21, 10, 8, 5},
+		{"Full height", 80, 10, 8, 0},
+		{"Over the top", 100, 10, 8, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, getTopDot(tt.val, tt.dotYScale, tt.height))
+		})
+	}
+}
+
 func TestGetOptimalScale_Custom(t *testing.T) {
 	const binSize = 60 // 1 minute
 
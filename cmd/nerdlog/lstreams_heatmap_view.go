@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	lhvColIdxName    = 0
+	lhvColIdxTotal   = 1
+	lhvColIdxHeatmap = 2
+)
+
+var (
+	// heatmapShades are used to draw a single heatmap cell, from the coldest to
+	// the hottest one. The very first one is only used for cells with no
+	// messages at all.
+	heatmapShades = []rune{' ', '░', '▒', '▓', '█'}
+)
+
+type LStreamsHeatmapViewParams struct {
+	// Resp is the log response to build the heatmap from. It must be non-nil.
+	Resp *core.LogRespTotal
+
+	// From and To define the time range of the heatmap.
+	From, To time.Time
+
+	// HistogramLStream is the logstream which the main histogram currently
+	// shows; if empty, the main histogram shows all logstreams together.
+	HistogramLStream string
+
+	// OnNarrow is called when the user presses Enter on some logstream, to
+	// narrow the logstreams filter down to just that logstream.
+	OnNarrow func(lstreamName string)
+
+	// OnHistogramLStream is called when the user presses Space on some
+	// logstream, to make the main histogram show only that logstream. If the
+	// histogram already shows it, then the lstreamName is empty, meaning the
+	// histogram should go back to showing all logstreams.
+	OnHistogramLStream func(lstreamName string)
+}
+
+// LStreamsHeatmapView shows how the messages are distributed across
+// logstreams and time: every row is a logstream, and every column is a time
+// bin. It's useful when a single logstream out of many starts to misbehave,
+// since in the merged histogram it's not visible which one it is.
+type LStreamsHeatmapView struct {
+	params   LStreamsHeatmapViewParams
+	mainView *MainView
+
+	tbl   *tview.Table
+	frame *tview.Frame
+
+	width, height int
+}
+
+func NewLStreamsHeatmapView(
+	mainView *MainView, params *LStreamsHeatmapViewParams,
+) *LStreamsHeatmapView {
+	lhv := &LStreamsHeatmapView{
+		params:   *params,
+		mainView: mainView,
+	}
+
+	lhv.tbl = tview.NewTable()
+	lhv.tbl.SetFixed(1, 0)
+	lhv.tbl.SetSelectable(true, false)
+	lhv.tbl.SetSelectedStyle(menuSelected)
+
+	lhv.tbl.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		getSelectedName := func() (string, bool) {
+			nRow, _ := lhv.tbl.GetSelection()
+			cell := lhv.tbl.GetCell(nRow, lhvColIdxName)
+			if cell == nil {
+				return "", false
+			}
+
+			name, ok := cell.GetReference().(string)
+			return name, ok
+		}
+
+		switch event.Key() {
+		case tcell.KeyEnter:
+			if name, ok := getSelectedName(); ok {
+				lhv.Hide()
+				lhv.params.OnNarrow(name)
+			}
+			return nil
+
+		case tcell.KeyEsc:
+			lhv.Hide()
+			return nil
+
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case ' ':
+				if name, ok := getSelectedName(); ok {
+					if name == lhv.params.HistogramLStream {
+						name = ""
+					}
+
+					lhv.Hide()
+					lhv.params.OnHistogramLStream(name)
+				}
+				return nil
+
+			case 'q':
+				lhv.Hide()
+				return nil
+			}
+		}
+
+		return event
+	})
+
+	lhv.frame = tview.NewFrame(lhv.tbl).SetBorders(0, 0, 0, 0, 0, 0)
+	lhv.frame.SetBorder(true).SetBorderPadding(0, 0, 1, 1)
+	lhv.frame.SetTitle("Logstreams heatmap")
+	lhv.frame.AddText(
+		"<Enter>: narrow logstreams, <Space>: show in histogram, <Esc>: close",
+		false, tview.AlignLeft, tcell.ColorLightGray,
+	)
+
+	lhv.updateUI()
+
+	return lhv
+}
+
+func (lhv *LStreamsHeatmapView) updateUI() {
+	resp := lhv.params.Resp
+
+	type lstreamTotal struct {
+		name  string
+		total int
+	}
+
+	totals := make([]lstreamTotal, 0, len(resp.MinuteStatsByLStream))
+	maxNameLen := len("logstream")
+	for name, stats := range resp.MinuteStatsByLStream {
+		total := 0
+		for _, v := range stats {
+			total += v.NumMsgs
+		}
+
+		totals = append(totals, lstreamTotal{name: name, total: total})
+
+		if maxNameLen < len(name) {
+			maxNameLen = len(name)
+		}
+	}
+
+	// The noisiest logstreams go first.
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].total != totals[j].total {
+			return totals[i].total > totals[j].total
+		}
+
+		return totals[i].name < totals[j].name
+	})
+
+	totalStr := fmt.Sprintf("%d", resp.NumMsgsTotal)
+	totalColWidth := len(totalStr)
+	if totalColWidth < len("total") {
+		totalColWidth = len("total")
+	}
+
+	// Figure out how much space we have for the heatmap itself: we take as much
+	// of the screen as possible, minus the name and total columns, minus the
+	// borders and paddings.
+	lhv.width = lhv.mainView.screenWidth - 4
+	numCols := lhv.width - 4 - maxNameLen - totalColWidth - 2
+	if numCols < 10 {
+		numCols = 10
+	}
+
+	from := lhv.params.From.Unix()
+	to := lhv.params.To.Unix()
+
+	binSize := int64(histogramBinSize)
+	if resp.StatsResolution > 0 && resp.StatsResolution < time.Minute {
+		binSize = int64(resp.StatsResolution / time.Second)
+	}
+
+	// First we need to calculate all the heatmap rows, so that we know the max
+	// value across all of them, and then we can actually draw them.
+	rows := make([][]int, 0, len(totals))
+	max := 0
+	for _, lt := range totals {
+		row := getHeatmapRow(resp.MinuteStatsByLStream[lt.name], from, to, binSize, numCols)
+		for _, v := range row {
+			if max < v {
+				max = v
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	lhv.tbl.Clear()
+
+	tz := lhv.mainView.params.Options.GetTimezone()
+	heatmapHeader := fmt.Sprintf(
+		"%s - %s",
+		lhv.params.From.In(tz).Format(withSecondsIfNeeded(inputTimeLayout, lhv.params.From)),
+		lhv.params.To.In(tz).Format(withSecondsIfNeeded(inputTimeLayout, lhv.params.To)),
+	)
+
+	lhv.tbl.SetCell(0, lhvColIdxName, newTableCellHeader("logstream"))
+	lhv.tbl.SetCell(0, lhvColIdxTotal, newTableCellHeader("total"))
+	lhv.tbl.SetCell(0, lhvColIdxHeatmap, newTableCellHeader(heatmapHeader))
+
+	for i, lt := range totals {
+		nRow := i + 1
+
+		name := lt.name
+		if name == lhv.params.HistogramLStream {
+			name = "[yellow::b]*[-::-]" + tview.Escape(name)
+		} else {
+			name = " " + tview.Escape(name)
+		}
+
+		lhv.tbl.SetCell(
+			nRow, lhvColIdxName,
+			newTableCellLogmsg(name).SetReference(lt.name),
+		)
+		lhv.tbl.SetCell(
+			nRow, lhvColIdxTotal,
+			newTableCellLogmsg(fmt.Sprintf("%d", lt.total)).SetAlign(tview.AlignRight),
+		)
+		lhv.tbl.SetCell(
+			nRow, lhvColIdxHeatmap,
+			newTableCellLogmsg(formatHeatmapRow(rows[i], max)).SetTextColor(tcell.ColorOrange),
+		)
+	}
+
+	if len(totals) > 0 {
+		lhv.tbl.Select(1, 0)
+	}
+
+	lhv.height = len(totals) + 4
+	if lhv.height > lhv.mainView.screenHeight-4 {
+		lhv.height = lhv.mainView.screenHeight - 4
+	}
+}
+
+func (lhv *LStreamsHeatmapView) Show() {
+	lhv.mainView.showModal(
+		pageNameLStreamsHeatmap, lhv.frame,
+		lhv.width,
+		lhv.height,
+		true,
+	)
+}
+
+func (lhv *LStreamsHeatmapView) Hide() {
+	lhv.mainView.hideModal(pageNameLStreamsHeatmap, true)
+}
+
+// getHeatmapRow splits the time range [from, to) into numCols columns (or
+// fewer, if there are not enough data bins for that many), and returns the
+// number of messages in every column. The binSize is the size of a data bin
+// in the stats, in seconds; every column consists of a whole number of bins.
+func getHeatmapRow(
+	stats map[int64]core.MinuteStatsItem, from, to, binSize int64, numCols int,
+) []int {
+	if numCols <= 0 || to <= from {
+		return nil
+	}
+
+	numBins := (to - from + binSize - 1) / binSize
+	binsPerCol := (numBins + int64(numCols) - 1) / int64(numCols)
+	numCols = int((numBins + binsPerCol - 1) / binsPerCol)
+
+	ret := make([]int, numCols)
+	for ts, v := range stats {
+		if ts < from || ts >= to {
+			continue
+		}
+
+		ret[(ts-from)/binSize/binsPerCol] += v.NumMsgs
+	}
+
+	return ret
+}
+
+// formatHeatmapRow returns a string with one rune per heatmap column, the
+// shade of which depends on how the value compares to the max one.
+func formatHeatmapRow(row []int, max int) string {
+	var sb strings.Builder
+	for _, v := range row {
+		sb.WriteRune(getHeatmapShade(v, max))
+	}
+
+	return sb.String()
+}
+
+func getHeatmapShade(v, max int) rune {
+	if v <= 0 || max <= 0 {
+		return heatmapShades[0]
+	}
+
+	numLevels := len(heatmapShades) - 1
+	level := (v*numLevels + max - 1) / max
+	if level > numLevels {
+		level = numLevels
+	}
+
+	return heatmapShades[level]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHeatmapRow(t *testing.T) {
+	stats := map[int64]core.MinuteStatsItem{
+		0:   {NumMsgs: 1},
+		60:  {NumMsgs: 2},
+		120: {NumMsgs: 3},
+		300: {NumMsgs: 4},
+		600: {NumMsgs: 100}, // Out of range
+	}
+
+	tests := []struct {
+		name     string
+		numCols  int
+		expected []int
+	}{
+		{
+			name:     "one bin per column",
+			numCols:  10,
+			expected: []int{1, 2, 3, 0, 0, 4, 0, 0, 0, 0},
+		},
+		{
+			name:     "two bins per column",
+			numCols:  5,
+			expected: []int{3, 3, 4, 0, 0},
+		},
+		{
+			name:     "three bins per column, fewer columns than requested",
+			numCols:  4,
+			expected: []int{6, 4, 0, 0},
+		},
+		{
+			name:     "more columns than bins",
+			numCols:  100,
+			expected: []int{1, 2, 3, 0, 0, 4, 0, 0, 0, 0},
+		},
+		{
+			name:     "no columns",
+			numCols:  0,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, getHeatmapRow(stats, 0, 600, 60, tt.numCols))
+		})
+	}
+}
+
+func TestFormatHeatmapRow(t *testing.T) {
+	assert.Equal(t, " ░▒▓██", formatHeatmapRow([]int{0, 1, 6, 11, 16, 20}, 20))
+	assert.Equal(t, "   ", formatHeatmapRow([]int{0, 0, 0}, 0))
+}
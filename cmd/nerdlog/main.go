@@ -8,6 +8,7 @@ import (
 
 	"github.com/dimonomid/nerdlog/clhistory"
 	"github.com/dimonomid/nerdlog/clipboard"
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/log"
 	"github.com/dimonomid/nerdlog/version"
 	"github.com/spf13/pflag"
@@ -17,7 +18,18 @@ import (
 const inputTimeLayout = "Jan2 15:04"
 const inputTimeLayoutMMHH = "15:04"
 
+// Same as above but with seconds; used when the time range is more precise
+// than a minute.
+const inputTimeLayoutSeconds = "Jan2 15:04:05"
+const inputTimeLayoutMMHHSS = "15:04:05"
+
 func main() {
+	// When ssh runs us as SSH_ASKPASS, forward the prompt to the nerdlog
+	// instance which runs that ssh, instead of starting the app.
+	if os.Getenv(core.EnvAskpassSocket) != "" {
+		os.Exit(core.RunAskpassHelper(os.Args[1:]))
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting home dir: %s\n", err)
@@ -43,6 +55,8 @@ func main() {
 		flagLogLevel         = pflag.String("loglevel", "error", "This is NOT about the logs that nerdlog fetches from the remote servers, it's rather about nerdlog's own log. Valid values are: error, warning, info, verbose1, verbose2 or verbose3")
 		flagSSHConfig        = pflag.String("ssh-config", filepath.Join(homeDir, ".ssh", "config"), "ssh config file to use; set to an empty string to disable reading ssh config")
 		flagSSHKeys          = pflag.StringSlice("ssh-key", defaultSSHKeys, "ssh keys to use; only the first existing file will be used")
+		flagSSHPasswordAuth  = pflag.Bool("ssh-password-auth", false, "If the host doesn't accept the ssh keys, try password and keyboard-interactive (e.g. OTP) authentication, asking for the password or for the answers in the UI. Only applies to the ssh-lib transport")
+		flagSSHCachePassword = pflag.Bool("ssh-cache-password", false, "Remember ssh passwords entered for every host until nerdlog exits, so that reconnecting doesn't ask for them again. Only applies to the ssh-lib transport with --ssh-password-auth")
 		flagSet              = pflag.StringSlice("set", []string{}, "Initial option values in the form option=value, in the same way you'd specify them for the :set command. This flag can be given multiple times")
 
 		flagNoJournalctlAccessWarn = pflag.Bool("no-journalctl-access-warning", false, "Suppress the warning when journalctl is being used by the user who can't read all system logs")
@@ -137,6 +151,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The ssh-bin transport runs the nerdlog binary itself as SSH_ASKPASS, to
+	// forward the ssh prompts to the UI. If we can't find it, ssh won't prompt.
+	askpassBinary, err := os.Executable()
+	if err != nil {
+		askpassBinary = ""
+	}
+
 	app, err := newNerdlogApp(
 		nerdlogAppParams{
 			initialOptionSets:    *flagSet,
@@ -148,6 +169,9 @@ func main() {
 			logstreamsConfigPath: *flagLStreamsConfig,
 			cmdHistoryFile:       *flagCmdHistoryFile,
 			sshKeys:              *flagSSHKeys,
+			sshPasswordAuth:      *flagSSHPasswordAuth,
+			sshCachePassword:     *flagSSHCachePassword,
+			sshAskpassBinary:     askpassBinary,
 
 			noJournalctlAccessWarn: *flagNoJournalctlAccessWarn,
 		},
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dimonomid/nerdlog/awkpattern"
 	"github.com/dimonomid/nerdlog/clhistory"
 	"github.com/dimonomid/nerdlog/clipboard"
 	"github.com/dimonomid/nerdlog/cmd/nerdlog/ui"
@@ -25,6 +26,9 @@ const (
 	pageNameRowDetails      = "row_details"
 	pageNameColumnDetails   = "column_details"
 	pageNameTextView        = "text_view"
+	pageNameLStreamsHeatmap = "lstreams_heatmap"
+	pageNameCountBy         = "count_by"
+	pageNameContext         = "context"
 )
 
 const (
@@ -32,6 +36,8 @@ const (
 	rowIdxLoadOlder = 1
 )
 
+// histogramBinSize is the default histogram bin size, in seconds; it might
+// be smaller if the logstreams have a sub-minute index resolution.
 const histogramBinSize = 60 // 1 minute
 
 type MainViewParams struct {
@@ -48,6 +54,16 @@ type MainViewParams struct {
 	OnDisconnectRequest OnDisconnectRequest
 	OnReconnectRequest  OnReconnectRequest
 
+	// OnContextQuery is called when the user wants to see the context lines
+	// around some message; once the lines are received, cb must be called from
+	// the UI goroutine.
+	OnContextQuery OnContextQueryCallback
+
+	// OnCleanupRemote is called when the user wants to find (and, unless
+	// params.DryRun is true, remove) the stale nerdlog files on the logstream
+	// hosts; once done, cb must be called from the UI goroutine.
+	OnCleanupRemote OnCleanupRemoteCallback
+
 	// TODO: support command history
 	OnCmd OnCmdCallback
 
@@ -93,6 +109,26 @@ type MainView struct {
 
 	histogram *Histogram
 
+	// histogramBinSize is the current bin size of the histogram, in seconds.
+	histogramBinSize int
+
+	// histogramLStream, if not empty, is the logstream name whose messages
+	// alone the histogram shows; otherwise, it shows all logstreams together.
+	histogramLStream string
+
+	// numAgg, if not nil, is the numeric aggregation which is requested with
+	// every query; its results can be shown on the histogram, depending on the
+	// "histogram" option.
+	numAgg *core.NumAggParams
+
+	// overlays are the extra patterns which are counted with every query, and
+	// shown on the histogram as separate series (see the :overlay command).
+	overlays []string
+
+	// curCountBy is the params of the last count-by query, if any; it's needed
+	// to drill down from the count-by results into the logs.
+	curCountBy *core.CountByParams
+
 	statusLineLeft  *tview.TextView
 	statusLineRight *tview.TextView
 
@@ -170,6 +206,8 @@ type OnLogQueryCallback func(params core.QueryLogsParams)
 type OnLStreamsChange func(lstreamsSpec string) error
 type OnDisconnectRequest func()
 type OnReconnectRequest func()
+type OnContextQueryCallback func(params core.QueryContextParams, cb func(resp *core.LogResp, err error))
+type OnCleanupRemoteCallback func(params core.CleanupRemoteParams, cb func(res map[string]*core.CleanupRemoteResp))
 type OnCmdCallback func(cmd string, opts CmdOpts)
 
 var (
@@ -223,6 +261,8 @@ func NewMainView(params *MainViewParams) *MainView {
 
 	mv := &MainView{
 		params: *params,
+
+		histogramBinSize: histogramBinSize,
 	}
 
 	var err error
@@ -255,7 +295,15 @@ func NewMainView(params *MainViewParams) *MainView {
 
 		switch event.Key() {
 		case tcell.KeyEnter:
-			mv.setQuery(mv.queryInput.GetText())
+			query := mv.queryInput.GetText()
+			if err := core.ValidateQuery(query); err != nil {
+				mv.showMessagebox("err", "Invalid query", getQueryErrorMsg(query, err), &MessageboxParams{
+					BackgroundColor: tcell.ColorDarkRed,
+				})
+				return nil
+			}
+
+			mv.setQuery(query)
 			mv.bumpTimeRange(false)
 
 			if mv.sendLStreamsChangeOnNextQuery {
@@ -516,38 +564,58 @@ func NewMainView(params *MainViewParams) *MainView {
 	mainFlex.AddItem(mv.topFlex, 1, 0, true)
 
 	mv.histogram = NewHistogram()
-	mv.histogram.SetBinSize(histogramBinSize) // 1 minute
+	mv.histogram.SetBinSize(mv.histogramBinSize)
 	mv.histogram.SetXFormatter(func(v int) string {
 		tz := mv.params.Options.GetTimezone()
 
 		t := time.Unix(int64(v), 0).In(tz)
-		if t.Hour() == 0 && t.Minute() == 0 {
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
 			return t.In(tz).Format("[yellow]Jan02[-]")
 		}
+		if t.Second() != 0 {
+			return t.In(tz).Format("15:04:05")
+		}
 		return t.In(tz).Format("15:04")
 	})
 	mv.histogram.SetCursorFormatter(func(from int, to *int, width int) string {
 		tz := mv.params.Options.GetTimezone()
 		fromTime := time.Unix(int64(from), 0).In(tz)
 
+		layout := "Jan02 15:04"
+		if mv.histogramBinSize < 60 {
+			layout = "Jan02 15:04:05"
+		}
+
 		if to == nil {
-			return fromTime.In(tz).Format("Jan02 15:04")
+			return fromTime.In(tz).Format(layout)
 		}
 
 		toTime := time.Unix(int64(*to), 0).In(tz)
 
+		// Keep the format like "14h0m" for the whole minutes, and only show the
+		// seconds when the selection has them.
+		dur := toTime.Sub(fromTime)
+		durStr := dur.String()
+		if dur%time.Minute == 0 {
+			durStr = strings.TrimSuffix(durStr, "0s")
+		}
+
 		return fmt.Sprintf(
 			"%s - %s (%s)",
-			fromTime.In(tz).Format("Jan02 15:04"),
-			toTime.In(tz).Format("Jan02 15:04"),
-			strings.TrimSuffix(toTime.Sub(fromTime).String(), "0s"),
+			fromTime.In(tz).Format(layout),
+			toTime.In(tz).Format(layout),
+			durStr,
 		)
 	})
 	mv.histogram.SetXMarker(func(from, to int, numChars int) []int {
 		tz := mv.params.Options.GetTimezone()
-		return getXMarksForHistogram(tz, from, to, numChars)
+		minStep := time.Duration(mv.histogramBinSize) * time.Second
+		return getXMarksForHistogram(tz, from, to, numChars, minStep)
+	})
+	mv.histogram.SetDataBinsSnapper(func(dataBinsInChartDot int) int {
+		binSize := time.Duration(mv.histogramBinSize) * time.Second
+		return snapDataBinsInChartDotForBinSize(dataBinsInChartDot, binSize)
 	})
-	mv.histogram.SetDataBinsSnapper(snapDataBinsInChartDot)
 	mv.histogram.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		event = mv.eventHandlerBrowserLike(event)
 		if event == nil {
@@ -594,7 +662,9 @@ func NewMainView(params *MainViewParams) *MainView {
 		}
 
 		mv.setTimeRange(fromTime, toTime)
-		mv.doQuery(doQueryParams{})
+
+		// When zooming into some range, we want the full detail for it.
+		mv.doQuery(doQueryParams{noSample: true})
 	})
 
 	mainFlex.AddItem(mv.histogram, 6, 0, false)
@@ -672,6 +742,7 @@ func NewMainView(params *MainViewParams) *MainView {
 				Query: mv.query,
 
 				LoadEarlier: true,
+				Gentle:      mv.params.Options.GetGentle(),
 			})
 
 			// Update the cell text
@@ -682,6 +753,27 @@ func NewMainView(params *MainViewParams) *MainView {
 			return
 		}
 
+		if row == mv.getRowIdxLoadNewer() {
+			// Request to load more (newer) logs
+
+			// Do the query to core
+			mv.params.OnLogQuery(core.QueryLogsParams{
+				From:  mv.actualFrom,
+				To:    mv.actualToForQuery,
+				Query: mv.query,
+
+				LoadLater: true,
+				Gentle:    mv.params.Options.GetGentle(),
+			})
+
+			// Update the cell text
+			mv.logsTable.SetCell(
+				row, 0,
+				newTableCellButton("... loading ..."),
+			)
+			return
+		}
+
 		// "Click" on a data cell: show details
 
 		firstCell := mv.logsTable.GetCell(row, 0)
@@ -984,6 +1076,10 @@ func (mv *MainView) applyQueryEditData(data QueryFull, dqp doQueryParams) error
 		return errors.Annotatef(err, "select query")
 	}
 
+	if err := core.ValidateQuery(data.Query); err != nil {
+		return errors.Annotatef(err, "query")
+	}
+
 	mv.setQuery(data.Query)
 	mv.setTimeRange(ftr.From, ftr.To)
 
@@ -1025,7 +1121,7 @@ func (mv *MainView) applyHMState(lsmanState *core.LStreamsManagerState) {
 	if !mv.curHMState.Connected && !mv.curHMState.NoMatchingLStreams {
 		var sb strings.Builder
 
-		sb.WriteString("Connecting to hosts...")
+		sb.WriteString(fmt.Sprintf("Connecting to hosts: %s...", getConnectingStatus(lsmanState)))
 
 		logstreams := make([]string, 0, len(lsmanState.ConnDetailsByLStream))
 		for logstream := range lsmanState.ConnDetailsByLStream {
@@ -1278,19 +1374,86 @@ func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 
 	mv.formatLogs()
 
-	if !resp.LoadedEarlier {
-		// Replaced all logs
-		mv.logsTable.Select(len(resp.Logs)+1, 0)
-		mv.logsTable.ScrollToEnd()
-		mv.bumpTimeRange(true)
-	} else {
+	if resp.LoadedEarlier {
 		// Loaded more (earlier) logs
 		numNewRows := mv.logsTable.GetRowCount() - oldNumRows
 		mv.logsTable.SetOffset(offsetRow+numNewRows, offsetCol)
 		mv.logsTable.Select(selectedRow+numNewRows, 0)
+	} else if resp.LoadedLater {
+		// Loaded more (newer) logs: they are added at the bottom, so the rows
+		// we already had stay where they were.
+		mv.logsTable.SetOffset(offsetRow, offsetCol)
+		mv.logsTable.Select(selectedRow, 0)
+	} else if resp.Order == core.LogsOrderAsc {
+		// Replaced all logs, and since these are the earliest ones, start from
+		// the top
+		mv.logsTable.Select(2, 0)
+		mv.logsTable.ScrollToBeginning()
+		mv.bumpTimeRange(true)
+	} else {
+		// Replaced all logs
+		mv.logsTable.Select(len(resp.Logs)+1, 0)
+		mv.logsTable.ScrollToEnd()
+		mv.bumpTimeRange(true)
+	}
+
+	msg := fmt.Sprintf("Query took: %s", resp.QueryDur.Round(1*time.Millisecond))
+	if warningsStr := formatQueryWarnings(resp.DebugInfo); warningsStr != "" {
+		mv.printMsg(msg+"; "+warningsStr, nlMsgLevelWarn)
+		return
 	}
 
-	mv.printMsg(fmt.Sprintf("Query took: %s", resp.QueryDur.Round(1*time.Millisecond)), nlMsgLevelInfo)
+	mv.printMsg(msg, nlMsgLevelInfo)
+}
+
+// formatQueryWarnings returns a human-readable message about the issues which
+// happened during the query on some logstreams, grouped by the reason, like
+// "index rebuilt: truncation detected (foo-01, foo-02)". If there were no
+// issues, returns an empty string.
+func formatQueryWarnings(debugInfo map[string]core.LogstreamDebugInfo) string {
+	var parts []string
+
+	parts = append(parts, formatLStreamsByReason(debugInfo, "index rebuilt", func(dbg core.LogstreamDebugInfo) string {
+		return dbg.IndexRebuilt
+	})...)
+
+	parts = append(parts, formatLStreamsByReason(debugInfo, "read rate not limited", func(dbg core.LogstreamDebugInfo) string {
+		return dbg.ReadRateIgnored
+	})...)
+
+	return strings.Join(parts, "; ")
+}
+
+// formatLStreamsByReason groups the logstreams by the reason returned by
+// getReason (ignoring the empty ones), and returns a message for every reason,
+// like "<what>: <reason> (foo-01, foo-02)".
+func formatLStreamsByReason(
+	debugInfo map[string]core.LogstreamDebugInfo,
+	what string,
+	getReason func(dbg core.LogstreamDebugInfo) string,
+) []string {
+	lstreamsByReason := map[string][]string{}
+	for lstreamName, dbg := range debugInfo {
+		if reason := getReason(dbg); reason != "" {
+			lstreamsByReason[reason] = append(lstreamsByReason[reason], lstreamName)
+		}
+	}
+
+	reasons := make([]string, 0, len(lstreamsByReason))
+	for reason := range lstreamsByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		lstreamNames := lstreamsByReason[reason]
+		sort.Strings(lstreamNames)
+
+		parts = append(parts, fmt.Sprintf("%s: %s (%s)", what, reason, strings.Join(lstreamNames, ", ")))
+	}
+
+	return parts
 }
 
 func (mv *MainView) getLastQueryDebugInfo() string {
@@ -1308,6 +1471,16 @@ func (mv *MainView) getLastQueryDebugInfo() string {
 
 	for _, lstreamName := range lstreamNames {
 		debugInfo := mv.curLogResp.DebugInfo[lstreamName]
+		if debugInfo.CompiledQuery != "" {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+
+			sb.WriteString(fmt.Sprintf("%s compiled awk pattern:\n", lstreamName))
+			sb.WriteString(debugInfo.CompiledQuery)
+			sb.WriteString("\n")
+		}
+
 		if len(debugInfo.AgentStdout) > 0 {
 			if sb.Len() > 0 {
 				sb.WriteString("\n")
@@ -1405,19 +1578,193 @@ func (mv *MainView) showConnDebugInfo() {
 	})
 }
 
-func (mv *MainView) formatLogs() {
+func (mv *MainView) showLStreamsHeatmap() {
+	if mv.curLogResp == nil || len(mv.curLogResp.MinuteStatsByLStream) == 0 {
+		mv.printMsg("No query results", nlMsgLevelErr)
+		return
+	}
+
+	lhv := NewLStreamsHeatmapView(mv, &LStreamsHeatmapViewParams{
+		Resp:             mv.curLogResp,
+		From:             mv.actualFrom,
+		To:               mv.actualTo,
+		HistogramLStream: mv.histogramLStream,
+
+		OnNarrow: func(lstreamName string) {
+			qf := mv.getQueryFull()
+			qf.LStreams = lstreamName
+
+			if err := mv.applyQueryEditData(qf, doQueryParams{}); err != nil {
+				mv.showMessagebox("err", "Error", err.Error(), nil)
+			}
+		},
+
+		OnHistogramLStream: func(lstreamName string) {
+			mv.setHistogramLStream(lstreamName)
+		},
+	})
+	lhv.Show()
+}
+
+// doCountByQuery runs a count-by query for the current time range, query and
+// logstreams; the results are shown in a CountByView once received.
+func (mv *MainView) doCountByQuery(countBy *core.CountByParams) {
+	mv.curCountBy = countBy
+
+	mv.params.OnLogQuery(core.QueryLogsParams{
+		From:  mv.actualFrom,
+		To:    mv.actualToForQuery,
+		Query: mv.query,
+
+		CountBy: countBy,
+		Gentle:  mv.params.Options.GetGentle(),
+	})
+}
+
+// applyCountBy shows the results of a count-by query.
+func (mv *MainView) applyCountBy(resp *core.LogRespTotal) {
+	if mv.curCountBy == nil {
+		// Should never happen, but be safe.
+		return
+	}
+
+	if len(resp.CountBy) == 0 {
+		mv.printMsg("No matching lines to count", nlMsgLevelWarn)
+		return
+	}
+
+	cbv := NewCountByView(mv, &CountByViewParams{
+		CountBy: *mv.curCountBy,
+		Resp:    resp,
+
+		OnDrillDown: func(pattern string) {
+			qf := mv.getQueryFull()
+			if core.IsStructQuery(qf.Query) {
+				mv.showMessagebox("err", "Error", "Drill-down is only supported with awk patterns, not with structured queries", nil)
+				return
+			}
+
+			var err error
+			qf.Query, err = awkpattern.AddTerm(qf.Query, pattern)
+			if err != nil {
+				mv.showMessagebox("err", "Error", "Can't add the filter to the query: "+err.Error(), nil)
+				return
+			}
+
+			if err := mv.applyQueryEditData(qf, doQueryParams{}); err != nil {
+				mv.showMessagebox("err", "Error", err.Error(), nil)
+			}
+		},
+	})
+	cbv.Show()
+}
+
+// setHistogramLStream makes the histogram show only the given logstream; if
+// it's an empty string, the histogram shows all logstreams together.
+func (mv *MainView) setHistogramLStream(lstreamName string) {
+	mv.histogramLStream = lstreamName
+	mv.bumpHistogramData()
+
+	if lstreamName != "" {
+		mv.printMsg(fmt.Sprintf("Histogram shows %s only", lstreamName), nlMsgLevelInfo)
+	} else {
+		mv.printMsg("Histogram shows all logstreams", nlMsgLevelInfo)
+	}
+}
+
+// setNumAgg sets the numeric aggregation to request with every query (nil
+// disables it), and reruns the query.
+func (mv *MainView) setNumAgg(numAgg *core.NumAggParams) {
+	mv.numAgg = numAgg
+	mv.doQuery(doQueryParams{})
+}
+
+// setOverlays sets the overlay patterns to request with every query (nil
+// disables them), and reruns the query.
+func (mv *MainView) setOverlays(overlays []string) {
+	mv.overlays = overlays
+	mv.doQuery(doQueryParams{})
+}
+
+// bumpHistogramData updates the histogram data from the current logs
+// response, either total or just for the histogramLStream. If the histogram
+// metric option is set to something other than count, and we have numeric
+// aggregation stats, then the histogram shows that metric instead (always for
+// all logstreams together).
+func (mv *MainView) bumpHistogramData() {
 	resp := mv.curLogResp
 	if resp == nil {
 		resp = &core.LogRespTotal{}
 	}
 
-	histogramData := make(map[int]int, len(resp.MinuteStats))
-	for k, v := range resp.MinuteStats {
+	// The stats might be more granular than a minute, if the logstreams have
+	// a sub-minute index resolution; the numeric aggregation stats are always
+	// per minute though.
+	binSize := histogramBinSize
+	if resp.StatsResolution > 0 && resp.StatsResolution < time.Minute {
+		binSize = int(resp.StatsResolution / time.Second)
+	}
+
+	metric := mv.params.Options.GetHistogramMetric()
+	if metric != HistogramMetricCount && resp.NumAggStats != nil {
+		binSize = histogramBinSize
+
+		numAggStats := resp.NumAggStats
+		mv.histogram.SetBinsValFunc(func(from, to int) int {
+			return getNumAggMetric(numAggStats, metric, from, to)
+		})
+	} else {
+		mv.histogram.SetBinsValFunc(nil)
+	}
+
+	minuteStats := resp.MinuteStats
+	if mv.histogramLStream != "" {
+		if lstreamStats, ok := resp.MinuteStatsByLStream[mv.histogramLStream]; ok {
+			minuteStats = lstreamStats
+		}
+	}
+
+	histogramData := make(map[int]int, len(minuteStats))
+	for k, v := range minuteStats {
 		histogramData[int(k)] = v.NumMsgs
 	}
 
+	if binSize != mv.histogramBinSize {
+		mv.histogramBinSize = binSize
+		mv.histogram.SetBinSize(binSize)
+	}
+
 	mv.histogram.SetData(histogramData)
 
+	// Overlays are always for all logstreams together.
+	overlays := make([]HistogramOverlay, 0, len(resp.OverlayStats))
+	for i, overlayStats := range resp.OverlayStats {
+		if i >= len(mv.overlays) {
+			break
+		}
+
+		data := make(map[int]int, len(overlayStats))
+		for k, v := range overlayStats {
+			data[int(k)] = v.NumMsgs
+		}
+
+		overlays = append(overlays, HistogramOverlay{
+			Label: mv.overlays[i],
+			Data:  data,
+		})
+	}
+
+	mv.histogram.SetOverlays(overlays)
+}
+
+func (mv *MainView) formatLogs() {
+	resp := mv.curLogResp
+	if resp == nil {
+		resp = &core.LogRespTotal{}
+	}
+
+	mv.bumpHistogramData()
+
 	// TODO: perhaps optimize it, instead of clearing and repopulating whole table
 	mv.logsTable.Clear()
 
@@ -1435,10 +1782,32 @@ func (mv *MainView) formatLogs() {
 	// Update table header
 	colNames := mv.updateTableHeader(resp.Logs)
 
-	mv.logsTable.SetCell(
-		rowIdxLoadOlder, 0,
-		newTableCellButton("< MOAR ! >"),
-	)
+	if resp.CountsOnly {
+		// There are no logs at all, only the histogram data.
+		mv.logsTable.SetCell(
+			rowIdxLoadOlder, 0,
+			newTableCellHeader("-- counts only --"),
+		)
+	} else if resp.Sampled {
+		// The sampled logs can't be paginated; to get all the logs, select a
+		// narrower range on the histogram.
+		mv.logsTable.SetCell(
+			rowIdxLoadOlder, 0,
+			newTableCellHeader("-- sampled --"),
+		)
+	} else if resp.Order != core.LogsOrderAsc {
+		mv.logsTable.SetCell(
+			rowIdxLoadOlder, 0,
+			newTableCellButton("< MOAR ! >"),
+		)
+	} else {
+		// In the ascending order we already have the earliest logs, so there's
+		// nothing to load.
+		mv.logsTable.SetCell(
+			rowIdxLoadOlder, 0,
+			newTableCellHeader("-- oldest first --"),
+		)
+	}
 
 	tz := mv.params.Options.GetTimezone()
 
@@ -1482,9 +1851,27 @@ func (mv *MainView) formatLogs() {
 		mv.logsTable.GetCell(rowIdx, 0).SetReference(msg)
 	}
 
+	if rowIdx := mv.getRowIdxLoadNewer(); rowIdx >= 0 {
+		mv.logsTable.SetCell(
+			rowIdx, 0,
+			newTableCellButton("< MOAR newer >"),
+		)
+	}
+
 	mv.bumpStatusLineRight()
 }
 
+// getRowIdxLoadNewer returns the index of the row acting as a button to load
+// more (newer) logs, or -1 if there's no such row: it's only shown if some
+// logstream might have more logs after the ones we have.
+func (mv *MainView) getRowIdxLoadNewer() int {
+	if mv.curLogResp == nil || !mv.curLogResp.HasMoreLater {
+		return -1
+	}
+
+	return len(mv.curLogResp.Logs) + 2
+}
+
 func (mv *MainView) bumpStatusLineLeft() {
 	sb := strings.Builder{}
 
@@ -1495,7 +1882,9 @@ func (mv *MainView) bumpStatusLineLeft() {
 	}
 
 	if !lsmanState.Connected && !lsmanState.NoMatchingLStreams {
-		sb.WriteString("conn ")
+		sb.WriteString("connecting ")
+		sb.WriteString(getConnectingStatus(lsmanState))
+		sb.WriteString(" ")
 	} else if lsmanState.Busy {
 		sb.WriteString("busy ")
 	} else {
@@ -1518,12 +1907,33 @@ func (mv *MainView) bumpStatusLineLeft() {
 	mv.statusLineLeft.SetText(sb.String())
 }
 
+// getConnectingStatus returns how many logstreams we're connecting to at the
+// moment, out of the total number, and how many more are waiting in the
+// connect queue (if any), like "20/300 (queued 280)".
+func getConnectingStatus(lsmanState *core.LStreamsManagerState) string {
+	numQueued := 0
+	for _, connDetails := range lsmanState.ConnDetailsByLStream {
+		if connDetails.Queued && !connDetails.Connected {
+			numQueued++
+		}
+	}
+
+	numConnecting := lsmanState.NumLStreams - lsmanState.NumConnected - numQueued
+
+	ret := fmt.Sprintf("%d/%d", numConnecting, lsmanState.NumLStreams)
+	if numQueued > 0 {
+		ret += fmt.Sprintf(" (queued %d)", numQueued)
+	}
+
+	return ret
+}
+
 func (mv *MainView) bumpStatusLineRight() {
 	selectedRow, _ := mv.logsTable.GetSelection()
 	selectedRow -= 1
 
 	var selectedRowStr string
-	if selectedRow >= 1 {
+	if selectedRow >= 1 && (mv.curLogResp == nil || selectedRow <= len(mv.curLogResp.Logs)) {
 		selectedRowStr = strconv.Itoa(selectedRow)
 	} else {
 		selectedRowStr = "-"
@@ -1542,6 +1952,8 @@ func (mv *MainView) bumpStatusLineRight() {
 func (mv *MainView) bumpHistogramExternalCursor(row int) {
 	if row == rowIdxLoadOlder {
 		row += 1
+	} else if row == mv.getRowIdxLoadNewer() {
+		row -= 1
 	}
 
 	firstCell := mv.logsTable.GetCell(row, 0)
@@ -1606,9 +2018,14 @@ func (mv *MainView) formatTimeRange() {
 
 	var timeStr string
 	if !mv.to.IsZero() {
-		timeStr = fmt.Sprintf("%s to %s (%s)", mv.from.Format(inputTimeLayout), mv.to.Format(inputTimeLayout), formatDuration(rangeDur))
+		timeStr = fmt.Sprintf(
+			"%s to %s (%s)",
+			mv.from.Format(withSecondsIfNeeded(inputTimeLayout, mv.from.Time)),
+			mv.to.Format(withSecondsIfNeeded(inputTimeLayout, mv.to.Time)),
+			formatDuration(rangeDur),
+		)
 	} else if mv.from.IsAbsolute() {
-		timeStr = fmt.Sprintf("%s to now (%s)", mv.from.Format(inputTimeLayout), formatDuration(rangeDur))
+		timeStr = fmt.Sprintf("%s to now (%s)", mv.from.Format(withSecondsIfNeeded(inputTimeLayout, mv.from.Time)), formatDuration(rangeDur))
 	} else {
 		timeStr = fmt.Sprintf("last %s", TimeOrDur{Dur: -mv.from.Dur})
 	}
@@ -1645,10 +2062,17 @@ func (mv *MainView) bumpTimeRange(updateHistogramRange bool) {
 	}
 
 	// Snap both actualFrom and actualTo to the 1m grid, rounding forward.
-	mv.actualFrom = truncateCeil(mv.actualFrom, 1*time.Minute)
-	mv.actualTo = truncateCeil(mv.actualTo, 1*time.Minute)
+	// If the user specified the time range with seconds though, snap to the
+	// 1s grid instead, so that sub-minute ranges are possible.
+	snap := 1 * time.Minute
+	if mv.from.Time.Second() != 0 || mv.to.Time.Second() != 0 {
+		snap = 1 * time.Second
+	}
+
+	mv.actualFrom = truncateCeil(mv.actualFrom, snap)
+	mv.actualTo = truncateCeil(mv.actualTo, snap)
 	if !mv.actualToForQuery.IsZero() {
-		mv.actualToForQuery = truncateCeil(mv.actualToForQuery, 1*time.Minute)
+		mv.actualToForQuery = truncateCeil(mv.actualToForQuery, snap)
 	}
 
 	// If from is after than to, swap them.
@@ -1696,6 +2120,10 @@ type doQueryParams struct {
 	// rebuild it from scratch (no-op for journalctl logstreams, because there's
 	// no nerdlog-maintained index for journalctl).
 	refreshIndex bool
+
+	// If noSample is true, the logs are not sampled even if the sample option
+	// is on.
+	noSample bool
 }
 
 func (mv *MainView) doQuery(params doQueryParams) {
@@ -1704,6 +2132,13 @@ func (mv *MainView) doQuery(params doQueryParams) {
 		To:    mv.actualToForQuery,
 		Query: mv.query,
 
+		NumAgg: mv.numAgg,
+		Sample: mv.params.Options.GetSample() && !params.noSample,
+
+		CountsOnly: mv.params.Options.GetCountsOnly(),
+		Gentle:     mv.params.Options.GetGentle(),
+		Overlays:   mv.overlays,
+
 		DontAddHistoryItem: params.dontAddHistoryItem,
 		RefreshIndex:       params.refreshIndex,
 	})
@@ -1875,6 +2310,15 @@ func (mv *MainView) showOriginalMsg(msg core.LogMsg) {
 	})
 }
 
+// showContext shows the raw lines which the message's logstream logged right
+// before and after it.
+func (mv *MainView) showContext(msg core.LogMsg) {
+	ctxv := NewContextView(mv, &ContextViewParams{
+		Msg: msg,
+	})
+	ctxv.Show()
+}
+
 func (mv *MainView) showModal(pageName string, primitive tview.Primitive, width, height int, focus bool) {
 	modalGrid := tview.NewGrid().
 		SetColumns(0, width, 0).
@@ -2084,7 +2528,7 @@ func (mv *MainView) handleDataRequest(dataReq *core.ShellConnDataRequest) {
 		OnInputFieldPressed: func(label string, idx int, value string, event *tcell.EventKey) *tcell.EventKey {
 			switch event.Key() {
 			case tcell.KeyEnter:
-				dataReq.ResponseCh <- value
+				dataReq.ResponseCh <- core.ShellConnDataResponse{Value: value, OK: true}
 				mv.hideModal(pageNameMessage+msgID, true)
 				return nil
 			}
@@ -2092,9 +2536,9 @@ func (mv *MainView) handleDataRequest(dataReq *core.ShellConnDataRequest) {
 			return event
 		},
 		OnEsc: func() {
-			// We need to send an empty response to indicate that the user has refused
-			// to provide the info.
-			dataReq.ResponseCh <- ""
+			// We need to send a response anyway, to indicate that the user has
+			// refused to provide the info.
+			dataReq.ResponseCh <- core.ShellConnDataResponse{}
 			mv.hideModal(pageNameMessage+msgID, true)
 		},
 		BackgroundColor: tcell.ColorDarkGreen,
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRowIdxLoadNewer(t *testing.T) {
+	mv := &MainView{}
+	assert.Equal(t, -1, mv.getRowIdxLoadNewer())
+
+	mv.curLogResp = &core.LogRespTotal{Logs: make([]core.LogMsg, 3)}
+	assert.Equal(t, -1, mv.getRowIdxLoadNewer())
+
+	// The row goes right after the header, the "MOAR" row and the logs.
+	mv.curLogResp.HasMoreLater = true
+	assert.Equal(t, 5, mv.getRowIdxLoadNewer())
+}
+
+func TestFormatQueryWarnings(t *testing.T) {
+	assert.Equal(t, "", formatQueryWarnings(map[string]core.LogstreamDebugInfo{
+		"foo-01": {},
+	}))
+
+	assert.Equal(t,
+		"index rebuilt: truncation detected (foo-01, foo-02); read rate not limited: pv is not available (foo-02, foo-03)",
+		formatQueryWarnings(map[string]core.LogstreamDebugInfo{
+			"foo-01": {IndexRebuilt: "truncation detected"},
+			"foo-02": {IndexRebuilt: "truncation detected", ReadRateIgnored: "pv is not available"},
+			"foo-03": {ReadRateIgnored: "pv is not available"},
+			"foo-04": {},
+		}),
+	)
+}
@@ -36,6 +36,18 @@ var mainMenu = []menuItem{
 			mv.params.OnCmd("xclip", CmdOpts{Internal: true})
 		},
 	},
+	{
+		Title: "Logstreams heatmap    :heatmap   ",
+		Handler: func(mv *MainView) {
+			mv.params.OnCmd("heatmap", CmdOpts{Internal: true})
+		},
+	},
+	{
+		Title: "Count by program      :countby   ",
+		Handler: func(mv *MainView) {
+			mv.params.OnCmd("countby program", CmdOpts{Internal: true})
+		},
+	},
 	{
 		Title: "Connection debug info :cdebug    ",
 		Handler: func(mv *MainView) {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+type HistogramMetric string
+
+const (
+	// HistogramMetricCount is the default: the histogram shows the number of
+	// messages. All the other metrics need the numeric aggregation to be
+	// enabled (see the :numagg command).
+	HistogramMetricCount HistogramMetric = "count"
+
+	HistogramMetricNumCount HistogramMetric = "numcount"
+	HistogramMetricAvg      HistogramMetric = "avg"
+	HistogramMetricMin      HistogramMetric = "min"
+	HistogramMetricMax      HistogramMetric = "max"
+	HistogramMetricSum      HistogramMetric = "sum"
+	HistogramMetricP50      HistogramMetric = "p50"
+	HistogramMetricP90      HistogramMetric = "p90"
+	HistogramMetricP95      HistogramMetric = "p95"
+	HistogramMetricP99      HistogramMetric = "p99"
+)
+
+// allHistogramMetrics maps every histogram metric to the function which
+// calculates it from the numeric aggregation stats; for HistogramMetricCount
+// it's nil, since it doesn't need numeric aggregation.
+var allHistogramMetrics = map[HistogramMetric]func(s *core.NumAggStatsItem) float64{
+	HistogramMetricCount: nil,
+
+	HistogramMetricNumCount: func(s *core.NumAggStatsItem) float64 { return float64(s.Count) },
+	HistogramMetricAvg:      func(s *core.NumAggStatsItem) float64 { return s.Avg() },
+	HistogramMetricMin:      func(s *core.NumAggStatsItem) float64 { return s.Min },
+	HistogramMetricMax:      func(s *core.NumAggStatsItem) float64 { return s.Max },
+	HistogramMetricSum:      func(s *core.NumAggStatsItem) float64 { return s.Sum },
+	HistogramMetricP50:      func(s *core.NumAggStatsItem) float64 { return s.Percentile(50) },
+	HistogramMetricP90:      func(s *core.NumAggStatsItem) float64 { return s.Percentile(90) },
+	HistogramMetricP95:      func(s *core.NumAggStatsItem) float64 { return s.Percentile(95) },
+	HistogramMetricP99:      func(s *core.NumAggStatsItem) float64 { return s.Percentile(99) },
+}
+
+func getAllHistogramMetricNames() []string {
+	ret := make([]string, 0, len(allHistogramMetrics))
+	for v := range allHistogramMetrics {
+		ret = append(ret, string(v))
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// getNumAggMetric merges the numeric aggregation stats for all minutes in the
+// range [from, to) (unix timestamps in seconds, and stats are keyed by
+// minutes), and calculates the given metric for the result, rounded to an
+// integer since that's what the histogram works with. If there are no values
+// in the range, returns 0.
+func getNumAggMetric(
+	stats map[int64]core.NumAggStatsItem, metric HistogramMetric, from, to int,
+) int {
+	metricFunc := allHistogramMetrics[metric]
+	if metricFunc == nil {
+		return 0
+	}
+
+	var merged core.NumAggStatsItem
+	for t := from - from%60; t < to; t += 60 {
+		if item, ok := stats[int64(t)]; ok {
+			merged.Merge(item)
+		}
+	}
+
+	if merged.Count == 0 {
+		return 0
+	}
+
+	return int(math.Round(metricFunc(&merged)))
+}
+
+// parseNumAggSpec parses the numeric aggregation spec as given to the :numagg
+// command, which is one of:
+//
+//   - "regex REGEX": the value is the first capture group of the REGEX, or the
+//     whole match if there are no capture groups;
+//   - "expr EXPR": the value is the result of the awk expression EXPR.
+//
+// In both cases, the leading numeric part of the string is used, so e.g.
+// "123ms" becomes 123.
+func parseNumAggSpec(spec string) (*core.NumAggParams, error) {
+	spec = strings.TrimSpace(spec)
+
+	kind, arg := spec, ""
+	if idx := strings.IndexRune(spec, ' '); idx >= 0 {
+		kind, arg = spec[:idx], strings.TrimSpace(spec[idx+1:])
+	}
+
+	ret := &core.NumAggParams{Arg: arg}
+
+	switch kind {
+	case "regex":
+		ret.Kind = core.NumAggKindRegex
+	case "expr":
+		ret.Kind = core.NumAggKindAwkExpr
+	case "":
+		return nil, errors.Errorf("numeric aggregation spec is required: regex REGEX or expr EXPR")
+	default:
+		return nil, errors.Errorf("invalid numeric aggregation spec %q: expected regex REGEX or expr EXPR", spec)
+	}
+
+	if err := ret.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ret, nil
+}
+
+// formatNumAggSpec is the opposite of parseNumAggSpec.
+func formatNumAggSpec(params *core.NumAggParams) string {
+	return string(params.Kind) + " " + params.Arg
+}
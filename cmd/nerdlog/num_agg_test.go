@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNumAggSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    *core.NumAggParams
+		wantErr string
+	}{
+		{
+			spec: "regex took=([0-9]+)ms",
+			want: &core.NumAggParams{Kind: core.NumAggKindRegex, Arg: "took=([0-9]+)ms"},
+		},
+		{
+			spec: "expr $9 * 1000",
+			want: &core.NumAggParams{Kind: core.NumAggKindAwkExpr, Arg: "$9 * 1000"},
+		},
+		{
+			spec:    "",
+			wantErr: "numeric aggregation spec is required: regex REGEX or expr EXPR",
+		},
+		{
+			spec:    "expr",
+			wantErr: "awk expression is empty",
+		},
+		{
+			spec:    "foo bar",
+			wantErr: `invalid numeric aggregation spec "foo bar": expected regex REGEX or expr EXPR`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseNumAggSpec(tt.spec)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetNumAggMetric(t *testing.T) {
+	stats := map[int64]core.NumAggStatsItem{
+		60:  {Count: 2, Sum: 30, Min: 10, Max: 20, Buckets: map[int]int{24: 1, 31: 1}},
+		120: {Count: 1, Sum: 100, Min: 100, Max: 100, Buckets: map[int]int{48: 1}},
+		300: {Count: 1, Sum: 7, Min: 7, Max: 7, Buckets: map[int]int{20: 1}},
+	}
+
+	assert.Equal(t, 15, getNumAggMetric(stats, HistogramMetricAvg, 60, 120))
+	assert.Equal(t, 43, getNumAggMetric(stats, HistogramMetricAvg, 60, 180))
+	assert.Equal(t, 100, getNumAggMetric(stats, HistogramMetricMax, 0, 300))
+	assert.Equal(t, 7, getNumAggMetric(stats, HistogramMetricMin, 0, 600))
+	assert.Equal(t, 4, getNumAggMetric(stats, HistogramMetricNumCount, 0, 600))
+	assert.Equal(t, 100, getNumAggMetric(stats, HistogramMetricP99, 0, 600))
+	assert.Equal(t, 0, getNumAggMetric(stats, HistogramMetricMax, 180, 300))
+	assert.Equal(t, 0, getNumAggMetric(stats, HistogramMetricCount, 0, 600))
+}
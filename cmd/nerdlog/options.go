@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/juju/errors"
 )
 
@@ -17,6 +19,37 @@ type Options struct {
 	MaxNumLines int
 
 	TransportMode TransportMode
+
+	// HistogramMetric is what the histogram shows: either the number of
+	// messages (HistogramMetricCount, the default), or some metric of the
+	// numeric aggregation (see the :numagg command).
+	HistogramMetric HistogramMetric
+
+	// LogsOrder is whether the latest (core.LogsOrderDesc, the default) or the
+	// earliest (core.LogsOrderAsc) matching logs are loaded.
+	LogsOrder core.LogsOrder
+
+	// Sample is whether the loaded logs are sampled across the whole time
+	// range (see core.QueryLogsParams.Sample), instead of being just the latest
+	// (or earliest) ones.
+	Sample bool
+
+	// CountsOnly is whether only the histogram data is loaded, without any
+	// log messages (see core.QueryLogsParams.CountsOnly).
+	CountsOnly bool
+
+	// Gentle is whether the logstreams are queried in the gentle mode, with
+	// the lowest CPU and IO priority (see core.QueryLogsParams.Gentle).
+	Gentle bool
+
+	// MaxParallelConnections is the max number of logstreams to which the
+	// connections are being established at the same time; the rest are
+	// queued. Zero means unlimited.
+	MaxParallelConnections int
+
+	// ConnectTimeout is the timeout for connecting to every single logstream,
+	// not counting the time spent in the queue.
+	ConnectTimeout time.Duration
 }
 
 type TransportMode string
@@ -31,6 +64,11 @@ var allTransportModes = map[TransportMode]struct{}{
 	TransportModeSSHBin: struct{}{},
 }
 
+var allLogsOrders = map[core.LogsOrder]struct{}{
+	core.LogsOrderDesc: struct{}{},
+	core.LogsOrderAsc:  struct{}{},
+}
+
 type OptionsShared struct {
 	mtx     *sync.Mutex
 	options Options
@@ -61,6 +99,48 @@ func (o *OptionsShared) GetTransportMode() TransportMode {
 	return o.options.TransportMode
 }
 
+func (o *OptionsShared) GetHistogramMetric() HistogramMetric {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.HistogramMetric
+}
+
+func (o *OptionsShared) GetLogsOrder() core.LogsOrder {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.LogsOrder
+}
+
+func (o *OptionsShared) GetSample() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.Sample
+}
+
+func (o *OptionsShared) GetCountsOnly() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.CountsOnly
+}
+
+func (o *OptionsShared) GetGentle() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.Gentle
+}
+
+func (o *OptionsShared) GetMaxParallelConnections() int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.MaxParallelConnections
+}
+
+func (o *OptionsShared) GetConnectTimeout() time.Duration {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.ConnectTimeout
+}
+
 func (o *OptionsShared) GetAll() Options {
 	o.mtx.Lock()
 	defer o.mtx.Unlock()
@@ -139,6 +219,144 @@ var AllOptions = map[string]*OptionMeta{
 		},
 		Help: "How to connect to remote hosts",
 	}, // }}}
+	"histogram": { // {{{
+		Get: func(o *Options) string {
+			return string(o.HistogramMetric)
+		},
+		Set: func(o *Options, value string) error {
+			if _, ok := allHistogramMetrics[HistogramMetric(value)]; !ok {
+				return errors.Errorf(
+					"invalid histogram metric %q, valid options are: %s",
+					value, strings.Join(getAllHistogramMetricNames(), ", "),
+				)
+			}
+
+			o.HistogramMetric = HistogramMetric(value)
+			return nil
+		},
+		Help: "What the histogram shows: count of messages, or a metric of the numeric aggregation (:numagg)",
+	}, // }}}
+	"order": { // {{{
+		Get: func(o *Options) string {
+			return string(o.LogsOrder)
+		},
+		Set: func(o *Options, value string) error {
+			if _, ok := allLogsOrders[core.LogsOrder(value)]; !ok {
+				return errors.Errorf(
+					"invalid order %q, valid options are: %s, %s",
+					value, core.LogsOrderDesc, core.LogsOrderAsc,
+				)
+			}
+
+			o.LogsOrder = core.LogsOrder(value)
+			return nil
+		},
+		Help: "Whether to load the latest (desc) or the earliest (asc) matching logs",
+	}, // }}}
+	"sample": { // {{{
+		Get: func(o *Options) string {
+			if o.Sample {
+				return "on"
+			}
+
+			return "off"
+		},
+		Set: func(o *Options, value string) error {
+			switch value {
+			case "on":
+				o.Sample = true
+			case "off":
+				o.Sample = false
+			default:
+				return errors.Errorf("invalid sample value %q, valid options are: on, off", value)
+			}
+
+			return nil
+		},
+		Help: "Whether to load the matching logs sampled across the whole time range",
+	}, // }}}
+	"counts_only": { // {{{
+		Get: func(o *Options) string {
+			if o.CountsOnly {
+				return "on"
+			}
+
+			return "off"
+		},
+		Set: func(o *Options, value string) error {
+			switch value {
+			case "on":
+				o.CountsOnly = true
+			case "off":
+				o.CountsOnly = false
+			default:
+				return errors.Errorf("invalid counts_only value %q, valid options are: on, off", value)
+			}
+
+			return nil
+		},
+		Help: "Whether to load only the histogram data, without the log messages",
+	}, // }}}
+	"gentle": { // {{{
+		Get: func(o *Options) string {
+			if o.Gentle {
+				return "on"
+			}
+
+			return "off"
+		},
+		Set: func(o *Options, value string) error {
+			switch value {
+			case "on":
+				o.Gentle = true
+			case "off":
+				o.Gentle = false
+			default:
+				return errors.Errorf("invalid gentle value %q, valid options are: on, off", value)
+			}
+
+			return nil
+		},
+		Help: "Whether to query the logstreams with the lowest CPU and IO priority, a single awk worker and a limited read rate (which needs pv on the host)",
+	}, // }}}
+	"max_parallel_connections": { // {{{
+		Get: func(o *Options) string {
+			return fmt.Sprint(o.MaxParallelConnections)
+		},
+		Set: func(o *Options, value string) error {
+			maxParallel, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if maxParallel < 0 {
+				return errors.Errorf("max_parallel_connections can't be negative")
+			}
+
+			o.MaxParallelConnections = maxParallel
+			return nil
+		},
+		Help: "How many logstreams to connect to at the same time, queueing the rest; 0 means unlimited",
+	}, // }}}
+	"connect_timeout": { // {{{
+		Get: func(o *Options) string {
+			return o.ConnectTimeout.String()
+		},
+		Set: func(o *Options, value string) error {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if timeout < time.Second {
+				return errors.Errorf("connect_timeout must be at least 1s")
+			}
+
+			o.ConnectTimeout = timeout
+			return nil
+		},
+		Help: "Timeout for connecting to every logstream, like 5s",
+	}, // }}}
 }
 
 func OptionMetaByName(name string) *OptionMeta {
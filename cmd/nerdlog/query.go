@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/awkpattern"
 	"github.com/dimonomid/nerdlog/shellescape"
 	"github.com/juju/errors"
+	"github.com/rivo/tview"
 )
 
 // QueryFull contains everything that defines a query: the logstreams filter, time range,
@@ -109,3 +114,24 @@ func (qf *QueryFull) UnmarshalShellCmdParts(parts []string) error {
 
 	return nil
 }
+
+// getQueryErrorMsg returns the message to show when the query is invalid: if
+// the error has a position, then the query itself is shown too, with a caret
+// pointing at the error position.
+func getQueryErrorMsg(query string, err error) string {
+	msg := tview.Escape(err.Error())
+
+	synErr, ok := errors.Cause(err).(*awkpattern.SyntaxError)
+	if !ok || strings.ContainsRune(query, '\n') {
+		return msg
+	}
+
+	caretOffset := synErr.Pos - 1
+	if caretOffset < 0 {
+		caretOffset = 0
+	}
+
+	return fmt.Sprintf(
+		"%s\n\n%s\n%s^", msg, tview.Escape(query), strings.Repeat(" ", caretOffset),
+	)
+}
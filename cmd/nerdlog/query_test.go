@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetQueryErrorMsg(t *testing.T) {
+	query := `/foo/ && ($5 == "[x]"`
+	err := core.ValidateQuery(query)
+	assert.Equal(t, `position 22: expected ")" to match "(" at position 10, got end of pattern`+"\n\n"+
+		`/foo/ && ($5 == "[x[]"`+"\n"+
+		`                     ^`, getQueryErrorMsg(query, err))
+
+	query = `@program:nginx AND`
+	err = core.ValidateQuery(query)
+	assert.Equal(t, "position 19: unexpected end of query\n\n"+
+		"@program:nginx AND\n"+
+		"                  ^", getQueryErrorMsg(query, err))
+
+	assert.Equal(t, "some error", getQueryErrorMsg("/foo/", errors.New("some error")))
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"fmt"
 	"sort"
-	"strings"
 
+	"github.com/dimonomid/nerdlog/awkpattern"
 	"github.com/dimonomid/nerdlog/cmd/nerdlog/ui"
 	"github.com/dimonomid/nerdlog/core"
 	"github.com/gdamore/tcell/v2"
@@ -57,6 +57,7 @@ type RowDetailsView struct {
 	okBtn       *tview.Button
 	cancelBtn   *tview.Button
 	showOrigBtn *tview.Button
+	showCtxBtn  *tview.Button
 	frame       *tview.Frame
 
 	affinity map[string]*rowDetailsFieldAffinity
@@ -402,7 +403,13 @@ func NewRowDetailsView(
 
 		getToggleFilterByValue := func(awkExpr string) func() {
 			return func() {
-				rdv.queryFull.Query = addToOrRemoveFromAwkQuery(rdv.queryFull.Query, awkExpr)
+				query, err := awkpattern.ToggleTerm(rdv.queryFull.Query, awkExpr)
+				if err != nil {
+					rdv.mainView.showMessagebox("err", "Error", "Can't edit the query: "+err.Error(), nil)
+					return
+				}
+
+				rdv.queryFull.Query = query
 				rdv.updateUI()
 			}
 		}
@@ -454,7 +461,10 @@ func NewRowDetailsView(
 				}
 			}
 
-			if rCtx.valExists && rCtx.field.Name != FieldNameTime && rCtx.field.Name != "lstream" {
+			// Filtering by value is done by editing the awk pattern, so it's not
+			// available for structured queries.
+			if rCtx.valExists && rCtx.field.Name != FieldNameTime && rCtx.field.Name != "lstream" &&
+				!core.IsStructQuery(rdv.queryFull.Query) {
 				if !rCtx.filteredByValue {
 					rdv.tbl.AddOption("[ ] Filter logs containing value", getToggleFilterByValue(rCtx.awkValue))
 				} else {
@@ -575,6 +585,23 @@ func NewRowDetailsView(
 			return event
 		})
 		focusers = append(focusers, rdv.showOrigBtn)
+
+		rdv.showCtxBtn = tview.NewButton("Show context")
+		rdv.showCtxBtn.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+			switch event.Key() {
+			case tcell.KeyEnter:
+				rdv.mainView.showContext(*params.Msg)
+				return nil
+			}
+
+			event = rdv.genericInputHandler(event, getGenericTabHandler(rdv.showCtxBtn), nil, nil)
+			if event == nil {
+				return nil
+			}
+
+			return event
+		})
+		focusers = append(focusers, rdv.showCtxBtn)
 	}
 
 	bottomFlex := tview.NewFlex().SetDirection(tview.FlexColumn)
@@ -587,6 +614,8 @@ func NewRowDetailsView(
 	if rdv.showOrigBtn != nil {
 		bottomFlex.
 			AddItem(rdv.showOrigBtn, 15, 0, false).
+			AddItem(nil, 1, 0, false).
+			AddItem(rdv.showCtxBtn, 14, 0, false).
 			AddItem(nil, 0, 1, false)
 	}
 	rdv.flex.AddItem(bottomFlex, 1, 0, false)
@@ -734,8 +763,8 @@ func (rdv *RowDetailsView) updateUI() {
 			awkName = "msg"
 		}
 
-		awkValue := fmt.Sprintf(`/%s/`, awkEscape(val))
-		filteredByValue := strings.Contains(rdv.queryFull.Query, awkValue)
+		awkValue := fmt.Sprintf(`/%s/`, awkpattern.QuoteRegex(val))
+		filteredByValue := awkpattern.HasTerm(rdv.queryFull.Query, awkValue)
 
 		nRow := i
 		if rdvEnableHeader {
@@ -845,46 +874,3 @@ func (rdv *RowDetailsView) applyQuery() error {
 
 	return nil
 }
-
-func awkEscape(s string) string {
-	s = strings.ReplaceAll(s, "\\", "\\\\")
-	s = strings.ReplaceAll(s, "|", "\\|")
-	s = strings.ReplaceAll(s, ".", "\\.")
-	s = strings.ReplaceAll(s, "(", "\\(")
-	s = strings.ReplaceAll(s, ")", "\\)")
-	s = strings.ReplaceAll(s, "{", "\\{")
-	s = strings.ReplaceAll(s, "}", "\\}")
-	s = strings.ReplaceAll(s, "[", "\\[")
-	s = strings.ReplaceAll(s, "]", "\\]")
-	s = strings.ReplaceAll(s, "<", "\\<")
-	s = strings.ReplaceAll(s, ">", "\\>")
-	s = strings.ReplaceAll(s, ":", "\\:")
-	// TODO: it's not complete, e.g. quotes aren't handled properly, but
-	// we can polish it after we switch to structured logs everywhere.
-	return s
-}
-
-func addToOrRemoveFromAwkQuery(query string, part string) string {
-	if !strings.Contains(query, part) {
-		// Need to add
-		if query == "" {
-			query = part
-		} else {
-			// TODO: it won't work if we have some ||, to handle it correctly we'd
-			// have to parse the awk expression, but for now I'm just ignoring the
-			// issue.
-			query += " && " + part
-		}
-	} else {
-		// Need to remove
-		if strings.Contains(query, part+" && ") {
-			query = strings.ReplaceAll(query, part+" && ", "")
-		} else if strings.Contains(query, " && "+part) {
-			query = strings.ReplaceAll(query, " && "+part, "")
-		} else {
-			query = strings.ReplaceAll(query, part, "")
-		}
-	}
-
-	return query
-}
@@ -11,14 +11,17 @@ import (
 //
 // The returned marks are on the most round places: e.g. if there are multiple
 // days, then at least some marks must be on the day boundary; the marks are
-// usually divisible by 5, 10, 30, or 60 mins, etc.
-func getXMarksForTimeRange(timezone *time.Location, from, to time.Time, maxNumMarks int) []time.Time {
+// usually divisible by 5, 10, 30, or 60 mins, etc. The step between the marks
+// is never smaller than minStep.
+func getXMarksForTimeRange(
+	timezone *time.Location, from, to time.Time, maxNumMarks int, minStep time.Duration,
+) []time.Time {
 	if !from.Before(to) || maxNumMarks <= 0 {
 		return nil
 	}
 
 	duration := to.Sub(from)
-	step := chooseStep(duration, maxNumMarks)
+	step := chooseStep(duration, maxNumMarks, minStep)
 	if step == 0 {
 		return nil
 	}
@@ -67,6 +70,12 @@ func truncateAlignedToMidnight(t time.Time, d time.Duration, loc *time.Location)
 }
 
 var snaps = []time.Duration{
+	time.Second * 1,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+	time.Second * 15,
+	time.Second * 30,
 	time.Minute * 1,
 	time.Minute * 2,
 	time.Minute * 5,
@@ -86,9 +95,14 @@ var snaps = []time.Duration{
 	time.Hour * 24 * 365,
 }
 
-// chooseStep picks a "round" duration step that will produce close to maxNumMarks marks.
-func chooseStep(duration time.Duration, maxNumMarks int) time.Duration {
+// chooseStep picks a "round" duration step, not smaller than minStep, that
+// will produce close to maxNumMarks marks.
+func chooseStep(duration time.Duration, maxNumMarks int, minStep time.Duration) time.Duration {
 	for _, step := range snaps {
+		if step < minStep {
+			continue
+		}
+
 		if int(duration/step) <= maxNumMarks {
 			return step
 		}
@@ -97,14 +111,16 @@ func chooseStep(duration time.Duration, maxNumMarks int) time.Duration {
 	return snaps[len(snaps)-1]
 }
 
-func getXMarksForHistogram(timezone *time.Location, from, to int, numChars int) []int {
+func getXMarksForHistogram(
+	timezone *time.Location, from, to int, numChars int, minStep time.Duration,
+) []int {
 	const minCharsDistanceBetweenMarks = 15
 	numMarks := numChars / minCharsDistanceBetweenMarks
 
 	fromTime := time.Unix(int64(from), 0).In(timezone)
 	toTime := time.Unix(int64(to), 0).In(timezone)
 
-	marksTime := getXMarksForTimeRange(timezone, fromTime, toTime, numMarks)
+	marksTime := getXMarksForTimeRange(timezone, fromTime, toTime, numMarks, minStep)
 	ret := make([]int, 0, len(marksTime))
 	for _, v := range marksTime {
 		ret = append(ret, int(v.Unix()))
@@ -113,14 +129,27 @@ func getXMarksForHistogram(timezone *time.Location, from, to int, numChars int)
 	return ret
 }
 
+// snapDataBinsInChartDot is like snapDataBinsInChartDotForBinSize, for the
+// default bin size of 1 minute.
 func snapDataBinsInChartDot(dataBinsInChartDot int) int {
+	return snapDataBinsInChartDotForBinSize(dataBinsInChartDot, time.Minute)
+}
+
+// snapDataBinsInChartDotForBinSize snaps the number of data bins in a chart
+// dot so that the dot covers one of the round durations from snaps; only the
+// durations which are multiples of the binSize are considered.
+func snapDataBinsInChartDotForBinSize(dataBinsInChartDot int, binSize time.Duration) int {
 	for _, snap := range snaps {
-		snapMinutes := int(snap / time.Minute)
+		if snap < binSize || snap%binSize != 0 {
+			continue
+		}
+
+		snapBins := int(snap / binSize)
 
-		if dataBinsInChartDot <= snapMinutes {
-			return snapMinutes
+		if dataBinsInChartDot <= snapBins {
+			return snapBins
 		}
 	}
 
-	return int(snaps[len(snaps)-1] / time.Minute)
+	return int(snaps[len(snaps)-1] / binSize)
 }
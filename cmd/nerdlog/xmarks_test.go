@@ -21,6 +21,7 @@ func TestGetXMarksForTimeRange(t *testing.T) {
 		name     string
 		from, to string
 		maxMarks int
+		minStep  time.Duration // If zero, 1 minute is used
 		expected []string
 	}{
 		{
@@ -140,6 +141,31 @@ func TestGetXMarksForTimeRange(t *testing.T) {
 				"2023-01-03T12:00:00Z",
 			},
 		},
+		{
+			name:     "2-minute range, 10s min step",
+			from:     "2023-01-01T12:00:00Z",
+			to:       "2023-01-01T12:02:00Z",
+			maxMarks: 5,
+			minStep:  10 * time.Second,
+			expected: []string{
+				"2023-01-01T12:00:00Z",
+				"2023-01-01T12:00:30Z",
+				"2023-01-01T12:01:00Z",
+				"2023-01-01T12:01:30Z",
+				"2023-01-01T12:02:00Z",
+			},
+		},
+		{
+			name:     "2-minute range, default min step",
+			from:     "2023-01-01T12:00:00Z",
+			to:       "2023-01-01T12:02:00Z",
+			maxMarks: 5,
+			expected: []string{
+				"2023-01-01T12:00:00Z",
+				"2023-01-01T12:01:00Z",
+				"2023-01-01T12:02:00Z",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,10 +173,38 @@ func TestGetXMarksForTimeRange(t *testing.T) {
 			from, _ := time.Parse(time.RFC3339, tt.from)
 			to, _ := time.Parse(time.RFC3339, tt.to)
 
-			actual := getXMarksForTimeRange(time.UTC, from, to, tt.maxMarks)
+			minStep := tt.minStep
+			if minStep == 0 {
+				minStep = time.Minute
+			}
+
+			actual := getXMarksForTimeRange(time.UTC, from, to, tt.maxMarks, minStep)
 			actualStrs := formatRFC3339Slice(actual)
 
 			assert.Equal(t, tt.expected, actualStrs)
 		})
 	}
 }
+
+func TestSnapDataBinsInChartDotForBinSize(t *testing.T) {
+	tests := []struct {
+		name               string
+		dataBinsInChartDot int
+		binSize            time.Duration
+		expected           int
+	}{
+		{name: "1m bins, exact", dataBinsInChartDot: 5, binSize: time.Minute, expected: 5},
+		{name: "1m bins, snap up", dataBinsInChartDot: 7, binSize: time.Minute, expected: 10},
+		{name: "10s bins, 1 bin", dataBinsInChartDot: 1, binSize: 10 * time.Second, expected: 1},
+		{name: "10s bins, snap to 30s", dataBinsInChartDot: 2, binSize: 10 * time.Second, expected: 3},
+		{name: "10s bins, snap to 1m", dataBinsInChartDot: 4, binSize: 10 * time.Second, expected: 6},
+		{name: "1s bins, snap to 5s", dataBinsInChartDot: 3, binSize: time.Second, expected: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := snapDataBinsInChartDotForBinSize(tt.dataBinsInChartDot, tt.binSize)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -1,6 +1,11 @@
 package core
 
-import "sort"
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+)
 
 type ConfigLogStreams map[string]ConfigLogStream
 
@@ -20,7 +25,10 @@ type ConfigLogStream struct {
 	// apply.
 	User string `yaml:"user"`
 
-	// TODO: optional Jumphost configuration, also with addr and user.
+	// Jumphost, if set, is the jumphost (aka bastion) to connect to the host
+	// through. Jumphosts can be chained: the jumphost can have its own
+	// jumphost, and so on.
+	Jumphost *ConfigJumphost `yaml:"jumphost,omitempty"`
 
 	// LogFiles contains a list of files which are part of the logstream, like
 	// ["/var/log/syslog", "/var/log/syslog.1"]. The [0]th item is the latest log
@@ -35,21 +43,87 @@ type ConfigLogStream struct {
 	Options ConfigLogStreamOptions `yaml:"options"`
 }
 
+// ConfigJumphost is the jumphost (aka bastion) to connect to some host
+// through.
+type ConfigJumphost struct {
+	// Hostname is the jumphost to connect to; it's required.
+	Hostname string `yaml:"hostname"`
+
+	// Port is the port to connect to; if empty, it's 22 (or, with the external
+	// ssh binary, whatever ssh decides).
+	Port string `yaml:"port"`
+
+	// User is the user to authenticate as on the jumphost; if empty, it's the
+	// current OS user (or, with the external ssh binary, whatever ssh decides).
+	User string `yaml:"user"`
+
+	// Jumphost, if set, is the jumphost to connect to this jumphost through.
+	Jumphost *ConfigJumphost `yaml:"jumphost,omitempty"`
+}
+
 // ConfigLogStreamOptions contains additional options for a particular logstream.
 type ConfigLogStreamOptions struct {
 	// Sudo is a shortcut for SudoMode: if Sudo is true, it's an equivalent of
 	// setting SudoMode to SudoModeFull.
 	Sudo bool `yaml:"sudo,omitempty"`
 
-	// SudoMode can be used to configure nerdlog to read log files with "sudo -n".
-	// See constants for the SudoMode type for more details.
+	// SudoMode can be used to configure nerdlog to read log files with elevated
+	// privileges. See constants for the SudoMode type for more details.
 	SudoMode SudoMode `yaml:"sudo_mode,omitempty"`
 
+	// SudoMethod specifies how the privileges are elevated: "sudo" (the
+	// default), "sudo_password" or "doas". See constants for the SudoMethod
+	// type for more details.
+	SudoMethod SudoMethod `yaml:"sudo_method,omitempty"`
+
 	// ShellInit can contain arbitrary shell commands which will be executed
 	// right after connecting to the host. A common use case is setting
 	// custom env vars for tests, like: "export TZ=America/New_York", but
 	// might be useful outside of tests as well.
 	ShellInit []string `yaml:"shell_init,omitempty"`
+
+	// IndexResolution is the granularity of the index which nerdlog maintains
+	// for the log files, and of the histogram data, like "10s". It must be a
+	// whole number of seconds which divides a minute; if empty, it's a minute.
+	// Smaller values make it possible to zoom into narrow time ranges
+	// efficiently on hosts which write a lot of logs, at the cost of a larger
+	// index and more histogram data to transfer.
+	IndexResolution string `yaml:"index_resolution,omitempty"`
+
+	// IndexDir is the logstream-side directory where nerdlog keeps the index
+	// files, like "~/.cache/nerdlog"; if empty, it's /tmp. Since /tmp is often
+	// cleaned on reboot, a persistent directory saves reindexing of big log
+	// files. A leading "~/" is expanded to the home directory on the host.
+	IndexDir string `yaml:"index_dir,omitempty"`
+
+	// MaxCPUs is the max number of awk workers which the agent may run in
+	// parallel when scanning a large time range; each worker handles its own
+	// part of the logs. It's also limited by the number of CPUs on the host.
+	// If zero, all the CPUs may be used; setting it to 1 disables parallel
+	// scanning.
+	MaxCPUs int `yaml:"max_cpus,omitempty"`
+
+	// Nice is the niceness (from 1 to 19) to run the agent with, so that it
+	// has lower CPU priority than everything else on the host; if zero, the
+	// niceness isn't changed.
+	Nice int `yaml:"nice,omitempty"`
+
+	// IONice is the IO scheduling class to run the agent with: "idle",
+	// "best-effort", or "best-effort:N" where N is the priority from 0 to 7;
+	// if empty, it isn't changed. It only works on Linux; on other systems
+	// it's ignored.
+	IONice string `yaml:"ionice,omitempty"`
+
+	// MaxReadRate limits how fast the agent reads the log files, like "20M"
+	// (per second); see ParseReadRate for the format. It requires "pv" on the
+	// host; if it's not there, the rate isn't limited. If empty, there is no
+	// limit.
+	MaxReadRate string `yaml:"max_read_rate,omitempty"`
+
+	// AWKBinary is the awk to use on the host, like "/usr/bin/mawk"; if empty,
+	// it's autodetected: gawk is preferred, but mawk, busybox awk and BSD awk
+	// work as well.
+	AWKBinary string `yaml:"awk_binary,omitempty"`
 }
 
 func (lss ConfigLogStreams) Keys() []string {
@@ -76,3 +150,24 @@ func (opts ConfigLogStreamOptions) EffectiveSudoMode() SudoMode {
 
 	return ""
 }
+
+// ParseIndexResolution parses the IndexResolution string like "10s"; empty
+// string results in 0, which means the default resolution of a minute.
+func ParseIndexResolution(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	res, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if res < time.Second || res > time.Minute || res%time.Second != 0 || time.Minute%res != 0 {
+		return 0, errors.Errorf(
+			"invalid index resolution %s: must be a whole number of seconds which divides a minute, like 10s", s,
+		)
+	}
+
+	return res, nil
+}
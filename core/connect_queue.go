@@ -0,0 +1,150 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectQueue limits the number of connections to the logstreams which are
+// being established at the same time, so that e.g. connecting to hundreds of
+// hosts doesn't trip the rate limits of the bastion which they're all
+// accessed through. The connections which don't fit are queued, and served
+// in the FIFO order as soon as the others complete (either successfully or
+// not).
+//
+// It's safe for concurrent use.
+type ConnectQueue struct {
+	mtx    sync.Mutex
+	params ConnectQueueParams
+
+	// numActive is how many slots are acquired at the moment.
+	numActive int
+	// waiting contains the slots which aren't acquired yet, in the FIFO order.
+	waiting []*connectSlot
+}
+
+type ConnectQueueParams struct {
+	// MaxParallel is the max number of connections being established at the
+	// same time. If zero, it's unlimited.
+	MaxParallel int
+
+	// Timeout is the timeout for every connection attempt to a single
+	// logstream; the time spent in the queue doesn't count. If zero,
+	// DefaultConnectTimeout is used.
+	Timeout time.Duration
+}
+
+// DefaultConnectTimeout is the default value of ConnectQueueParams.Timeout.
+const DefaultConnectTimeout = 5 * time.Second
+
+// connectSlot represents a single connection attempt in the ConnectQueue.
+type connectSlot struct {
+	queue *ConnectQueue
+
+	// readyCh is closed once the slot is acquired, and the connection attempt
+	// can proceed.
+	readyCh chan struct{}
+
+	acquired bool
+	released bool
+}
+
+func NewConnectQueue(params ConnectQueueParams) *ConnectQueue {
+	return &ConnectQueue{
+		params: params,
+	}
+}
+
+// SetParams updates the params; if MaxParallel is increased, the queued
+// connection attempts proceed right away. If it's decreased, the attempts
+// which are in progress already aren't affected.
+func (q *ConnectQueue) SetParams(params ConnectQueueParams) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.params = params
+	q.serveLocked()
+}
+
+// GetTimeout returns the timeout for a single connection attempt.
+func (q *ConnectQueue) GetTimeout() time.Duration {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.params.Timeout == 0 {
+		return DefaultConnectTimeout
+	}
+
+	return q.params.Timeout
+}
+
+// enqueue adds a new slot to the queue. The caller needs to wait for its
+// readyCh to be closed before connecting, and to call release once the
+// connection attempt is done (or canceled), regardless of whether the slot was
+// acquired.
+func (q *ConnectQueue) enqueue() *connectSlot {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	slot := &connectSlot{
+		queue:   q,
+		readyCh: make(chan struct{}),
+	}
+
+	q.waiting = append(q.waiting, slot)
+	q.serveLocked()
+
+	return slot
+}
+
+// serveLocked acquires as many waiting slots as the limit allows. It expects
+// q.mtx to be locked already.
+func (q *ConnectQueue) serveLocked() {
+	for len(q.waiting) > 0 && (q.params.MaxParallel <= 0 || q.numActive < q.params.MaxParallel) {
+		slot := q.waiting[0]
+		q.waiting = q.waiting[1:]
+
+		slot.acquired = true
+		q.numActive++
+		close(slot.readyCh)
+	}
+}
+
+// isAcquired returns whether the slot is acquired already, so the connection
+// attempt can proceed.
+func (slot *connectSlot) isAcquired() bool {
+	select {
+	case <-slot.readyCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the slot if it's acquired, or removes it from the queue
+// otherwise. It's a no-op if the slot is released already.
+func (slot *connectSlot) release() {
+	q := slot.queue
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if slot.released {
+		return
+	}
+
+	slot.released = true
+
+	if slot.acquired {
+		q.numActive--
+	} else {
+		for i, s := range q.waiting {
+			if s == slot {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+
+	q.serveLocked()
+}
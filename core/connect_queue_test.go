@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectQueue(t *testing.T) {
+	q := NewConnectQueue(ConnectQueueParams{MaxParallel: 2})
+	assert.Equal(t, DefaultConnectTimeout, q.GetTimeout())
+
+	slots := make([]*connectSlot, 5)
+	for i := range slots {
+		slots[i] = q.enqueue()
+	}
+
+	getAcquired := func() []bool {
+		ret := make([]bool, 0, len(slots))
+		for _, slot := range slots {
+			ret = append(ret, slot.isAcquired())
+		}
+
+		return ret
+	}
+
+	assert.Equal(t, []bool{true, true, false, false, false}, getAcquired())
+
+	// Once a connection attempt is done, the next one in the queue proceeds.
+	slots[0].release()
+	assert.Equal(t, []bool{true, true, true, false, false}, getAcquired())
+
+	// Releasing twice is a no-op.
+	slots[0].release()
+	assert.Equal(t, []bool{true, true, true, false, false}, getAcquired())
+
+	// A queued slot can be canceled, and then it never gets acquired.
+	slots[3].release()
+	slots[1].release()
+	assert.Equal(t, []bool{true, true, true, false, true}, getAcquired())
+
+	// Removing the limit lets everyone in.
+	slots[3] = q.enqueue()
+	assert.False(t, slots[3].isAcquired())
+
+	q.SetParams(ConnectQueueParams{Timeout: 30 * time.Second})
+	assert.Equal(t, []bool{true, true, true, true, true}, getAcquired())
+	assert.Equal(t, 30*time.Second, q.GetTimeout())
+
+	assert.True(t, q.enqueue().isAcquired())
+}
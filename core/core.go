@@ -7,6 +7,18 @@ const (
 	MaxNumLinesDefault = 250
 )
 
+// LogsOrder defines which logs are returned when there are more than
+// MaxNumLines of them in the time range.
+type LogsOrder string
+
+const (
+	// LogsOrderDesc means that the latest logs are returned; it's the default.
+	LogsOrderDesc LogsOrder = "desc"
+
+	// LogsOrderAsc means that the earliest logs are returned.
+	LogsOrderAsc LogsOrder = "asc"
+)
+
 type QueryLogsParams struct {
 	// maxNumLines is how many log lines the nerdlog_agent.sh will return at
 	// most.
@@ -17,10 +29,26 @@ type QueryLogsParams struct {
 
 	Query string
 
+	// Order defines whether the latest or the earliest MaxNumLines logs are
+	// returned; empty means LogsOrderDesc. It's ignored when LoadEarlier or
+	// LoadLater is set: those just continue the logs we already have.
+	Order LogsOrder
+
+	// If Sample is true, then instead of the latest (or earliest) MaxNumLines
+	// logs, every logstream returns up to MaxNumLines logs spread evenly across
+	// all the matching logs in the time range, to give a representative
+	// overview. Such logs can't be paginated, and Order is ignored then. Like
+	// Order, it's ignored when LoadEarlier or LoadLater is set.
+	Sample bool
+
 	// If LoadEarlier is true, it means we're only loading the logs _before_ the ones
 	// we already had.
 	LoadEarlier bool
 
+	// If LoadLater is true, it means we're only loading the logs _after_ the
+	// ones we already had. It can't be used together with LoadEarlier.
+	LoadLater bool
+
 	// If DontAddHistoryItem is true, the browser-like history will not be
 	// populated with a new item (it should be used exactly when we're navigating
 	// this browser-like history back and forth)
@@ -30,20 +58,114 @@ type QueryLogsParams struct {
 	// rebuild it from scratch (no-op for journalctl logstreams, because there's
 	// no nerdlog-maintained index for journalctl).
 	RefreshIndex bool
+
+	// If CountBy is not nil, this is a "count by" query: instead of the log
+	// lines, every logstream returns the top counts of the matching lines
+	// grouped by some field (see CountByParams), and those are merged together
+	// into LogRespTotal.CountBy. Such a query doesn't affect the logs which
+	// were loaded before.
+	CountBy *CountByParams
+
+	// If NumAgg is not nil, then for every matching line a numeric value is
+	// extracted (see NumAggParams), and the per-minute stats of these values
+	// are returned as NumAggStats.
+	NumAgg *NumAggParams
+
+	// If CountsOnly is true, the logstreams don't collect and return the log
+	// lines at all: only MinuteStats and NumMsgsTotal are returned (and
+	// OverlayStats, if Overlays are given). It's much faster on huge time
+	// ranges, when only the shape of the histogram is needed. Such logs can't
+	// be paginated, obviously.
+	CountsOnly bool
+
+	// Overlays is a list of additional queries (in the same format as Query),
+	// for each of which the logstreams count the matching lines in the time
+	// range, regardless of Query, and return them as OverlayStats, in the same
+	// order. It's meant to show these as separate series on the histogram. Like
+	// Order, it's ignored when LoadEarlier or LoadLater is set.
+	Overlays []string
+
+	// If Gentle is true, the agent runs with the lowest CPU and IO priority,
+	// without parallel workers, and with the limited read rate (unless the
+	// logstream has even lower rate configured); it's useful for querying the
+	// hosts which are already struggling, to not make things worse.
+	Gentle bool
+}
+
+// QueryContextParams describes a request for the raw (unfiltered) log lines
+// around a single log message, see LStreamsManager.QueryContext.
+type QueryContextParams struct {
+	// Msg is the log message to get the context of. The logstream is taken from
+	// Msg.Context["lstream"], and the message is located by its
+	// CombinedLinenumber, or by its Time in case of journalctl.
+	Msg LogMsg
+
+	// NumLines is how many lines to get before and after the Msg.
+	NumLines int
+}
+
+// CleanupRemoteParams describes a request to clean up the stale nerdlog files
+// on the logstream hosts, see LStreamsManager.CleanupRemote.
+type CleanupRemoteParams struct {
+	// If DryRun is true, the stale files are only listed, but not removed.
+	DryRun bool
+}
+
+// CleanupRemoteResp is the result of the cleanup on a single logstream.
+type CleanupRemoteResp struct {
+	// Files are the stale files found on the host: agent scripts and index
+	// files, owned by the user, which are not used by the current session.
+	Files []RemoteFile
+
+	// Err is set if the cleanup failed on this logstream.
+	Err error
+}
+
+// RemoteFile is a file on the logstream host.
+type RemoteFile struct {
+	Path string
+	Size int64
+
+	// Err is set if the file couldn't be removed.
+	Err string
 }
 
 // LogResp is a log response from a single logstream
 type LogResp struct {
 	// MinuteStats is a map from the unix timestamp (in seconds) to the stats for
-	// the minute starting at this timestamp.
+	// the minute starting at this timestamp. Despite the name, if the
+	// logstream is configured with the sub-minute index resolution, then
+	// every item covers StatsResolution instead of a minute.
 	MinuteStats map[int64]MinuteStatsItem
 
+	// StatsResolution is how much time every item in MinuteStats and
+	// OverlayStats covers; normally it's a minute, but it can be less, see
+	// ConfigLogStreamOptions.IndexResolution.
+	StatsResolution time.Duration
+
 	Logs []LogMsg
 
 	// NumMsgsTotal is the total number of messages in the time range (and
 	// included in MinuteStats). This number is usually larger than len(Logs).
 	NumMsgsTotal int
 
+	// NumAggStats is only populated if QueryLogsParams.NumAgg was set; it's a
+	// map from the unix timestamp (in seconds) to the numeric aggregation stats
+	// for the minute starting at this timestamp. Minutes without any values
+	// are not included.
+	NumAggStats map[int64]NumAggStatsItem
+
+	// OverlayStats is only populated if QueryLogsParams.Overlays was set; it
+	// has one item per overlay, in the same order, and every item is like
+	// MinuteStats, but for the lines matching that overlay query.
+	OverlayStats []map[int64]MinuteStatsItem
+
+	// CountBy is only populated for the "count by" queries, it's a map from the
+	// value to the number of matching lines with that value. Only the top K
+	// values are included here, and CountByRest is the sum of all the rest.
+	CountBy     map[string]int
+	CountByRest int
+
 	// DebugInfo contains info collected during this particular query.
 	DebugInfo LogstreamDebugInfo
 }
@@ -53,6 +175,19 @@ type LogstreamDebugInfo struct {
 	// info printed by the agent script.
 	AgentStdout []string
 	AgentStderr []string
+
+	// CompiledQuery is only set if the query was a structured query (see
+	// StructQuery), and it contains the awk pattern it was compiled into.
+	CompiledQuery string `json:",omitempty"`
+
+	// IndexRebuilt, if not empty, is the reason why the agent had to rebuild
+	// the index from scratch during this query, like "truncation detected".
+	IndexRebuilt string `json:",omitempty"`
+
+	// ReadRateIgnored, if not empty, is the reason why the agent couldn't limit
+	// the read rate (see ConfigLogStreamOptions.MaxReadRate and the gentle
+	// mode), like "pv is not available".
+	ReadRateIgnored string `json:",omitempty"`
 }
 
 // LogRespTotal is a log response from a LStreamsManager. It's merged from
@@ -62,10 +197,47 @@ type LogRespTotal struct {
 	// the logs (the Logs slice still contains everything though).
 	LoadedEarlier bool
 
+	// If LoadedLater is true, it means we've just loaded more logs after the
+	// ones we already had (the Logs slice still contains everything though).
+	LoadedLater bool
+
+	// Order is the order used by the query which loaded the logs initially
+	// (not the LoadEarlier or LoadLater one). In the ascending order, there is
+	// nothing to load earlier.
+	Order LogsOrder
+
+	// Sampled is true if the logs were loaded with QueryLogsParams.Sample.
+	Sampled bool
+
+	// CountsOnly is true if the logs were queried with
+	// QueryLogsParams.CountsOnly, so there are only stats, and no Logs.
+	CountsOnly bool
+
+	// HasMoreLater is true if at least one logstream might have more logs after
+	// the ones we have, so it makes sense to query with LoadLater again.
+	HasMoreLater bool
+
 	// MinuteStats is a map from the unix timestamp (in seconds) to the stats for
-	// the minute starting at this timestamp.
+	// the minute (or StatsResolution) starting at this timestamp.
 	MinuteStats map[int64]MinuteStatsItem
 
+	// StatsResolution is the finest LogResp.StatsResolution among all the
+	// logstreams; it's a minute, unless some logstreams are configured with a
+	// sub-minute index resolution. Zero if there were no responses.
+	StatsResolution time.Duration
+
+	// MinuteStatsByLStream is a map from the logstream name to the MinuteStats
+	// of that logstream alone; MinuteStats above is the sum of all of them.
+	MinuteStatsByLStream map[string]map[int64]MinuteStatsItem
+
+	// NumAggStats is only populated if QueryLogsParams.NumAgg was set; it's
+	// the same as LogResp.NumAggStats, but merged from all logstreams.
+	NumAggStats map[int64]NumAggStatsItem
+
+	// OverlayStats is only populated if QueryLogsParams.Overlays was set; it's
+	// the same as LogResp.OverlayStats, but merged from all logstreams.
+	OverlayStats []map[int64]MinuteStatsItem
+
 	Logs []LogMsg
 
 	// NumMsgsTotal is the total number of messages in the time range (and
@@ -74,6 +246,13 @@ type LogRespTotal struct {
 
 	Errs []error
 
+	// CountBy is only populated for the "count by" queries (in which case Logs
+	// is empty); it contains values merged from all logstreams, sorted by the
+	// count, most frequent first. CountByRest is the sum of counts which didn't
+	// make it to the top K on their logstreams.
+	CountBy     []CountByItem
+	CountByRest int
+
 	// DebugInfo is a map from the logstream name to the corresponding debug info
 	// collected during this particular query.
 	DebugInfo map[string]LogstreamDebugInfo
@@ -92,7 +92,14 @@ type CoreTestStepQueryParams struct {
 
 	Pattern string `yaml:"pattern"`
 
+	Order  LogsOrder `yaml:"order"`
+	Sample bool      `yaml:"sample"`
+
+	CountsOnly bool     `yaml:"counts_only"`
+	Overlays   []string `yaml:"overlays"`
+
 	LoadEarlier bool `yaml:"load_earlier"`
+	LoadLater   bool `yaml:"load_later"`
 
 	RefreshIndex bool `yaml:"refresh_index"`
 }
@@ -103,7 +110,12 @@ func (p *CoreTestStepQueryParams) RealParams() QueryLogsParams {
 		From:         p.From.Time,
 		To:           p.To.Time,
 		Query:        p.Pattern,
+		Order:        p.Order,
+		Sample:       p.Sample,
+		CountsOnly:   p.CountsOnly,
+		Overlays:     p.Overlays,
 		LoadEarlier:  p.LoadEarlier,
+		LoadLater:    p.LoadLater,
 		RefreshIndex: p.RefreshIndex,
 	}
 }
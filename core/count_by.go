@@ -0,0 +1,249 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/awkpattern"
+	"github.com/juju/errors"
+)
+
+const (
+	// CountByTopKDefault is a default for CountByParams.TopK.
+	CountByTopKDefault = 50
+)
+
+// CountByKind specifies how to extract the value to group log lines by, in
+// the "count by" queries.
+type CountByKind string
+
+const (
+	// CountByKindProgram groups by the syslog program, like "nginx" or "sshd".
+	CountByKindProgram CountByKind = "program"
+
+	// CountByKindRegex groups by the regex match: if the regex has a capture
+	// group, then the first group is used as the value, otherwise the whole
+	// match.
+	CountByKindRegex CountByKind = "regex"
+
+	// CountByKindAwkField groups by the awk field $N.
+	CountByKindAwkField CountByKind = "field"
+)
+
+// CountByParams specifies a "count by" query: instead of returning the log
+// lines themselves, the agent groups all matching lines by the value of some
+// field, and returns the top counts for every logstream.
+type CountByParams struct {
+	Kind CountByKind
+
+	// Arg depends on the Kind: for CountByKindRegex it's a regular expression,
+	// for CountByKindAwkField it's the field number N (as in awk's $N), and for
+	// CountByKindProgram it's ignored.
+	Arg string
+
+	// TopK is how many top values to return from every logstream. If zero,
+	// CountByTopKDefault is used.
+	TopK int
+}
+
+// Validate returns an error if the params are invalid.
+func (p *CountByParams) Validate() error {
+	switch p.Kind {
+	case CountByKindProgram:
+		// Nothing to check
+
+	case CountByKindRegex:
+		if p.Arg == "" {
+			return errors.Errorf("regex is empty")
+		}
+
+		if _, err := regexp.Compile(p.Arg); err != nil {
+			return errors.Annotatef(err, "invalid regex")
+		}
+
+	case CountByKindAwkField:
+		n, err := strconv.Atoi(p.Arg)
+		if err != nil {
+			return errors.Annotatef(err, "invalid field number %q", p.Arg)
+		}
+
+		if n < 0 {
+			return errors.Errorf("invalid field number %d: must not be negative", n)
+		}
+
+	default:
+		return errors.Errorf("invalid count-by kind %q", p.Kind)
+	}
+
+	if p.TopK < 0 {
+		return errors.Errorf("invalid top K %d: must not be negative", p.TopK)
+	}
+
+	return nil
+}
+
+// GetTopK returns TopK, or CountByTopKDefault if TopK is zero.
+func (p *CountByParams) GetTopK() int {
+	if p.TopK == 0 {
+		return CountByTopKDefault
+	}
+
+	return p.TopK
+}
+
+// awkExpr returns an awk expression which evaluates to the value to group
+// the current log line by. If the line should not be counted at all, the
+// expression evaluates to an empty string.
+//
+// The timeFormat is needed to figure out where the syslog envelope is.
+func (p *CountByParams) awkExpr(timeFormat *TimeFormatDescr) (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	switch p.Kind {
+	case CountByKindProgram:
+		fieldNum := awkSyslogProgramFieldNum(timeFormat)
+
+		return fmt.Sprintf(`nlProgram($%d)`, fieldNum), nil
+
+	case CountByKindRegex:
+		return awkMatchGroupExpr(p.Arg), nil
+
+	case CountByKindAwkField:
+		return "$" + p.Arg, nil
+	}
+
+	// Validate would have returned an error.
+	panic("should never be here")
+}
+
+// awkRegexEscapeSlashes escapes all the unescaped slashes in the regex, so
+// that it can be used in an awk regex literal like /foo/.
+func awkRegexEscapeSlashes(re string) string {
+	var sb strings.Builder
+
+	escaped := false
+	for _, r := range re {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '/':
+			sb.WriteRune('\\')
+		}
+
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// awkMatchGroupExpr returns an awk expression which evaluates to the first
+// capture group of the regex matched against the whole line (or the whole
+// match if there are no groups), or an empty string if it doesn't match. The
+// regex must be already validated.
+//
+// It uses the nlMatchGroup function defined by the agent, which needs the
+// regex split into the parts before, inside and after the group, because
+// non-GNU awks can't return capture groups; see splitRegexGroup.
+func awkMatchGroupExpr(regex string) string {
+	re := regexp.MustCompile(regex)
+
+	groupIdx := 0
+	var pre, grp, suf string
+	if re.NumSubexp() > 0 {
+		groupIdx = 1
+		pre, grp, suf, _ = splitRegexGroup(regex)
+	}
+
+	return fmt.Sprintf(
+		"nlMatchGroup($0, %s, %d, %s, %s, %s)",
+		awkpattern.QuoteString(regex), groupIdx,
+		awkpattern.QuoteString(pre), awkpattern.QuoteString(grp), awkpattern.QuoteString(suf),
+	)
+}
+
+// splitRegexGroup splits the regex into the parts before, inside and after
+// the first capture group, so that the group's contents can be found without
+// the capture groups support, by matching these parts separately. It only
+// works if the group is not repeated and there are no alternations at the top
+// level, since otherwise the parts can't be matched separately; in this case,
+// ok is false.
+func splitRegexGroup(regex string) (pre, grp, suf string, ok bool) {
+	start, end := -1, -1
+	depth := 0
+	escaped := false
+	inBracket := false
+
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+
+		switch {
+		case escaped:
+			escaped = false
+
+		case c == '\\':
+			escaped = true
+
+		case inBracket:
+			if c == ']' {
+				inBracket = false
+			}
+
+		case c == '[':
+			inBracket = true
+			// The "]" right after "[" or "[^" is a literal one.
+			if i+1 < len(regex) && regex[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(regex) && regex[i+1] == ']' {
+				i++
+			}
+
+		case c == '(':
+			if depth == 0 && start == -1 {
+				start = i
+			}
+			depth++
+
+		case c == ')':
+			depth--
+			if depth == 0 && end == -1 && start != -1 {
+				end = i
+			}
+
+		case c == '|':
+			if depth == 0 {
+				return "", "", "", false
+			}
+		}
+	}
+
+	if start == -1 || end == -1 {
+		return "", "", "", false
+	}
+
+	pre, grp, suf = regex[:start], regex[start+1:end], regex[end+1:]
+
+	// Non-capturing groups and the like, as well as repeated groups, can't be
+	// handled.
+	if strings.HasPrefix(grp, "?") || strings.IndexAny(suf, "*+?{") == 0 {
+		return "", "", "", false
+	}
+
+	return pre, grp, suf, true
+}
+
+// CountByItem is a single value from the merged "count by" results.
+type CountByItem struct {
+	Value string
+	Count int
+
+	// CountByLStream is a map from the logstream name to the count of this
+	// value in that logstream.
+	CountByLStream map[string]int
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countByAWKExprTestCase struct {
+	name            string
+	params          CountByParams
+	timestampLayout string
+
+	wantExpr string
+	wantErr  string
+}
+
+func TestCountByAWKExpr(t *testing.T) {
+	testCases := []countByAWKExprTestCase{
+		{
+			name:            "program, traditional syslog",
+			params:          CountByParams{Kind: CountByKindProgram},
+			timestampLayout: "Jan _2 15:04:05",
+			wantExpr:        `nlProgram($5)`,
+		},
+		{
+			name:            "program, ISO8601",
+			params:          CountByParams{Kind: CountByKindProgram},
+			timestampLayout: "2006-01-02T15:04:05.000000Z07:00",
+			wantExpr:        `nlProgram($3)`,
+		},
+		{
+			name:     "regex without capture groups",
+			params:   CountByParams{Kind: CountByKindRegex, Arg: `status=[0-9]+`},
+			wantExpr: `nlMatchGroup($0, "status=[0-9]+", 0, "", "", "")`,
+		},
+		{
+			name:     "regex with capture group and slashes",
+			params:   CountByParams{Kind: CountByKindRegex, Arg: `GET (/api/[a-z]+)\/`},
+			wantExpr: `nlMatchGroup($0, "GET (/api/[a-z]+)\\/", 1, "GET ", "/api/[a-z]+", "\\/")`,
+		},
+		{
+			name:     "regex with alternation",
+			params:   CountByParams{Kind: CountByKindRegex, Arg: `user=([a-z]+)|uid=[0-9]+`},
+			wantExpr: `nlMatchGroup($0, "user=([a-z]+)|uid=[0-9]+", 1, "", "", "")`,
+		},
+		{
+			name:     "field",
+			params:   CountByParams{Kind: CountByKindAwkField, Arg: "7"},
+			wantExpr: `$7`,
+		},
+		{
+			name:    "invalid regex",
+			params:  CountByParams{Kind: CountByKindRegex, Arg: `foo(`},
+			wantErr: "invalid regex: error parsing regexp: missing closing ): `foo(`",
+		},
+		{
+			name:    "invalid field",
+			params:  CountByParams{Kind: CountByKindAwkField, Arg: "foo"},
+			wantErr: `invalid field number "foo": strconv.Atoi: parsing "foo": invalid syntax`,
+		},
+		{
+			name:    "invalid kind",
+			params:  CountByParams{Kind: "foo"},
+			wantErr: `invalid count-by kind "foo"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := tc.params.awkExpr(&TimeFormatDescr{
+				TimestampLayout: tc.timestampLayout,
+			})
+
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantExpr, expr)
+		})
+	}
+}
+
+func TestSplitRegexGroup(t *testing.T) {
+	type testCase struct {
+		regex string
+
+		wantPre string
+		wantGrp string
+		wantSuf string
+		wantOK  bool
+	}
+
+	testCases := []testCase{
+		{regex: `took=([0-9.]+)ms`, wantPre: `took=`, wantGrp: `[0-9.]+`, wantSuf: `ms`, wantOK: true},
+		{regex: `^(a(b|c))(d)`, wantPre: `^`, wantGrp: `a(b|c)`, wantSuf: `(d)`, wantOK: true},
+		{regex: `\(x\) ([a-z]+)`, wantPre: `\(x\) `, wantGrp: `[a-z]+`, wantSuf: ``, wantOK: true},
+		{regex: `[(]x[)] ([a-z]+)`, wantPre: `[(]x[)] `, wantGrp: `[a-z]+`, wantSuf: ``, wantOK: true},
+		{regex: `[](] ([a-z]+)`, wantPre: `[](] `, wantGrp: `[a-z]+`, wantSuf: ``, wantOK: true},
+		{regex: `[^](] ([a-z]+)`, wantPre: `[^](] `, wantGrp: `[a-z]+`, wantSuf: ``, wantOK: true},
+		{regex: `a (b|c) d`, wantPre: `a `, wantGrp: `b|c`, wantSuf: ` d`, wantOK: true},
+
+		{regex: `no groups`},
+		{regex: `a|(b)`},
+		{regex: `(ab)+`},
+		{regex: `(ab){2}`},
+		{regex: `(?:ab)(c)`},
+	}
+
+	for _, tc := range testCases {
+		pre, grp, suf, ok := splitRegexGroup(tc.regex)
+		assert.Equal(t, tc.wantOK, ok, tc.regex)
+		assert.Equal(t, tc.wantPre, pre, tc.regex)
+		assert.Equal(t, tc.wantGrp, grp, tc.regex)
+		assert.Equal(t, tc.wantSuf, suf, tc.regex)
+	}
+}
+
+func TestMergeCountByResps(t *testing.T) {
+	resps := map[string]*LogResp{
+		"host1": {
+			CountBy:     map[string]int{"nginx": 10, "sshd": 3},
+			CountByRest: 2,
+		},
+		"host2": {
+			CountBy:     map[string]int{"sshd": 7, "cron": 3},
+			CountByRest: 1,
+		},
+	}
+
+	ret := mergeCountByResps(resps)
+
+	assert.Equal(t, []CountByItem{
+		{Value: "nginx", Count: 10, CountByLStream: map[string]int{"host1": 10}},
+		{Value: "sshd", Count: 10, CountByLStream: map[string]int{"host1": 3, "host2": 7}},
+		{Value: "cron", Count: 3, CountByLStream: map[string]int{"host2": 3}},
+	}, ret.CountBy)
+	assert.Equal(t, 3, ret.CountByRest)
+}
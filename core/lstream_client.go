@@ -7,6 +7,8 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"math/rand"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,12 +17,23 @@ import (
 	"github.com/juju/errors"
 
 	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/awkpattern"
 	"github.com/dimonomid/nerdlog/log"
 )
 
 const SpecialFilenameJournalctl = "journalctl"
 
-const connectionTimeout = 5 * time.Second
+const (
+	// reconnectDelayMin and reconnectDelayMax specify the range of the delay
+	// before reconnecting after a failed connection attempt: it starts from the
+	// min, and doubles after every failed attempt, up to the max.
+	reconnectDelayMin = 2 * time.Second
+	reconnectDelayMax = 1 * time.Minute
+
+	// maxCmdRetries is how many times a query interrupted by the lost
+	// connection is retried after reconnecting, before giving up.
+	maxCmdRetries = 2
+)
 
 // Setting useGzip to false is just a simple way to disable gzip, for debugging
 // purposes or w/e, since it's still experimental. Maybe we need to add a flag
@@ -41,12 +54,14 @@ const (
 )
 
 // queryLogsArgsTimeLayout is used to format the --from and --to arguments for
-// nerdlog_agent.sh.
+// nerdlog_agent.sh. It includes seconds, so that the time range can be
+// narrower than a minute; the agent uses the index to find the right place
+// in the logs with the index resolution, and then filters by the exact time.
 //
 // TODO: make it dynamic; e.g. generating that day string like "02" requires
 // some extra logic in the agent script for the traditional syslog format
 // (which has it space-padded, not zero-padded).
-const queryLogsArgsTimeLayout = "2006-01-02-15:04"
+const queryLogsArgsTimeLayout = "2006-01-02-15:04:05"
 
 // queryLogsTimestampUntilSecondsTimeLayout is used to format the
 // --timestamp-until-seconds arguments for nerdlog_agent.sh.
@@ -73,6 +88,12 @@ type LStreamClient struct {
 	connectUpdCh chan ShellConnUpdate
 	enqueueCmdCh chan lstreamCmd
 
+	// connectSlot is non-nil in the LStreamClientStateConnecting state; it's
+	// our place in the ConnectQueue. Until it's acquired, connectSlotReadyCh
+	// is its readyCh, and we don't actually connect yet.
+	connectSlot        *connectSlot
+	connectSlotReadyCh chan struct{}
+
 	// timezone is a string received from the logstream
 	timezone string
 	// location is loaded based on the timezone. If failed, it'll be UTC.
@@ -98,6 +119,11 @@ type LStreamClient struct {
 	curCmdCtx  *lstreamCmdCtx
 	nextCmdIdx int
 
+	// interruptedCmds contains the queries which were either running or queued
+	// when the connection was lost unexpectedly; they're retried once we
+	// reconnect and bootstrap successfully.
+	interruptedCmds []lstreamCmd
+
 	// disconnectReqCh is sent to when Close is called.
 	disconnectReqCh chan disconnectReq
 	tearingDown     bool
@@ -161,6 +187,10 @@ type ConnDetails struct {
 	// Err is an error message from the last connection attempt.
 	Err string
 
+	// Queued is true if the connection attempt is waiting in the ConnectQueue
+	// for other connections to complete.
+	Queued bool `json:",omitempty"`
+
 	// Connected shows whether the connection has already succeeded. Unlike other
 	// fields in this struct, it's set by the LStreamsManager manually.
 	Connected bool
@@ -223,6 +253,25 @@ type LStreamClientParams struct {
 	// an existing key is found.
 	SSHKeys []string
 
+	// SSHPasswordAuth specifies whether the password and keyboard-interactive
+	// ssh auth should be tried; see ShellTransportSSHLibParams.PasswordAuth.
+	SSHPasswordAuth bool
+
+	// SSHCachePassword specifies whether the ssh passwords entered by the user
+	// should be remembered for the rest of the session; see
+	// ShellTransportSSHLibParams.CachePassword.
+	SSHCachePassword bool
+
+	// SSHAskpassBinary is the path to the nerdlog binary to be used as
+	// SSH_ASKPASS by the ssh-bin transport; see
+	// ShellTransportSSHBinParams.AskpassBinary.
+	SSHAskpassBinary string
+
+	// ConnectQueue limits the number of connections being established at the
+	// same time, shared by all the clients of the LStreamsManager. If nil, the
+	// client gets its own queue with no limit and the default timeout.
+	ConnectQueue *ConnectQueue
+
 	Logger *log.Logger
 
 	// ClientID is just an arbitrary string (should be filename-friendly though)
@@ -241,7 +290,12 @@ type LStreamClientParams struct {
 // config. The config must be valid (e.g. it should contain exactly one item),
 // otherwise createTransport panics.
 func createTransport(
-	config ConfigLogStreamShellTransport, sshKeys []string, logger *log.Logger,
+	config ConfigLogStreamShellTransport,
+	sshKeys []string,
+	sshPasswordAuth bool,
+	sshCachePassword bool,
+	sshAskpassBinary string,
+	logger *log.Logger,
 ) ShellTransport {
 	var transport ShellTransport
 
@@ -251,8 +305,10 @@ func createTransport(
 		}
 
 		transport = NewShellTransportSSHLib(ShellTransportSSHLibParams{
-			SSHKeys:     sshKeys,
-			ConnDetails: *config.SSHLib,
+			SSHKeys:       sshKeys,
+			PasswordAuth:  sshPasswordAuth,
+			CachePassword: sshCachePassword,
+			ConnDetails:   *config.SSHLib,
 
 			Logger: logger,
 		})
@@ -264,9 +320,12 @@ func createTransport(
 		}
 
 		transport = NewShellTransportSSHBin(ShellTransportSSHBinParams{
-			Host: config.SSHBin.Host,
-			User: config.SSHBin.User,
-			Port: config.SSHBin.Port,
+			Host:      config.SSHBin.Host,
+			User:      config.SSHBin.User,
+			Port:      config.SSHBin.Port,
+			Jumphosts: config.SSHBin.Jumphosts,
+
+			AskpassBinary: sshAskpassBinary,
 
 			Logger: logger,
 		})
@@ -296,11 +355,29 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 		panic("Clock is nil")
 	}
 
+	if params.ConnectQueue == nil {
+		params.ConnectQueue = NewConnectQueue(ConnectQueueParams{})
+	}
+
 	params.Logger = params.Logger.WithNamespaceAppended(
 		fmt.Sprintf("LSClient_%s", params.LogStream.Name),
 	)
 
-	transport := createTransport(params.LogStream.Transport, params.SSHKeys, params.Logger)
+	transport := createTransport(
+		params.LogStream.Transport,
+		params.SSHKeys, params.SSHPasswordAuth, params.SSHCachePassword, params.SSHAskpassBinary,
+		params.Logger,
+	)
+
+	opts := params.LogStream.Options
+	if opts.SudoMode != "" && opts.SudoMode != SudoModeNone && opts.SudoMethod == SudoMethodSudoPassword {
+		transport = NewShellTransportSudoPassword(ShellTransportSudoPasswordParams{
+			Inner: transport,
+			Descr: params.LogStream.Name,
+
+			Logger: params.Logger,
+		})
+	}
 
 	lsc := &LStreamClient{
 		params: params,
@@ -320,8 +397,6 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 	//debugFile, _ := os.Create("/tmp/lsclient_debug.log")
 	//lsc.debugFile = debugFile
 
-	lsc.changeState(LStreamClientStateConnecting)
-
 	go lsc.run()
 
 	return lsc
@@ -354,9 +429,23 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 		lsc.conn.conn.Close()
 	}
 
+	// If the connection was lost unexpectedly (as opposed to the disconnect
+	// which was requested via disconnectReqCh, in which case we'd go through
+	// the LStreamClientStateDisconnecting state), remember the queries that
+	// were interrupted, to retry them after reconnecting.
+	if isStateConnected(oldState) && newState == LStreamClientStateDisconnected && !lsc.tearingDown {
+		lsc.saveInterruptedCmds()
+	}
+
 	switch oldState {
 	case LStreamClientStateConnecting:
 		lsc.connectUpdCh = nil
+
+		// Either the connection attempt is done, or we didn't even get to it yet;
+		// in any case, let others connect.
+		lsc.connectSlot.release()
+		lsc.connectSlot = nil
+		lsc.connectSlotReadyCh = nil
 	case LStreamClientStateConnectedBusy:
 		lsc.curCmdCtx = nil
 		lsc.busyStage = BusyStage{}
@@ -379,10 +468,18 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 		// Forget whatever conn debug messages we've accumulated.
 		lsc.connDebugMessages = nil
 
-		// Initiate new connection
+		// Initiate new connection, once there's a free slot for it in the queue.
 		lsc.numConnAttempts++
 		lsc.connectUpdCh = make(chan ShellConnUpdate, 1)
-		lsc.transport.Connect(lsc.connectUpdCh)
+		lsc.connectSlot = lsc.params.ConnectQueue.enqueue()
+		if lsc.connectSlot.isAcquired() {
+			lsc.startConnecting()
+		} else {
+			lsc.connectSlotReadyCh = lsc.connectSlot.readyCh
+			lsc.sendUpdate(&LStreamClientUpdate{
+				ConnDetails: lsc.makeConnDetailsMsg(""),
+			})
+		}
 
 	case LStreamClientStateConnectedIdle:
 		if len(lsc.cmdQueue) > 0 {
@@ -397,10 +494,93 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 	}
 }
 
+// startConnecting initiates the actual connection, after the connect slot is
+// acquired.
+func (lsc *LStreamClient) startConnecting() {
+	lsc.connectSlotReadyCh = nil
+	lsc.transport.Connect(lsc.connectUpdCh, lsc.params.ConnectQueue.GetTimeout())
+}
+
+// isConnectQueued returns whether we're waiting for a free slot in the
+// ConnectQueue.
+func (lsc *LStreamClient) isConnectQueued() bool {
+	return lsc.connectSlotReadyCh != nil
+}
+
+// saveInterruptedCmds moves the current query (if any) and the queued ones
+// to lsc.interruptedCmds, unless they were retried too many times already,
+// in which case they fail.
+func (lsc *LStreamClient) saveInterruptedCmds() {
+	cmds := lsc.cmdQueue
+	if lsc.curCmdCtx != nil {
+		cmds = append([]lstreamCmd{lsc.curCmdCtx.cmd}, cmds...)
+	}
+
+	for _, cmd := range cmds {
+		if cmd.queryLogs == nil {
+			// Nothing else is worth retrying: pings and bootstraps are done on
+			// every connection anyway, and cleanups can just be rerun manually.
+			continue
+		}
+
+		cmd.numRetries++
+		if cmd.numRetries > maxCmdRetries {
+			lsc.failCmd(cmd, errors.Errorf(
+				"connection lost while running the query, gave up after %d retries", maxCmdRetries,
+			))
+			continue
+		}
+
+		lsc.params.Logger.Infof("Connection lost, will retry the query after reconnecting (retry %d)", cmd.numRetries)
+		lsc.interruptedCmds = append(lsc.interruptedCmds, cmd)
+	}
+
+	lsc.cmdQueue = nil
+}
+
+// failInterruptedCmds fails all the interrupted queries with the given error.
+func (lsc *LStreamClient) failInterruptedCmds(err error) {
+	for _, cmd := range lsc.interruptedCmds {
+		lsc.failCmd(cmd, err)
+	}
+
+	lsc.interruptedCmds = nil
+}
+
+// failCmd responds to the query which isn't running (so sendCmdResp can't be
+// used) with the given error.
+func (lsc *LStreamClient) failCmd(cmd lstreamCmd, err error) {
+	if cmd.respCh == nil {
+		return
+	}
+
+	cmd.respCh <- lstreamCmdRes{
+		hostname: lsc.params.LogStream.Name,
+		resp:     &LogResp{},
+		err:      err,
+	}
+}
+
+// getReconnectDelay returns the delay before the next connection attempt,
+// given the number of the failed attempts so far.
+func getReconnectDelay(numFailedAttempts int) time.Duration {
+	delay := reconnectDelayMin
+	for i := 1; i < numFailedAttempts && delay < reconnectDelayMax; i++ {
+		delay *= 2
+	}
+
+	if delay > reconnectDelayMax {
+		delay = reconnectDelayMax
+	}
+
+	return delay
+}
+
 func (lsc *LStreamClient) makeConnDetailsMsg(err string) *ConnDetails {
 	return &ConnDetails{
 		Messages: lsc.connDebugMessages,
 		Err:      err,
+		Queued:   lsc.isConnectQueued(),
 	}
 }
 
@@ -432,8 +612,21 @@ func (lsc *LStreamClient) run() {
 	var connectAfter time.Time
 	var lastUpdTime time.Time
 
+	// Start connecting right away. It's done here and not in the constructor,
+	// so that creating hundreds of clients at once doesn't flood the updates
+	// channel while the LStreamsManager is busy creating them.
+	lsc.changeState(LStreamClientStateConnecting)
+
 	for {
 		select {
+		case <-lsc.connectSlotReadyCh:
+			lsc.params.Logger.Verbose1f("Got connect slot, connecting")
+			lsc.startConnecting()
+
+			lsc.sendUpdate(&LStreamClientUpdate{
+				ConnDetails: lsc.makeConnDetailsMsg(""),
+			})
+
 		case upd := <-lsc.connectUpdCh:
 			if dbg := upd.DebugInfo; dbg != nil {
 				// Got some debug info about the connection.
@@ -452,9 +645,18 @@ func (lsc *LStreamClient) run() {
 				// The connection has either succeeded or failed.
 
 				if res.Err != nil {
+					// Back off exponentially, with some jitter, so that a lot of
+					// logstreams failing at once (e.g. when VPN is down) don't retry all
+					// at the same time.
+					delay := getReconnectDelay(lsc.numConnAttempts)
+					delay += time.Duration(rand.Int63n(int64(delay / 5)))
+
 					lsc.params.Logger.Errorf("Shell connection failed: %s", res.Err.Error())
 					lsc.sendUpdate(&LStreamClientUpdate{
-						ConnDetails: lsc.makeConnDetailsMsg(fmt.Sprintf("attempt %d: %s", lsc.numConnAttempts, res.Err.Error())),
+						ConnDetails: lsc.makeConnDetailsMsg(fmt.Sprintf(
+							"attempt %d: %s (retrying in %s)",
+							lsc.numConnAttempts, res.Err.Error(), delay.Round(time.Second),
+						)),
 					})
 
 					lsc.changeState(LStreamClientStateDisconnected)
@@ -463,7 +665,7 @@ func (lsc *LStreamClient) run() {
 						continue
 					}
 
-					connectAfter = lsc.params.Clock.Now().Add(2 * time.Second)
+					connectAfter = lsc.params.Clock.Now().Add(delay)
 					continue
 				}
 
@@ -582,38 +784,161 @@ func (lsc *LStreamClient) run() {
 					// Nothing special to do
 					cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
 
+				case cmdCtx.cmd.cleanup != nil:
+					resp := cmdCtx.cleanupCtx.Resp
+
+					switch {
+					case strings.HasPrefix(line, "cleanup_file:"):
+						// cleanup_file:<size>\t<path>
+						parts := strings.SplitN(strings.TrimPrefix(line, "cleanup_file:"), "\t", 2)
+						if len(parts) != 2 {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("malformed cleanup_file line %q", line))
+							continue
+						}
+
+						size, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing file size in %q", line))
+							continue
+						}
+
+						resp.Files = append(resp.Files, RemoteFile{
+							Path: parts[1],
+							Size: size,
+						})
+
+					case strings.HasPrefix(line, "cleanup_failed:"):
+						// cleanup_failed:<path>; it's always printed right after the
+						// cleanup_file line for the same path.
+						p := strings.TrimPrefix(line, "cleanup_failed:")
+						if n := len(resp.Files); n > 0 && resp.Files[n-1].Path == p {
+							resp.Files[n-1].Err = "failed to remove"
+						}
+
+					default:
+						cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+					}
+
 				case cmdCtx.cmd.queryLogs != nil:
 					respCtx := cmdCtx.queryLogsCtx
 					resp := respCtx.Resp
 
 					switch {
 					case strings.HasPrefix(line, "s:"):
+						// s:<minute key>,<count>, or with the sub-minute index resolution:
+						// s:<minute key>,<second>,<count>
 						parts := strings.Split(strings.TrimPrefix(line, "s:"), ",")
-						if len(parts) < 2 {
-							err := errors.Errorf("malformed mstats %q: expected at least 2 parts", line)
+						minuteKey, parts, err := lsc.parseStatsKey(parts)
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats %q", line))
+							continue
+						}
+
+						if len(parts) < 1 {
+							err := errors.Errorf("malformed mstats %q: no count", line)
 							cmdCtx.errs = append(cmdCtx.errs, err)
 							continue
 						}
 
-						t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, parts[0], lsc.location)
+						n, err := strconv.Atoi(parts[0])
 						if err != nil {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
 							continue
 						}
 
-						t = InferYear(lsc.params.Clock.Now(), t)
-						t = t.UTC()
+						resp.MinuteStats[minuteKey] = MinuteStatsItem{
+							NumMsgs: n,
+						}
+
+					case strings.HasPrefix(line, "o:"):
+						// o:<minute key>,<overlay idx>,<count>, or with the sub-minute
+						// index resolution: o:<minute key>,<second>,<overlay idx>,<count>
+						parts := strings.Split(strings.TrimPrefix(line, "o:"), ",")
+						minuteKey, parts, err := lsc.parseStatsKey(parts)
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing overlay stats %q", line))
+							continue
+						}
+
+						if len(parts) != 2 {
+							err := errors.Errorf("malformed overlay stats %q: expected overlay idx and count", line)
+							cmdCtx.errs = append(cmdCtx.errs, err)
+							continue
+						}
+
+						idx, err := strconv.Atoi(parts[0])
+						if err != nil || idx < 0 || idx >= len(resp.OverlayStats) {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing overlay stats: invalid overlay index in %q", line))
+							continue
+						}
 
 						n, err := strconv.Atoi(parts[1])
 						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing overlay stats"))
 							continue
 						}
 
-						resp.MinuteStats[t.Unix()] = MinuteStatsItem{
+						resp.OverlayStats[idx][minuteKey] = MinuteStatsItem{
 							NumMsgs: n,
 						}
 
+					case strings.HasPrefix(line, "na:"):
+						// na:<minute key>,<count>,<sum>,<min>,<max>,<num non-positive>,<buckets>
+						parts := strings.Split(strings.TrimPrefix(line, "na:"), ",")
+						if len(parts) != 7 {
+							err := errors.Errorf("malformed numeric agg stats %q: expected 7 parts", line)
+							cmdCtx.errs = append(cmdCtx.errs, err)
+							continue
+						}
+
+						minuteKey, err := lsc.parseMinuteKey(parts[0])
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing numeric agg stats"))
+							continue
+						}
+
+						item, err := parseNumAggStatsItem(parts[1:])
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing numeric agg stats %q", line))
+							continue
+						}
+
+						if resp.NumAggStats == nil {
+							resp.NumAggStats = map[int64]NumAggStatsItem{}
+						}
+
+						resp.NumAggStats[minuteKey] = *item
+
+					case strings.HasPrefix(line, "cb:"):
+						// cb:<count>:<value>
+						msg := strings.TrimPrefix(line, "cb:")
+						idx := strings.IndexRune(msg, ':')
+						if idx <= 0 {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing count-by msg: no count in %q", line))
+							continue
+						}
+
+						n, err := strconv.Atoi(msg[:idx])
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing count-by msg: invalid count in %q", line))
+							continue
+						}
+
+						if resp.CountBy == nil {
+							resp.CountBy = map[string]int{}
+						}
+
+						resp.CountBy[msg[idx+1:]] = n
+
+					case strings.HasPrefix(line, "cb_rest:"):
+						n, err := strconv.Atoi(strings.TrimPrefix(line, "cb_rest:"))
+						if err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing count-by rest: invalid count in %q", line))
+							continue
+						}
+
+						resp.CountByRest = n
+
 					case strings.HasPrefix(line, "logfile:"):
 						msg := strings.TrimPrefix(line, "logfile:")
 						idx := strings.IndexRune(msg, ':')
@@ -686,8 +1011,17 @@ func (lsc *LStreamClient) run() {
 
 						err = lsc.parseLine(&logMsg)
 						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg %q", line))
-							continue
+							// The context lines are raw, so some of them might legitimately
+							// be not parseable (e.g. continuation lines of a multiline
+							// message); just keep them as they are, with the time of the
+							// previous line.
+							if cmdCtx.cmd.queryLogs.context == nil {
+								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg %q", line))
+								continue
+							}
+
+							logMsg.Time = respCtx.lastTime
+							logMsg.Msg = logMsg.OrigLine
 						}
 
 						if logMsg.Time.Before(respCtx.lastTime) {
@@ -763,6 +1097,8 @@ func (lsc *LStreamClient) run() {
 					}
 				case cmdCtx.cmd.ping != nil:
 					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+				case cmdCtx.cmd.cleanup != nil:
+					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 				case cmdCtx.cmd.queryLogs != nil:
 					switch {
 					case strings.HasPrefix(line, "p:"):
@@ -809,6 +1145,20 @@ func (lsc *LStreamClient) run() {
 						default:
 							cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 						}
+
+					case strings.HasPrefix(line, "index_rebuilt:"):
+						// The agent had to rebuild the index, e.g. because the log file was
+						// truncated in place.
+						reason := strings.TrimPrefix(line, "index_rebuilt:")
+						cmdCtx.queryLogsCtx.Resp.DebugInfo.IndexRebuilt = reason
+						lsc.params.Logger.Infof("Index rebuilt on %s: %s", lsc.params.LogStream.Name, reason)
+
+					case strings.HasPrefix(line, "read_rate_ignored:"):
+						// The agent was asked to limit the read rate, but couldn't.
+						reason := strings.TrimPrefix(line, "read_rate_ignored:")
+						cmdCtx.queryLogsCtx.Resp.DebugInfo.ReadRateIgnored = reason
+						lsc.params.Logger.Infof("Read rate not limited on %s: %s", lsc.params.LogStream.Name, reason)
+
 					default:
 						cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 					}
@@ -829,7 +1179,7 @@ func (lsc *LStreamClient) run() {
 				lsc.startCmd(lstreamCmd{
 					ping: &lstreamCmdPing{},
 				})
-			} else if !connectAfter.IsZero() {
+			} else if !connectAfter.IsZero() && !lsc.params.Clock.Now().Before(connectAfter) {
 				connectAfter = time.Time{}
 				lsc.changeState(LStreamClientStateConnecting)
 			}
@@ -845,11 +1195,32 @@ func (lsc *LStreamClient) run() {
 				lsc.params.LogStream.Name = req.changeName
 			}
 
-			// If we're already disconnected, consider ourselves torn-down already.
-			// Otherwise, initiate disconnection.
+			// The LStreamsManager forgets the in-progress query on explicit
+			// reconnect, so don't retry it.
+			lsc.interruptedCmds = nil
+
+			// If we're already disconnected, either consider ourselves torn-down
+			// already, or reconnect right away without waiting for the backoff.
+			// If we're still waiting in the connect queue, there's nothing to
+			// disconnect either. Otherwise, initiate disconnection.
 			if lsc.state == LStreamClientStateDisconnected {
 				if req.teardown {
 					close(lsc.disconnectedBeforeTeardownCh)
+				} else {
+					connectAfter = time.Time{}
+					lsc.numConnAttempts = 0
+					lsc.changeState(LStreamClientStateConnecting)
+				}
+			} else if lsc.state == LStreamClientStateConnecting && !req.teardown && !lsc.isConnectQueued() {
+				// We're reconnecting already, and there's no way to abort the
+				// connection attempt in progress anyway.
+				lsc.params.Logger.Infof("Already connecting, ignoring reconnect request")
+			} else if lsc.isConnectQueued() {
+				lsc.changeState(LStreamClientStateDisconnected)
+				if req.teardown {
+					close(lsc.disconnectedBeforeTeardownCh)
+				} else {
+					lsc.changeState(LStreamClientStateConnecting)
 				}
 			} else {
 				lsc.changeState(LStreamClientStateDisconnecting)
@@ -1041,11 +1412,11 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 
 		var parts []string
 
-		// If requested, run the whole thing with "sudo -n".
-		if lsc.params.LogStream.Options.SudoMode == SudoModeFull {
-			parts = append(parts, "sudo", "-n")
-		}
+		// If requested, run the whole thing with sudo (or whatever sudo method
+		// is configured).
+		parts = append(parts, lsc.getFullSudoPrefix()...)
 
+		parts = append(parts, lsc.getGranularSudoPasswordPipe()...)
 		parts = append(parts, lsc.getTimeEnvVars()...)
 
 		parts = append(
@@ -1059,6 +1430,10 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
 		}
 
+		parts = append(parts, lsc.getAWKBinaryArgs()...)
+		parts = append(parts, lsc.getGranularSudoArgs()...)
+		parts = append(parts, lsc.getGranularSudoRedirects()...)
+
 		stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
 		stdinBuf.Write([]byte("  if [ $? -ne 0 ]; then echo 'bootstrap failed'; exit 1; fi\n"))
 
@@ -1070,16 +1445,49 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		lsc.params.Logger.Verbose3f("Starting command: ping %+v", cmdCtx.cmd.ping)
 		cmdCtx.pingCtx = &lstreamCmdCtxPing{}
 
-		cmd := "whoami\n"
+		// Besides checking that the connection is alive, refresh the modification
+		// time of the agent and index files, so that cleanups from other nerdlog
+		// sessions know that they're still in use, see getCleanupScript.
+		touchParts := append(
+			lsc.getFullSudoPrefix(),
+			"touch", "-c",
+			shellQuote(lsc.getLStreamNerdlogAgentPath()),
+			shellQuotePath(lsc.getLStreamIndexFilePath()),
+		)
+
+		cmd := strings.Join(touchParts, " ") + " 2>/dev/null; whoami\n"
 		stdinBuf := lsc.conn.conn.Stdin()
 		stdinBuf.Write([]byte(cmd))
 		stdinBuf.Write([]byte("echo exit_code:$?\n"))
 
+	case cmdCtx.cmd.cleanup != nil:
+		lsc.params.Logger.Verbose3f("Starting command: cleanup %+v", cmdCtx.cmd.cleanup)
+		cmdCtx.cleanupCtx = &lstreamCmdCtxCleanup{
+			Resp: &CleanupRemoteResp{},
+		}
+
+		cmd := getCleanupScript(
+			lsc.getCleanupDirs(), cmdCtx.cmd.cleanup.keep, cmdCtx.cmd.cleanup.dryRun,
+		)
+
+		// If requested, run it with sudo, since then all the files were created
+		// by root. In the granular mode, the files are owned by the user.
+		if sudoPrefix := lsc.getFullSudoPrefix(); len(sudoPrefix) > 0 {
+			cmd = strings.Join(sudoPrefix, " ") + " sh -c " + shellQuote(cmd)
+		}
+
+		lsc.params.Logger.Verbose2f("Executing cleanup command(%s): %s", lsc.params.LogStream.Name, cmd)
+
+		stdinBuf := lsc.conn.conn.Stdin()
+		stdinBuf.Write([]byte(cmd + "\n"))
+		stdinBuf.Write([]byte("echo exit_code:$?\n"))
+
 	case cmdCtx.cmd.queryLogs != nil:
 		lsc.params.Logger.Verbose3f("Starting command: queryLogs %+v", cmdCtx.cmd.queryLogs)
 		cmdCtx.queryLogsCtx = &lstreamCmdCtxQueryLogs{
 			Resp: &LogResp{
-				MinuteStats: map[int64]MinuteStatsItem{},
+				MinuteStats:     map[int64]MinuteStatsItem{},
+				StatsResolution: lsc.getIndexResolution(),
 			},
 		}
 
@@ -1089,22 +1497,29 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "echo", gzipStartMarker, ";")
 		}
 
-		// If requested, run the whole thing with "sudo -n".
-		if lsc.params.LogStream.Options.SudoMode == SudoModeFull {
-			parts = append(parts, "sudo", "-n")
-		}
+		// If requested, run the whole thing with sudo (or whatever sudo method
+		// is configured).
+		parts = append(parts, lsc.getFullSudoPrefix()...)
 
+		parts = append(parts, lsc.getGranularSudoPasswordPipe()...)
 		parts = append(parts, lsc.getTimeEnvVars()...)
 
+		throttling := getThrottling(&lsc.params.LogStream.Options, cmdCtx.cmd.queryLogs.gentle)
+		parts = append(parts, throttling.commandPrefix()...)
+
 		parts = append(
 			parts,
 			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
 			"query",
-			"--index-file", shellQuote(lsc.getLStreamIndexFilePath()),
+			"--index-file", shellQuotePath(lsc.getLStreamIndexFilePath()),
 			"--max-num-lines", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.maxNumLines)),
 			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
 		)
 
+		parts = append(parts, throttling.agentArgs()...)
+		parts = append(parts, lsc.getAWKBinaryArgs()...)
+		parts = append(parts, lsc.getGranularSudoArgs()...)
+
 		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
 			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
 		}
@@ -1117,6 +1532,18 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(lsc.location).Format(queryLogsArgsTimeLayout)))
 		}
 
+		if res := lsc.getIndexResolution(); res != time.Minute {
+			parts = append(parts, "--index-resolution", strconv.Itoa(int(res/time.Second)))
+		}
+
+		if cmdCtx.cmd.queryLogs.order != "" {
+			parts = append(parts, "--order", shellQuote(string(cmdCtx.cmd.queryLogs.order)))
+		}
+
+		if cmdCtx.cmd.queryLogs.sample {
+			parts = append(parts, "--sample")
+		}
+
 		if cmdCtx.cmd.queryLogs.linesUntil > 0 {
 			parts = append(parts, "--lines-until", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.linesUntil)))
 		}
@@ -1139,16 +1566,129 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			)
 		}
 
+		if cmdCtx.cmd.queryLogs.linesSince > 0 {
+			parts = append(parts, "--lines-since", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.linesSince)))
+		}
+
+		if ts := cmdCtx.cmd.queryLogs.timestampSince; ts != nil {
+			wholeSecondTime := ts.time.Truncate(time.Second)
+
+			parts = append(parts,
+				"--timestamp-since-seconds",
+				shellQuote(
+					wholeSecondTime.In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
+				),
+
+				"--timestamp-since-precise",
+				shellQuote(
+					ts.time.In(lsc.location).Format(queryLogsTimestampUntilPreciseTimeLayout),
+				),
+
+				"--skip-n-earliest", shellQuote(strconv.Itoa(ts.numMsgs)),
+			)
+		}
+
 		if cmdCtx.cmd.queryLogs.refreshIndex {
 			parts = append(parts, "--refresh-index")
 		}
 
+		if cmdCtx.cmd.queryLogs.countsOnly {
+			parts = append(parts, "--counts-only")
+		}
+
+		if overlays := cmdCtx.cmd.queryLogs.overlays; len(overlays) > 0 {
+			cmdCtx.queryLogsCtx.Resp.OverlayStats = make([]map[int64]MinuteStatsItem, len(overlays))
+			for i, overlay := range overlays {
+				cmdCtx.queryLogsCtx.Resp.OverlayStats[i] = map[int64]MinuteStatsItem{}
+
+				awkPattern, err := compileQueryToAWK(overlay, lsc.timeFormat)
+				if err != nil {
+					// Should never happen since LStreamsManager validates it, but if it
+					// does, the error will be reported as the command result.
+					cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "overlay %q", overlay))
+					continue
+				}
+
+				parts = append(parts, "--overlay-pattern", shellQuote(awkPattern))
+			}
+		}
+
+		if c := cmdCtx.cmd.queryLogs.context; c != nil {
+			parts = append(parts, "--context-lines", shellQuote(strconv.Itoa(c.numLines)))
+
+			if c.time.IsZero() {
+				parts = append(parts, "--context-linenr", shellQuote(strconv.Itoa(c.linenr)))
+			} else {
+				parts = append(parts,
+					"--context-timestamp-precise",
+					shellQuote(
+						c.time.In(lsc.location).Format(queryLogsTimestampUntilPreciseTimeLayout),
+					),
+
+					"--context-timestamp-since-seconds",
+					shellQuote(
+						c.time.Truncate(time.Second).In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
+					),
+
+					"--context-timestamp-until-seconds",
+					shellQuote(
+						roundUpToNextSecond(c.time).In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
+					),
+				)
+			}
+		}
+
+		if countBy := cmdCtx.cmd.queryLogs.countBy; countBy != nil {
+			countByExpr, err := countBy.awkExpr(lsc.timeFormat)
+			if err != nil {
+				// Should never happen since LStreamsManager validates it, but if it
+				// does, the error will be reported as the command result.
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "count by"))
+			} else {
+				parts = append(
+					parts,
+					"--count-by-expr", shellQuote(countByExpr),
+					"--count-by-top", shellQuote(strconv.Itoa(countBy.GetTopK())),
+				)
+			}
+		}
+
+		if numAgg := cmdCtx.cmd.queryLogs.numAgg; numAgg != nil {
+			numAggExpr, err := numAgg.awkExpr()
+			if err != nil {
+				// Should never happen since LStreamsManager validates it, but if it
+				// does, the error will be reported as the command result.
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "numeric aggregation"))
+			} else {
+				parts = append(parts, "--num-agg-expr", shellQuote(numAggExpr))
+			}
+		}
+
 		parts = append(parts, agentQueryTimeFormatArgs(&lsc.timeFormat.AWKExpr)...)
 
-		if cmdCtx.cmd.queryLogs.query != "" {
-			parts = append(parts, shellQuote(cmdCtx.cmd.queryLogs.query))
+		if query := cmdCtx.cmd.queryLogs.query; query != "" {
+			awkPattern, err := compileQueryToAWK(query, lsc.timeFormat)
+			if err != nil {
+				// Should never happen since LStreamsManager validates it, but if it
+				// does, the error will be reported as the command result.
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "query"))
+			} else {
+				if IsStructQuery(query) {
+					cmdCtx.queryLogsCtx.Resp.DebugInfo.CompiledQuery = awkPattern
+				}
+
+				// If the pattern is simple enough, let the agent prefilter the lines
+				// with grep, which is much faster than awk.
+				for _, literal := range awkpattern.Literals(awkPattern) {
+					parts = append(parts, "--prefilter-literal", shellQuote(literal))
+				}
+
+				parts = append(parts, shellQuote(awkPattern))
+			}
 		}
 
+		parts = append(parts, lsc.getGranularSudoRedirects()...)
+
 		if useGzip {
 			parts = append(parts, "|", "gzip", ";", "echo", gzipEndMarker)
 		}
@@ -1211,15 +1751,200 @@ func (lsc *LStreamClient) getLStreamNerdlogAgentPath() string {
 }
 
 // getLStreamIndexFilePath returns the logstream-side path to the index file for
-// the particular log stream.
+// the particular log stream. It might start with "~/", so it needs to be
+// quoted with shellQuotePath.
 func (lsc *LStreamClient) getLStreamIndexFilePath() string {
-	return fmt.Sprintf(
-		"/tmp/nerdlog_agent_index_%s_%s",
-		lsc.params.ClientID,
-		filepathToId(lsc.params.LogStream.LogFileLast()),
+	return path.Join(
+		lsc.getLStreamIndexDir(),
+		fmt.Sprintf(
+			"nerdlog_agent_index_%s_%s",
+			lsc.params.ClientID,
+			filepathToId(lsc.params.LogStream.LogFileLast()),
+		),
 	)
 }
 
+// sudoPasswordVar is the name of the shell variable on the host which
+// contains the password for SudoMethodSudoPassword.
+const sudoPasswordVar = "NERDLOG_SUDO_PASSWORD"
+
+// sudoPasswordFD is the file descriptor on which the agent reads the password
+// for SudoMethodSudoPassword in the granular mode, see
+// getGranularSudoPasswordPipe.
+const sudoPasswordFD = 3
+
+// sudoPasswordFunc is the name of the shell function on the host which runs
+// the given command with sudo for SudoMethodSudoPassword, see
+// getSudoPasswordFuncDef.
+const sudoPasswordFunc = "nerdlog_sudo"
+
+// getSudoPasswordCheckCmd returns the shell command which checks the password
+// from sudoPasswordVar with "sudo -S -v".
+func getSudoPasswordCheckCmd() string {
+	return `printf '%s\n' "$` + sudoPasswordVar + `" | sudo -S -p '' -v >/dev/null 2>&1`
+}
+
+// getSudoPasswordFuncDef returns the definition of the sudoPasswordFunc shell
+// function. If sudo has cached credentials, it doesn't read the password, so
+// piping it to "sudo -S" would leave it on the stdin of the command; therefore
+// the function only pipes the password if "sudo -n -v" fails (e.g. the
+// credentials have expired, or sudoers has timestamp_timeout=0), and otherwise
+// runs the command with "sudo -n" and stdin from /dev/null. Either way, the
+// command gets no stdin.
+func getSudoPasswordFuncDef() string {
+	return sudoPasswordFunc + `() { ` +
+		`if sudo -n -v >/dev/null 2>&1; then sudo -n "$@" </dev/null; ` +
+		`else printf '%s\n' "$` + sudoPasswordVar + `" | sudo -S -p '' "$@"; fi; }`
+}
+
+// getSudoPrefix returns the shell words to put before a command to run it
+// with elevated privileges using the given method.
+func getSudoPrefix(method SudoMethod) []string {
+	switch method {
+	case SudoMethodSudoPassword:
+		return []string{sudoPasswordFunc}
+	case SudoMethodDoas:
+		// Using env, so that the VAR=value args work like with sudo.
+		return []string{"doas", "-n", "env"}
+	default:
+		return []string{"sudo", "-n"}
+	}
+}
+
+// getFullSudoPrefix returns the shell words to put before the agent command
+// if the logstream uses SudoModeFull; otherwise, it's nil.
+func (lsc *LStreamClient) getFullSudoPrefix() []string {
+	if lsc.params.LogStream.Options.SudoMode != SudoModeFull {
+		return nil
+	}
+
+	return getSudoPrefix(lsc.params.LogStream.Options.SudoMethod)
+}
+
+// usesGranularSudoPassword returns whether the logstream uses SudoModeGranular
+// with SudoMethodSudoPassword, in which case the agent needs the password,
+// since it runs sudo itself.
+func (lsc *LStreamClient) usesGranularSudoPassword() bool {
+	opts := lsc.params.LogStream.Options
+	return opts.SudoMode == SudoModeGranular && opts.SudoMethod == SudoMethodSudoPassword
+}
+
+// getGranularSudoPasswordPipe returns the shell words to put before the agent
+// command to pipe the sudo password to it, if needed (see
+// usesGranularSudoPassword). The pipe is then moved to sudoPasswordFD by
+// getGranularSudoRedirects, so the password is neither in the agent env nor
+// on its stdin.
+func (lsc *LStreamClient) getGranularSudoPasswordPipe() []string {
+	if !lsc.usesGranularSudoPassword() {
+		return nil
+	}
+
+	return []string{"printf", `'%s\n'`, `"$` + sudoPasswordVar + `"`, "|"}
+}
+
+// getGranularSudoRedirects returns the redirects to put right after the agent
+// args, to go with getGranularSudoPasswordPipe.
+func (lsc *LStreamClient) getGranularSudoRedirects() []string {
+	if !lsc.usesGranularSudoPassword() {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("%d<&0", sudoPasswordFD), "</dev/null"}
+}
+
+// getGranularSudoArgs returns the agent args for SudoModeGranular, if the
+// logstream uses it.
+func (lsc *LStreamClient) getGranularSudoArgs() []string {
+	opts := lsc.params.LogStream.Options
+	if opts.SudoMode != SudoModeGranular {
+		return nil
+	}
+
+	method := opts.SudoMethod
+	if method == "" {
+		method = SudoMethodSudo
+	}
+
+	return []string{"--sudo-method", shellQuote(string(method))}
+}
+
+// getAWKBinaryArgs returns the agent args to use the awk binary configured for
+// the logstream, if any; see LogStreamOptions.AWKBinary.
+func (lsc *LStreamClient) getAWKBinaryArgs() []string {
+	if lsc.params.LogStream.Options.AWKBinary == "" {
+		return nil
+	}
+
+	return []string{"--awk-binary", shellQuote(lsc.params.LogStream.Options.AWKBinary)}
+}
+
+// getLStreamIndexDir returns the logstream-side directory for the index files,
+// see LogStreamOptions.IndexDir.
+func (lsc *LStreamClient) getLStreamIndexDir() string {
+	if lsc.params.LogStream.Options.IndexDir == "" {
+		return "/tmp"
+	}
+
+	return lsc.params.LogStream.Options.IndexDir
+}
+
+// getCleanupDirs returns the logstream-side directories where nerdlog files
+// might be found: /tmp for the agent script, and the index dir.
+func (lsc *LStreamClient) getCleanupDirs() []string {
+	dirs := []string{"/tmp"}
+	if indexDir := lsc.getLStreamIndexDir(); indexDir != "/tmp" {
+		dirs = append(dirs, indexDir)
+	}
+
+	return dirs
+}
+
+// cleanupMinAge is how long ago a nerdlog file must have been modified for
+// getCleanupScript to consider it stale. The files which are in use are
+// touched on every query and ping, so they never get that old, even if they
+// belong to another nerdlog session.
+const cleanupMinAge = 24 * time.Hour
+
+// getCleanupScript returns a shell script which finds the stale nerdlog files
+// (agent scripts and index files not modified within cleanupMinAge) in the
+// given dirs, owned by the current user, except the ones in keep, and for each
+// of them prints
+// "cleanup_file:<size>\t<path>"; unless it's a dry run, also removes the
+// file, printing "cleanup_failed:<path>" if it fails.
+func getCleanupScript(dirs, keep []string, dryRun bool) string {
+	globs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		globs = append(globs, shellQuotePath(dir)+"/nerdlog_agent_*")
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("for f in " + strings.Join(globs, " ") + "; do ")
+	sb.WriteString(`[ -f "$f" ] && [ -O "$f" ] || continue; `)
+	sb.WriteString(fmt.Sprintf(
+		`[ -n "$(find "$f" -prune -mmin +%d)" ] || continue; `, int(cleanupMinAge/time.Minute),
+	))
+
+	if len(keep) > 0 {
+		keepPatterns := make([]string, 0, len(keep))
+		for _, p := range keep {
+			keepPatterns = append(keepPatterns, shellQuotePath(p))
+		}
+
+		sb.WriteString(`case "$f" in ` + strings.Join(keepPatterns, "|") + ") continue ;; esac; ")
+	}
+
+	sb.WriteString(`printf 'cleanup_file:%s\t%s\n' "$(wc -c < "$f")" "$f"; `)
+
+	if !dryRun {
+		sb.WriteString(`rm -f "$f" 2>/dev/null || echo "cleanup_failed:$f"; `)
+	}
+
+	sb.WriteString("done")
+
+	return sb.String()
+}
+
 // filepathToId takes a path and returns a string suitable to be used as
 // part of a filename (with all slashes removed).
 func filepathToId(p string) string {
@@ -1344,6 +2069,12 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 					timeFormat.TimestampLayout,
 				)
 				lsc.timeFormat = timeFormat
+
+				// If we've just reconnected after losing the connection, retry the
+				// queries which were interrupted.
+				lsc.cmdQueue = append(lsc.interruptedCmds, lsc.cmdQueue...)
+				lsc.interruptedCmds = nil
+
 				lsc.changeState(LStreamClientStateConnectedIdle)
 				return
 			}
@@ -1372,10 +2103,18 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 
 		lsc.changeState(LStreamClientStateDisconnected)
 
+		// We won't reconnect after a failed bootstrap, so the queries which were
+		// interrupted can't be retried.
+		lsc.failInterruptedCmds(errors.Annotatef(err, "bootstrap after reconnecting"))
+
 	case cmdCtx.cmd.ping != nil:
 		lsc.sendCmdResp(nil, nil)
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
+	case cmdCtx.cmd.cleanup != nil:
+		lsc.sendCmdResp(cmdCtx.cleanupCtx.Resp, summaryCmdError(cmdCtx))
+		lsc.changeState(LStreamClientStateConnectedIdle)
+
 	case cmdCtx.cmd.queryLogs != nil:
 		resp := cmdCtx.queryLogsCtx.Resp
 		resp.DebugInfo.AgentStdout = cmdCtx.unhandledStdout
@@ -1445,6 +2184,63 @@ type parseLineResult struct {
 	ctxMap map[string]string
 }
 
+// parseMinuteKey parses the minute key as printed by the agent in the stats,
+// and returns the corresponding unix timestamp (in seconds).
+func (lsc *LStreamClient) parseMinuteKey(minuteKey string) (int64, error) {
+	t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, minuteKey, lsc.location)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	t = InferYear(lsc.params.Clock.Now(), t)
+
+	return t.UTC().Unix(), nil
+}
+
+// parseStatsKey parses the key of the stats as printed by the agent, given
+// the stats line split by commas: the minute key, followed by the second of
+// the bucket if the index resolution is less than a minute. Returns the
+// corresponding unix timestamp (in seconds), and the rest of the parts.
+func (lsc *LStreamClient) parseStatsKey(parts []string) (int64, []string, error) {
+	if len(parts) < 1 {
+		return 0, nil, errors.Errorf("no minute key")
+	}
+
+	ts, err := lsc.parseMinuteKey(parts[0])
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	parts = parts[1:]
+
+	if lsc.getIndexResolution() != time.Minute {
+		if len(parts) < 1 {
+			return 0, nil, errors.Errorf("no second")
+		}
+
+		second, err := strconv.Atoi(parts[0])
+		if err != nil || second < 0 || second >= 60 {
+			return 0, nil, errors.Errorf("invalid second %q", parts[0])
+		}
+
+		ts += int64(second)
+		parts = parts[1:]
+	}
+
+	return ts, parts, nil
+}
+
+// getIndexResolution returns the effective index resolution for the
+// logstream, which is also the resolution of the stats. Sub-minute resolution
+// is only possible if the logs have seconds in the timestamps.
+func (lsc *LStreamClient) getIndexResolution() time.Duration {
+	res := lsc.params.LogStream.Options.IndexResolution
+	if res == 0 || lsc.timeFormat == nil || lsc.timeFormat.AWKExpr.Second == `"00"` {
+		return time.Minute
+	}
+
+	return res
+}
+
 func (lsc *LStreamClient) parseLine(logMsg *LogMsg) error {
 	if err := lsc.parseLogMsgTimestamp(logMsg); err != nil {
 		return errors.Annotatef(err, "parsing time")
@@ -1716,6 +2512,16 @@ func shellQuote(s string) string {
 	return fmt.Sprintf("'%s'", strings.Replace(s, "'", "'\"'\"'", -1))
 }
 
+// shellQuotePath is like shellQuote, but if the path starts with "~/", the
+// tilde is replaced with "$HOME", so that it's still expanded by the shell.
+func shellQuotePath(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		return `"$HOME"/` + shellQuote(strings.TrimPrefix(p, "~/"))
+	}
+
+	return shellQuote(p)
+}
+
 func agentQueryTimeFormatArgs(awkExpr *TimeFormatAWKExpr) []string {
 	return []string{
 		"--awktime-month", shellQuote(awkExpr.Month),
@@ -1723,5 +2529,6 @@ func agentQueryTimeFormatArgs(awkExpr *TimeFormatAWKExpr) []string {
 		"--awktime-day", shellQuote(awkExpr.Day),
 		"--awktime-hhmm", shellQuote(awkExpr.HHMM),
 		"--awktime-minute-key", shellQuote(awkExpr.MinuteKey),
+		"--awktime-second", shellQuote(awkExpr.Second),
 	}
 }
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellQuotePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/tmp", want: "/tmp"},
+		{in: "/tmp/foo bar", want: "'/tmp/foo bar'"},
+		{in: "~/.cache/nerdlog", want: `"$HOME"/.cache/nerdlog`},
+		{in: "~/my dir", want: `"$HOME"/'my dir'`},
+		{in: "~foo", want: "'~foo'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, shellQuotePath(tt.in))
+		})
+	}
+}
+
+func TestCleanupScript(t *testing.T) {
+	indexDir := t.TempDir()
+
+	// Two nerdlog sessions share the host: "cur" is the one running the
+	// cleanup, and "other" is a live one which just doesn't know about the
+	// former. The "gone" session is long gone, so its files are stale.
+	staleTime := time.Now().Add(-cleanupMinAge - time.Hour)
+	for _, f := range []struct {
+		name  string
+		stale bool
+	}{
+		{"nerdlog_agent_index_cur_syslog", false},
+		{"nerdlog_agent_cur_syslog.sh", true},
+		{"nerdlog_agent_index_other_syslog", false},
+		{"nerdlog_agent_other_syslog.sh", false},
+		{"nerdlog_agent_index_gone_syslog", true},
+		{"nerdlog_agent_gone_syslog.sh", true},
+		{"some_other_file", true},
+	} {
+		p := filepath.Join(indexDir, f.name)
+		require.NoError(t, os.WriteFile(p, []byte("12345"), 0644))
+
+		if f.stale {
+			require.NoError(t, os.Chtimes(p, staleTime, staleTime))
+		}
+	}
+
+	runCleanup := func(dryRun bool) []string {
+		script := getCleanupScript(
+			[]string{indexDir},
+			[]string{
+				filepath.Join(indexDir, "nerdlog_agent_index_cur_syslog"),
+				filepath.Join(indexDir, "nerdlog_agent_cur_syslog.sh"),
+			},
+			dryRun,
+		)
+
+		out, err := exec.Command("sh", "-c", script).Output()
+		require.NoError(t, err)
+
+		var ret []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if line != "" {
+				ret = append(ret, strings.Replace(line, indexDir, "DIR", 1))
+			}
+		}
+
+		sort.Strings(ret)
+		return ret
+	}
+
+	wantLines := []string{
+		"cleanup_file:5\tDIR/nerdlog_agent_gone_syslog.sh",
+		"cleanup_file:5\tDIR/nerdlog_agent_index_gone_syslog",
+	}
+
+	// Dry run only lists the files.
+	assert.Equal(t, wantLines, runCleanup(true))
+	assert.Equal(t, wantLines, runCleanup(true))
+
+	// Actual run removes them.
+	assert.Equal(t, wantLines, runCleanup(false))
+	assert.Equal(t, []string(nil), runCleanup(false))
+
+	entries, err := os.ReadDir(indexDir)
+	require.NoError(t, err)
+
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+
+	assert.Equal(t, []string{
+		"nerdlog_agent_cur_syslog.sh",
+		"nerdlog_agent_index_cur_syslog",
+		"nerdlog_agent_index_other_syslog",
+		"nerdlog_agent_other_syslog.sh",
+		"some_other_file",
+	}, remaining)
+}
+
+func TestGetReconnectDelay(t *testing.T) {
+	testCases := []struct {
+		numFailedAttempts int
+		want              time.Duration
+	}{
+		{0, 2 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{5, 32 * time.Second},
+		{6, 1 * time.Minute},
+		{100, 1 * time.Minute},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, getReconnectDelay(tc.numFailedAttempts), "attempts: %d", tc.numFailedAttempts)
+	}
+}
+
+func TestSudoArgs(t *testing.T) {
+	testCases := []struct {
+		opts LogStreamOptions
+
+		wantPrefix    string
+		wantPipe      string
+		wantArgs      string
+		wantRedirects string
+	}{
+		{
+			opts: LogStreamOptions{},
+		},
+		{
+			opts: LogStreamOptions{SudoMode: SudoModeNone, SudoMethod: SudoMethodDoas},
+		},
+		{
+			opts:       LogStreamOptions{SudoMode: SudoModeFull},
+			wantPrefix: "sudo -n",
+		},
+		{
+			opts:       LogStreamOptions{SudoMode: SudoModeFull, SudoMethod: SudoMethodDoas},
+			wantPrefix: "doas -n env",
+		},
+		{
+			opts:       LogStreamOptions{SudoMode: SudoModeFull, SudoMethod: SudoMethodSudoPassword},
+			wantPrefix: "nerdlog_sudo",
+		},
+		{
+			opts:     LogStreamOptions{SudoMode: SudoModeGranular},
+			wantArgs: "--sudo-method sudo",
+		},
+		{
+			opts:          LogStreamOptions{SudoMode: SudoModeGranular, SudoMethod: SudoMethodSudoPassword},
+			wantPipe:      `printf '%s\n' "$NERDLOG_SUDO_PASSWORD" |`,
+			wantArgs:      "--sudo-method sudo_password",
+			wantRedirects: "3<&0 </dev/null",
+		},
+	}
+
+	for _, tc := range testCases {
+		lsc := &LStreamClient{
+			params: LStreamClientParams{
+				LogStream: LogStream{Options: tc.opts},
+			},
+		}
+
+		assert.Equal(t, tc.wantPrefix, strings.Join(lsc.getFullSudoPrefix(), " "), "opts: %+v", tc.opts)
+		assert.Equal(t, tc.wantPipe, strings.Join(lsc.getGranularSudoPasswordPipe(), " "), "opts: %+v", tc.opts)
+		assert.Equal(t, tc.wantArgs, strings.Join(lsc.getGranularSudoArgs(), " "), "opts: %+v", tc.opts)
+		assert.Equal(t, tc.wantRedirects, strings.Join(lsc.getGranularSudoRedirects(), " "), "opts: %+v", tc.opts)
+	}
+}
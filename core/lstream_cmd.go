@@ -12,6 +12,11 @@ type lstreamCmd struct {
 	bootstrap *lstreamCmdBootstrap
 	ping      *lstreamCmdPing
 	queryLogs *lstreamCmdQueryLogs
+	cleanup   *lstreamCmdCleanup
+
+	// numRetries is how many times the command was interrupted by the lost
+	// connection, and retried after reconnecting; see maxCmdRetries.
+	numRetries int
 }
 
 type lstreamCmdCtx struct {
@@ -22,6 +27,7 @@ type lstreamCmdCtx struct {
 	bootstrapCtx *lstreamCmdCtxBootstrap
 	pingCtx      *lstreamCmdCtxPing
 	queryLogsCtx *lstreamCmdCtxQueryLogs
+	cleanupCtx   *lstreamCmdCtxCleanup
 
 	// Initially, stdoutDoneIdx and stderrDoneIdx are set to false. Once we
 	// receive the "command_done" marker from either stdout or stderr, we set the
@@ -80,6 +86,13 @@ type lstreamCmdQueryLogs struct {
 
 	query string
 
+	// order is passed to nerdlog_agent.sh as --order; empty means the default,
+	// which is LogsOrderDesc.
+	order LogsOrder
+
+	// If sample is true, --sample is passed to nerdlog_agent.sh.
+	sample bool
+
 	// If linesUntil is not zero, it'll be passed to nerdlog_agent.sh as --lines-until.
 	// Effectively, only logs BEFORE this log line (not including it) will be output.
 	linesUntil int
@@ -90,10 +103,66 @@ type lstreamCmdQueryLogs struct {
 	// when using journalctl).
 	timestampUntil *timeAndNumMsgs
 
+	// If linesSince is not zero, it'll be passed to nerdlog_agent.sh as
+	// --lines-since. Effectively, only logs AFTER this log line (not including
+	// it) will be output. This is used for the forward pagination.
+	linesSince int
+
+	// timestampSince is not zero, it'll be passed to nerdlog_agent as
+	// --timestamp-since-precise and --timestamp-since-seconds. It serves the
+	// same purpose as linesSince for cases when we don't have line numbers (e.g.
+	// when using journalctl).
+	timestampSince *timeAndNumMsgs
+
 	// If refreshIndex is true, we'll drop the index file, and rebuild it from
 	// scratch (no-op for journalctl logstreams, because there's no
 	// nerdlog-maintained index for journalctl).
 	refreshIndex bool
+
+	// If countBy is not nil, it's a "count by" query, see CountByParams.
+	countBy *CountByParams
+
+	// If numAgg is not nil, the numeric values are aggregated, see NumAggParams.
+	numAgg *NumAggParams
+
+	// If countsOnly is true, --counts-only is passed to nerdlog_agent.sh.
+	countsOnly bool
+
+	// If gentle is true, the agent is run in the gentle mode, see
+	// QueryLogsParams.Gentle.
+	gentle bool
+
+	// overlays are the queries to pass as --overlay-pattern, after compiling
+	// them into awk patterns.
+	overlays []string
+
+	// If context is not nil, then instead of the regular query, the raw lines
+	// around a single log line are returned; all the other fields except
+	// maxNumLines are ignored then.
+	context *lstreamCmdQueryContext
+}
+
+type lstreamCmdQueryContext struct {
+	// numLines is passed to nerdlog_agent.sh as --context-lines.
+	numLines int
+
+	// For log files, linenr is the combined line number of the log line to get
+	// the context of, and for journalctl, time is its timestamp.
+	linenr int
+	time   time.Time
+}
+
+type lstreamCmdCleanup struct {
+	// keep are the logstream-side paths of the files which must not be removed
+	// since they're used by the current session; they might start with "~/".
+	keep []string
+
+	// If dryRun is true, the stale files are only listed, but not removed.
+	dryRun bool
+}
+
+type lstreamCmdCtxCleanup struct {
+	Resp *CleanupRemoteResp
 }
 
 type lstreamCmdCtxQueryLogs struct {
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/dimonomid/clock"
-	"github.com/dimonomid/ssh_config"
 	"github.com/juju/errors"
 
 	"github.com/dimonomid/nerdlog/log"
@@ -40,6 +39,10 @@ type LStreamsManager struct {
 	// with one key, and add an item here with a different key.
 	lscPendingTeardown map[string]int
 
+	// connectQueue is shared by all the LStreamClient-s, to limit the number of
+	// connections being established at the same time.
+	connectQueue *ConnectQueue
+
 	lstreamsByState map[LStreamClientState]map[string]struct{}
 	numNotConnected int
 
@@ -69,18 +72,37 @@ type LStreamsManagerParams struct {
 
 	// SSHConfig contains the general ssh config, typically coming from
 	// ~/.ssh/config.
-	SSHConfig *ssh_config.Config
+	SSHConfig *SSHConfig
 
 	// SSHKeys specifies paths to ssh keys to try, in the given order, until
 	// an existing key is found.
 	SSHKeys []string
 
+	// SSHPasswordAuth specifies whether the password and keyboard-interactive
+	// ssh auth should be tried; see ShellTransportSSHLibParams.PasswordAuth.
+	SSHPasswordAuth bool
+
+	// SSHCachePassword specifies whether the ssh passwords entered by the user
+	// should be remembered for the rest of the session; see
+	// ShellTransportSSHLibParams.CachePassword.
+	SSHCachePassword bool
+
+	// SSHAskpassBinary is the path to the nerdlog binary to be used as
+	// SSH_ASKPASS by the ssh-bin transport; see
+	// ShellTransportSSHBinParams.AskpassBinary.
+	SSHAskpassBinary string
+
 	Logger *log.Logger
 
 	InitialLStreams string
 
 	InitialUseExternalSSH bool
 
+	// InitialConnectQueueParams specifies the initial limit of connections
+	// being established at the same time, and the connection timeout; it can
+	// be changed later with SetConnectQueueParams.
+	InitialConnectQueueParams ConnectQueueParams
+
 	// ClientID is just an arbitrary string (should be filename-friendly though)
 	// which will be appended to the nerdlog_agent.sh and its index filenames.
 	//
@@ -111,6 +133,8 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 		lscBusyStages:      map[string]BusyStage{},
 		lscPendingTeardown: map[string]int{},
 
+		connectQueue: NewConnectQueue(params.InitialConnectQueueParams),
+
 		lstreamUpdatesCh: make(chan *LStreamClientUpdate, 1024),
 		reqCh:            make(chan lstreamsManagerReq, 8),
 		respCh:           make(chan lstreamCmdRes),
@@ -147,6 +171,13 @@ func (lsman *LStreamsManager) SetUseExternalSSH(useExternalSSH bool) {
 	<-resCh
 }
 
+// SetConnectQueueParams updates the limit of connections being established at
+// the same time, and the connection timeout. The connections which are in
+// progress already aren't affected.
+func (lsman *LStreamsManager) SetConnectQueueParams(params ConnectQueueParams) {
+	lsman.connectQueue.SetParams(params)
+}
+
 func (lsman *LStreamsManager) setUseExternalSSH(useExternalSSH bool) {
 	// If unchanged, then do nothing.
 	if lsman.useExternalSSH == useExternalSSH {
@@ -227,6 +258,13 @@ func (lsman *LStreamsManager) updateHAs() {
 		lsc := NewLStreamClient(LStreamClientParams{
 			LogStream: ls,
 			SSHKeys:   lsman.params.SSHKeys,
+
+			SSHPasswordAuth:  lsman.params.SSHPasswordAuth,
+			SSHCachePassword: lsman.params.SSHCachePassword,
+			SSHAskpassBinary: lsman.params.SSHAskpassBinary,
+
+			ConnectQueue: lsman.connectQueue,
+
 			Logger:    lsman.params.Logger,
 			ClientID:  lsman.params.ClientID, //fmt.Sprintf("%s-%d", lsman.params.ClientID, rand.Int()),
 			UpdatesCh: lsman.lstreamUpdatesCh,
@@ -385,6 +423,69 @@ func (lsman *LStreamsManager) run() {
 					panic("req.queryLogs.MaxNumLines is zero")
 				}
 
+				if req.queryLogs.LoadEarlier && req.queryLogs.LoadLater {
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Errorf("can't load earlier and later logs at the same time")},
+					})
+					continue
+				}
+
+				if (req.queryLogs.LoadEarlier || req.queryLogs.LoadLater) && lsman.curLogs.sampled {
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Errorf("can't load more logs: the current logs are sampled")},
+					})
+					continue
+				}
+
+				if (req.queryLogs.LoadEarlier || req.queryLogs.LoadLater) && lsman.curLogs.countsOnly {
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Errorf("can't load more logs: the current query is counts only")},
+					})
+					continue
+				}
+
+				switch req.queryLogs.Order {
+				case "", LogsOrderDesc, LogsOrderAsc:
+					// Valid
+				default:
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Errorf("invalid order %q", req.queryLogs.Order)},
+					})
+					continue
+				}
+
+				if err := ValidateQuery(req.queryLogs.Query); err != nil {
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Annotatef(err, "query")},
+					})
+					continue
+				}
+
+				if err := validateOverlays(req.queryLogs.Overlays); err != nil {
+					lsman.sendLogRespUpdate(&LogRespTotal{
+						Errs: []error{errors.Trace(err)},
+					})
+					continue
+				}
+
+				if req.queryLogs.CountBy != nil {
+					if err := req.queryLogs.CountBy.Validate(); err != nil {
+						lsman.sendLogRespUpdate(&LogRespTotal{
+							Errs: []error{errors.Annotatef(err, "count by")},
+						})
+						continue
+					}
+				}
+
+				if req.queryLogs.NumAgg != nil {
+					if err := req.queryLogs.NumAgg.Validate(); err != nil {
+						lsman.sendLogRespUpdate(&LogRespTotal{
+							Errs: []error{errors.Annotatef(err, "numeric aggregation")},
+						})
+						continue
+					}
+				}
+
 				lsman.curQueryLogsCtx = &manQueryLogsCtx{
 					req:       req.queryLogs,
 					startTime: lsman.params.Clock.Now(),
@@ -404,6 +505,29 @@ func (lsman *LStreamsManager) run() {
 						query: req.queryLogs.Query,
 
 						refreshIndex: req.queryLogs.RefreshIndex,
+						gentle:       req.queryLogs.Gentle,
+
+						countBy: req.queryLogs.CountBy,
+						numAgg:  req.queryLogs.NumAgg,
+					}
+
+					// The order only matters for the initial query; when loading more
+					// logs, the agent figures which ones to return from the
+					// --lines-until / --lines-since and friends.
+					if !req.queryLogs.LoadEarlier && !req.queryLogs.LoadLater {
+						// Overlays don't make sense for the count-by queries, since there is
+						// no histogram for them.
+						if req.queryLogs.CountBy == nil {
+							cmdQueryLogs.overlays = req.queryLogs.Overlays
+						}
+
+						if req.queryLogs.CountsOnly {
+							cmdQueryLogs.countsOnly = true
+						} else if req.queryLogs.Sample {
+							cmdQueryLogs.sample = true
+						} else if req.queryLogs.Order != LogsOrderDesc {
+							cmdQueryLogs.order = req.queryLogs.Order
+						}
 					}
 
 					if req.queryLogs.LoadEarlier {
@@ -432,6 +556,20 @@ func (lsman *LStreamsManager) run() {
 								}
 							}
 						}
+					} else if req.queryLogs.LoadLater {
+						// Same as above, but paginating forward: we query logs after the
+						// latest one we have from this logstream. If we have none, then
+						// there's nothing to paginate from, so it's the same as a regular
+						// query, and it'd return the latest logs.
+						if nodeCtx, ok := lsman.curLogs.perNode[lstreamName]; ok {
+							if n := len(nodeCtx.logs); n > 0 {
+								if nodeCtx.logs[n-1].LogFilename == SpecialFilenameJournalctl {
+									cmdQueryLogs.timestampSince = getLatestTimeAndNumMsgs(nodeCtx.logs)
+								} else {
+									cmdQueryLogs.linesSince = nodeCtx.logs[n-1].CombinedLinenumber
+								}
+							}
+						}
 					}
 
 					lsc.EnqueueCmd(lstreamCmd{
@@ -440,6 +578,99 @@ func (lsman *LStreamsManager) run() {
 					})
 				}
 
+			case req.queryContext != nil:
+				r := req.queryContext
+				lstreamName := r.params.Msg.Context["lstream"]
+
+				lsc, ok := lsman.lscs[lstreamName]
+				if !ok {
+					r.resCh <- lstreamCmdRes{err: errors.Errorf("no such logstream: %q", lstreamName)}
+					continue
+				}
+
+				if !isStateConnected(lsman.lscStates[lstreamName]) {
+					r.resCh <- lstreamCmdRes{err: errors.Errorf("logstream %q is not connected", lstreamName)}
+					continue
+				}
+
+				if r.params.NumLines <= 0 {
+					r.resCh <- lstreamCmdRes{err: errors.Errorf("number of context lines must be positive, got %d", r.params.NumLines)}
+					continue
+				}
+
+				cmdContext := lstreamCmdQueryContext{
+					numLines: r.params.NumLines,
+				}
+
+				if r.params.Msg.LogFilename == SpecialFilenameJournalctl {
+					cmdContext.time = r.params.Msg.Time
+				} else {
+					cmdContext.linenr = r.params.Msg.CombinedLinenumber
+				}
+
+				lsc.EnqueueCmd(lstreamCmd{
+					respCh: r.resCh,
+					queryLogs: &lstreamCmdQueryLogs{
+						// The agent requires it, but it doesn't matter for the context.
+						maxNumLines: r.params.NumLines,
+
+						context: &cmdContext,
+					},
+				})
+
+			case req.cleanupRemote != nil:
+				r := req.cleanupRemote
+
+				// The files used by any of the logstreams in the current session must
+				// be kept. We don't bother figuring out which logstreams share the
+				// same host, and just keep all of them everywhere.
+				var keep []string
+				for _, lsc := range lsman.lscs {
+					keep = append(keep, lsc.getLStreamNerdlogAgentPath(), lsc.getLStreamIndexFilePath())
+				}
+
+				sort.Strings(keep)
+
+				respCh := make(chan lstreamCmdRes, len(lsman.lscs))
+				numCmds := 0
+				for name, lsc := range lsman.lscs {
+					if !isStateConnected(lsman.lscStates[name]) {
+						continue
+					}
+
+					lsc.EnqueueCmd(lstreamCmd{
+						respCh: respCh,
+						cleanup: &lstreamCmdCleanup{
+							keep:   keep,
+							dryRun: r.params.DryRun,
+						},
+					})
+
+					numCmds++
+				}
+
+				// Collect the responses in a separate goroutine, to avoid blocking the
+				// manager loop.
+				go func() {
+					ret := make(map[string]*CleanupRemoteResp, numCmds)
+					for i := 0; i < numCmds; i++ {
+						res := <-respCh
+
+						resp, _ := res.resp.(*CleanupRemoteResp)
+						if resp == nil {
+							resp = &CleanupRemoteResp{}
+						}
+
+						if res.err != nil {
+							resp.Err = res.err
+						}
+
+						ret[res.hostname] = resp
+					}
+
+					r.resCh <- ret
+				}()
+
 			case req.updLStreams != nil:
 				r := req.updLStreams
 				lsman.params.Logger.Infof("LStreams manager: update logstreams spec: %s", r.logStreamsSpec)
@@ -598,6 +829,29 @@ func getEarliestTimeAndNumMsgs(logs []LogMsg) *timeAndNumMsgs {
 	return ret
 }
 
+// getLatestTimeAndNumMsgs is the counterpart of getEarliestTimeAndNumMsgs,
+// used for the forward pagination.
+func getLatestTimeAndNumMsgs(logs []LogMsg) *timeAndNumMsgs {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	ret := &timeAndNumMsgs{
+		time:    logs[len(logs)-1].Time,
+		numMsgs: 1,
+	}
+
+	for i := len(logs) - 2; i >= 0; i-- {
+		if !logs[i].Time.Equal(ret.time) {
+			break
+		}
+
+		ret.numMsgs++
+	}
+
+	return ret
+}
+
 func (lsman *LStreamsManager) getNumLStreamClientsTearingDown() int {
 	numPending := 0
 	for _, v := range lsman.lscPendingTeardown {
@@ -625,6 +879,8 @@ type lstreamsManagerReq struct {
 	// Exactly one field must be non-nil
 
 	queryLogs         *QueryLogsParams
+	queryContext      *lstreamsManagerReqQueryContext
+	cleanupRemote     *lstreamsManagerReqCleanupRemote
 	updLStreams       *lstreamsManagerReqUpdLStreams
 	setUseExternalSSH *lstreamsManagerReqSetUseExternalSSH
 	ping              bool
@@ -637,6 +893,16 @@ type lstreamsManagerReqUpdLStreams struct {
 	resCh          chan<- error
 }
 
+type lstreamsManagerReqQueryContext struct {
+	params QueryContextParams
+	resCh  chan lstreamCmdRes
+}
+
+type lstreamsManagerReqCleanupRemote struct {
+	params CleanupRemoteParams
+	resCh  chan map[string]*CleanupRemoteResp
+}
+
 type lstreamsManagerReqSetUseExternalSSH struct {
 	useExternalSSH bool
 	resCh          chan<- struct{}
@@ -649,6 +915,47 @@ func (lsman *LStreamsManager) QueryLogs(params QueryLogsParams) {
 	}
 }
 
+// QueryContext gets the raw (unfiltered) log lines around the given message
+// from its logstream, and blocks until they are received. It doesn't affect
+// the logs loaded by QueryLogs, and can be called while some query is in
+// progress (then the logstream will first finish that query).
+func (lsman *LStreamsManager) QueryContext(params QueryContextParams) (*LogResp, error) {
+	lsman.params.Logger.Verbose1f("QueryContext: %+v", params)
+	resCh := make(chan lstreamCmdRes, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		queryContext: &lstreamsManagerReqQueryContext{
+			params: params,
+			resCh:  resCh,
+		},
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		return nil, errors.Trace(res.err)
+	}
+
+	return res.resp.(*LogResp), nil
+}
+
+// CleanupRemote finds the stale nerdlog files (agent scripts and index files
+// which are not used by the current session) on all the connected logstreams,
+// and unless params.DryRun is true, removes them. It blocks until all the
+// logstreams respond, and returns the results keyed by the logstream name.
+func (lsman *LStreamsManager) CleanupRemote(params CleanupRemoteParams) map[string]*CleanupRemoteResp {
+	lsman.params.Logger.Verbose1f("CleanupRemote: %+v", params)
+	resCh := make(chan map[string]*CleanupRemoteResp, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		cleanupRemote: &lstreamsManagerReqCleanupRemote{
+			params: params,
+			resCh:  resCh,
+		},
+	}
+
+	return <-resCh
+}
+
 func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
 	resCh := make(chan error, 1)
 
@@ -695,12 +1002,48 @@ type manLogsCtx struct {
 	minuteStats  map[int64]MinuteStatsItem
 	numMsgsTotal int
 
+	// minuteStatsByLStream is the same as minuteStats, but broken down by
+	// logstream name.
+	minuteStatsByLStream map[string]map[int64]MinuteStatsItem
+
+	// statsResolution is the finest stats resolution among all logstreams.
+	statsResolution time.Duration
+
+	// numAggStats is merged from all logstreams; it's only populated if the
+	// query had the NumAgg params.
+	numAggStats map[int64]NumAggStatsItem
+
+	// order is the order used by the query which loaded the logs initially.
+	order LogsOrder
+
+	// sampled is true if the logs were loaded with QueryLogsParams.Sample.
+	sampled bool
+
+	// countsOnly is true if the logs were queried with
+	// QueryLogsParams.CountsOnly, so we only have stats and no logs.
+	countsOnly bool
+
+	// openEnded is true if the query which loaded the logs initially had no
+	// To, so the logstreams might have written newer logs since then, which
+	// can be loaded with LoadLater.
+	openEnded bool
+
+	// overlayStats is merged from all logstreams; it's only populated if the
+	// query had Overlays.
+	overlayStats []map[int64]MinuteStatsItem
+
 	perNode map[string]*manLogsNodeCtx
 }
 
 type manLogsNodeCtx struct {
 	logs          []LogMsg
 	isMaxNumLines bool
+
+	// hasMoreLater is true if the last query which loaded the latest logs we
+	// have (either the initial one in the ascending order, or the forward
+	// pagination one) returned MaxNumLines logs, so there might be more logs
+	// after the ones we have.
+	hasMoreLater bool
 }
 
 type LStreamsManagerUpdate struct {
@@ -843,15 +1186,73 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 		return
 	}
 
+	// Count-by queries are merged separately, and they don't touch the logs
+	// we've loaded before.
+	if lsman.curQueryLogsCtx.req.CountBy != nil {
+		lsman.sendLogRespUpdate(mergeCountByResps(resps))
+		return
+	}
+
 	// If we're not adding to already existing logs, reset w/e we've had already,
 	// and calculate minuteStats from the resps.
-	if !lsman.curQueryLogsCtx.req.LoadEarlier {
+	if !lsman.curQueryLogsCtx.req.LoadEarlier && !lsman.curQueryLogsCtx.req.LoadLater {
 		lsman.curLogs = manLogsCtx{
-			minuteStats: map[int64]MinuteStatsItem{},
-			perNode:     map[string]*manLogsNodeCtx{},
+			minuteStats:          map[int64]MinuteStatsItem{},
+			minuteStatsByLStream: map[string]map[int64]MinuteStatsItem{},
+			perNode:              map[string]*manLogsNodeCtx{},
+			order:                lsman.curQueryLogsCtx.req.Order,
+			sampled:              lsman.curQueryLogsCtx.req.Sample,
+			countsOnly:           lsman.curQueryLogsCtx.req.CountsOnly,
+			openEnded:            lsman.curQueryLogsCtx.req.To.IsZero(),
+		}
+
+		// Sampling is ignored for the counts-only queries.
+		if lsman.curLogs.countsOnly {
+			lsman.curLogs.sampled = false
+		}
+
+		// Order is ignored for the sampled logs.
+		if lsman.curLogs.order == "" || lsman.curLogs.sampled {
+			lsman.curLogs.order = LogsOrderDesc
+		}
+
+		if lsman.curQueryLogsCtx.req.NumAgg != nil {
+			lsman.curLogs.numAggStats = map[int64]NumAggStatsItem{}
+		}
+
+		if overlays := lsman.curQueryLogsCtx.req.Overlays; len(overlays) > 0 {
+			lsman.curLogs.overlayStats = make([]map[int64]MinuteStatsItem, len(overlays))
+			for i := range overlays {
+				lsman.curLogs.overlayStats[i] = map[int64]MinuteStatsItem{}
+			}
 		}
 
 		for nodeName, resp := range resps {
+			lsman.curLogs.minuteStatsByLStream[nodeName] = resp.MinuteStats
+
+			if resp.StatsResolution != 0 &&
+				(lsman.curLogs.statsResolution == 0 || resp.StatsResolution < lsman.curLogs.statsResolution) {
+				lsman.curLogs.statsResolution = resp.StatsResolution
+			}
+
+			for k, v := range resp.NumAggStats {
+				item := lsman.curLogs.numAggStats[k]
+				item.Merge(v)
+				lsman.curLogs.numAggStats[k] = item
+			}
+
+			for i, overlayStats := range resp.OverlayStats {
+				if i >= len(lsman.curLogs.overlayStats) {
+					break
+				}
+
+				for k, v := range overlayStats {
+					lsman.curLogs.overlayStats[i][k] = MinuteStatsItem{
+						NumMsgs: lsman.curLogs.overlayStats[i][k].NumMsgs + v.NumMsgs,
+					}
+				}
+			}
+
 			for k, v := range resp.MinuteStats {
 				lsman.curLogs.minuteStats[k] = MinuteStatsItem{
 					NumMsgs: lsman.curLogs.minuteStats[k].NumMsgs + v.NumMsgs,
@@ -860,18 +1261,33 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 				lsman.curLogs.numMsgsTotal += v.NumMsgs
 			}
 
+			// If the logstream returned MaxNumLines logs, it means we might not
+			// have all the logs: in the descending order, it's the earliest ones
+			// that might be missing, and in the ascending order, the latest ones.
+			// The sampled logs are spread across the whole time range, so nothing
+			// is missing at either end.
+			isMaxNumLines := len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines &&
+				!lsman.curLogs.sampled && !lsman.curLogs.countsOnly
 			lsman.curLogs.perNode[nodeName] = &manLogsNodeCtx{
 				logs:          resp.Logs,
-				isMaxNumLines: len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines,
+				isMaxNumLines: isMaxNumLines && lsman.curLogs.order == LogsOrderDesc,
+				hasMoreLater:  isMaxNumLines && lsman.curLogs.order == LogsOrderAsc,
 			}
 		}
-	} else {
+	} else if lsman.curQueryLogsCtx.req.LoadEarlier {
 		// Add to existing logs
 		for nodeName, resp := range resps {
 			pn := lsman.curLogs.perNode[nodeName]
 			pn.logs = append(resp.Logs, pn.logs...)
 			pn.isMaxNumLines = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
 		}
+	} else {
+		// Add to existing logs, but at the end
+		for nodeName, resp := range resps {
+			pn := lsman.curLogs.perNode[nodeName]
+			pn.logs = append(pn.logs, resp.Logs...)
+			pn.hasMoreLater = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
+		}
 	}
 
 	// Collect debug info
@@ -881,13 +1297,21 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	}
 
 	ret := &LogRespTotal{
-		MinuteStats:   lsman.curLogs.minuteStats,
-		NumMsgsTotal:  lsman.curLogs.numMsgsTotal,
-		LoadedEarlier: lsman.curQueryLogsCtx.req.LoadEarlier,
-		DebugInfo:     debugInfo,
+		MinuteStats:          lsman.curLogs.minuteStats,
+		MinuteStatsByLStream: lsman.curLogs.minuteStatsByLStream,
+		StatsResolution:      lsman.curLogs.statsResolution,
+		NumAggStats:          lsman.curLogs.numAggStats,
+		NumMsgsTotal:         lsman.curLogs.numMsgsTotal,
+		LoadedEarlier:        lsman.curQueryLogsCtx.req.LoadEarlier,
+		LoadedLater:          lsman.curQueryLogsCtx.req.LoadLater,
+		Order:                lsman.curLogs.order,
+		Sampled:              lsman.curLogs.sampled,
+		CountsOnly:           lsman.curLogs.countsOnly,
+		OverlayStats:         lsman.curLogs.overlayStats,
+		DebugInfo:            debugInfo,
 	}
 
-	var logsCoveredSince time.Time
+	var logsCoveredSince, logsCoveredUntil time.Time
 
 	for _, pn := range lsman.curLogs.perNode {
 		ret.Logs = append(ret.Logs, pn.logs...)
@@ -897,6 +1321,23 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 		if pn.isMaxNumLines && logsCoveredSince.Before(pn.logs[0].Time) {
 			logsCoveredSince = pn.logs[0].Time
 		}
+
+		// Same for the other end, if the logstream might have more logs later.
+		if pn.hasMoreLater && len(pn.logs) > 0 {
+			ret.HasMoreLater = true
+
+			lastTime := pn.logs[len(pn.logs)-1].Time
+			if logsCoveredUntil.IsZero() || lastTime.Before(logsCoveredUntil) {
+				logsCoveredUntil = lastTime
+			}
+		}
+	}
+
+	// If the time range is open-ended, the logstreams might have written newer
+	// logs since the query, so it's always possible to load them. Nothing is cut
+	// in this case though, since we do have all the logs until the query time.
+	if lsman.curLogs.openEnded && !lsman.curLogs.sampled && !lsman.curLogs.countsOnly {
+		ret.HasMoreLater = true
 	}
 
 	sort.SliceStable(ret.Logs, func(i, j int) bool {
@@ -915,9 +1356,92 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	})
 	ret.Logs = ret.Logs[coveredSinceIdx:]
 
+	// And similarly, cut the logs after the timespan that we're sure we have
+	// covered from all nodes (only relevant for the ascending order and the
+	// forward pagination). The logs which are cut here are still kept in
+	// perNode, so they'll show up once we load more.
+	if !logsCoveredUntil.IsZero() {
+		coveredUntilIdx := sort.Search(len(ret.Logs), func(i int) bool {
+			return ret.Logs[i].Time.After(logsCoveredUntil)
+		})
+		ret.Logs = ret.Logs[:coveredUntilIdx]
+	}
+
 	lsman.sendLogRespUpdate(ret)
 }
 
+// validateOverlays checks that all the overlay queries are valid and
+// non-empty.
+func validateOverlays(overlays []string) error {
+	for _, overlay := range overlays {
+		if strings.TrimSpace(overlay) == "" {
+			return errors.Errorf("overlay query can't be empty")
+		}
+
+		if err := ValidateQuery(overlay); err != nil {
+			return errors.Annotatef(err, "overlay %q", overlay)
+		}
+	}
+
+	return nil
+}
+
+// mergeCountByResps merges "count by" results from all logstreams into a
+// single LogRespTotal.
+func mergeCountByResps(resps map[string]*LogResp) *LogRespTotal {
+	ret := &LogRespTotal{
+		MinuteStats:          map[int64]MinuteStatsItem{},
+		MinuteStatsByLStream: make(map[string]map[int64]MinuteStatsItem, len(resps)),
+		DebugInfo:            make(map[string]LogstreamDebugInfo, len(resps)),
+	}
+
+	itemsByValue := map[string]*CountByItem{}
+
+	for lstreamName, resp := range resps {
+		for k, v := range resp.MinuteStats {
+			ret.MinuteStats[k] = MinuteStatsItem{
+				NumMsgs: ret.MinuteStats[k].NumMsgs + v.NumMsgs,
+			}
+
+			ret.NumMsgsTotal += v.NumMsgs
+		}
+
+		ret.MinuteStatsByLStream[lstreamName] = resp.MinuteStats
+		ret.DebugInfo[lstreamName] = resp.DebugInfo
+
+		for value, count := range resp.CountBy {
+			item, ok := itemsByValue[value]
+			if !ok {
+				item = &CountByItem{
+					Value:          value,
+					CountByLStream: map[string]int{},
+				}
+				itemsByValue[value] = item
+			}
+
+			item.Count += count
+			item.CountByLStream[lstreamName] = count
+		}
+
+		ret.CountByRest += resp.CountByRest
+	}
+
+	ret.CountBy = make([]CountByItem, 0, len(itemsByValue))
+	for _, item := range itemsByValue {
+		ret.CountBy = append(ret.CountBy, *item)
+	}
+
+	sort.Slice(ret.CountBy, func(i, j int) bool {
+		if ret.CountBy[i].Count != ret.CountBy[j].Count {
+			return ret.CountBy[i].Count > ret.CountBy[j].Count
+		}
+
+		return ret.CountBy[i].Value < ret.CountBy[j].Value
+	})
+
+	return ret
+}
+
 func (lsman *LStreamsManager) randomString(length int) string {
 	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
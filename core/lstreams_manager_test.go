@@ -0,0 +1,100 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeLogRespsHasMoreLater(t *testing.T) {
+	t0 := time.Date(2025, 3, 12, 10, 0, 0, 0, time.UTC)
+
+	makeLogs := func(lstream string, minutes ...int) []LogMsg {
+		logs := make([]LogMsg, 0, len(minutes))
+		for _, m := range minutes {
+			logs = append(logs, LogMsg{
+				Time:    t0.Add(time.Duration(m) * time.Minute),
+				Context: map[string]string{"lstream": lstream},
+			})
+		}
+
+		return logs
+	}
+
+	testCases := []struct {
+		descr string
+		req   QueryLogsParams
+		resps map[string]*LogResp
+
+		wantHasMoreLater bool
+		wantNumLogs      int
+	}{
+		{
+			descr: "desc, bounded range: we have all the latest logs",
+			req:   QueryLogsParams{MaxNumLines: 2, To: t0.Add(time.Hour)},
+			resps: map[string]*LogResp{
+				"a": {Logs: makeLogs("a", 1, 2)},
+			},
+			wantHasMoreLater: false,
+			wantNumLogs:      2,
+		},
+		{
+			descr: "desc, open-ended range: newer logs might have been written",
+			req:   QueryLogsParams{MaxNumLines: 2},
+			resps: map[string]*LogResp{
+				"a": {Logs: makeLogs("a", 1)},
+			},
+			wantHasMoreLater: true,
+			wantNumLogs:      1,
+		},
+		{
+			descr: "asc, bounded range, one logstream hit the limit",
+			req:   QueryLogsParams{MaxNumLines: 2, To: t0.Add(time.Hour), Order: LogsOrderAsc},
+			resps: map[string]*LogResp{
+				"a": {Logs: makeLogs("a", 1, 2)},
+				"b": {Logs: makeLogs("b", 1)},
+				"c": {Logs: makeLogs("c", 3)},
+			},
+			wantHasMoreLater: true,
+			// The log from "c" is cut, since "a" might have more logs before it.
+			wantNumLogs: 3,
+		},
+		{
+			descr: "asc, bounded range, no logstream hit the limit",
+			req:   QueryLogsParams{MaxNumLines: 2, To: t0.Add(time.Hour), Order: LogsOrderAsc},
+			resps: map[string]*LogResp{
+				"a": {Logs: makeLogs("a", 1)},
+			},
+			wantHasMoreLater: false,
+			wantNumLogs:      1,
+		},
+		{
+			descr: "sampled logs can't be paginated",
+			req:   QueryLogsParams{MaxNumLines: 2, Sample: true},
+			resps: map[string]*LogResp{
+				"a": {Logs: makeLogs("a", 1, 2)},
+			},
+			wantHasMoreLater: false,
+			wantNumLogs:      2,
+		},
+	}
+
+	for _, tc := range testCases {
+		updatesCh := make(chan LStreamsManagerUpdate, 1)
+		lsman := &LStreamsManager{
+			params: LStreamsManagerParams{UpdatesCh: updatesCh},
+			curQueryLogsCtx: &manQueryLogsCtx{
+				req:   &tc.req,
+				resps: tc.resps,
+				errs:  map[string]error{},
+			},
+		}
+
+		lsman.mergeLogRespsAndSend()
+		resp := (<-updatesCh).LogResp
+
+		assert.Equal(t, tc.wantHasMoreLater, resp.HasMoreLater, tc.descr)
+		assert.Equal(t, tc.wantNumLogs, len(resp.Logs), tc.descr)
+	}
+}
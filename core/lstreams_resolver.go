@@ -3,9 +3,9 @@ package core
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dimonomid/nerdlog/shellescape"
-	"github.com/dimonomid/ssh_config"
 	"github.com/gobwas/glob"
 	"github.com/juju/errors"
 )
@@ -29,7 +29,7 @@ type LStreamsResolverParams struct {
 	ConfigLogStreams ConfigLogStreams
 
 	// SSHConfig is the general SSH config, typically coming from ~/.ssh/config
-	SSHConfig *ssh_config.Config
+	SSHConfig *SSHConfig
 }
 
 func NewLStreamsResolver(params LStreamsResolverParams) *LStreamsResolver {
@@ -66,8 +66,18 @@ type LogStream struct {
 // ConfigLogStreamShellTransportSSHLib contains params for the ssh transport
 // using internal ssh library.
 type ConfigLogStreamShellTransportSSHLib struct {
-	Host     ConfigHost
-	Jumphost *ConfigHost
+	Host ConfigHost
+
+	// Jumphosts is the chain of jumphosts to connect to the Host through, in
+	// the order of connecting: the first one is connected to directly, and
+	// every next one through the previous one. If empty, the Host is connected
+	// to directly.
+	Jumphosts []ConfigHost
+
+	// ProxyCommand, if not empty, is the command (coming from the ssh config)
+	// to run locally, and to talk to the Host over its stdin and stdout,
+	// instead of connecting over TCP. It's never set together with Jumphosts.
+	ProxyCommand string
 }
 
 // ConfigLogStreamShellTransportSSHBin contains params for the ssh transport
@@ -83,6 +93,11 @@ type ConfigLogStreamShellTransportSSHBin struct {
 	// will be prefixed with "<user>@", otherwise the destination will be just
 	// the Host.
 	User string
+
+	// Jumphosts is optional: if present, it'll be passed to the ssh binary
+	// using the -J flag. Every item is like "[user@]host[:port]", in the order
+	// of connecting.
+	Jumphosts []string
 }
 
 type ConfigLogStreamShellTransportLocalhost struct {
@@ -98,15 +113,46 @@ type ConfigLogStreamShellTransport struct {
 type LogStreamOptions struct {
 	SudoMode SudoMode
 
+	// SudoMethod is how the privileges are elevated if SudoMode is full or
+	// granular; empty means SudoMethodSudo.
+	SudoMethod SudoMethod
+
 	// ShellInit can contain arbitrary shell commands which will be executed
 	// right after connecting to the host. A common use case is setting
 	// custom env vars for tests, like: "export TZ=America/New_York", but
 	// might be useful outside of tests as well.
 	ShellInit []string
+
+	// IndexResolution is the granularity of the index and the histogram data,
+	// see ConfigLogStreamOptions.IndexResolution. Zero means a minute.
+	IndexResolution time.Duration
+
+	// IndexDir is the logstream-side directory for the index files, see
+	// ConfigLogStreamOptions.IndexDir. Empty means /tmp.
+	IndexDir string
+
+	// MaxCPUs is the max number of parallel awk workers on the logstream, see
+	// ConfigLogStreamOptions.MaxCPUs. Zero means no limit.
+	MaxCPUs int
+
+	// Nice and IONice are the CPU and IO priority of the agent, see
+	// ConfigLogStreamOptions.Nice and ConfigLogStreamOptions.IONice. Zero
+	// values mean no change.
+	Nice   int
+	IONice string
+
+	// MaxReadRate is the max rate (in bytes per second) at which the agent
+	// reads the log files, see ConfigLogStreamOptions.MaxReadRate. Zero means
+	// no limit.
+	MaxReadRate int64
+
+	// AWKBinary is the awk to use on the logstream, see
+	// ConfigLogStreamOptions.AWKBinary. Empty means autodetect.
+	AWKBinary string
 }
 
-// SudoMode can be used to configure nerdlog to read log files with "sudo -n".
-// See constants below for more details.
+// SudoMode can be used to configure nerdlog to read log files with elevated
+// privileges, using the SudoMethod. See constants below for more details.
 type SudoMode string
 
 const (
@@ -117,20 +163,48 @@ const (
 	SudoModeNone SudoMode = "none"
 
 	// SudoModeFull means that the whole nerdlog_agent.sh script will be executed
-	// with "sudo -n". Useful for cases when the log files are owned by root but
-	// sudo doesn't require a password.
+	// with elevated privileges (by default, with "sudo -n"). Useful for cases
+	// when the log files are owned by root.
 	SudoModeFull SudoMode = "full"
 
-	// If needed, we might implement something like SudoModeGranular, which would
-	// mean that the agent script runs without sudo, but then internally it
-	// executes some commands with sudo. It would mean a more complicated setup
-	// and more maintenance burden and harder to configure sudoers file, so
-	// postponed until we actually need it (if at all).
+	// SudoModeGranular means that the agent script runs as the regular user,
+	// and only the commands which read the log files (tail, head and cat) are
+	// executed with elevated privileges. It makes it possible to limit the
+	// sudoers (or doas.conf) rules to just these commands; the index files are
+	// then owned by the regular user as well.
+	SudoModeGranular SudoMode = "granular"
 )
 
 var ValidSudoModes = map[SudoMode]struct{}{
-	SudoModeNone: {},
-	SudoModeFull: {},
+	SudoModeNone:     {},
+	SudoModeFull:     {},
+	SudoModeGranular: {},
+}
+
+// SudoMethod specifies how exactly the privileges are elevated when SudoMode
+// is either SudoModeFull or SudoModeGranular.
+type SudoMethod string
+
+const (
+	// SudoMethodSudo means "sudo -n", so sudo must not require a password. It's
+	// the default.
+	SudoMethodSudo SudoMethod = "sudo"
+
+	// SudoMethodSudoPassword means "sudo -S", with the password which the user
+	// is asked for after connecting to the host (and which is then remembered
+	// until nerdlog exits). The password is kept in a non-exported shell
+	// variable on the host, and piped to sudo.
+	SudoMethodSudoPassword SudoMethod = "sudo_password"
+
+	// SudoMethodDoas means "doas -n", so doas must be configured with "nopass"
+	// for the commands.
+	SudoMethodDoas SudoMethod = "doas"
+)
+
+var ValidSudoMethods = map[SudoMethod]struct{}{
+	SudoMethodSudo:         {},
+	SudoMethodSudoPassword: {},
+	SudoMethodDoas:         {},
 }
 
 type ConfigHost struct {
@@ -144,6 +218,10 @@ type ConfigHost struct {
 	Addr string
 	// User is the username to authenticate as.
 	User string
+
+	// IdentityFiles are the ssh keys to try for this host (coming from the ssh
+	// config), before the globally configured ones.
+	IdentityFiles []string
 }
 
 func (ch *ConfigHost) Key() string {
@@ -213,11 +291,14 @@ func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, er
 // draftLogStream is a draft version of LogStream; it's used as temporary
 // storage in the process of resolving logstreams.
 type draftLogStream struct {
-	name     string
-	host     ConfigHost
-	jumphost *ConfigHost
-	logFiles []string
-	options  LogStreamOptions
+	name      string
+	host      ConfigHost
+	jumphosts []ConfigHost
+	// proxyCommand is the ProxyCommand from the ssh config, see
+	// ConfigLogStreamShellTransportSSHLib.ProxyCommand.
+	proxyCommand string
+	logFiles     []string
+	options      LogStreamOptions
 }
 
 // parseLogStreamSpecEntry parses a single logstream spec entry like
@@ -234,7 +315,7 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 	}
 
 	var plstream *parsedLStream
-	var jhconf *ConfigHost
+	var jhconfs []ConfigHost
 	var logFiles []string
 
 	curFlag := ""
@@ -245,6 +326,7 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		}
 
 		switch curFlag {
+		// The jumphost flag can be given multiple times, to chain them.
 		case "-J", "--jumphost":
 			jhparsed, err := r.parseLStreamStr(part)
 			if err != nil {
@@ -261,10 +343,10 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				return nil, errors.Errorf("parsing %q as a jumphost: too many colons", part)
 			}
 
-			jhconf = &ConfigHost{
+			jhconfs = append(jhconfs, ConfigHost{
 				Addr: fmt.Sprintf("%s:%s", jhparsed.hostname, jhPort),
 				User: jhparsed.user,
-			}
+			})
 
 		case "":
 			var err error
@@ -303,7 +385,7 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				Addr: fmt.Sprintf("%s:%s", plstream.hostname, plstream.port),
 				User: plstream.user,
 			},
-			jumphost: jhconf,
+			jumphosts: jhconfs,
 
 			logFiles: logFiles,
 		},
@@ -317,19 +399,13 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		return nil, errors.Annotatef(err, "expanding from nerdlog config")
 	}
 
-	// Expand from ssh config.
-	lsConfigFromSSHConfig, err := sshConfigToLSConfig(r.params.SSHConfig)
-	if err != nil {
-		return nil, errors.Annotatef(err, "parsing ssh config")
-	}
-
+	// Expand globs from ssh config. The connection details are not filled here
+	// regardless of whether we use external ssh: the ssh config has to be
+	// evaluated for the actual host and user (because of the Match blocks, etc),
+	// so it's done separately below.
 	lstreams, err = expandFromLogStreamsConfig(
-		lstreams, lsConfigFromSSHConfig, expandOpts{
-			// If using internal ssh library, then expand everything as usual: expand
-			// globs and fill in the missing details. But if using external ssh, then
-			// only expand globs, and leave filling all the missing connection
-			// details up to ssh.
-			skipFillingConnDetails: r.params.UseExternalSSH,
+		lstreams, sshConfigToLSConfig(r.params.SSHConfig), expandOpts{
+			skipFillingConnDetails: true,
 		},
 	)
 	if err != nil {
@@ -340,6 +416,11 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		// We're not using external ssh binary, so also try to fill in the
 		// details from the parsed ssh config, and then from the defaults too.
 
+		lstreams, err = setLogStreamsSSHConfigDetails(lstreams, r.params.SSHConfig, r.params.CurOSUser)
+		if err != nil {
+			return nil, errors.Annotatef(err, "filling details from ssh config")
+		}
+
 		lstreams, err = setLogStreamsConnDefaults(lstreams, r.params.CurOSUser)
 		if err != nil {
 			return nil, errors.Annotatef(err, "setting defaults")
@@ -392,8 +473,9 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				// Use internal ssh library
 				transport = ConfigLogStreamShellTransport{
 					SSHLib: &ConfigLogStreamShellTransportSSHLib{
-						Host:     ls.host,
-						Jumphost: ls.jumphost,
+						Host:         ls.host,
+						Jumphosts:    ls.jumphosts,
+						ProxyCommand: ls.proxyCommand,
 					},
 				}
 			} else {
@@ -403,11 +485,22 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 					return nil, errors.Annotatef(err, "parsing addr %s for external ssh binary", ls.host.Addr)
 				}
 
+				var jumphosts []string
+				for _, jh := range ls.jumphosts {
+					jhSpec, err := sshBinHostSpec(jh)
+					if err != nil {
+						return nil, errors.Annotatef(err, "jumphost for external ssh binary")
+					}
+
+					jumphosts = append(jumphosts, jhSpec)
+				}
+
 				transport = ConfigLogStreamShellTransport{
 					SSHBin: &ConfigLogStreamShellTransportSSHBin{
-						Host: parsedAddr.host,
-						Port: parsedAddr.port,
-						User: ls.host.User,
+						Host:      parsedAddr.host,
+						Port:      parsedAddr.port,
+						User:      ls.host.User,
+						Jumphosts: jumphosts,
 					},
 				}
 			}
@@ -563,16 +656,65 @@ func expandFromLogStreamsConfig(
 				addrCopy.host = matchedItem.Key
 			}
 
+			// Jumphosts only come from the nerdlog config (or from the -J flag), so
+			// we use them regardless of skipFillingConnDetails: the external ssh
+			// binary wouldn't know about them otherwise.
+			if len(lsCopy.jumphosts) == 0 && matchedItem.Jumphost != nil {
+				lsCopy.jumphosts = jumphostConfigHosts(matchedItem.Jumphost)
+			}
+
 			// For non-connection details, override them if not specified already.
 
 			if lsCopy.options.SudoMode == "" {
 				lsCopy.options.SudoMode = matchedItem.Options.EffectiveSudoMode()
 			}
 
+			if lsCopy.options.SudoMethod == "" {
+				lsCopy.options.SudoMethod = matchedItem.Options.SudoMethod
+			}
+
 			if lsCopy.options.ShellInit == nil {
 				lsCopy.options.ShellInit = matchedItem.Options.ShellInit
 			}
 
+			if lsCopy.options.IndexResolution == 0 {
+				indexResolution, err := ParseIndexResolution(matchedItem.Options.IndexResolution)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+
+				lsCopy.options.IndexResolution = indexResolution
+			}
+
+			if lsCopy.options.IndexDir == "" {
+				lsCopy.options.IndexDir = matchedItem.Options.IndexDir
+			}
+
+			if lsCopy.options.MaxCPUs == 0 {
+				lsCopy.options.MaxCPUs = matchedItem.Options.MaxCPUs
+			}
+
+			if lsCopy.options.Nice == 0 {
+				lsCopy.options.Nice = matchedItem.Options.Nice
+			}
+
+			if lsCopy.options.IONice == "" {
+				lsCopy.options.IONice = matchedItem.Options.IONice
+			}
+
+			if lsCopy.options.MaxReadRate == 0 {
+				maxReadRate, err := ParseReadRate(matchedItem.Options.MaxReadRate)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+
+				lsCopy.options.MaxReadRate = maxReadRate
+			}
+
+			if lsCopy.options.AWKBinary == "" {
+				lsCopy.options.AWKBinary = matchedItem.Options.AWKBinary
+			}
+
 			if len(lsCopy.logFiles) == 0 {
 				lsCopy.logFiles = matchedItem.LogFiles
 			}
@@ -612,6 +754,30 @@ func setLogStreamsConnDefaults(
 			ls.host.User = osUser
 		}
 
+		// Same for the jumphosts; the slice is copied, since it might be shared
+		// between multiple logstreams.
+		jumphosts := make([]ConfigHost, 0, len(ls.jumphosts))
+		for _, jh := range ls.jumphosts {
+			jhPort, err := portFromAddr(jh.Addr)
+			if err != nil {
+				return nil, errors.Annotatef(err, "logstream #%d, getting jumphost port", i+1)
+			}
+
+			if jhPort == "" {
+				jh.Addr += "22"
+			}
+
+			if jh.User == "" {
+				jh.User = osUser
+			}
+
+			jumphosts = append(jumphosts, jh)
+		}
+
+		if len(jumphosts) > 0 {
+			ls.jumphosts = jumphosts
+		}
+
 		ret = append(ret, ls)
 	}
 
@@ -657,6 +823,41 @@ func parseAddr(addr string) (parsedAddr, error) {
 	}, nil
 }
 
+// jumphostConfigHosts returns the chain of jumphosts from the config as
+// ConfigHost-s, in the order of connecting: the innermost nested jumphost
+// (the one to connect to directly) first, and jh itself last.
+func jumphostConfigHosts(jh *ConfigJumphost) []ConfigHost {
+	var ret []ConfigHost
+	if jh.Jumphost != nil {
+		ret = jumphostConfigHosts(jh.Jumphost)
+	}
+
+	return append(ret, ConfigHost{
+		Addr: fmt.Sprintf("%s:%s", jh.Hostname, jh.Port),
+		User: jh.User,
+	})
+}
+
+// sshBinHostSpec returns the host spec like "[user@]host[:port]", as the
+// external ssh binary takes it in the -J flag.
+func sshBinHostSpec(ch ConfigHost) (string, error) {
+	addr, err := parseAddr(ch.Addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	ret := addr.host
+	if ch.User != "" {
+		ret = ch.User + "@" + ret
+	}
+
+	if addr.port != "" {
+		ret += ":" + addr.port
+	}
+
+	return ret, nil
+}
+
 // hostnameFromAddr takes an address like net.Dial takes, in the form of
 // "host:port", and returns the host part.
 func hostnameFromAddr(addr string) (string, error) {
@@ -679,45 +880,136 @@ func portFromAddr(addr string) (string, error) {
 	return parts[1], nil
 }
 
-func sshConfigToLSConfig(sshConfig *ssh_config.Config) (ConfigLogStreams, error) {
+// sshConfigToLSConfig returns the logstreams config with all the host aliases
+// from the ssh config, so that globs can be expanded using them. The entries
+// are empty: the actual details are filled by setLogStreamsSSHConfigDetails.
+func sshConfigToLSConfig(sshConfig *SSHConfig) ConfigLogStreams {
 	if sshConfig == nil {
-		return nil, nil
+		return nil
 	}
 
-	ret := make(ConfigLogStreams, len(sshConfig.Hosts))
+	ret := make(ConfigLogStreams, len(sshConfig.Aliases()))
+	for _, alias := range sshConfig.Aliases() {
+		ret[alias] = ConfigLogStream{}
+	}
 
-	for _, host := range sshConfig.Hosts {
-		if len(host.Patterns) == 0 {
-			continue
-		}
+	return ret
+}
 
-		name := host.Patterns[0].String()
-		if name == "" {
-			continue
+// setLogStreamsSSHConfigDetails goes through each of the logstreams, and fills
+// in missing connection details from the ssh config: hostname, port, user,
+// identity files, and ProxyJump or ProxyCommand (unless the jumphosts are
+// already configured). The jumphosts are also resolved using the ssh config,
+// just like ssh does it with ProxyJump.
+//
+// Like setLogStreamsConnDefaults, it shouldn't be used with the external ssh
+// binary.
+func setLogStreamsSSHConfigDetails(
+	logStreams []draftLogStream,
+	sshConfig *SSHConfig,
+	osUser string,
+) ([]draftLogStream, error) {
+	if sshConfig == nil {
+		return logStreams, nil
+	}
+
+	ret := make([]draftLogStream, 0, len(logStreams))
+
+	for i, ls := range logStreams {
+		hostConfig, err := setHostSSHConfigDetails(&ls.host, sshConfig, osUser)
+		if err != nil {
+			return nil, errors.Annotatef(err, "logstream #%d", i+1)
 		}
 
-		// If it's a pattern, ignore it
-		// (there might be valid use cases where we'd want to use them, but
-		// not bothering for now)
-		if strings.ContainsAny(name, "*?[]") {
-			continue
+		if len(ls.jumphosts) == 0 {
+			if hostConfig.ProxyJump != "" {
+				for _, spec := range strings.Split(hostConfig.ProxyJump, ",") {
+					jh, err := parseProxyJumpHost(spec)
+					if err != nil {
+						return nil, errors.Annotatef(err, "logstream #%d, parsing ProxyJump", i+1)
+					}
+
+					ls.jumphosts = append(ls.jumphosts, jh)
+				}
+			}
+
+			ls.proxyCommand = hostConfig.ProxyCommand
 		}
 
-		hostname, _ := sshConfig.Get(name, "HostName")
-		port, _ := sshConfig.Get(name, "Port")
-		user, _ := sshConfig.Get(name, "User")
+		// Copy the jumphosts slice, since it might be shared between multiple
+		// logstreams.
+		jumphosts := make([]ConfigHost, 0, len(ls.jumphosts))
+		for _, jh := range ls.jumphosts {
+			if _, err := setHostSSHConfigDetails(&jh, sshConfig, osUser); err != nil {
+				return nil, errors.Annotatef(err, "logstream #%d, jumphost", i+1)
+			}
 
-		if hostname == "" && port == "" && user == "" {
-			// We can't get anything useful out of this entry anyway, so don't add it
-			continue
+			jumphosts = append(jumphosts, jh)
 		}
 
-		ret[name] = ConfigLogStream{
-			Hostname: hostname,
-			Port:     port,
-			User:     user,
+		if len(jumphosts) > 0 {
+			ls.jumphosts = jumphosts
 		}
+
+		ret = append(ret, ls)
 	}
 
 	return ret, nil
 }
+
+// setHostSSHConfigDetails fills in missing details of the host from the ssh
+// config, and returns the resolved ssh config for the host.
+func setHostSSHConfigDetails(
+	host *ConfigHost, sshConfig *SSHConfig, osUser string,
+) (*SSHHostConfig, error) {
+	addr, err := parseAddr(host.Addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing address")
+	}
+
+	hostConfig := sshConfig.Resolve(addr.host, host.User, osUser)
+
+	if hostConfig.HostName != "" {
+		addr.host = hostConfig.HostName
+	}
+
+	if addr.port == "" {
+		addr.port = hostConfig.Port
+	}
+
+	if host.User == "" {
+		host.User = hostConfig.User
+	}
+
+	host.Addr = fmt.Sprintf("%s:%s", addr.host, addr.port)
+	host.IdentityFiles = hostConfig.IdentityFiles
+
+	return &hostConfig, nil
+}
+
+// parseProxyJumpHost parses a single host from the ProxyJump option, like
+// "[user@]host[:port]".
+func parseProxyJumpHost(spec string) (ConfigHost, error) {
+	spec = strings.TrimSpace(spec)
+
+	var user string
+	if atIdx := strings.LastIndex(spec, "@"); atIdx >= 0 {
+		user = spec[:atIdx]
+		spec = spec[atIdx+1:]
+	}
+
+	parts := strings.Split(spec, ":")
+	if parts[0] == "" || len(parts) > 2 {
+		return ConfigHost{}, errors.Errorf("invalid jumphost %q", spec)
+	}
+
+	port := ""
+	if len(parts) == 2 {
+		port = parts[1]
+	}
+
+	return ConfigHost{
+		Addr: fmt.Sprintf("%s:%s", parts[0], port),
+		User: user,
+	}, nil
+}
@@ -4,20 +4,24 @@ import (
 	"bytes"
 	_ "embed"
 	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/dimonomid/ssh_config"
 	"github.com/stretchr/testify/assert"
 )
 
 //go:embed resolver_testdata/ssh_config_1
 var testSSHConfig1Str []byte
-var testSSHConfig1 *ssh_config.Config
+var testSSHConfig1 *SSHConfig
+
+// testSSHHomeDir is the home dir used for the test ssh configs.
+const testSSHHomeDir = "/home/testuser"
 
 func init() {
 	buf := bytes.NewBuffer(testSSHConfig1Str)
 	var err error
-	testSSHConfig1, err = ssh_config.Decode(buf, false)
+	testSSHConfig1, err = ParseSSHConfig(buf, testSSHHomeDir)
 	if err != nil {
 		panic(fmt.Sprintf("embedded ssh_config_1 is broken: %s", err.Error()))
 	}
@@ -94,7 +98,7 @@ type resolverTestCase struct {
 	osUser string
 
 	configLogStreams ConfigLogStreams
-	sshConfig        *ssh_config.Config
+	sshConfig        *SSHConfig
 
 	// input is the logstream spec string that we're feeding to Resolve()
 	input string
@@ -1402,8 +1406,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-01.com:3001",
-								User: "user-foo-from-ssh-config-01",
+								Addr:          "host-foo-from-ssh-config-01.com:3001",
+								User:          "user-foo-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1414,8 +1419,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-02.com:3002",
-								User: "user-foo-from-ssh-config-02",
+								Addr:          "host-foo-from-ssh-config-02.com:3002",
+								User:          "user-foo-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1457,8 +1463,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-01.com:3001",
-								User: "user-foo-from-ssh-config-01",
+								Addr:          "host-foo-from-ssh-config-01.com:3001",
+								User:          "user-foo-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1469,8 +1476,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-02.com:3002",
-								User: "user-foo-from-ssh-config-02",
+								Addr:          "host-foo-from-ssh-config-02.com:3002",
+								User:          "user-foo-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1481,8 +1489,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-bar-from-ssh-config-01.com:3001",
-								User: "user-bar-from-ssh-config-01",
+								Addr:          "host-bar-from-ssh-config-01.com:3001",
+								User:          "user-bar-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1493,8 +1502,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-bar-from-ssh-config-02.com:3002",
-								User: "user-bar-from-ssh-config-02",
+								Addr:          "host-bar-from-ssh-config-02.com:3002",
+								User:          "user-bar-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1555,8 +1565,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-01.com:3001",
-								User: "user-foo-from-ssh-config-01",
+								Addr:          "host-foo-from-ssh-config-01.com:3001",
+								User:          "user-foo-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1567,8 +1578,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-02.com:3002",
-								User: "user-foo-from-ssh-config-02",
+								Addr:          "host-foo-from-ssh-config-02.com:3002",
+								User:          "user-foo-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1610,8 +1622,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-ssh-config-02.com:3002",
-								User: "user-foo-from-ssh-config-02",
+								Addr:          "host-foo-from-ssh-config-02.com:3002",
+								User:          "user-foo-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1644,8 +1657,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "sshrealhost.com:4001",
-								User: "user-from-ssh-config",
+								Addr:          "sshrealhost.com:4001",
+								User:          "user-from-ssh-config",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1678,8 +1692,9 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-noport-from-ssh-config-01.com:22",
-								User: "user-noport-from-ssh-config-01",
+								Addr:          "host-noport-from-ssh-config-01.com:22",
+								User:          "user-noport-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1724,8 +1739,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-nerdlog-config-01.com:2001",
-								User: "user-foo-from-nerdlog-config-01",
+								Addr:          "host-foo-from-nerdlog-config-01.com:2001",
+								User:          "user-foo-from-nerdlog-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1736,8 +1752,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-foo-from-nerdlog-config-02.com:2002",
-								User: "user-foo-from-nerdlog-config-02",
+								Addr:          "host-foo-from-nerdlog-config-02.com:2002",
+								User:          "user-foo-from-nerdlog-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1785,8 +1802,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-bar-from-nerdlog-config-01.com:6001",
-								User: "user-bar-from-nerdlog-config-01",
+								Addr:          "host-bar-from-nerdlog-config-01.com:6001",
+								User:          "user-bar-from-nerdlog-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1797,8 +1815,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-bar-from-nerdlog-config-02.com:6002",
-								User: "user-bar-from-nerdlog-config-02",
+								Addr:          "host-bar-from-nerdlog-config-02.com:6002",
+								User:          "user-bar-from-nerdlog-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1844,8 +1863,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-baz-from-ssh-config-01.com:7001",
-								User: "user-baz-from-ssh-config-01",
+								Addr:          "host-baz-from-ssh-config-01.com:7001",
+								User:          "user-baz-from-ssh-config-01",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -1856,8 +1876,9 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-baz-from-ssh-config-02.com:7002",
-								User: "user-baz-from-ssh-config-02",
+								Addr:          "host-baz-from-ssh-config-02.com:7002",
+								User:          "user-baz-from-ssh-config-02",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -2050,8 +2071,9 @@ func TestLStreamsResolverShellInit(t *testing.T) {
 					Transport: ConfigLogStreamShellTransport{
 						SSHLib: &ConfigLogStreamShellTransportSSHLib{
 							Host: ConfigHost{
-								Addr: "host-with-shell-init.com:22",
-								User: "osuser",
+								Addr:          "host-with-shell-init.com:22",
+								User:          "osuser",
+								IdentityFiles: []string{"/home/testuser/.ssh/id_rsa"},
 							},
 						},
 					},
@@ -2088,3 +2110,552 @@ func TestLStreamsResolverShellInit(t *testing.T) {
 		})
 	}
 }
+
+func TestLStreamsResolverJumphost(t *testing.T) {
+	configLogStreams := ConfigLogStreams(map[string]ConfigLogStream{
+		"behind-bastion": ConfigLogStream{
+			Hostname: "internal-host.com",
+			Jumphost: &ConfigJumphost{
+				Hostname: "bastion-2.com",
+				User:     "user-bastion-2",
+				Jumphost: &ConfigJumphost{
+					Hostname: "bastion-1.com",
+					Port:     "2222",
+				},
+			},
+		},
+	})
+
+	tests := []resolverTestCase{
+		{
+			name:   "chained jumphosts from nerdlog config",
+			osUser: "osuser",
+
+			configLogStreams: configLogStreams,
+
+			input: "behind-bastion",
+
+			wantStreams: map[string]LogStream{
+				"behind-bastion": {
+					Name: "behind-bastion",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "internal-host.com:22",
+								User: "osuser",
+							},
+							Jumphosts: []ConfigHost{
+								{Addr: "bastion-1.com:2222", User: "osuser"},
+								{Addr: "bastion-2.com:22", User: "user-bastion-2"},
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"behind-bastion": {
+					Name: "behind-bastion",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host:      "internal-host.com",
+							Jumphosts: []string{"bastion-1.com:2222", "user-bastion-2@bastion-2.com"},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "repeated -J flags",
+			osUser: "osuser",
+
+			input: "myuser@myhost.com -J bastion-1.com:2222 -J jhuser@bastion-2.com",
+
+			wantStreams: map[string]LogStream{
+				"myuser@myhost.com -J bastion-1.com:2222 -J jhuser@bastion-2.com": {
+					Name: "myuser@myhost.com -J bastion-1.com:2222 -J jhuser@bastion-2.com",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "myhost.com:22",
+								User: "myuser",
+							},
+							Jumphosts: []ConfigHost{
+								{Addr: "bastion-1.com:2222", User: "osuser"},
+								{Addr: "bastion-2.com:22", User: "jhuser"},
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"myuser@myhost.com -J bastion-1.com:2222 -J jhuser@bastion-2.com": {
+					Name: "myuser@myhost.com -J bastion-1.com:2222 -J jhuser@bastion-2.com",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host:      "myhost.com",
+							User:      "myuser",
+							Jumphosts: []string{"bastion-1.com:2222", "jhuser@bastion-2.com"},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverSSHConfigDirectives(t *testing.T) {
+	homeDir, err := filepath.Abs(filepath.Join("resolver_testdata", "ssh_home"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sshConfig, err := ParseSSHConfigFile(filepath.Join(homeDir, ".ssh", "config"), homeDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []resolverTestCase{
+		{
+			name:   "glob with hosts from the included file",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshincluded-*",
+
+			wantStreams: map[string]LogStream{
+				"sshincluded-01": {
+					Name: "sshincluded-01",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-included-01.com:9001",
+								User: "user-included",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+				"sshincluded-02": {
+					Name: "sshincluded-02",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-included-02.com:22",
+								User: "user-included",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshincluded-01": {
+					Name: "sshincluded-01",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshincluded-01",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+				"sshincluded-02": {
+					Name: "sshincluded-02",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshincluded-02",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "match host against the resolved hostname",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshmatch-01",
+
+			wantStreams: map[string]LogStream{
+				"sshmatch-01": {
+					Name: "sshmatch-01",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-match-01.com:8022",
+								User: "default-user",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshmatch-01": {
+					Name: "sshmatch-01",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshmatch-01",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "match originalhost and user",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "admin@sshmatch-02",
+
+			wantStreams: map[string]LogStream{
+				"admin@sshmatch-02": {
+					Name: "admin@sshmatch-02",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-match-02-admin.com:22",
+								User: "admin",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"admin@sshmatch-02": {
+					Name: "admin@sshmatch-02",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshmatch-02",
+							User: "admin",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "match host against the hostname with tokens, and not canonical",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshmatch-03",
+
+			wantStreams: map[string]LogStream{
+				"sshmatch-03": {
+					Name: "sshmatch-03",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "sshmatch-03.example.com:8023",
+								User: "user-not-canonical",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshmatch-03": {
+					Name: "sshmatch-03",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshmatch-03",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "identity files with tokens, and from match user",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "deploy@sshidentity",
+
+			wantStreams: map[string]LogStream{
+				"deploy@sshidentity": {
+					Name: "deploy@sshidentity",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-identity.com:22",
+								User: "deploy",
+								IdentityFiles: []string{
+									filepath.Join(homeDir, ".ssh", "id_deploy"),
+									filepath.Join(homeDir, ".ssh", "id_identity"),
+									filepath.Join(homeDir, ".ssh", "id_deploy@host-identity.com"),
+								},
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"deploy@sshidentity": {
+					Name: "deploy@sshidentity",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshidentity",
+							User: "deploy",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "proxyjump, with the jumphosts resolved from ssh config too",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshproxyjump",
+
+			wantStreams: map[string]LogStream{
+				"sshproxyjump": {
+					Name: "sshproxyjump",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "internal-proxyjump.com:22",
+								User: "default-user",
+							},
+							Jumphosts: []ConfigHost{
+								{Addr: "bastion.com:2222", User: "jhuser"},
+								{Addr: "bastion-02.com:22", User: "user-bastion-02"},
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshproxyjump": {
+					Name: "sshproxyjump",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshproxyjump",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "proxycommand with tokens",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshproxycommand",
+
+			wantStreams: map[string]LogStream{
+				"sshproxycommand": {
+					Name: "sshproxycommand",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "internal-proxycommand.com:22",
+								User: "default-user",
+							},
+							ProxyCommand: "ssh -W internal-proxycommand.com:22 gateway.com",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshproxycommand": {
+					Name: "sshproxycommand",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshproxycommand",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "proxycommand with double quotes",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshproxycommand-quoted",
+
+			wantStreams: map[string]LogStream{
+				"sshproxycommand-quoted": {
+					Name: "sshproxycommand-quoted",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "internal-proxycommand.com:22",
+								User: "default-user",
+							},
+							ProxyCommand: `sh -c "nc internal-proxycommand.com 22"`,
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshproxycommand-quoted": {
+					Name: "sshproxycommand-quoted",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshproxycommand-quoted",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "proxycommand with single quotes and extra spaces",
+			osUser: "osuser",
+
+			sshConfig: sshConfig,
+
+			input: "sshproxycommand-single-quoted",
+
+			wantStreams: map[string]LogStream{
+				"sshproxycommand-single-quoted": {
+					Name: "sshproxycommand-single-quoted",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "sshproxycommand-single-quoted:22",
+								User: "default-user",
+							},
+							ProxyCommand: `ssh -o 'ProxyCommand none'  -W 'sshproxycommand-single-quoted:22' gateway.com`,
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"sshproxycommand-single-quoted": {
+					Name: "sshproxycommand-single-quoted",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "sshproxycommand-single-quoted",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverIndexResolution(t *testing.T) {
+	configLogStreams := ConfigLogStreams(map[string]ConfigLogStream{
+		"my-10s": ConfigLogStream{
+			Hostname: "host-10s.com",
+			Options: ConfigLogStreamOptions{
+				IndexResolution: "10s",
+			},
+		},
+		"my-7s": ConfigLogStream{
+			Hostname: "host-7s.com",
+			Options: ConfigLogStreamOptions{
+				IndexResolution: "7s",
+			},
+		},
+	})
+
+	tests := []resolverTestCase{
+		{
+			name:   "valid",
+			osUser: "osuser",
+
+			configLogStreams: configLogStreams,
+
+			input: "my-10s",
+
+			wantStreams: map[string]LogStream{
+				"my-10s": {
+					Name: "my-10s",
+					Transport: ConfigLogStreamShellTransport{
+						SSHLib: &ConfigLogStreamShellTransportSSHLib{
+							Host: ConfigHost{
+								Addr: "host-10s.com:22",
+								User: "osuser",
+							},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+					Options: LogStreamOptions{
+						IndexResolution: 10 * time.Second,
+					},
+				},
+			},
+			wantStreamsSSHBin: map[string]LogStream{
+				"my-10s": {
+					Name: "my-10s",
+					Transport: ConfigLogStreamShellTransport{
+						SSHBin: &ConfigLogStreamShellTransportSSHBin{
+							Host: "host-10s.com",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+					Options: LogStreamOptions{
+						IndexResolution: 10 * time.Second,
+					},
+				},
+			},
+		},
+		{
+			name:   "doesn't divide a minute",
+			osUser: "osuser",
+
+			configLogStreams: configLogStreams,
+
+			input: "my-7s",
+
+			wantErr: "parsing entry #1 (my-7s): expanding from nerdlog config: invalid index resolution 7s: must be a whole number of seconds which divides a minute, like 10s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
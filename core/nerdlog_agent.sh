@@ -12,7 +12,8 @@ trap 'echo "exit_code:$?"' EXIT
 
 # Arguments:
 #
-# --from, --to: time in the format "2006-01-02-15:04".
+# --from, --to: time in the format "2006-01-02-15:04", or with seconds:
+# "2006-01-02-15:04:05".
 
 # Those numbers are supposed to go up as the query progresses; the Go app
 # will then be able to tell which node is the slowest and show info for it.
@@ -28,8 +29,17 @@ SPECIAL_FILENAME_JOURNALCTL="journalctl"
 # 2025-04-27T21:31:11.670468+00:00 myhot systemd[1]: Something happened.
 JOURNALCTL_FORMAT_FLAG="--output=short-iso-precise"
 
+# INDEX_FORMAT_VERSION is stored in the index file as "index_version", and
+# must be bumped every time the index format changes incompatibly; an index
+# file with a different version is deleted and rebuilt from scratch.
+INDEX_FORMAT_VERSION=2
+
 indexfile=/tmp/nerdlog_agent_index
 
+# index_resolution is the granularity of the index and of the stats, in
+# seconds; see --index-resolution.
+index_resolution=60
+
 logfile_prev="${SPECIAL_FILENAME_AUTO}"
 logfile_last="${SPECIAL_FILENAME_AUTO}"
 
@@ -37,44 +47,98 @@ positional_args=()
 
 max_num_lines=100
 
+# order is either "desc" (the default: return the latest --max-num-lines
+# matching lines) or "asc" (return the earliest ones).
+order="desc"
+
+# If sample is non-empty, the matching lines are sampled, see --sample.
+sample=""
+
+# max_cpus and min_chunk_size limit the number of parallel awk workers, see
+# --max-cpus and --min-chunk-size.
+max_cpus=""
+min_chunk_size=$((32*1024*1024))
+
+# If max_read_rate is non-empty, the log files are read at most at this rate,
+# see --max-read-rate.
+max_read_rate=""
+
+# If awk_binary is non-empty, this awk is used instead of autodetecting it,
+# see --awk-binary.
+awk_binary=""
+
+# If sudo_method is non-empty, the commands which read the log files are run
+# with elevated privileges, see --sudo-method and elevate.
+sudo_method=""
+
+count_by_expr=""
+count_by_top=50
+
+num_agg_expr=""
+
+# If counts_only is non-empty, only the stats are printed, see --counts-only.
+counts_only=""
+
+# overlay_patterns are the awk patterns given with --overlay-pattern.
+overlay_patterns=()
+
+# prefilter_literals are the strings given with --prefilter-literal.
+prefilter_literals=()
+
 awktime_month='monthByName[substr($0, 1, 3)]'
 awktime_year='yearByMonth[month]'
 awktime_day='(substr($0, 5, 1) == " ") ? "0" substr($0, 6, 1) : substr($0, 5, 2)'
 awktime_hhmm='substr($0, 8, 5)'
 awktime_minute_key='substr($0, 1, 12)'
+awktime_second='substr($0, 14, 2)'
 # TODO: double check that if any of these is provided manually in a flag,
 # then all of them are provided manually.
 
-function find_gawk_binary() { # {{{
-  gawk_path="$(which gawk)"
-  if [[ $? == 0 ]]; then
-    if [ -x "$gawk_path" ]; then
-      awk_version_str="$($gawk_path --version)"
-      if [[ $? == 0 ]]; then
-        if echo "$awk_version_str" | grep -q 'GNU Awk'; then
-          # gawk works fine
-          echo "$gawk_path"
-          exit 0
-        fi
-      fi
-    fi
+# get_awk_kind prints the kind of the given awk binary: "gawk", "busybox",
+# "mawk" or "bsd"; the latter is used for everything else, since the BSD awk
+# (the one true awk) doesn't have any options to identify itself.
+function get_awk_kind() { # {{{
+  local awk_path="$1"
+
+  if "$awk_path" --version 2>/dev/null </dev/null | grep -q 'GNU Awk'; then
+    echo "gawk"
+  elif "$awk_path" --help 2>&1 </dev/null | grep -q 'BusyBox'; then
+    echo "busybox"
+  elif "$awk_path" -W version 2>&1 </dev/null | grep -q 'mawk'; then
+    echo "mawk"
+  else
+    echo "bsd"
   fi
+} # }}}
 
-  awk_path="$(which awk)"
-  if [[ $? == 0 ]]; then
-    if [ -x "$awk_path" ]; then
-      awk_version_str="$($awk_path --version)"
-      if [[ $? == 0 ]]; then
-        if echo "$awk_version_str" | grep -q 'GNU Awk'; then
-          # awk works fine
-          echo "$awk_path"
-          exit 0
-        fi
-      fi
+# find_awk_binary prints the path to the awk binary to use. GNU Awk is
+# preferred, but if it's not available, any other awk will do.
+function find_awk_binary() { # {{{
+  local candidate
+  local awk_path
+  local fallback_path=""
+
+  for candidate in gawk awk mawk nawk; do
+    awk_path="$(command -v $candidate)" || continue
+    if [ ! -x "$awk_path" ]; then
+      continue
     fi
+
+    if [[ "$(get_awk_kind "$awk_path")" == "gawk" ]]; then
+      echo "$awk_path"
+      return 0
+    fi
+
+    if [[ "$fallback_path" == "" ]]; then
+      fallback_path="$awk_path"
+    fi
+  done
+
+  if [[ "$fallback_path" == "" ]]; then
+    return 1
   fi
 
-  exit 1
+  echo "$fallback_path"
 } # }}}
 
 function detect_timezone() { # {{{
@@ -156,12 +220,34 @@ while [[ $# -gt 0 ]]; do
       shift # past argument
       shift # past value
       ;;
+
+    # --index-resolution is how many seconds a single index entry (and a single
+    # stats bucket) covers; it must divide 60. By default it's 60, i.e. a
+    # minute; smaller values make it possible to efficiently query narrow time
+    # ranges on hosts which write a lot of logs, at the cost of a larger index.
+    # The stats are then printed as "s:<minute key>,<second>,<count>", where
+    # the second is the start of the bucket within the minute.
+    --index-resolution)
+      index_resolution="$2"
+      shift # past argument
+      shift # past value
+      ;;
     -u|--lines-until)
       lines_until="$2"
       shift # past argument
       shift # past value
       ;;
 
+    # --lines-since is the opposite of --lines-until, used for the forward
+    # pagination: only logs AFTER this log line (not including it) will be
+    # output, and since we're paginating forward, those are the first
+    # --max-num-lines matching lines after it, not the last ones.
+    --lines-since)
+      lines_since="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
     # The 3 arguments below:
     # --timestamp-until-seconds, --timestamp-until-precise, --skip-n-latest
     # are needed specifically for pagination in journalctl.
@@ -259,15 +345,194 @@ while [[ $# -gt 0 ]]; do
       shift # past value
       ;;
 
+    # The 3 arguments below:
+    # --timestamp-since-seconds, --timestamp-since-precise, --skip-n-earliest
+    # are the counterparts of the 3 arguments above, used for the forward
+    # pagination in journalctl: the --timestamp-since-precise is the exact
+    # timestamp of the very latest message we have, --skip-n-earliest is how
+    # many messages we already have on this timestamp, and the
+    # --timestamp-since-seconds is the same timestamp rounded down to the whole
+    # second, which is passed to journalctl as --since. In this case,
+    # journalctl is called without the --reverse, so we first get the earliest
+    # messages, which we need to skip.
+    --timestamp-since-seconds)
+      timestamp_since_seconds="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --timestamp-since-precise)
+      timestamp_since_precise="$2"
+      if [[ "$skip_n_earliest" == "" ]]; then
+        skip_n_earliest=1
+      fi
+      shift # past argument
+      shift # past value
+      ;;
+    --skip-n-earliest)
+      skip_n_earliest="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
     --refresh-index)
       refresh_index="1"
       shift # past argument
       ;;
+
+    # If --context-lines is given, then instead of the regular query, the raw
+    # (unfiltered) lines around a single log line are printed: --context-lines
+    # lines before and after it. For log files, the line is identified by
+    # --context-linenr (the same line number as the "m:" lines have), and for
+    # journalctl, by the --context-timestamp-precise (with the same format as
+    # --timestamp-until-precise), and the --context-timestamp-since-seconds
+    # and --context-timestamp-until-seconds are the same timestamp rounded down
+    # and up to the whole second, to be passed to journalctl.
+    --context-lines)
+      context_lines="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --context-linenr)
+      context_linenr="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --context-timestamp-precise)
+      context_timestamp_precise="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --context-timestamp-since-seconds)
+      context_timestamp_since_seconds="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --context-timestamp-until-seconds)
+      context_timestamp_until_seconds="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # If --count-by-expr is given, then instead of printing the matching lines,
+    # we group them by the value of this awk expression (lines for which it
+    # evaluates to an empty string are not counted), and print the top
+    # --count-by-top values with their counts, as "cb:<count>:<value>", followed
+    # by "cb_rest:<count>" which is the sum of the counts of all other values.
+    --count-by-expr)
+      count_by_expr="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --count-by-top)
+      count_by_top="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # If --num-agg-expr is given, then for every matching line we evaluate this
+    # awk expression (lines for which it evaluates to an empty string are
+    # skipped), and calculate per-minute stats of the resulting numbers, which
+    # are printed as
+    # "na:<minute key>,<count>,<sum>,<min>,<max>,<num non-positive>,<buckets>",
+    # where buckets look like "72:1;73:3", see awk_func_num_agg for details.
+    --num-agg-expr)
+      num_agg_expr="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --counts-only makes the agent skip collecting and printing the matching
+    # lines: only the per-minute stats (and the overlay stats, if any) are
+    # printed, which is faster and uses much less traffic.
+    --counts-only)
+      counts_only="1"
+      shift # past argument
+      ;;
+
+    # --overlay-pattern can be given multiple times; for every pattern, the
+    # lines in the time range which match it are counted per minute (regardless
+    # of the main pattern), and printed as "o:<minute key>,<idx>,<count>",
+    # where idx is the 0-based index of the pattern in the order given.
+    --overlay-pattern)
+      overlay_patterns+=("$2")
+      shift # past argument
+      shift # past value
+      ;;
+
+    # When scanning a large part of the logs, the agent splits it into chunks
+    # (at the index entries), and runs an awk worker for every chunk in
+    # parallel, then merges the results. The number of workers is limited by
+    # the number of CPUs, --max-cpus (if given), and by --min-chunk-size (in
+    # bytes): every chunk is at least that large.
+    --max-cpus)
+      max_cpus="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --min-chunk-size)
+      min_chunk_size="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --max-read-rate limits how fast the log files are read (in bytes per
+    # second), both for indexing and querying, so that we don't hog the IO on
+    # an already struggling host. It needs "pv"; if it's not available, the
+    # rate isn't limited, and "read_rate_ignored:" is printed to let the user
+    # know.
+    --max-read-rate)
+      max_read_rate="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --awk-binary specifies the awk to use, instead of autodetecting it. It
+    # can be any of gawk, mawk, busybox awk or BSD awk.
+    --awk-binary)
+      awk_binary="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --sudo-method enables the granular sudo mode: the agent itself runs as
+    # the regular user, but the commands which read the log files (tail, head
+    # and cat) are run with either "sudo" (passwordless), "sudo_password" (the
+    # password is read from the fd 3) or "doas".
+    --sudo-method)
+      sudo_method="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --prefilter-literal can be given multiple times; it's an optimization
+    # hint: every line matching the pattern is guaranteed to contain all these
+    # strings literally, so we can drop the other lines with a cheap
+    # "grep -F" before they hit awk. The lines which pass it are still checked
+    # against the pattern as usual.
+    --prefilter-literal)
+      prefilter_literals+=("$2")
+      shift # past argument
+      shift # past value
+      ;;
+
     -l|--max-num-lines)
       max_num_lines="$2"
       shift # past argument
       shift # past value
       ;;
+    --order)
+      order="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # --sample makes the agent return up to --max-num-lines matching lines
+    # spread evenly across all the matching lines in the time range, instead
+    # of the latest (or earliest) ones.
+    --sample)
+      sample="1"
+      shift # past argument
+      ;;
 
     --awktime-month)
       awktime_month="$2"
@@ -294,6 +559,11 @@ while [[ $# -gt 0 ]]; do
       shift # past argument
       shift # past value
       ;;
+    --awktime-second)
+      awktime_second="$2"
+      shift # past argument
+      shift # past value
+      ;;
 
     -*|--*)
       echo "Unknown option $1" 1>&2
@@ -325,6 +595,126 @@ if [[ $timestamp_until_precise != "" || $timestamp_until_seconds != "" || $skip_
   fi
 fi
 
+if [[ $timestamp_since_precise != "" || $timestamp_since_seconds != "" || $skip_n_earliest != "" ]]; then
+  if [[ "$timestamp_since_precise" == "" ]]; then
+    echo "error:--timestamp-since-seconds, --timestamp-since-precise, --skip-n-earliest should all be given together, but --timestamp-since-precise is not set" 1>&2
+    exit 1
+  fi
+
+  if [[ "$timestamp_since_seconds" == "" ]]; then
+    echo "error:--timestamp-since-seconds, --timestamp-since-precise, --skip-n-earliest should all be given together, but --timestamp-since-seconds is not set" 1>&2
+    exit 1
+  fi
+
+  if [[ "$skip_n_earliest" == "" ]]; then
+    echo "error:--timestamp-since-seconds, --timestamp-since-precise, --skip-n-earliest should all be given together, but --skip-n-earliest is not set" 1>&2
+    exit 1
+  fi
+fi
+
+if [[ "$context_lines" != "" ]]; then
+  if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
+    if [[ "$context_timestamp_precise" == "" || "$context_timestamp_since_seconds" == "" || "$context_timestamp_until_seconds" == "" ]]; then
+      echo "error:with journalctl, --context-lines requires --context-timestamp-precise, --context-timestamp-since-seconds and --context-timestamp-until-seconds" 1>&2
+      exit 1
+    fi
+  elif [[ "$context_linenr" == "" ]]; then
+    echo "error:--context-lines requires --context-linenr" 1>&2
+    exit 1
+  fi
+fi
+
+if [[ "$order" != "desc" && "$order" != "asc" ]]; then
+  echo "error:invalid --order $order, should be either asc or desc" 1>&2
+  exit 1
+fi
+
+if ! [[ "$index_resolution" =~ ^[0-9]+$ ]] || (( index_resolution < 1 || index_resolution > 60 || 60 % index_resolution != 0 )); then
+  echo "error:invalid --index-resolution $index_resolution, should be a number of seconds which divides 60" 1>&2
+  exit 1
+fi
+
+for timestr in "$from" "$to"; do
+  if [[ "$timestr" != "" ]] && ! [[ "$timestr" =~ ^[0-9]{4}-[0-9]{2}-[0-9]{2}-[0-9]{2}:[0-9]{2}(:[0-9]{2})?$ ]]; then
+    echo "error:invalid time $timestr, should be either 2006-01-02-15:04 or 2006-01-02-15:04:05" 1>&2
+    exit 1
+  fi
+done
+
+# Prints the given timestr like "2006-01-02-15:04" or "2006-01-02-15:04:05"
+# rounded down to the $index_resolution, in the same form as it's stored in
+# the index: without seconds if the resolution is a minute, and with seconds
+# otherwise.
+function timestr_to_index_key() { # {{{
+  local timestr="$1"
+  if [[ "$index_resolution" == "60" ]]; then
+    echo "${timestr:0:16}"
+    return
+  fi
+
+  local seconds="${timestr:17:2}"
+  printf "%s:%02d\n" "${timestr:0:16}" $(( 10#${seconds:-0} / index_resolution * index_resolution ))
+} # }}}
+
+# Returns success if the given timestr is on the $index_resolution grid, so
+# that the index alone is enough to find the exact place in the logs.
+function is_timestr_on_index_grid() { # {{{
+  local seconds="${1:17:2}"
+  (( 10#${seconds:-0} % index_resolution == 0 ))
+} # }}}
+
+# from_idx and to_idx are the keys to look up in the index; if the --from or
+# --to is not on the index grid, then the awk script also filters the lines
+# by the precise time: from_precise and to_precise, which always have seconds.
+from_idx=""
+from_precise=""
+if [[ "$from" != "" ]]; then
+  from_idx="$(timestr_to_index_key "$from")"
+  if ! is_timestr_on_index_grid "$from"; then
+    from_precise="$from"
+  fi
+fi
+
+# Since the --to is exclusive, when it's not on the grid, we need the first
+# index entry after the to_idx (to_idx_strict).
+to_idx=""
+to_idx_strict=""
+to_precise=""
+if [[ "$to" != "" ]]; then
+  to_idx="$(timestr_to_index_key "$to")"
+  if ! is_timestr_on_index_grid "$to"; then
+    to_idx_strict="1"
+    to_precise="$to"
+  fi
+fi
+
+# awk_index_key is an awk expression to get the key of the index bucket
+# within the day: "15:04" or, with sub-minute resolution, "15:04:05", where
+# seconds are rounded down to the resolution. Similarly, awk_stats_key_suffix
+# is appended to the minute key to get the key for the stats.
+awk_index_key='('"$awktime_hhmm"')'
+awk_stats_key_suffix=''
+if (( index_resolution < 60 )); then
+  awk_bucket_second='sprintf("%02d", int(('"$awktime_second"') / '$index_resolution') * '$index_resolution')'
+  awk_index_key+=' ":" '"$awk_bucket_second"
+  awk_stats_key_suffix=' "," '"$awk_bucket_second"
+fi
+
+if [[ "$sample" != "" && ( "$lines_until" != "" || "$timestamp_until_precise" != "" || "$lines_since" != "" || "$timestamp_since_precise" != "" ) ]]; then
+  echo "error:--sample can't be used together with --lines-until, --lines-since, --timestamp-until-* or --timestamp-since-*" 1>&2
+  exit 1
+fi
+
+if [[ "$sample" != "" && "$counts_only" != "" ]]; then
+  echo "error:--sample can't be used together with --counts-only" 1>&2
+  exit 1
+fi
+
+if [[ ( "$lines_until" != "" || "$timestamp_until_precise" != "" ) && ( "$lines_since" != "" || "$timestamp_since_precise" != "" ) ]]; then
+  echo "error:--lines-until and --timestamp-until-* can't be used together with --lines-since and --timestamp-since-*" 1>&2
+  exit 1
+fi
+
 # Either use the provided current year and month (for tests), or get the actual ones.
 if [[ "$CUR_YEAR" == "" ]]; then
   CUR_YEAR="$(date +'%Y')"
@@ -334,15 +724,134 @@ if [[ "$CUR_MONTH" == "" ]]; then
   CUR_MONTH="$(date +'%m')"
 fi
 
-# TODO: instead of always detecting it, add support for the --awk-binary flag,
-# and only autodetect if it wasn't provided. Also, gotta always do this during
-# logstream_info command.
-awk_binary="$(find_gawk_binary)"
-if [[ $? != 0 ]]; then
-  echo "error:gawk (GNU Awk) is a requirement, but not found on the system. Please install it, then retry" 1>&2
+# Same for the number of CPUs.
+if [[ "$NUM_CPUS" == "" ]]; then
+  NUM_CPUS="$(nproc 2>/dev/null || getconf _NPROCESSORS_ONLN 2>/dev/null || echo 1)"
+fi
+
+case "$sudo_method" in
+  ""|sudo|sudo_password|doas)
+    ;;
+  *)
+    echo "error:invalid sudo method $sudo_method" 1>&2
+    exit 1
+    ;;
+esac
+
+# With sudo_password, the password is read from the fd 3 once, and is kept in
+# a non-exported variable, so that only elevate passes it to sudo.
+sudo_password=""
+if [[ "$sudo_method" == "sudo_password" ]]; then
+  if ! IFS= read -r sudo_password <&3 2>/dev/null; then
+    echo "error:no sudo password given on the fd 3" 1>&2
+    exit 1
+  fi
+  exec 3<&-
+fi
+
+# elevate runs the given command with the privileges configured by
+# --sudo-method, or just runs it as is if there's no --sudo-method. The command
+# must not read stdin: with sudo_password, if sudo has cached credentials, it
+# wouldn't read the password, and it'd be left on the stdin of the command; so
+# the password is only piped to sudo if "sudo -n -v" fails, and otherwise the
+# command gets its stdin from /dev/null.
+function elevate() { # {{{
+  case "$sudo_method" in
+    sudo)
+      sudo -n "$@"
+      ;;
+    sudo_password)
+      if sudo -n -v >/dev/null 2>&1; then
+        sudo -n "$@" </dev/null
+      else
+        printf '%s\n' "$sudo_password" | sudo -S -p '' "$@"
+      fi
+      ;;
+    doas)
+      doas -n "$@"
+      ;;
+    *)
+      "$@"
+      ;;
+  esac
+} # }}}
+
+# elevate_prefix is the same as elevate, but for the commands which are
+# evaluated from strings, see gen_cmds_for_range.
+elevate_prefix=""
+if [[ "$sudo_method" != "" ]]; then
+  elevate_prefix="elevate "
+fi
+
+if [[ "$awk_binary" == "" ]]; then
+  awk_binary="$(find_awk_binary)"
+  if [[ $? != 0 ]]; then
+    echo "error:awk is a requirement, but not found on the system. Please install it (preferably gawk), then retry" 1>&2
+    exit 1
+  fi
+elif ! command -v "$awk_binary" > /dev/null 2>&1; then
+  echo "error:awk binary $awk_binary is not found" 1>&2
   exit 1
 fi
 
+awk_kind="$(get_awk_kind "$awk_binary")"
+
+# run_awk runs awk in a way that works the same for all the supported awks:
+#
+# - In the bytes mode, so that length() and friends work with bytes, not
+#   characters (we rely on that to calculate byte offsets). gawk has the -b
+#   option for that; the other awks either don't support multibyte characters
+#   at all, or do it depending on the locale, so just use the C locale for them.
+# - Making sure that big integers, like byte offsets in files larger than 2GB,
+#   are printed in full: e.g. mawk would otherwise print 1.09951e+12 instead of
+#   1099511627776.
+function run_awk() { # {{{
+  if [[ "$awk_kind" == "gawk" ]]; then
+    "$awk_binary" -b "$@"
+  else
+    LC_ALL=C "$awk_binary" -v CONVFMT=%.15g -v OFMT=%.15g "$@"
+  fi
+} # }}}
+
+use_read_rate=""
+if [[ "$max_read_rate" != "" ]]; then
+  if command -v pv >/dev/null 2>&1; then
+    use_read_rate="1"
+  else
+    echo "read_rate_ignored:pv is not available" 1>&2
+  fi
+fi
+
+# read_rate_divisor is the number of read_logfile calls running at the same time
+# (e.g. by the parallel workers), so that the total rate is still at most
+# $max_read_rate.
+read_rate_divisor=1
+
+# read_logfile prints the given file (or stdin, if no file is given), but if
+# --max-read-rate was given, then it's done at most at that rate.
+function read_logfile() { # {{{
+  # With --sudo-method, only cat may read the files, so the rest is done on
+  # its output.
+  if [[ $# -gt 0 && "$sudo_method" != "" ]]; then
+    elevate cat "$@" | read_logfile
+    local codes=(${PIPESTATUS[@]})
+    [[ ${codes[0]} == 0 && ${codes[1]} == 0 ]]
+    return $?
+  fi
+
+  if [[ "$use_read_rate" == "" ]]; then
+    cat "$@"
+    return $?
+  fi
+
+  local rate=$(( max_read_rate / read_rate_divisor ))
+  if (( rate < 1 )); then
+    rate=1
+  fi
+
+  pv -q -L "$rate" "$@"
+} # }}}
+
 # Use either a real journalctl, or a mocked one.
 journalctl_binary="journalctl"
 if [[ "${NERDLOG_JOURNALCTL_MOCK}" != "" ]]; then
@@ -426,6 +935,11 @@ fi
 case "${command}" in
   query)
     shift
+
+    # Refresh the modification time of the files we use, so that cleanups from
+    # other nerdlog sessions know that they're still in use.
+    touch -c "$0" "$indexfile" 2>/dev/null
+
     # Will be handled below.
     ;;
 
@@ -443,7 +957,12 @@ case "${command}" in
         exit 1
       fi
 
-      if [ ! -r ${logfile_last} ]; then
+      if [[ "$sudo_method" != "" ]]; then
+        if ! elevate head -c 0 ${logfile_last} > /dev/null 2>&1; then
+          echo "error:${logfile_last} exists but is not readable with --sudo-method $sudo_method, check your sudoers config" 1>&2
+          exit 1
+        fi
+      elif [ ! -r ${logfile_last} ]; then
         echo "error:${logfile_last} exists but is not readable, check your permissions" 1>&2
         exit 1
       fi
@@ -453,7 +972,12 @@ case "${command}" in
         exit 1
       fi
 
-      if [ ! -r ${logfile_prev} ]; then
+      if [[ "$sudo_method" != "" ]]; then
+        if ! elevate head -c 0 ${logfile_prev} > /dev/null 2>&1; then
+          echo "error:${logfile_prev} exists but is not readable with --sudo-method $sudo_method, check your sudoers config" 1>&2
+          exit 1
+        fi
+      elif [ ! -r ${logfile_prev} ]; then
         echo "error:${logfile_prev} exists but is not readable, check your permissions" 1>&2
         exit 1
       fi
@@ -461,14 +985,14 @@ case "${command}" in
       # Print a bunch of example log lines, so that the client can autodetect the
       # format.
       if [ -s ${logfile_last} ]; then
-        last_line="$(tail -n 1 ${logfile_last})" || exit 1
-        first_line="$(head -n 1 ${logfile_last})" || exit 1
+        last_line="$(elevate tail -n 1 ${logfile_last})" || exit 1
+        first_line="$(elevate head -n 1 ${logfile_last})" || exit 1
         echo "example_log_line:$last_line"
         echo "example_log_line:$first_line"
       fi
       if [ -s ${logfile_prev} ]; then
-        last_line="$(tail -n 1 ${logfile_prev})" || exit 1
-        first_line="$(head -n 1 ${logfile_prev})" || exit 1
+        last_line="$(elevate tail -n 1 ${logfile_prev})" || exit 1
+        first_line="$(elevate head -n 1 ${logfile_prev})" || exit 1
         echo "example_log_line:$last_line"
         echo "example_log_line:$first_line"
       fi
@@ -518,6 +1042,450 @@ function printPercentage(numCur, numTotal) {
 }
 '
 
+# Prints the top N values collected in the countBy array, the most frequent
+# first (and if the counts are equal, sorted by value, to make the output
+# deterministic), followed by the sum of the counts of all other values.
+#
+# It would be easier with the gawk-specific PROCINFO["sorted_in"], but to
+# support other awks, we maintain the sorted top N values manually.
+awk_func_print_count_by='
+function countByBefore(k1, k2) {
+  if (countBy[k1] != countBy[k2]) {
+    return countBy[k1] > countBy[k2];
+  }
+
+  return k1 < k2;
+}
+
+function printCountBy(topN,    k, i, j, n, top, restSum) {
+  n = 0;
+  restSum = 0;
+
+  for (k in countBy) {
+    # Find the position for k among the current top values.
+    i = n;
+    while (i >= 1 && countByBefore(k, top[i])) {
+      i--;
+    }
+
+    if (i >= topN) {
+      restSum += countBy[k];
+      continue;
+    }
+
+    # If the top is full already, the last value goes to the rest.
+    if (n == topN) {
+      restSum += countBy[top[n]];
+      n--;
+    }
+
+    for (j = n; j > i; j--) {
+      top[j+1] = top[j];
+    }
+    top[i+1] = k;
+    n++;
+  }
+
+  for (i = 1; i <= n; i++) {
+    print "cb:" countBy[top[i]] ":" top[i];
+  }
+
+  print "cb_rest:" restSum;
+}
+'
+
+# Helper functions for the awk code generated on the Go side (structured
+# queries, count by and numeric aggregation), which help to avoid using
+# gawk-specific features like gensub or match with the array argument.
+#
+# nlMatchGroup(s, re, idx, pre, grp, suf) returns the capture group idx (which
+# is either 0 for the whole match, or 1 for the first group) of the regex re
+# matched against s, or an empty string if it doesn't match. Non-GNU awks can't
+# return capture groups, so for them the regex is also given split into the
+# parts before the group, the group itself and after the group; we find the
+# whole match first, and then find where exactly the group is in it. If the
+# regex can't be split (grp is empty), the whole match is returned.
+awk_func_nl_match_group='
+function nlMatchGroup(s, re, idx, pre, grp, suf,    m, n, i, j) {
+  if (!match(s, re)) {
+    return "";
+  }
+
+  m = substr(s, RSTART, RLENGTH);
+  if (idx == 0 || grp == "") {
+    return m;
+  }
+
+  n = length(m);
+  for (i = 1; i <= n+1; i++) {
+    if (substr(m, 1, i-1) !~ ("^" pre "$")) {
+      continue;
+    }
+
+    for (j = n+1; j >= i; j--) {
+      if (substr(m, i, j-i) ~ ("^(" grp ")$") && substr(m, j) ~ ("^" suf "$")) {
+        return substr(m, i, j-i);
+      }
+    }
+  }
+
+  return "";
+}
+'
+if [[ "$awk_kind" == "gawk" ]]; then
+  awk_func_nl_match_group='
+function nlMatchGroup(s, re, idx, pre, grp, suf,    m) {
+  return match(s, re, m) ? m[idx] : "";
+}
+'
+fi
+
+awk_func_nl_helpers='
+'$awk_func_nl_match_group'
+
+# nlProgram returns the syslog program name from the field like "foo[123]:".
+function nlProgram(s) {
+  sub(/(\[[0-9]+\])?:$/, "", s);
+  return s;
+}
+
+# nlPID returns the pid from the field like "foo[123]:", or an empty string.
+function nlPID(s) {
+  return match(s, /\[[0-9]+\]:$/) ? substr(s, RSTART+1, RLENGTH-3) : "";
+}
+
+# nlKeyValue returns the value from the key=value pair in s, where keyRe is a
+# regex matching the key; if the value is in double quotes, they are stripped.
+function nlKeyValue(s, keyRe,    v) {
+  if (!match(s, "(^|[ \t])" keyRe "=(\"[^\"]*\"|[^ \t]*)")) {
+    return "";
+  }
+
+  v = substr(s, RSTART, RLENGTH);
+  sub(/^[^=]*=/, "", v);
+  gsub(/^"|"$/, "", v);
+  return v;
+}
+'
+
+# Accounts the value v in the numeric aggregation stats for the given minute
+# key. Besides count, sum, min and max, we also maintain a log-scale histogram
+# of positive values, so that the percentiles can be approximated (and merged
+# across minutes and logstreams) on the Go side: bucket i covers values in the
+# range [1.1^i, 1.1^(i+1)). NOTE: this 1.1 must be in sync with
+# NumAggBucketGamma in core/num_agg.go.
+#
+# Bucket indices for every minute key are also remembered in numAggBucketList,
+# so that we do not have to iterate all buckets for every minute key when
+# printing.
+awk_func_num_agg='
+function numAggAdd(key, v,    b, bi) {
+  if (!(key in numAggCnt)) {
+    numAggMin[key] = v;
+    numAggMax[key] = v;
+  }
+
+  numAggCnt[key]++;
+  numAggSum[key] += v;
+  if (v < numAggMin[key]) {
+    numAggMin[key] = v;
+  }
+  if (v > numAggMax[key]) {
+    numAggMax[key] = v;
+  }
+
+  if (v <= 0) {
+    numAggNonPos[key]++;
+    return;
+  }
+
+  b = log(v) / log(1.1);
+  bi = int(b);
+  if (bi > b) {
+    bi--;
+  }
+
+  if (!((key, bi) in numAggBuckets)) {
+    numAggBucketList[key] = numAggBucketList[key] (numAggBucketList[key] == "" ? "" : ";") bi;
+  }
+  numAggBuckets[key, bi]++;
+}
+
+function printNumAgg(    key, n, i, bucketIdxs, buckets) {
+  for (key in numAggCnt) {
+    buckets = "";
+    n = split(numAggBucketList[key], bucketIdxs, ";");
+    for (i = 1; i <= n; i++) {
+      buckets = buckets (i > 1 ? ";" : "") bucketIdxs[i] ":" numAggBuckets[key, bucketIdxs[i]];
+    }
+
+    printf "na:%s,%d,%.10g,%.10g,%.10g,%d,%s\n", key, numAggCnt[key], numAggSum[key], numAggMin[key], numAggMax[key], numAggNonPos[key], buckets;
+  }
+}
+'
+
+# If --num-agg-expr is given, awk_num_agg_check is injected in the awk script
+# right after a matching line is accounted in the stats (it expects the
+# curMinKey to be set), and awk_num_agg_print is injected in the END block,
+# right after the stats are printed.
+awk_num_agg_check=''
+awk_num_agg_print=''
+if [[ "$num_agg_expr" != "" ]]; then
+  awk_num_agg_check='
+    numAggVal = ('"$num_agg_expr"');
+    if (numAggVal != "") {
+      numAggAdd(curMinKey, numAggVal + 0);
+    }
+  '
+  awk_num_agg_print="printNumAgg();"
+fi
+
+# If --counts-only is given, awk_counts_only_check is injected in the awk
+# script right after a matching line is accounted in the stats, so that the
+# line is not remembered for printing.
+awk_counts_only_check=''
+if [[ "$counts_only" != "" ]]; then
+  awk_counts_only_check='next;'
+fi
+
+# If --overlay-pattern is given, awk_overlays_check is injected in the awk
+# script before the main pattern check, so that all the lines in the time
+# range are checked against every overlay pattern; and awk_overlays_print is
+# injected in the END block, right after the stats are printed.
+awk_overlays_check=''
+awk_overlays_print=''
+if [[ ${#overlay_patterns[@]} -gt 0 ]]; then
+  awk_overlays_check='{ overlayMinKey = '"$awktime_minute_key"';'
+  for i in "${!overlay_patterns[@]}"; do
+    awk_overlays_check+='
+    if ('"${overlay_patterns[$i]}"') { overlayStats[overlayMinKey'"$awk_stats_key_suffix"' "," '$i']++; }'
+  done
+  awk_overlays_check+='
+  }'
+
+  awk_overlays_print='
+    for (x in overlayStats) {
+      print "o:" x "," overlayStats[x]
+    }
+  '
+fi
+
+# grep_literals reads the lines from stdin and prints the ones which contain
+# all the given strings, prefixed with "<line number>:<byte offset>:" (like
+# "grep -n -b" does), where both are relative to stdin; line numbers are
+# 1-based, byte offsets are 0-based. Unlike grep, it doesn't fail if nothing
+# matches.
+function grep_literals() { # {{{
+  local literal="$1"
+  shift
+
+  if [[ $# == 0 ]]; then
+    LC_ALL=C grep -a -F -n -b -e "$literal" || [[ $? == 1 ]]
+    return $?
+  fi
+
+  # Only the first grep adds the prefix, so the next ones might match it too,
+  # but it's fine: it only means that some extra lines get through, and the
+  # awk script checks them against the actual pattern anyway.
+  LC_ALL=C grep -a -F -n -b -e "$literal" | grep_literals_more "$@"
+  local codes=(${PIPESTATUS[@]})
+  [[ ${codes[0]} == 0 || ${codes[0]} == 1 ]] && [[ ${codes[1]} == 0 ]]
+} # }}}
+
+function grep_literals_more() { # {{{
+  local literal="$1"
+  shift
+
+  if [[ $# == 0 ]]; then
+    LC_ALL=C grep -a -F -e "$literal" || [[ $? == 1 ]]
+    return $?
+  fi
+
+  LC_ALL=C grep -a -F -e "$literal" | grep_literals_more "$@"
+  local codes=(${PIPESTATUS[@]})
+  [[ ${codes[0]} == 0 || ${codes[0]} == 1 ]] && [[ ${codes[1]} == 0 ]]
+} # }}}
+
+# If --prefilter-literal is given, the lines are prefiltered with
+# grep_literals before they hit awk, which is a lot faster when the pattern
+# filters out most of the lines. In this case, the lines come to awk with the
+# "<line number>:<byte offset>:" prefix, so awk_prefilter_parse (injected
+# before anything else) strips it, and awk_lnr is the awk expression for the
+# line number (relative to the awk input without the prefiltering). Also,
+# since there are way fewer lines to go through, we check the percentage on
+# every line, see awk_percentage_cond.
+#
+# We can't prefilter if there are overlays though, since those need to see
+# all the lines in the time range; and we don't prefilter journalctl output,
+# since it's a different code path altogether. Also, we double check that the
+# grep supports all the flags we need; e.g. some busybox builds don't have -b.
+use_prefilter=""
+awk_prefilter_parse=''
+awk_lnr='NR'
+awk_lines_descr='lines'
+awk_percentage_cond='NR % 100 == 0'
+if [[ ${#prefilter_literals[@]} -gt 0 && ${#overlay_patterns[@]} == 0 && "$logfile_last" != "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
+  if [[ "$(echo foo | grep_literals foo 2>/dev/null)" == "1:0:foo" ]]; then
+    use_prefilter="1"
+    awk_prefilter_parse='
+    {
+      prefixLen = index($0, ":");
+      lnr = substr($0, 1, prefixLen-1) + 0;
+      $0 = substr($0, prefixLen+1);
+
+      prefixLen = index($0, ":");
+      bytenr = substr($0, 1, prefixLen-1) + 1;
+      $0 = substr($0, prefixLen+1);
+    }
+    '
+    awk_lnr='lnr'
+    awk_lines_descr='prefiltered lines'
+    awk_percentage_cond=''
+  else
+    echo "debug:grep doesn't support the flags needed for prefiltering, not using it" 1>&2
+  fi
+fi
+
+# If --count-by-expr is given, awk_count_by_check is injected in the awk
+# script right after a matching line is accounted in the stats: instead of
+# remembering the line, we only count its value. And awk_count_by_print is
+# injected at the very end, to print the results.
+awk_count_by_check=''
+awk_count_by_print=''
+if [[ "$count_by_expr" != "" ]]; then
+  awk_count_by_check='
+    countByKey = ('"$count_by_expr"');
+    if (countByKey != "") {
+      countBy[countByKey]++;
+    }
+    next;
+  '
+  awk_count_by_print="printCountBy($count_by_top);"
+fi
+
+# awk_func_sample implements the sampling (--sample): every matching line is
+# passed to sampleAdd, which keeps every sampleStride-th of them. Once there
+# are 2*maxlines lines kept, every other one is dropped and the stride is
+# doubled, so the kept lines are always spread evenly, and their order is
+# preserved. In the end, sampleIdx picks maxlines of them, also evenly.
+awk_func_sample='
+function sampleAdd(line, nr,    i) {
+  if (sampleStride == 0) {
+    sampleStride = 1;
+  }
+
+  numSampleCandidates++;
+  if (numSampleCandidates % sampleStride != 0) {
+    return;
+  }
+
+  sampleLines[numSampled] = line;
+  sampleNRs[numSampled] = nr;
+  numSampled++;
+
+  if (numSampled >= 2*maxlines) {
+    for (i = 0; i < maxlines; i++) {
+      sampleLines[i] = sampleLines[2*i+1];
+      sampleNRs[i] = sampleNRs[2*i+1];
+    }
+
+    numSampled = maxlines;
+    sampleStride *= 2;
+  }
+}
+
+function sampleNum() {
+  return numSampled < maxlines ? numSampled : maxlines;
+}
+
+function sampleIdx(i) {
+  if (numSampled <= maxlines) {
+    return i;
+  }
+
+  return int((i+1)*numSampled/maxlines) - 1;
+}
+'
+
+# If --sample is given, awk_sample_check is injected in the awk script instead
+# of remembering the line for printing.
+awk_sample_check=''
+if [[ "$sample" != "" ]]; then
+  awk_sample_check='
+    sampleAdd($0, '$awk_lnr');
+    next;
+  '
+fi
+
+# awk_vars initializes monthByName and yearByMonth, which are used by the
+# default awktime_month and awktime_year expressions; it must be injected in
+# the BEGIN block, and it requires awk_func_infer_year.
+awk_vars='
+  monthByName["Jan"] = "01";
+  monthByName["Feb"] = "02";
+  monthByName["Mar"] = "03";
+  monthByName["Apr"] = "04";
+  monthByName["May"] = "05";
+  monthByName["Jun"] = "06";
+  monthByName["Jul"] = "07";
+  monthByName["Aug"] = "08";
+  monthByName["Sep"] = "09";
+  monthByName["Oct"] = "10";
+  monthByName["Nov"] = "11";
+  monthByName["Dec"] = "12";
+
+  curYear = '${CUR_YEAR}';
+  curMonth = '${CUR_MONTH}';
+
+  yearByMonth["01"] = inferYear(1, curYear, curMonth) "";
+  yearByMonth["02"] = inferYear(2, curYear, curMonth) "";
+  yearByMonth["03"] = inferYear(3, curYear, curMonth) "";
+  yearByMonth["04"] = inferYear(4, curYear, curMonth) "";
+  yearByMonth["05"] = inferYear(5, curYear, curMonth) "";
+  yearByMonth["06"] = inferYear(6, curYear, curMonth) "";
+  yearByMonth["07"] = inferYear(7, curYear, curMonth) "";
+  yearByMonth["08"] = inferYear(8, curYear, curMonth) "";
+  yearByMonth["09"] = inferYear(9, curYear, curMonth) "";
+  yearByMonth["10"] = inferYear(10, curYear, curMonth) "";
+  yearByMonth["11"] = inferYear(11, curYear, curMonth) "";
+  yearByMonth["12"] = inferYear(12, curYear, curMonth) "";
+'
+
+awk_func_infer_year='
+function inferYear(logMonth, curYear, curMonth) {
+  delta = logMonth - curMonth
+
+  if (delta <= -11)       # log month is Jan, current is Dec -> next year
+    return curYear + 1
+  else if (delta >= 8)    # log month is Sep-Dec, current is Jan -> previous year
+    return curYear - 1
+  else
+    return curYear
+}
+'
+
+# If the --from or --to are not on the index grid, awk_time_range_check is
+# injected in the awk script before anything else, to filter out the lines
+# outside of the precise time range.
+awk_time_range_check=''
+if [[ "$from_precise" != "" || "$to_precise" != "" ]]; then
+  awk_time_range_check='{
+    month = '"$awktime_month"';
+    year = '"$awktime_year"';
+    day = '"$awktime_day"';
+    curTimestrPrecise = year "-" month "-" day "-" ('"$awktime_hhmm"') ":" ('"$awktime_second"');'
+  if [[ "$from_precise" != "" ]]; then
+    awk_time_range_check+='
+    if (curTimestrPrecise < "'"${from_precise:0:16}:${from_precise:17:2}"'") { next; }'
+  fi
+  if [[ "$to_precise" != "" ]]; then
+    awk_time_range_check+='
+    if (curTimestrPrecise >= "'"${to_precise:0:16}:${to_precise:17:2}"'") { next; }'
+  fi
+  awk_time_range_check+='
+  }'
+fi
+
 function run_awk_script_logfiles {
   awk_pattern=''
   if [[ "$user_pattern" != "" ]]; then
@@ -533,18 +1501,37 @@ function run_awk_script_logfiles {
   # only do the division when the percentage changes, so we calculate the next
   # point when it'd change, and going forward we just compare it with a simple
   # "<".
+  awk_sample_print=''
+  if [[ "$sample" != "" ]]; then
+    awk_sample_print='
+    for (i = 0; i < sampleNum(); i++) {
+      idx = sampleIdx(i);
+      print "m:" (sampleNRs[idx] + '$from_linenr_int' - 1) ":" sampleLines[idx];
+    }
+    '
+  fi
+
   awk_script='
   '$awk_func_print_percentage'
+  '$awk_func_print_count_by'
+  '$awk_func_nl_helpers'
+  '$awk_func_num_agg'
+  '$awk_func_sample'
+  '$awk_func_infer_year'
 
   BEGIN {
     bytenr=1; curline=0; maxlines='$max_num_lines'; lastPercent=0;
     numFilteredOut=0;
     prevMinKey="";
+    '$awk_vars'
   }
+  '$awk_prefilter_parse'
   { bytenr += length($0)+1 }
-  NR % 100 == 0 {
+  '"$awk_percentage_cond"' {
     printPercentage(bytenr, '$num_bytes_to_scan')
   }
+  '$awk_time_range_check'
+  '$awk_overlays_check'
   '$awk_pattern'
   {
     curMinKey = '"$awktime_minute_key"';
@@ -576,12 +1563,17 @@ function run_awk_script_logfiles {
       #prevMinKey = curMinKey;
     #}
 
-    stats[curMinKey]++;
+    stats[curMinKey'"$awk_stats_key_suffix"']++;
+    '$awk_num_agg_check'
+    '$awk_counts_only_check'
 
     '$lines_until_check'
+    '$lines_since_check'
+    '$awk_count_by_check'
+    '$awk_sample_check'
 
     lastlines[curline] = $0;
-    lastNRs[curline] = NR;
+    lastNRs[curline] = '$awk_lnr';
     curline++
     if (curline >= maxlines) {
       curline = 0;
@@ -591,7 +1583,7 @@ function run_awk_script_logfiles {
   }
 
   END {
-    print "debug:Filtered out " numFilteredOut " from " NR " lines" > "/dev/stderr"
+    print "debug:Filtered out " numFilteredOut " from " NR " '"$awk_lines_descr"'" > "/dev/stderr"
 
     print "logfile:'$logfile_prev':0";
     print "logfile:'$logfile_last':'$prevlog_lines'";
@@ -599,6 +1591,9 @@ function run_awk_script_logfiles {
     for (x in stats) {
       print "s:" x "," stats[x]
     }
+    '$awk_num_agg_print'
+    '$awk_overlays_print'
+    '$awk_sample_print'
 
     for (i = 0; i < maxlines; i++) {
       ln = curline + i;
@@ -614,15 +1609,98 @@ function run_awk_script_logfiles {
 
       print "m:" curNR ":" lastlines[ln];
     }
+
+    '$awk_count_by_print'
   }
   '
 
-  "$awk_binary" -b "$awk_script" "$@"
+  run_awk "$awk_script" "$@"
   if [[ "$?" != 0 ]]; then
     return 1
   fi
 }
 
+# Unfortunately journalctl prints multiline messages without the leading
+# timestamp and other details: instead, they just add padding with spaces,
+# which breaks our parsing; so awk_journalctl_fix_multiline manually replaces
+# this padding with the details from the previous non-padded line.
+awk_journalctl_fix_multiline='
+  {
+    if (substr($0, 1, 1) == " ") {
+      # Find out the number of leading spaces
+      numLeadingSpace = length($0)
+      if (NF > 0) {
+        numLeadingSpace = index($0, $1) - 1;
+      }
+
+      if (length(lastline) < numLeadingSpace) {
+        print "error:line has more leading whitespaces than the length of the previous line";
+        exit 1;
+      }
+
+      # Replace these leading spaces with the same amount of characters from the previous line.
+      $0 = substr(lastline, 1, numLeadingSpace) substr($0, numLeadingSpace + 1);
+    }
+
+    lastline = $0;
+  }
+'
+
+# Prints the raw journalctl messages around the one with the timestamp
+# --context-timestamp-precise: all the messages with this exact timestamp,
+# and --context-lines messages before and after them.
+function print_journalctl_context() { # {{{
+  local precise_len=${#context_timestamp_precise}
+
+  echo "logfile:${SPECIAL_FILENAME_JOURNALCTL}:0"
+
+  # The messages before (and on) the timestamp: going backwards, and then
+  # printing in the normal order.
+  eval "$journalctl_binary $JOURNALCTL_FORMAT_FLAG --quiet --reverse --until \"$context_timestamp_until_seconds\"" | \
+    run_awk '
+    '"$awk_journalctl_fix_multiline"'
+    {
+      curtime = substr($0, 1, '$precise_len');
+      if (curtime > "'"$context_timestamp_precise"'") {
+        next;
+      }
+
+      if (curtime < "'"$context_timestamp_precise"'") {
+        if (numBefore >= '$context_lines') {
+          exit;
+        }
+        numBefore++;
+      }
+
+      lines[numLines++] = $0;
+    }
+    END {
+      for (i = numLines-1; i >= 0; i--) {
+        print "m:0:" lines[i];
+      }
+    }
+  '
+
+  # And the messages after the timestamp.
+  eval "$journalctl_binary $JOURNALCTL_FORMAT_FLAG --quiet --since \"$context_timestamp_since_seconds\"" | \
+    run_awk '
+    '"$awk_journalctl_fix_multiline"'
+    {
+      curtime = substr($0, 1, '$precise_len');
+      if (curtime <= "'"$context_timestamp_precise"'") {
+        next;
+      }
+
+      if (numAfter >= '$context_lines') {
+        exit;
+      }
+      numAfter++;
+
+      print "m:0:" $0;
+    }
+  '
+} # }}}
+
 function run_awk_script_journalctl {
   awk_pattern_check=''
   if [[ "$user_pattern" != "" ]]; then
@@ -663,6 +1741,42 @@ function run_awk_script_journalctl {
     '
   fi
 
+  # Same as awk_skip_n_latest_check above, but for the forward pagination,
+  # when journalctl is called without --reverse.
+  awk_skip_n_earliest_check=''
+  if [[ "$timestamp_since_precise" != "" && "$skip_n_earliest" != "" ]]; then
+    awk_skip_n_earliest_check='
+    (needToSkipEarliest) {
+      curtime = substr($0, 1, timestampSincePreciseLen);
+
+      # If the timestamp is smaller than what we already have, just skip.
+      if (curtime < timestampSincePrecise) {
+        next;
+      }
+
+      # If the timestamp is exactly the same as what we already have,
+      # skip the skip_n_earliest lines.
+      if (curtime == timestampSincePrecise) {
+        numSameTimestamp++;
+        if (numSameTimestamp <= '"$skip_n_earliest"') {
+          next;
+        }
+
+        # We have skipped enough lines, remember that
+        print "debug:Skipped " NR-1 " earliest lines" > "/dev/stderr"
+        needToSkipEarliest = 0;
+      }
+
+      # If the timestamp is later than what we already have,
+      # remember that we are done skipping, to avoid doing useless work.
+      if (curtime > timestampSincePrecise) {
+        print "debug:Skipped " NR-1 " earliest lines" > "/dev/stderr"
+        needToSkipEarliest = 0;
+      }
+    }
+    '
+  fi
+
   early_exit_check=''
   if [[ "$stop_after_max_num_lines" != "" ]]; then
     early_exit_check='curline >= maxlines {
@@ -671,11 +1785,45 @@ function run_awk_script_journalctl {
     }'
   fi
 
+  awk_sample_print=''
+  if [[ "$sample" != "" ]]; then
+    awk_sample_print='
+    for (i = 0; i < sampleNum(); i++) {
+      idx = isReversed ? sampleIdx(sampleNum()-1-i) : sampleIdx(i);
+      print "m:0:" sampleLines[idx];
+    }
+    '
+  fi
+
   awk_script='
   '$awk_func_print_percentage'
+  '$awk_func_print_count_by'
+  '$awk_func_nl_helpers'
+  '$awk_func_num_agg'
+  '$awk_func_sample'
+
+  # Returns the number of seconds since the epoch for the given date and time,
+  # as if it was in UTC. We only use it to calculate the differences between
+  # the timestamps, so the timezone does not matter. Not using mktime, since
+  # not every awk has it; the algorithm is from
+  # http://howardhinnant.github.io/date_algorithms.html#days_from_civil
+  function toTimestamp(year, month, day, hh, mm, ss,    era, yoe, doy, doe) {
+    year += 0;
+    month += 0;
+    if (month <= 2) {
+      year--;
+    }
+
+    era = int((year >= 0 ? year : year-399) / 400);
+    yoe = year - era*400;
+    doy = int((153*(month > 2 ? month-3 : month+9) + 2) / 5) + day - 1;
+    doe = yoe*365 + int(yoe/4) - int(yoe/100) + doy;
+
+    return (era*146097 + doe - 719468)*86400 + hh*3600 + mm*60 + ss;
+  }
 
   # Takes timestamp in the same format as we use for --from and --to and
-  # store in the index ("2006-01-02-15:04"), and returns the corresponding unix
+  # store in the index ("2006-01-02-15:04", optionally with seconds), and returns the corresponding unix
   # timestamp.
   function indexTimestrToTimestamp(timestr) {
     year = substr(timestr, 1, 4);
@@ -683,8 +1831,9 @@ function run_awk_script_journalctl {
     day = substr(timestr, 9, 2);
     hh = substr(timestr, 12, 2);
     mm = substr(timestr, 15, 2);
+    ss = (length(timestr) > 16) ? substr(timestr, 18, 2) : "00";
 
-    return mktime(year " " month " " day " " hh " " mm " 00");
+    return toTimestamp(year, month, day, hh, mm, ss);
   }
 
   BEGIN {
@@ -697,6 +1846,13 @@ function run_awk_script_journalctl {
     timestampUntilPreciseLen=length(timestampUntilPrecise);
     numSameTimestamp=0;
     needToSkip = timestampUntilPreciseLen > 0 ? 1 : 0;
+    timestampSincePrecise="'"$timestamp_since_precise"'";
+    timestampSincePreciseLen=length(timestampSincePrecise);
+    needToSkipEarliest = timestampSincePreciseLen > 0 ? 1 : 0;
+
+    # Whether journalctl was called with --reverse, so we get the latest
+    # messages first.
+    isReversed = '"$journalctl_reversed"';
 
     # Find out earliest and latest timestamp for percentage calculations.
     earliestTimestamp=0;
@@ -717,7 +1873,7 @@ function run_awk_script_journalctl {
       latestTimestamp = indexTimestrToTimestamp("'$to'");
     } else {
       # No "to" timestamp; just use the current time.
-      latestTimestamp = systime();
+      latestTimestamp = indexTimestrToTimestamp("'"$(date +%Y-%m-%d-%H:%M:%S)"'");
     }
 
     timespanSeconds = 0;
@@ -726,29 +1882,7 @@ function run_awk_script_journalctl {
     }
   }
 
-  {
-    # Unfortunately journalctl prints multiline messages without the leading
-    # timestamp and other details: instead, they just add padding with spaces,
-    # which breaks our parsing; so we manually replace this padding with the
-    # details from the previous non-padded line.
-    if (substr($0, 1, 1) == " ") {
-      # Find out the number of leading spaces
-      numLeadingSpace = length($0)
-      if (NF > 0) {
-        numLeadingSpace = index($0, $1) - 1;
-      }
-
-      if (length(lastline) < numLeadingSpace) {
-        print "error:line has more leading whitespaces than the length of the previous line";
-        exit 1;
-      }
-
-      # Replace these leading spaces with the same amount of characters from the previous line.
-      $0 = substr(lastline, 1, numLeadingSpace) substr($0, numLeadingSpace + 1);
-    }
-
-    lastline = $0;
-  }
+  '$awk_journalctl_fix_multiline'
 
   # Print percentage based on time. It is not as great as if it was
   # based on the number of bytes as we have it for the logfiles (because the
@@ -761,19 +1895,28 @@ function run_awk_script_journalctl {
     hhmm = '"$awktime_hhmm"';
     hh = substr(hhmm, 1, 2);
     mm = substr(hhmm, 4, 2);
-    curTimestamp = mktime(year " " month " " day " " hh " " mm " 00");
+    curTimestamp = toTimestamp(year, month, day, hh, mm, 0);
 
-    if (timespanSeconds > 0) {
+    if (timespanSeconds > 0 && isReversed) {
       printPercentage(latestTimestamp-curTimestamp, timespanSeconds)
+    } else if (timespanSeconds > 0) {
+      printPercentage(curTimestamp-earliestTimestamp, timespanSeconds)
     } else {
       # We do not know the timespan, so just do not print any percentages.
     }
   }
 
+  '$awk_overlays_check'
   '$awk_pattern_check'
   '$awk_skip_n_latest_check'
+  '$awk_skip_n_earliest_check'
   {
-    stats['"$awktime_minute_key"']++;
+    curMinKey = '"$awktime_minute_key"';
+    stats[curMinKey'"$awk_stats_key_suffix"']++;
+    '$awk_num_agg_check'
+    '$awk_counts_only_check'
+    '$awk_count_by_check'
+    '$awk_sample_check'
 
     if (curline < maxlines) {
       lines[curline] = $0;
@@ -790,10 +1933,21 @@ function run_awk_script_journalctl {
     for (x in stats) {
       print "s:" x "," stats[x]
     }
+    '$awk_num_agg_print'
+    '$awk_overlays_print'
+    '$awk_sample_print'
 
-    for (i = curline-1; i >= 0; i--) {
-      print "m:0:" lines[i];
+    if (isReversed) {
+      for (i = curline-1; i >= 0; i--) {
+        print "m:0:" lines[i];
+      }
+    } else {
+      for (i = 0; i < curline; i++) {
+        print "m:0:" lines[i];
+      }
     }
+
+    '$awk_count_by_print'
   }
   '
 
@@ -805,19 +1959,31 @@ function run_awk_script_journalctl {
 
 user_pattern=$1
 
+if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" && "$context_lines" != "" ]]; then
+  print_journalctl_context
+  exit 0
+fi
+
 if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
   echo "p:stage:$STAGE_QUERYING:querying logs:Note that journalctl can be SLOW. Consider using log files." 1>&2
 
   # For both $from and $to, convert the format
-  # "2006-01-02-15:04" -> "2006-01-02 15:04:00"
+  # "2006-01-02-15:04" -> "2006-01-02 15:04:00", or
+  # "2006-01-02-15:04:05" -> "2006-01-02 15:04:05"
   journalctl_from=""
   if [[ "$from" != "" ]]; then
-    journalctl_from="${from:0:10} ${from:11}:00"
+    journalctl_from="${from:0:10} ${from:11}"
+    if [[ ${#from} == 16 ]]; then
+      journalctl_from="${journalctl_from}:00"
+    fi
   fi
 
   journalctl_to=""
   if [[ "$to" != "" ]]; then
-    journalctl_to="${to:0:10} ${to:11}:00"
+    journalctl_to="${to:0:10} ${to:11}"
+    if [[ ${#to} == 16 ]]; then
+      journalctl_to="${journalctl_to}:00"
+    fi
   fi
 
   stop_after_max_num_lines=""
@@ -833,9 +1999,24 @@ if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
   # files); and also when we're just getting the next page and not interested
   # in timeline histogram data for the full period, we just exit early after
   # accumulating $max_num_lines.
-  cmd="$journalctl_binary $JOURNALCTL_FORMAT_FLAG --quiet --reverse"
+  #
+  # The only exceptions are the forward pagination (--timestamp-since-*) and
+  # the ascending order, when we need the earliest messages.
+  journalctl_reversed="1"
+  if [[ -n "$timestamp_since_seconds" || "$order" == "asc" ]]; then
+    journalctl_reversed="0"
+  fi
+
+  cmd="$journalctl_binary $JOURNALCTL_FORMAT_FLAG --quiet"
+  if [[ "$journalctl_reversed" == "1" ]]; then
+    cmd="$cmd --reverse"
+  fi
 
-  if [[ -n "$journalctl_from" ]]; then
+  if [[ -n "$timestamp_since_seconds" ]]; then
+    cmd="$cmd --since \"$timestamp_since_seconds\""
+    stop_after_max_num_lines="1"
+    # NOTE: we'll also skip the $skip_n_earliest messages with the earliest timestamp.
+  elif [[ -n "$journalctl_from" ]]; then
     cmd="$cmd --since \"$journalctl_from\""
   fi
 
@@ -856,6 +2037,9 @@ if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
     stop_after_max_num_lines="$stop_after_max_num_lines"   \
     timestamp_until_precise="$timestamp_until_precise"   \
     skip_n_latest="$skip_n_latest"   \
+    timestamp_since_precise="$timestamp_since_precise"   \
+    skip_n_earliest="$skip_n_earliest"   \
+    journalctl_reversed="$journalctl_reversed"   \
     run_awk_script_journalctl -
 
   codes=(${PIPESTATUS[@]})
@@ -920,37 +2104,6 @@ function refresh_index { # {{{
   local last_bytenr=0
   local prevlog_bytes=$(get_prevlog_bytenr)
 
-  awk_vars='
-    monthByName["Jan"] = "01";
-    monthByName["Feb"] = "02";
-    monthByName["Mar"] = "03";
-    monthByName["Apr"] = "04";
-    monthByName["May"] = "05";
-    monthByName["Jun"] = "06";
-    monthByName["Jul"] = "07";
-    monthByName["Aug"] = "08";
-    monthByName["Sep"] = "09";
-    monthByName["Oct"] = "10";
-    monthByName["Nov"] = "11";
-    monthByName["Dec"] = "12";
-
-    curYear = '${CUR_YEAR}';
-    curMonth = '${CUR_MONTH}';
-
-    yearByMonth["01"] = inferYear(1, curYear, curMonth) "";
-    yearByMonth["02"] = inferYear(2, curYear, curMonth) "";
-    yearByMonth["03"] = inferYear(3, curYear, curMonth) "";
-    yearByMonth["04"] = inferYear(4, curYear, curMonth) "";
-    yearByMonth["05"] = inferYear(5, curYear, curMonth) "";
-    yearByMonth["06"] = inferYear(6, curYear, curMonth) "";
-    yearByMonth["07"] = inferYear(7, curYear, curMonth) "";
-    yearByMonth["08"] = inferYear(8, curYear, curMonth) "";
-    yearByMonth["09"] = inferYear(9, curYear, curMonth) "";
-    yearByMonth["10"] = inferYear(10, curYear, curMonth) "";
-    yearByMonth["11"] = inferYear(11, curYear, curMonth) "";
-    yearByMonth["12"] = inferYear(12, curYear, curMonth) "";
-  '
-
   # Add new entries to index, if needed
 
   # NOTE: syslogFieldsToIndexTimestr parses the traditional systemd timestamp
@@ -971,16 +2124,7 @@ function refresh_index { # {{{
   # bunch of other time-filtering logic here. Although it's cool since it
   # includes the year, microseconds, and timezone.
   awk_functions='
-function inferYear(logMonth, curYear, curMonth) {
-  delta = logMonth - curMonth
-
-  if (delta <= -11)       # log month is Jan, current is Dec -> next year
-    return curYear + 1
-  else if (delta >= 8)    # log month is Sep-Dec, current is Jan -> previous year
-    return curYear - 1
-  else
-    return curYear
-}
+'$awk_func_infer_year'
 
 function printIndexLine(outfile, timestr, linenr, bytenr) {
   print "idx\t" timestr "\t" linenr "\t" bytenr >> outfile;
@@ -992,8 +2136,11 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
 # awk will work in terms of bytes, not characters. We use length($0) there and
 # we rely on it being number of bytes.
 
+  # NOTE: with a sub-minute --index-resolution, the lastHHMM and curHHMM also
+  # include the seconds rounded down to the resolution, like "15:04:10"; see
+  # awk_index_key.
   scriptInitFromLastTimestr='
-    lastHHMM = substr(lastTimestr, 8, 5);
+    lastHHMM = substr(lastTimestr, 12);
     '
 
   scriptSetCurTimestr='
@@ -1002,9 +2149,8 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     month = '"$awktime_month"';
     year = '"$awktime_year"';
     day = '"$awktime_day"';
-    hhmm = '"$awktime_hhmm"';
 
-    curTimestr = year "-" month "-" day "-" hhmm;
+    curTimestr = year "-" month "-" day "-" curHHMM;
 
     # Ignore decreased timestamps: treat them as if the timestamp did not change.
     if (curTimestr < lastTimestr) {
@@ -1021,7 +2167,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   script1='BEGIN { bytenr_next=1; lastPercent=0 }
 {
   bytenr_next += length($0)+1
-  curHHMM = '"$awktime_hhmm"';
+  curHHMM = '"$awk_index_key"';
 }'
 
   if [ -s $indexfile ]
@@ -1033,7 +2179,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     local last_bytenr="$(tail -n 1 $indexfile | cut -f4)"
     local size_to_index=$((total_size-last_bytenr))
 
-    tail -c +$((last_bytenr-prevlog_bytes)) $logfile_last | "$awk_binary" -b "$awk_functions
+    elevate tail -c +$((last_bytenr-prevlog_bytes)) $logfile_last | read_logfile | run_awk "$awk_functions
   BEGIN {
     $awk_vars
     lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr
@@ -1054,9 +2200,16 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   else
     echo "p:stage:$STAGE_INDEX_FULL:indexing from scratch" 1>&2
 
-    echo "prevlog_modtime	$(get_file_modtime $logfile_prev)" > $indexfile
+    # The index might live in some persistent dir like ~/.cache/nerdlog, which
+    # doesn't exist yet.
+    mkdir -p "$(dirname "$indexfile")" || return 1
+
+    echo "index_version	$INDEX_FORMAT_VERSION" > $indexfile
+    echo "prevlog_modtime	$(get_file_modtime $logfile_prev)" >> $indexfile
+    echo "index_resolution	$index_resolution" >> $indexfile
+    echo "lastlog_fingerprint	$(get_file_fingerprint $logfile_last)" >> $indexfile
 
-    "$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastHHMM=\"\"; }"'
+    read_logfile $logfile_prev | run_awk "$awk_functions BEGIN { $awk_vars lastHHMM=\"\"; }"'
   '"$script1"'
   ( lastHHMM != curHHMM ) {
     '"$scriptSetCurTimestr"';
@@ -1065,7 +2218,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     '"$scriptSetLastTimestrEtc"'
   }
   END { print "prevlog_lines\t" NR >> "'$indexfile'" }
-  ' $logfile_prev
+  ' -
     if [[ "$?" != 0 ]]; then
       echo "debug:failed to index from scratch $logfile_prev, removing index file" 1>&2
       rm $indexfile
@@ -1081,7 +2234,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     if [[ "$lastTimestrLine" =~ ^idx$'\t' ]]; then
       lastTimestr="$(echo "$lastTimestrLine" | cut -f2)"
     fi
-    "$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr }"'
+    read_logfile $logfile_last | run_awk "$awk_functions BEGIN { $awk_vars lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr }"'
   '"$script1"'
   ( lastHHMM != curHHMM ) {
     '"$scriptSetCurTimestr"';
@@ -1090,7 +2243,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     printPercentage(bytenr, '$total_size');
     '"$scriptSetLastTimestrEtc"'
   }
-  ' $logfile_last
+  ' -
     if [[ "$?" != 0 ]]; then
       echo "debug:failed to index from scratch $logfile_last, removing index file" 1>&2
       rm $indexfile
@@ -1100,22 +2253,26 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
 } # }}}
 
 # Performs index lookup by a timestr like "2006-01-02-15:04" (typically given
-# as --from or --to, and it's also stored in the index in the same form).
+# as --from or --to, and it's also stored in the index in the same form; with
+# a sub-minute --index-resolution, it also has seconds: "2006-01-02-15:04:05").
 #
 # Prints result: one of "found", "before" or "after"; and if the result
 # is "found", then also prints linenumber and bytenumber, space-separated.
 # "before" means the given timestr is earlier than the earliest log we have,
 # and "after" obviously means that it's later than the latest log we have.
 #
+# If the second argument is non-empty, then the lookup is strict: an index
+# entry with exactly the given timestr is skipped, and the next one is used.
+#
 # One possible use is:
 #   read -r my_result my_linenr my_bytenr <<<$(get_linenr_and_bytenr_from_index my_timestr)
 #
 # Now we can use those vars $my_result, $my_linenr and $my_bytenr
 function get_linenr_and_bytenr_from_index() { # {{{
-  "$awk_binary" -F"\t" '
+  run_awk -F"\t" '
     BEGIN { isFirstIdx = 1; printed = 0; }
     $1 == "idx" {
-      if ("'$1'" == $2) {
+      if ("'$2'" == "" && "'$1'" == $2) {
         print "found " $3 " " $4;
         printed = 1;
         exit
@@ -1140,24 +2297,107 @@ function get_linenr_and_bytenr_from_index() { # {{{
 } # }}}
 
 function get_prevlog_lines_from_index() { # {{{
-  if ! "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "prevlog_lines" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
+  if ! run_awk -F"\t" 'BEGIN { found=0 } $1 == "prevlog_lines" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
     return 1
   fi
 } # }}}
 
+# Prints the index format version stored in the index; if it's not there,
+# then the index was built before the version was introduced, so it's 0.
+function get_index_version_from_index() { # {{{
+  run_awk -F"\t" 'BEGIN { ver=0 } $1 == "index_version" { ver = $2; exit } END { print ver }' $indexfile
+} # }}}
+
+# Prints the index resolution stored in the index; if it's not there, then
+# the index was built before the resolution became configurable, so it's 60.
+function get_index_resolution_from_index() { # {{{
+  run_awk -F"\t" 'BEGIN { res=60 } $1 == "index_resolution" { res = $2; exit } END { print res }' $indexfile
+} # }}}
+
 function get_prevlog_modtime_from_index() { # {{{
-  if ! "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "prevlog_modtime" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
+  if ! run_awk -F"\t" 'BEGIN { found=0 } $1 == "prevlog_modtime" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
     return 1
   fi
 } # }}}
 
+# Prints the fingerprint of the given file: the checksum of its first line, or
+# nothing if the file is empty. If the file gets truncated in place and then
+# some new lines are written to it, the fingerprint will change.
+function get_file_fingerprint() { # {{{
+  if [ -s "$1" ]; then
+    elevate head -n 1 "$1" | cksum | cut -d' ' -f1
+  fi
+} # }}}
+
+function get_lastlog_fingerprint_from_index() { # {{{
+  run_awk -F"\t" '$1 == "lastlog_fingerprint" { print $2; exit }' $indexfile
+} # }}}
+
+# If $logfile_last looks truncated since the index was built, prints the
+# details; otherwise prints nothing. The file is considered truncated if
+# either it's now smaller than the latest indexed offset, or its first line
+# has changed.
+function get_lastlog_truncation_details() { # {{{
+  local last_idx_bytenr
+  last_idx_bytenr="$(run_awk -F"\t" '$1 == "idx" { bytenr = $4 } END { print bytenr }' $indexfile)"
+  if [[ "$last_idx_bytenr" != "" ]] && (( last_idx_bytenr > total_size )); then
+    echo "the latest indexed offset is $last_idx_bytenr, but the total size is only $total_size"
+    return 0
+  fi
+
+  local stored_fingerprint
+  stored_fingerprint="$(get_lastlog_fingerprint_from_index)"
+  if [[ "$stored_fingerprint" != "" ]]; then
+    local cur_fingerprint
+    cur_fingerprint="$(get_file_fingerprint $logfile_last)"
+    if [[ "$cur_fingerprint" != "$stored_fingerprint" ]]; then
+      echo "the first line of $logfile_last has changed"
+      return 0
+    fi
+  fi
+} # }}}
+
 function get_prevlog_bytenr() { # {{{
   get_file_size $logfile_prev
 } # }}}
 
+# Prints the raw lines around the line --context-linenr (which is the line
+# number in both log files combined, the same as the "m:" lines have): the
+# --context-lines lines before and after it.
+function print_logfiles_context() { # {{{
+  # The line numbers the client has are based on the number of lines in the
+  # previous log file which is stored in the index, so try to use that one.
+  local prevlog_lines
+  prevlog_lines=$(get_prevlog_lines_from_index 2>/dev/null)
+  if [[ $? != 0 ]]; then
+    prevlog_lines=$(elevate cat "$logfile_prev" | run_awk 'END { print NR }'; exit ${PIPESTATUS[0]}) || return 1
+  fi
+
+  echo "logfile:$logfile_prev:0"
+  echo "logfile:$logfile_last:$prevlog_lines"
+
+  elevate cat "$logfile_prev" "$logfile_last" | run_awk '
+    NR > '$((context_linenr+context_lines))' { exit; }
+    NR >= '$((context_linenr-context_lines))' { print "m:" NR ":" $0; }
+  '
+} # }}}
+
+if [[ "$context_lines" != "" ]]; then
+  print_logfiles_context || exit 1
+  exit 0
+fi
+
 is_outside_of_range=0
 if [[ "$from" != "" || "$to" != "" ]]; then
   # If indexfile exists, check if it's valid and relevant; if not, delete it.
+  if [ -e "$indexfile" ]; then
+    stored_index_version="$(get_index_version_from_index)"
+    if [[ "$stored_index_version" != "$INDEX_FORMAT_VERSION" ]]; then
+      echo "debug:index format version has changed: stored $stored_index_version, current $INDEX_FORMAT_VERSION, deleting index file" 1>&2
+      rm -f $indexfile || exit 1
+    fi
+  fi
+
   if [ -e "$indexfile" ]; then
     # Check timestamp in the first line of /tmp/nerdlog_agent_index, and if
     # $logfile_prev's modification time is newer, then delete whole index
@@ -1172,6 +2412,25 @@ if [[ "$from" != "" || "$to" != "" ]]; then
       echo "debug:broken index file (no prevlog lines), deleting it" 1>&2
       rm -f $indexfile || exit 1
     fi
+
+    if [ -e "$indexfile" ]; then
+      stored_index_resolution="$(get_index_resolution_from_index)"
+      if [[ "$stored_index_resolution" != "$index_resolution" ]]; then
+        echo "debug:index resolution has changed: stored $stored_index_resolution, requested $index_resolution, deleting index file" 1>&2
+        rm -f $indexfile || exit 1
+      fi
+    fi
+
+    # The latest log file might have been truncated in place, e.g. by logrotate
+    # with copytruncate, and then the offsets in the index are wrong.
+    if [ -e "$indexfile" ]; then
+      truncation_details="$(get_lastlog_truncation_details)"
+      if [[ "$truncation_details" != "" ]]; then
+        echo "debug:index rebuilt: truncation detected: $truncation_details" 1>&2
+        echo "index_rebuilt:truncation detected" 1>&2
+        rm -f $indexfile || exit 1
+      fi
+    fi
   fi
 
   refresh_and_retry=0
@@ -1180,7 +2439,7 @@ if [[ "$from" != "" || "$to" != "" ]]; then
 
   if [ -s "$indexfile" ]; then
     if [[ "$from" != "" ]]; then
-        read -r from_result from_linenr from_bytenr <<<$(get_linenr_and_bytenr_from_index "$from") || exit 1
+        read -r from_result from_linenr from_bytenr <<<$(get_linenr_and_bytenr_from_index "$from_idx") || exit 1
         if [[ "$from_result" != "found" ]]; then
           echo "debug:the from ${from} isn't found, gonna refresh the index" 1>&2
           refresh_and_retry=1
@@ -1188,7 +2447,7 @@ if [[ "$from" != "" || "$to" != "" ]]; then
     fi
 
     if [[ "$to" != "" ]]; then
-      read -r to_result to_linenr to_bytenr <<<$(get_linenr_and_bytenr_from_index "$to") || exit 1
+      read -r to_result to_linenr to_bytenr <<<$(get_linenr_and_bytenr_from_index "$to_idx" "$to_idx_strict") || exit 1
       if [[ "$to_result" != "found" ]]; then
         echo "debug:the to ${to} isn't found, gonna refresh the index" 1>&2
         refresh_and_retry=1
@@ -1203,7 +2462,7 @@ if [[ "$from" != "" || "$to" != "" ]]; then
     refresh_index || exit 1
 
     if [[ "$from" != "" ]]; then
-      read -r from_result from_linenr from_bytenr <<<$(get_linenr_and_bytenr_from_index "$from") || exit 1
+      read -r from_result from_linenr from_bytenr <<<$(get_linenr_and_bytenr_from_index "$from_idx") || exit 1
 
       if [[ "$from_result" == "before" ]]; then
         echo "debug:the from ${from} isn't found, will use the beginning" 1>&2
@@ -1223,7 +2482,7 @@ if [[ "$from" != "" || "$to" != "" ]]; then
     fi
 
     if [[ "$to" != "" ]]; then
-      read -r to_result to_linenr to_bytenr <<<$(get_linenr_and_bytenr_from_index "$to") || exit 1
+      read -r to_result to_linenr to_bytenr <<<$(get_linenr_and_bytenr_from_index "$to_idx" "$to_idx_strict") || exit 1
 
       if [[ "$to_result" == "after" ]]; then
         echo "debug:the to ${to} isn't found, will use the end" 1>&2
@@ -1265,10 +2524,28 @@ if [[ "$from_linenr" == "" ]]; then
   from_linenr_int=1
 fi
 
-lines_until_check=''
-if [[ "$lines_until" != "" ]]; then
-  lines_until_check="if (NR >= $((lines_until-from_linenr_int+1))) { next; }"
-fi
+# set_lines_checks sets lines_until_check and lines_since_check for the awk
+# script which gets the lines starting from the line number $1 (as per
+# from_linenr_int).
+function set_lines_checks() { # {{{
+  local from_linenr_int="$1"
+
+  lines_until_check=''
+  if [[ "$lines_until" != "" ]]; then
+    lines_until_check="if ($awk_lnr >= $((lines_until-from_linenr_int+1))) { next; }"
+  fi
+
+  # When paginating forward or using the ascending order, we need the first
+  # $max_num_lines lines (after the $lines_since, if given), so once we have
+  # them, the rest are only accounted in the stats.
+  lines_since_check=''
+  if [[ "$lines_since" != "" ]]; then
+    lines_since_check="if ($awk_lnr <= $((lines_since-from_linenr_int+1))) { next; } "
+  fi
+  if [[ "$lines_since" != "" || ( "$order" == "asc" && "$sample" == "" ) ]]; then
+    lines_since_check="${lines_since_check}if (numLinesSince >= maxlines) { next; } numLinesSince++;"
+  fi
+} # }}}
 
 num_bytes_to_scan=0
 if [[ "$from_bytenr" == "" && "$to_bytenr" == "" ]]; then
@@ -1309,70 +2586,270 @@ fi
 # do the "-n N", not "-n +N" (but for the latest logfile, which is constantly
 # appended to, we have to use the "-n +N")
 
-# Generate commands to get all the logs as per requested timerange.
-declare -a cmds
-if [[ "$from_bytenr" != "" && $(( from_bytenr > prevlog_bytes )) == 1 ]]; then
-  # Only $logfile_last is used.
-  from_bytenr=$(( from_bytenr - prevlog_bytes ))
-  if [[ "$to_bytenr" != "" ]]; then
-    to_bytenr=$(( to_bytenr - prevlog_bytes ))
-    echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the latest $logfile_last" 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last | head -c $((to_bytenr - from_bytenr))")
-  else
-    # Most common case
-    echo "debug:Getting logs from offset $from_bytenr until the end of latest $logfile_last." 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last")
-  fi
-elif [[ "$to_bytenr" != "" && $(( to_bytenr <= prevlog_bytes )) == 1 ]]; then
-  # Only $logfile_prev is used.
-  if [[ "$from_bytenr" != "" ]]; then
-    echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the prev $logfile_prev" 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_prev | head -c $((to_bytenr - from_bytenr))")
+# gen_cmds_for_range sets the global `cmds` array to the commands which print
+# all the logs from the offset $1 to the offset $2 (exclusive). Offsets are
+# 1-based, across both log files (like in the index), and either of them can
+# be empty, which means the very beginning or the very end, respectively.
+function gen_cmds_for_range() { # {{{
+  local from_bytenr="$1"
+  local to_bytenr="$2"
+  local info
+
+  cmds=()
+  if [[ "$from_bytenr" != "" && $(( from_bytenr > prevlog_bytes )) == 1 ]]; then
+    # Only $logfile_last is used.
+    from_bytenr=$(( from_bytenr - prevlog_bytes ))
+    if [[ "$to_bytenr" != "" ]]; then
+      to_bytenr=$(( to_bytenr - prevlog_bytes ))
+      echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the latest $logfile_last" 1>&2
+      cmds+=("${elevate_prefix}tail -c +$from_bytenr $logfile_last | head -c $((to_bytenr - from_bytenr))")
+    else
+      # Most common case
+      echo "debug:Getting logs from offset $from_bytenr until the end of latest $logfile_last." 1>&2
+      cmds+=("${elevate_prefix}tail -c +$from_bytenr $logfile_last")
+    fi
+  elif [[ "$to_bytenr" != "" && $(( to_bytenr <= prevlog_bytes )) == 1 ]]; then
+    # Only $logfile_prev is used.
+    if [[ "$from_bytenr" != "" ]]; then
+      echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the prev $logfile_prev" 1>&2
+      cmds+=("${elevate_prefix}tail -c +$from_bytenr $logfile_prev | head -c $((to_bytenr - from_bytenr))")
+    else
+      echo "debug:Getting logs from the very beginning to offset $(( to_bytenr - 1 )), all in the prev $logfile_prev." 1>&2
+      cmds+=("${elevate_prefix}head -c $(( to_bytenr - 1)) $logfile_prev")
+    fi
   else
-    echo "debug:Getting logs from the very beginning to offset $(( to_bytenr - 1 )), all in the prev $logfile_prev." 1>&2
-    cmds+=("head -c $(( to_bytenr - 1)) $logfile_prev")
+    # Both log files are used
+    if [[ "$from_bytenr" != "" ]]; then
+      info="Getting logs from offset $from_bytenr in prev $logfile_prev"
+      cmds+=("${elevate_prefix}tail -c +$from_bytenr $logfile_prev")
+    else
+      info="Getting logs from the very beginning in prev $logfile_prev"
+      cmds+=("${elevate_prefix}cat $logfile_prev")
+    fi
+
+    if [[ "$to_bytenr" != "" ]]; then
+      info="$info to offset $(( to_bytenr - prevlog_bytes - 1 )) in latest $logfile_last"
+      cmds+=("${elevate_prefix}head -c $(( to_bytenr - prevlog_bytes - 1 )) $logfile_last")
+    else
+      info="$info until the end of latest $logfile_last"
+      cmds+=("${elevate_prefix}cat $logfile_last")
+    fi
+
+    echo "debug:$info" 1>&2
   fi
-else
-  # Both log files are used
-  if [[ "$from_bytenr" != "" ]]; then
-    info="Getting logs from offset $from_bytenr in prev $logfile_prev"
-    cmds+=("tail -c +$from_bytenr $logfile_prev")
-  else
-    info="Getting logs from the very beginning in prev $logfile_prev"
-    cmds+=("cat $logfile_prev")
+} # }}}
+
+# run_query_worker prints the query results for the logs from the offset $1
+# to the offset $2 (see gen_cmds_for_range), where the line number of the
+# first line is $3.
+function run_query_worker() { # {{{
+  local from_bytenr="$1"
+  local to_bytenr="$2"
+  local from_linenr_int="$3"
+
+  gen_cmds_for_range "$from_bytenr" "$to_bytenr"
+  set_lines_checks "$from_linenr_int"
+
+  local cmds_concatenated
+  cmds_concatenated="$(concat_cmds_array)"
+  echo "debug:Command to filter logs by time range:" 1>&2
+  echo "debug: bash -c '$cmds_concatenated'" 1>&2
+
+  if [[ "$use_read_rate" != "" ]]; then
+    cmds_concatenated="{ $cmds_concatenated; } | read_logfile"
   fi
 
-  if [[ "$to_bytenr" != "" ]]; then
-    info="$info to offset $(( to_bytenr - prevlog_bytes - 1 )) in latest $logfile_last"
-    cmds+=("head -c $(( to_bytenr - prevlog_bytes - 1 )) $logfile_last")
-  else
-    info="$info until the end of latest $logfile_last"
-    cmds+=("cat $logfile_last")
+  if [[ "$use_prefilter" != "" ]]; then
+    echo "debug:Prefiltering with grep -F:$(printf " %q" "${prefilter_literals[@]}")" 1>&2
+    cmds_concatenated="{ $cmds_concatenated; } | grep_literals $(printf " %q" "${prefilter_literals[@]}")"
+  fi
+
+  # Now execute all those commands, and feed those logs to the awk script
+  # which will analyze them and produce the final output.
+  eval $cmds_concatenated | \
+    user_pattern="$user_pattern"                          \
+    max_num_lines="$max_num_lines"                        \
+    num_bytes_to_scan="$num_bytes_to_scan"                \
+    lines_until_check="$lines_until_check"                \
+    lines_since_check="$lines_since_check"                \
+    prevlog_lines="$prevlog_lines"                        \
+    from_linenr_int="$from_linenr_int"                    \
+    run_awk_script_logfiles -
+
+  local codes=(${PIPESTATUS[@]})
+  for status in "${codes[@]}"; do
+    if [[ $status -ne 0 ]]; then
+      return 1
+    fi
+  done
+} # }}}
+
+# get_num_workers prints the number of parallel awk workers to use for
+# scanning $num_bytes_to_scan bytes; see --max-cpus.
+function get_num_workers() { # {{{
+  local num_workers="$NUM_CPUS"
+
+  if [[ "$max_cpus" != "" ]] && (( max_cpus < num_workers )); then
+    num_workers="$max_cpus"
+  fi
+
+  local max_by_size=$(( num_bytes_to_scan / min_chunk_size ))
+  if (( max_by_size < num_workers )); then
+    num_workers="$max_by_size"
   fi
 
-  echo "debug:$info" 1>&2
+  if (( num_workers < 1 )); then
+    num_workers=1
+  fi
+
+  echo "$num_workers"
+} # }}}
+
+# get_split_points_from_index prints the points (as "<linenr> <bytenr>") to
+# split the range from the offset $1 to the offset $2 (exclusive) into at most
+# $3 chunks of roughly the same size. The points are taken from the index,
+# so they are always at the beginning of a line, and we know the line
+# numbers. There might be fewer chunks than requested if the index is too
+# sparse.
+function get_split_points_from_index() { # {{{
+  run_awk -F"\t" '
+    function target(chunk) {
+      return '$1' + chunk * ('$2' - '$1') / '$3';
+    }
+
+    BEGIN { chunk = 1; lastBytenr = '$1'; }
+    $1 == "idx" && $4 > lastBytenr && $4 < '$2' && $4 >= target(chunk) {
+      print $3 " " $4;
+      lastBytenr = $4;
+
+      while (chunk < '$3' && $4 >= target(chunk)) {
+        chunk++;
+      }
+
+      if (chunk >= '$3') {
+        exit;
+      }
+    }
+  ' $indexfile
+} # }}}
+
+# awk_merge_workers_output merges the stdout of all the workers, given in the
+# order of their chunks: the stats are summed up, and out of all the matching
+# lines, only the latest (or, in the ascending order, earliest) maxlines are
+# kept.
+awk_merge_workers_output='
+  BEGIN { maxlines = '$max_num_lines'; }
+  /^logfile:/ {
+    if (!($0 in seenLogfiles)) {
+      seenLogfiles[$0] = 1;
+      print;
+    }
+    next;
+  }
+  /^(s|o):/ {
+    match($0, /,[0-9]+$/);
+    stats[substr($0, 1, RSTART-1)] += substr($0, RSTART+1);
+    next;
+  }
+  /^m:/ { lines[numLines++] = $0; next; }
+  { print }
+  END {
+    for (x in stats) {
+      print x "," stats[x];
+    }
+
+    from = 0;
+    to = numLines;
+    if ("'$lines_since'" != "" || "'$order'" == "asc") {
+      if (to > maxlines) {
+        to = maxlines;
+      }
+    } else if (numLines > maxlines) {
+      from = numLines - maxlines;
+    }
+
+    for (i = from; i < to; i++) {
+      print lines[i];
+    }
+  }
+'
+
+# Sampling, count-by and numeric aggregation can't be merged from the partial
+# results (or at least not easily), so for those we always use a single
+# worker.
+num_workers=1
+if [[ "$sample" == "" && "$count_by_expr" == "" && "$num_agg_expr" == "" ]]; then
+  num_workers="$(get_num_workers)"
+fi
+
+# Both range boundaries as offsets, for splitting.
+range_from="$from_bytenr"
+if [[ "$range_from" == "" ]]; then
+  range_from=1
+fi
+
+range_to="$to_bytenr"
+if [[ "$range_to" == "" ]]; then
+  range_to=$(( total_size + 1 ))
+fi
+
+chunks_from_bytenr=("$from_bytenr")
+chunks_from_linenr=("$from_linenr_int")
+if (( num_workers > 1 )); then
+  while read -r split_linenr split_bytenr; do
+    chunks_from_bytenr+=("$split_bytenr")
+    chunks_from_linenr+=("$split_linenr")
+  done < <(get_split_points_from_index "$range_from" "$range_to" "$num_workers")
 fi
 
-cmds_concatenated="$(concat_cmds_array)"
-echo "debug:Command to filter logs by time range:" 1>&2
-echo "debug: bash -c '$cmds_concatenated'" 1>&2
-
-# Now execute all those commands, and feed those logs to the awk script
-# which will analyze them and produce the final output.
-eval $cmds_concatenated | \
-  user_pattern="$user_pattern"                          \
-  max_num_lines="$max_num_lines"                        \
-  num_bytes_to_scan="$num_bytes_to_scan"                \
-  lines_until_check="$lines_until_check"                \
-  prevlog_lines="$prevlog_lines"                        \
-  from_linenr_int="$from_linenr_int"                    \
-  run_awk_script_logfiles -
-
-codes=(${PIPESTATUS[@]})
-for status in "${codes[@]}"; do
-  if [[ $status -ne 0 ]]; then
+num_chunks=${#chunks_from_bytenr[@]}
+
+if [[ $num_chunks == 1 ]]; then
+  run_query_worker "$from_bytenr" "$to_bytenr" "$from_linenr_int" || exit 1
+else
+  echo "debug:Scanning $num_bytes_to_scan bytes in $num_chunks chunks in parallel" 1>&2
+
+  # The workers' output might be big, so instead of hardcoding /tmp (which
+  # might be small), use $TMPDIR if it's set, or the index dir otherwise, which
+  # is /tmp by default, but can be configured.
+  workers_dir="$(mktemp -d "${TMPDIR:-$(dirname "$indexfile")}/nerdlog_agent_workers_XXXXXX")" || exit 1
+  trap 'exit_code=$?; rm -rf "$workers_dir"; echo "exit_code:$exit_code"' EXIT
+
+  read_rate_divisor=$num_chunks
+
+  worker_pids=()
+  for (( i = 0; i < num_chunks; i++ )); do
+    chunk_to_bytenr="$to_bytenr"
+    if (( i + 1 < num_chunks )); then
+      chunk_to_bytenr="${chunks_from_bytenr[$((i+1))]}"
+    fi
+
+    run_query_worker \
+      "${chunks_from_bytenr[$i]}" "$chunk_to_bytenr" "${chunks_from_linenr[$i]}" \
+      > "$workers_dir/$i.out" 2> "$workers_dir/$i.err" &
+    worker_pids+=($!)
+  done
+
+  # Wait for the workers in order, so that their stderr is printed in order
+  # as well, and the progress only goes up; the workers' own progress lines
+  # are meaningless here, so we skip them.
+  workers_failed=""
+  for (( i = 0; i < num_chunks; i++ )); do
+    if ! wait "${worker_pids[$i]}"; then
+      workers_failed="1"
+    fi
+
+    grep -v '^p:p:' "$workers_dir/$i.err" 1>&2
+    echo "p:p:$(( (i+1) * 100 / num_chunks ))" 1>&2
+  done
+
+  if [[ "$workers_failed" != "" ]]; then
     exit 1
   fi
-done
+
+  for (( i = 0; i < num_chunks; i++ )); do
+    cat "$workers_dir/$i.out"
+  done | run_awk "$awk_merge_workers_output" || exit 1
+fi
 
 echo "p:stage:$STAGE_DONE:done" 1>&2
@@ -41,6 +41,13 @@ type AgentTestCaseYaml struct {
 	Env []string `yaml:"env"`
 
 	Args []string `yaml:"args"`
+
+	// IndexLogfiles, if set, specifies the logfiles to build the initial index
+	// from: the agent first runs with these logfiles (without checking any
+	// outputs), and then they are replaced with Logfiles for the actual test.
+	// It's useful to test how the agent handles the log files which changed
+	// between the queries, e.g. got truncated in place.
+	IndexLogfiles *testutils.TestCaseLogfiles `yaml:"index_logfiles"`
 }
 
 func TestNerdlogAgent(t *testing.T) {
@@ -65,16 +72,233 @@ func TestNerdlogAgent(t *testing.T) {
 		panic(err)
 	}
 
-	for _, testCaseDir := range testCaseDirs {
-		t.Run(testCaseDir, func(t *testing.T) {
-			if err := runAgentTestCase(t, nerdlogAgentShFname, testCasesDir, repoRoot, testCaseDir); err != nil {
-				t.Fatalf("running agent test case %s: %s", testCaseDir, err.Error())
+	awks := getAgentTestAwks(t)
+	if len(awks) == 0 {
+		t.Fatal("no awk found")
+	}
+
+	for _, awk := range awks {
+		t.Run(awk.name, func(t *testing.T) {
+			for _, testCaseDir := range testCaseDirs {
+				t.Run(testCaseDir, func(t *testing.T) {
+					if err := runAgentTestCase(t, awk.binary, nerdlogAgentShFname, testCasesDir, repoRoot, testCaseDir); err != nil {
+						t.Fatalf("running agent test case %s: %s", testCaseDir, err.Error())
+					}
+				})
 			}
 		})
 	}
 }
 
-func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot, testName string) error {
+// TestNerdlogAgentSudoPassword checks that with the sudo_password method,
+// the password never ends up in the agent env or on its stdin, both in the
+// full and granular sudo modes, and regardless of whether sudo needs the
+// password or has the credentials cached.
+func TestNerdlogAgentSudoPassword(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to get caller info")
+	}
+
+	parentDir := filepath.Dir(filename)
+	nerdlogAgentShFname := filepath.Join(parentDir, "nerdlog_agent.sh")
+	logfilesDir := filepath.Join(parentDir, "core_testdata", "input_logfiles", "tiny")
+
+	realBash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const password = "my secret"
+
+	// sudoCredsModes are the states of the sudo credentials cache to test with.
+	sudoCredsModes := []string{
+		// The credentials aren't cached, but "sudo -v" caches them.
+		"not_cached",
+		// The credentials are cached already.
+		"cached",
+		// Like timestamp_timeout=0 in sudoers: the credentials are never cached.
+		"no_timestamp",
+	}
+
+	for _, sudoMode := range []SudoMode{SudoModeFull, SudoModeGranular} {
+		for _, credsMode := range sudoCredsModes {
+			descr := fmt.Sprintf("sudo mode %s, creds: %s", sudoMode, credsMode)
+			dir := t.TempDir()
+
+			// Mock sudo: with -S, reads the password from stdin unless the
+			// credentials are cached, and -v caches them (unless there's the
+			// no_timestamp file). It logs its env, which is inherited from the
+			// agent in the granular mode, and whatever is left on stdin for the
+			// command.
+			mockSudo := fmt.Sprintf(`#!/bin/sh
+env >> %[1]s/sudo_env
+while true; do
+  case "$1" in
+    -S) stdin_pw=1; shift ;;
+    -p) shift 2 ;;
+    -n) shift ;;
+    -v) validate=1; shift ;;
+    *) break ;;
+  esac
+done
+if [ ! -e %[1]s/cached ]; then
+  if [ "$stdin_pw" != 1 ]; then echo "a password is required" 1>&2; exit 1; fi
+  IFS= read -r pw
+  if [ "$pw" != %[2]s ]; then echo "wrong password" 1>&2; exit 1; fi
+fi
+if [ "$validate" = 1 ]; then
+  if [ ! -e %[1]s/no_timestamp ]; then touch %[1]s/cached; fi
+  exit 0
+fi
+cat >> %[1]s/cmd_stdin
+exec "$@" </dev/null
+`, dir, shellQuote(password))
+
+			// Mock bash, which logs the env and stdin of the agent.
+			mockBash := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = %[2]s ]; then
+  env > %[1]s/agent_env
+  cat > %[1]s/agent_stdin
+fi
+exec %[3]s "$@" </dev/null
+`, dir, shellQuote(nerdlogAgentShFname), shellQuote(realBash))
+
+			binDir := filepath.Join(dir, "bin")
+			assert.NoError(t, os.Mkdir(binDir, 0755))
+			assert.NoError(t, os.WriteFile(filepath.Join(binDir, "sudo"), []byte(mockSudo), 0755))
+			assert.NoError(t, os.WriteFile(filepath.Join(binDir, "bash"), []byte(mockBash), 0755))
+
+			switch credsMode {
+			case "cached":
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, "cached"), nil, 0644))
+			case "no_timestamp":
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, "no_timestamp"), nil, 0644))
+			}
+
+			lsc := &LStreamClient{
+				params: LStreamClientParams{
+					LogStream: LogStream{Options: LogStreamOptions{
+						SudoMode:   sudoMode,
+						SudoMethod: SudoMethodSudoPassword,
+					}},
+				},
+			}
+
+			// Same as the bootstrap command built by LStreamClient.
+			var parts []string
+			parts = append(parts, lsc.getFullSudoPrefix()...)
+			parts = append(parts, lsc.getGranularSudoPasswordPipe()...)
+			parts = append(
+				parts,
+				"bash", shellQuote(nerdlogAgentShFname),
+				"logstream_info",
+				"--logfile-last", shellQuote(filepath.Join(logfilesDir, "syslog")),
+				"--logfile-prev", shellQuote(filepath.Join(logfilesDir, "syslog.1")),
+			)
+			parts = append(parts, lsc.getGranularSudoArgs()...)
+			parts = append(parts, lsc.getGranularSudoRedirects()...)
+
+			// Like ShellTransportSudoPassword does, the password is in a
+			// non-exported shell var, and the sudo function is defined.
+			script := fmt.Sprintf(
+				"%s=%s\n%s\n%s\n",
+				sudoPasswordVar, shellQuote(password), getSudoPasswordFuncDef(), strings.Join(parts, " "),
+			)
+
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+			out, err := cmd.CombinedOutput()
+			if !assert.NoError(t, err, "%s: output: %s", descr, out) {
+				continue
+			}
+
+			assert.Contains(t, string(out), "example_log_line:", descr)
+
+			sudoEnv, err := os.ReadFile(filepath.Join(dir, "sudo_env"))
+			assert.NoError(t, err, "%s: sudo must be used", descr)
+			assert.NotContains(t, string(sudoEnv), password, descr)
+
+			agentEnv, err := os.ReadFile(filepath.Join(dir, "agent_env"))
+			assert.NoError(t, err, descr)
+			assert.NotContains(t, string(agentEnv), password, descr)
+
+			agentStdin, err := os.ReadFile(filepath.Join(dir, "agent_stdin"))
+			assert.NoError(t, err, descr)
+			assert.NotContains(t, string(agentStdin), password, descr)
+
+			cmdStdin, err := os.ReadFile(filepath.Join(dir, "cmd_stdin"))
+			assert.NoError(t, err, "%s: sudo must run a command", descr)
+			assert.NotContains(t, string(cmdStdin), password, descr)
+		}
+	}
+}
+
+// agentTestAwk is an awk implementation to run the agent tests with.
+type agentTestAwk struct {
+	name string
+
+	// binary is passed to the agent as --awk-binary.
+	binary string
+}
+
+// agentTestAwkNames are the awk implementations to look for in $PATH.
+var agentTestAwkNames = []string{"gawk", "mawk", "busybox", "original-awk", "nawk", "awk"}
+
+// getAgentTestAwks returns all the awk implementations available locally, so
+// that the agent tests run with every one of them. If the same binary is
+// available under different names (like awk being a symlink to mawk), it's
+// only returned once.
+//
+// The env var NERDLOG_AGENT_TEST_AWKS can contain a comma-separated list of
+// names to only use these, e.g. "gawk,busybox".
+func getAgentTestAwks(t *testing.T) []agentTestAwk {
+	names := agentTestAwkNames
+	if v := os.Getenv("NERDLOG_AGENT_TEST_AWKS"); v != "" {
+		names = strings.Split(v, ",")
+	}
+
+	var ret []agentTestAwk
+	seen := map[string]struct{}{}
+
+	for _, name := range names {
+		binary, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+
+		resolved, err := filepath.EvalSymlinks(binary)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := seen[resolved]; ok {
+			continue
+		}
+		seen[resolved] = struct{}{}
+
+		if name == "busybox" {
+			// Busybox figures what to run by the name, so make a symlink named awk;
+			// but first check that this busybox has awk at all.
+			if err := exec.Command(binary, "awk", "BEGIN {}").Run(); err != nil {
+				continue
+			}
+
+			symlink := filepath.Join(t.TempDir(), "awk")
+			if err := os.Symlink(binary, symlink); err != nil {
+				t.Fatalf("creating busybox awk symlink: %s", err.Error())
+			}
+
+			binary = symlink
+		}
+
+		ret = append(ret, agentTestAwk{name: name, binary: binary})
+	}
+
+	return ret
+}
+
+func runAgentTestCase(t *testing.T, awkBinary, nerdlogAgentShFname, testCasesDir, repoRoot, testName string) error {
 	testCaseDir := filepath.Join(testCasesDir, testName)
 	testCaseDescrFname := filepath.Join(testCaseDir, agentTestCaseYamlFname)
 
@@ -118,6 +342,7 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 		"--logfile-last", provisioned.LogfileLast,
 		"--logfile-prev", provisioned.LogfilePrev,
 		"--index-file", indexFname,
+		"--awk-binary", awkBinary,
 	}
 
 	if provisioned.LogfileLast == "journalctl" {
@@ -130,11 +355,34 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 			"--awktime-day", "substr($0, 9, 2)",
 			"--awktime-hhmm", "substr($0, 12, 5)",
 			"--awktime-minute-key", "substr($0, 6, 11)",
+			"--awktime-second", "substr($0, 18, 2)",
 		)
 	}
 
 	cmdArgs = append(cmdArgs, tc.Args...)
 
+	if tc.IndexLogfiles != nil {
+		indexResolved, err := testutils.ResolveLogfiles(testCaseDir, tc.IndexLogfiles)
+		if err != nil {
+			return errors.Annotatef(err, "resolving index logfiles")
+		}
+
+		if _, err := testutils.ProvisionLogFiles(indexResolved, testOutputDir, repoRoot); err != nil {
+			return errors.Annotatef(err, "provisioning index logfiles")
+		}
+
+		if err := runNerdlogAgent(t, &tc, cmdArgs, testCaseDir, provisioned.ExtraEnv, testName, testNerdlogAgentParams{
+			skipChecks: true,
+		}); err != nil {
+			return errors.Annotatef(err, "building the initial index")
+		}
+
+		// Now put the actual logfiles in place.
+		if _, err := testutils.ProvisionLogFiles(resolved, testOutputDir, repoRoot); err != nil {
+			return errors.Annotatef(err, "provisioning logfiles after building the initial index")
+		}
+	}
+
 	// Do the full run, with the provided initial index (which in most cases
 	// means, without any index)
 	if err := runNerdlogAgent(t, &tc, cmdArgs, testCaseDir, provisioned.ExtraEnv, testName, testNerdlogAgentParams{
@@ -164,6 +412,12 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 		return nil
 	}
 
+	// Some commands (e.g. getting the context lines with --context-lines) don't
+	// build the index at all, so there's nothing to index up.
+	if _, err := os.Stat(indexFname); os.IsNotExist(err) {
+		return nil
+	}
+
 	// indexReduceStep specifies how many lines we remove from the index at every
 	// step here. For most tests, it's 25.
 	indexReduceStep := 25
@@ -238,6 +492,9 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 
 type testNerdlogAgentParams struct {
 	checkStderr bool
+
+	// If skipChecks is true, the outputs are not checked at all.
+	skipChecks bool
 }
 
 func runNerdlogAgent(
@@ -294,6 +551,10 @@ func runNerdlogAgent(
 		return errors.Annotatef(err, "running nerdlog query command %+v", bashArgs)
 	}
 
+	if params.skipChecks {
+		return nil
+	}
+
 	wantStdout, err := os.ReadFile(filepath.Join(testCaseDir, "want_stdout"))
 	if err != nil {
 		return errors.Annotatef(err, "reading want_stdout")
@@ -342,7 +603,9 @@ func runNerdlogAgent(
 //	exit_code:0
 //
 // And returns the same string, but all the lines starting from "s:" being sorted
-// lexicographically. This is just for better testability.
+// lexicographically. This is just for better testability. The same goes for
+// the numeric aggregation stats, starting from "na:", which are printed right
+// after the "s:" lines, so they all get sorted together.
 func sortStatBucketLines(nerdlogStdout []byte) []byte {
 	scanner := bufio.NewScanner(bytes.NewReader(nerdlogStdout))
 	var out bytes.Buffer
@@ -361,7 +624,7 @@ func sortStatBucketLines(nerdlogStdout []byte) []byte {
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		if len(line) > 2 && line[:2] == "s:" {
+		if strings.HasPrefix(line, "s:") || strings.HasPrefix(line, "na:") || strings.HasPrefix(line, "o:") {
 			statLines = append(statLines, line)
 		} else {
 			flushStatLines()
@@ -736,6 +999,63 @@ func BenchmarkNerdlogAgentHugeLogOneHourCompleteIndex(b *testing.B) {
 	}
 }
 
+// BenchmarkNerdlogAgentLargeLogLiteralPattern and
+// BenchmarkNerdlogAgentLargeLogLiteralPatternPrefiltered run the same query
+// with a simple literal pattern, without and with the grep prefiltering, so
+// they can be compared.
+func BenchmarkNerdlogAgentLargeLogLiteralPattern(b *testing.B) {
+	benchmarkNerdlogAgentLargeLogPattern(b, "/Backup completed/")
+}
+
+func BenchmarkNerdlogAgentLargeLogLiteralPatternPrefiltered(b *testing.B) {
+	benchmarkNerdlogAgentLargeLogPattern(
+		b, "--prefilter-literal", "Backup completed", "/Backup completed/",
+	)
+}
+
+func benchmarkNerdlogAgentLargeLogPattern(b *testing.B, patternArgs ...string) {
+	if err := generateLogfilesLarge(); err != nil {
+		b.Fatalf("failed to generate log files: %s", err.Error())
+	}
+
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		b.Fatal("unable to get caller info")
+	}
+
+	parentDir := filepath.Dir(filename)
+	nerdlogAgentShFname := filepath.Join(parentDir, "nerdlog_agent.sh")
+
+	indexFname := filepath.Join(agentTestOutputRoot, "bench_large_index")
+
+	cmdArgs := append(
+		[]string{
+			nerdlogAgentShFname,
+			"query",
+			"--logfile-last", "/tmp/nerdlog_agent_test_output/randomlog_large",
+			"--logfile-prev", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
+			"--index-file", indexFname,
+			"--max-num-lines", "100",
+			"--from", "2025-03-10-00:00",
+		},
+		patternArgs...,
+	)
+
+	// Build the index
+	os.Remove(indexFname)
+	if err := runNerdlogAgentForBenchmark(cmdArgs); err != nil {
+		b.Fatalf("initial runNerdlogAgentForBenchmark failed: %s", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := runNerdlogAgentForBenchmark(cmdArgs); err != nil {
+			b.Fatalf("runNerdlogAgentForBenchmark failed: %s", err)
+		}
+	}
+}
+
 func generateLogfilesLarge() error {
 	t, err := time.Parse(time.RFC3339, "2025-03-09T06:00:00Z")
 	if err != nil {
@@ -0,0 +1,246 @@
+package core
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// NumAggBucketGamma defines the log-scale buckets used to approximate
+// percentiles: every bucket i covers values in the range
+// [gamma^i, gamma^(i+1)), so the relative error of any percentile is within
+// about 5%. NOTE: it must be in sync with the same constant in
+// nerdlog_agent.sh.
+const NumAggBucketGamma = 1.1
+
+// NumAggKind specifies how to extract a numeric value from a log line, in the
+// numeric aggregation queries.
+type NumAggKind string
+
+const (
+	// NumAggKindRegex extracts the value using a regex: if the regex has a
+	// capture group, then the first group is used as the value, otherwise the
+	// whole match. Like in awk, leading numeric part of the string is used, so
+	// e.g. "123ms" becomes 123.
+	NumAggKindRegex NumAggKind = "regex"
+
+	// NumAggKindAwkExpr extracts the value using an arbitrary awk expression,
+	// like "$9" or "substr($9, 6)".
+	NumAggKindAwkExpr NumAggKind = "expr"
+)
+
+// NumAggParams specifies the numeric aggregation: for every matching log line,
+// the agent extracts a numeric value (lines without the value are skipped),
+// and calculates per-minute stats (count, sum, min, max and approximate
+// percentiles) which are returned as NumAggStats alongside the MinuteStats.
+type NumAggParams struct {
+	Kind NumAggKind
+
+	// Arg depends on the Kind: for NumAggKindRegex it's a regular expression,
+	// for NumAggKindAwkExpr it's an awk expression.
+	Arg string
+}
+
+// Validate returns an error if the params are invalid.
+func (p *NumAggParams) Validate() error {
+	switch p.Kind {
+	case NumAggKindRegex:
+		if p.Arg == "" {
+			return errors.Errorf("regex is empty")
+		}
+
+		if _, err := regexp.Compile(p.Arg); err != nil {
+			return errors.Annotatef(err, "invalid regex")
+		}
+
+	case NumAggKindAwkExpr:
+		if p.Arg == "" {
+			return errors.Errorf("awk expression is empty")
+		}
+
+	default:
+		return errors.Errorf("invalid numeric aggregation kind %q", p.Kind)
+	}
+
+	return nil
+}
+
+// awkExpr returns an awk expression which evaluates to the numeric value of
+// the current log line, or an empty string if there's no value.
+func (p *NumAggParams) awkExpr() (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	switch p.Kind {
+	case NumAggKindRegex:
+		return awkMatchGroupExpr(p.Arg), nil
+
+	case NumAggKindAwkExpr:
+		return "(" + p.Arg + ")", nil
+	}
+
+	// Validate would have returned an error.
+	panic("should never be here")
+}
+
+// NumAggStatsItem contains the numeric aggregation stats for a single minute.
+type NumAggStatsItem struct {
+	// Count is the number of values.
+	Count int
+
+	Sum float64
+	Min float64
+	Max float64
+
+	// Buckets is a log-scale histogram of positive values: the key is the
+	// bucket index i, covering values in the range [gamma^i, gamma^(i+1)),
+	// where gamma is NumAggBucketGamma; the value is the number of values in
+	// that bucket.
+	Buckets map[int]int
+
+	// NumNonPositive is the number of values which are <= 0; those are not
+	// included in the Buckets.
+	NumNonPositive int
+}
+
+// Merge adds all the values from the other item to this one.
+func (s *NumAggStatsItem) Merge(other NumAggStatsItem) {
+	if other.Count == 0 {
+		return
+	}
+
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.NumNonPositive += other.NumNonPositive
+
+	if len(other.Buckets) > 0 && s.Buckets == nil {
+		s.Buckets = make(map[int]int, len(other.Buckets))
+	}
+
+	for k, v := range other.Buckets {
+		s.Buckets[k] += v
+	}
+}
+
+// Avg returns the average value, or 0 if there are no values.
+func (s *NumAggStatsItem) Avg() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return s.Sum / float64(s.Count)
+}
+
+// Percentile returns an approximate value of the given percentile (from 0 to
+// 100), or 0 if there are no values.
+func (s *NumAggStatsItem) Percentile(p float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(s.Count)))
+	if rank < 1 {
+		rank = 1
+	} else if rank > s.Count {
+		rank = s.Count
+	}
+
+	// We don't know much about non-positive values, so just assume they're all
+	// equal to the min value.
+	if rank <= s.NumNonPositive {
+		return s.Min
+	}
+
+	bucketIdxs := make([]int, 0, len(s.Buckets))
+	for k := range s.Buckets {
+		bucketIdxs = append(bucketIdxs, k)
+	}
+	sort.Ints(bucketIdxs)
+
+	cnt := s.NumNonPositive
+	for _, idx := range bucketIdxs {
+		cnt += s.Buckets[idx]
+		if cnt >= rank {
+			// Use geometric middle of the bucket, but make sure it doesn't go out
+			// of the actual range.
+			v := math.Pow(NumAggBucketGamma, float64(idx)+0.5)
+			return math.Max(s.Min, math.Min(s.Max, v))
+		}
+	}
+
+	// Should never happen unless the data is inconsistent.
+	return s.Max
+}
+
+// parseNumAggStatsItem parses the numeric aggregation stats as printed by the
+// agent (without the "na:" prefix and the minute key), split by commas:
+// count, sum, min, max, number of non-positive values, and buckets like
+// "72:1;73:3" (bucket index and count, separated by semicolons).
+func parseNumAggStatsItem(parts []string) (*NumAggStatsItem, error) {
+	if len(parts) != 6 {
+		return nil, errors.Errorf("expected 6 parts, got %d", len(parts))
+	}
+
+	ret := &NumAggStatsItem{}
+
+	var err error
+
+	if ret.Count, err = strconv.Atoi(parts[0]); err != nil {
+		return nil, errors.Annotatef(err, "parsing count")
+	}
+
+	if ret.Sum, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return nil, errors.Annotatef(err, "parsing sum")
+	}
+
+	if ret.Min, err = strconv.ParseFloat(parts[2], 64); err != nil {
+		return nil, errors.Annotatef(err, "parsing min")
+	}
+
+	if ret.Max, err = strconv.ParseFloat(parts[3], 64); err != nil {
+		return nil, errors.Annotatef(err, "parsing max")
+	}
+
+	if ret.NumNonPositive, err = strconv.Atoi(parts[4]); err != nil {
+		return nil, errors.Annotatef(err, "parsing number of non-positive values")
+	}
+
+	if parts[5] != "" {
+		bucketStrs := strings.Split(parts[5], ";")
+		ret.Buckets = make(map[int]int, len(bucketStrs))
+
+		for _, bucketStr := range bucketStrs {
+			bucketParts := strings.Split(bucketStr, ":")
+			if len(bucketParts) != 2 {
+				return nil, errors.Errorf("malformed bucket %q", bucketStr)
+			}
+
+			idx, err := strconv.Atoi(bucketParts[0])
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing bucket index")
+			}
+
+			cnt, err := strconv.Atoi(bucketParts[1])
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing bucket count")
+			}
+
+			ret.Buckets[idx] = cnt
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// numAggStatsFromValues does on the Go side what the agent does in awk, for
+// testing.
+func numAggStatsFromValues(values ...float64) NumAggStatsItem {
+	var ret NumAggStatsItem
+
+	for _, v := range values {
+		item := NumAggStatsItem{Count: 1, Sum: v, Min: v, Max: v}
+		if v <= 0 {
+			item.NumNonPositive = 1
+		} else {
+			idx := int(math.Floor(math.Log(v) / math.Log(NumAggBucketGamma)))
+			item.Buckets = map[int]int{idx: 1}
+		}
+
+		ret.Merge(item)
+	}
+
+	return ret
+}
+
+func TestNumAggStatsItem(t *testing.T) {
+	var values []float64
+	for i := 1; i <= 1000; i++ {
+		values = append(values, float64(i))
+	}
+
+	// Split the values between two items, and then merge them, to make sure
+	// that merging works as well.
+	item := numAggStatsFromValues(values[:300]...)
+	item.Merge(numAggStatsFromValues(values[300:]...))
+
+	assert.Equal(t, 1000, item.Count)
+	assert.Equal(t, 500500.0, item.Sum)
+	assert.Equal(t, 1.0, item.Min)
+	assert.Equal(t, 1000.0, item.Max)
+	assert.Equal(t, 500.5, item.Avg())
+
+	for _, p := range []float64{50, 90, 95, 99} {
+		want := p * 10
+		got := item.Percentile(p)
+		assert.InEpsilonf(t, want, got, 0.05, "p%v", p)
+	}
+
+	assert.InEpsilon(t, 1.0, item.Percentile(0), 0.05)
+	assert.Equal(t, 1000.0, item.Percentile(100))
+
+	var empty NumAggStatsItem
+	assert.Equal(t, 0.0, empty.Percentile(95))
+	assert.Equal(t, 0.0, empty.Avg())
+}
+
+func TestNumAggStatsItemNonPositive(t *testing.T) {
+	item := numAggStatsFromValues(-5, 0, 0, 10)
+
+	assert.Equal(t, 3, item.NumNonPositive)
+	assert.Equal(t, -5.0, item.Percentile(50))
+	assert.Equal(t, 10.0, item.Percentile(99))
+}
+
+func TestParseNumAggStatsItem(t *testing.T) {
+	item, err := parseNumAggStatsItem([]string{"4", "1.5e+03", "100", "1000", "1", "48:1;72:2"})
+	assert.NoError(t, err)
+	assert.Equal(t, &NumAggStatsItem{
+		Count:          4,
+		Sum:            1500,
+		Min:            100,
+		Max:            1000,
+		NumNonPositive: 1,
+		Buckets:        map[int]int{48: 1, 72: 2},
+	}, item)
+
+	item, err = parseNumAggStatsItem([]string{"1", "0", "0", "0", "1", ""})
+	assert.NoError(t, err)
+	assert.Nil(t, item.Buckets)
+
+	_, err = parseNumAggStatsItem([]string{"1", "0", "0", "0", "1", "48"})
+	assert.EqualError(t, err, `malformed bucket "48"`)
+
+	_, err = parseNumAggStatsItem([]string{"1", "0", "0"})
+	assert.EqualError(t, err, "expected 6 parts, got 3")
+}
+
+func TestNumAggAWKExpr(t *testing.T) {
+	expr, err := (&NumAggParams{Kind: NumAggKindRegex, Arg: `took=([0-9.]+)ms`}).awkExpr()
+	assert.NoError(t, err)
+	assert.Equal(t, `nlMatchGroup($0, "took=([0-9.]+)ms", 1, "took=", "[0-9.]+", "ms")`, expr)
+
+	expr, err = (&NumAggParams{Kind: NumAggKindAwkExpr, Arg: `substr($9, 6)`}).awkExpr()
+	assert.NoError(t, err)
+	assert.Equal(t, `(substr($9, 6))`, expr)
+
+	_, err = (&NumAggParams{Kind: NumAggKindAwkExpr}).awkExpr()
+	assert.EqualError(t, err, "awk expression is empty")
+}
@@ -96,6 +96,18 @@ type TimeFormatAWKExpr struct {
 	// "substr($0, 1, 16)" (to include the year) or "substr($0, 6, 11)" (to not
 	// include the year).
 	MinuteKey string
+
+	// Second is an AWK expression to get the seconds string like "05"; it's
+	// only used when the index resolution is less than a minute, or when the
+	// queried time range doesn't start or end on a whole minute. If the format
+	// doesn't have seconds at all, it's just `"00"`.
+	//
+	// So e.g. for the traditional syslog format "Jan _2 15:04:05", it should be
+	// "substr($0, 14, 2)".
+	//
+	// For the format "2006-01-02T15:04:05.000000Z07:00", it should rather be
+	// "substr($0, 18, 2)".
+	Second string
 }
 
 func GetTimeFormatDescrFromLogLines(logLines []string) (*TimeFormatDescr, error) {
@@ -226,6 +238,12 @@ func GenerateTimeDescr(layout string) (*TimeFormatDescr, error) {
 		MinuteKey: substr(minuteKeyStart, minuteKeyEnd-minuteKeyStart),
 	}
 
+	if partInfo["second"] != nil {
+		awk.Second = substr(partInfo["second"].index, partInfo["second"].length)
+	} else {
+		awk.Second = `"00"`
+	}
+
 	if partInfo["year"] != nil {
 		awk.Year = substr(partInfo["year"].index, partInfo["year"].length)
 	} else {
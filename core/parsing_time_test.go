@@ -80,6 +80,7 @@ func TestGenerateTimeDescr(t *testing.T) {
 					Day:       `(substr($0, 5, 1) == " ") ? "0" substr($0, 6, 1) : substr($0, 5, 2)`,
 					HHMM:      "substr($0, 8, 5)",
 					MinuteKey: "substr($0, 1, 12)",
+					Second:    "substr($0, 14, 2)",
 				},
 			},
 		},
@@ -95,6 +96,7 @@ func TestGenerateTimeDescr(t *testing.T) {
 					Day:       "substr($0, 9, 2)",
 					HHMM:      "substr($0, 12, 5)",
 					MinuteKey: "substr($0, 6, 11)",
+					Second:    "substr($0, 18, 2)",
 				},
 			},
 		},
@@ -110,6 +112,7 @@ func TestGenerateTimeDescr(t *testing.T) {
 					Day:       "substr($0, 9, 2)",
 					HHMM:      "substr($0, 12, 5)",
 					MinuteKey: "substr($0, 6, 11)",
+					Second:    "substr($0, 18, 2)",
 				},
 			},
 		},
@@ -125,6 +128,23 @@ func TestGenerateTimeDescr(t *testing.T) {
 					Day:       "substr($0, 9, 2)",
 					HHMM:      "substr($0, 12, 5)",
 					MinuteKey: "substr($0, 6, 11)",
+					Second:    "substr($0, 18, 2)",
+				},
+			},
+		},
+		{
+			name:   "No seconds",
+			layout: "2006-01-02 15:04",
+			expected: &TimeFormatDescr{
+				TimestampLayout: "2006-01-02 15:04",
+				MinuteKeyLayout: "01-02 15:04",
+				AWKExpr: TimeFormatAWKExpr{
+					Month:     "substr($0, 6, 2)",
+					Year:      "substr($0, 1, 4)",
+					Day:       "substr($0, 9, 2)",
+					HHMM:      "substr($0, 12, 5)",
+					MinuteKey: "substr($0, 6, 11)",
+					Second:    `"00"`,
 				},
 			},
 		},
@@ -1,6 +1,9 @@
 package core
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // ShellTransport provides an abstraction for getting shell access to a host;
 // e.g. via SSH or just local shell. In the future, tsh (Teleport) might be
@@ -9,8 +12,10 @@ type ShellTransport interface {
 	// Connect attempts to connect to the shell. It just spawns a goroutine and
 	// returns immediately, and later on the result (or maybe requests for
 	// additional data such as passphrases) will be delivered to the provided
-	// channel.
-	Connect(resCh chan<- ShellConnUpdate)
+	// channel. If the connection isn't established within the given timeout
+	// (not counting the time spent waiting for the user to provide the
+	// requested data), it fails.
+	Connect(resCh chan<- ShellConnUpdate, timeout time.Duration)
 }
 
 // ShellConn provides an abstraction of a shell connection; can be implemented
@@ -68,11 +73,74 @@ type ShellConnDataRequest struct {
 	DataKind ShellConnDataKind
 
 	// ResponseCh is where the user response should be sent.
-	ResponseCh chan<- string
+	ResponseCh chan<- ShellConnDataResponse
+}
+
+// ShellConnDataResponse is the user response to ShellConnDataRequest.
+type ShellConnDataResponse struct {
+	// Value is the data provided by the user; might be empty, e.g. if the
+	// passphrase is empty indeed.
+	Value string
+
+	// OK is false if the user has refused to provide the data.
+	OK bool
 }
 
 type ShellConnDataKind int
 
 const (
+	// ShellConnDataKindPassword is for secrets: the input is not shown.
 	ShellConnDataKindPassword ShellConnDataKind = iota
+	// ShellConnDataKindText is for non-secret data: the input is shown as
+	// typed, e.g. for keyboard-interactive challenges which ask to echo the
+	// answer.
+	ShellConnDataKindText
 )
+
+// dataRequestSem makes sure that we only ask the user for one thing at a
+// time, even if multiple hosts are connecting concurrently. It's a channel
+// rather than a mutex, so that waiting for it can be canceled.
+var dataRequestSem = make(chan struct{}, 1)
+
+// requestData asks the user for some data using ShellConnDataRequest, waits
+// for the response and returns it. The returned bool is false if the user has
+// refused to provide the data, or if the done channel was closed before the
+// user has answered; done can be nil, meaning that the request is never
+// canceled.
+func requestData(
+	resCh chan<- ShellConnUpdate, done <-chan struct{},
+	title, message string, kind ShellConnDataKind,
+) (string, bool) {
+	select {
+	case dataRequestSem <- struct{}{}:
+	case <-done:
+		return "", false
+	}
+	defer func() { <-dataRequestSem }()
+
+	// Buffered, so that the UI doesn't get stuck if the request was canceled
+	// while the user was answering.
+	responseCh := make(chan ShellConnDataResponse, 1)
+
+	upd := ShellConnUpdate{
+		DataRequest: &ShellConnDataRequest{
+			Title:      title,
+			Message:    message,
+			DataKind:   kind,
+			ResponseCh: responseCh,
+		},
+	}
+
+	select {
+	case resCh <- upd:
+	case <-done:
+		return "", false
+	}
+
+	select {
+	case resp := <-responseCh:
+		return resp.Value, resp.OK
+	case <-done:
+		return "", false
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"time"
 
 	"github.com/dimonomid/nerdlog/log"
 	"github.com/juju/errors"
@@ -27,7 +28,8 @@ func NewShellTransportLocal(params ShellTransportLocalParams) *ShellTransportLoc
 }
 
 // Connect starts the local shell and sends the result to the provided channel.
-func (s *ShellTransportLocal) Connect(resCh chan<- ShellConnUpdate) {
+// The timeout is ignored, since starting a local shell doesn't hang.
+func (s *ShellTransportLocal) Connect(resCh chan<- ShellConnUpdate, timeout time.Duration) {
 	go s.doConnect(resCh)
 }
 
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -25,6 +26,17 @@ type ShellTransportSSHBinParams struct {
 	User string
 	Port string
 
+	// Jumphosts, if not empty, is passed to ssh with the -J flag; see
+	// ConfigLogStreamShellTransportSSHBin.Jumphosts.
+	Jumphosts []string
+
+	// AskpassBinary is the path to the nerdlog binary, which ssh runs as
+	// SSH_ASKPASS to forward its prompts (passwords, key passphrases, unknown
+	// host keys) to the UI; see RunAskpassHelper. If empty, or if the ssh
+	// binary is too old to support SSH_ASKPASS_REQUIRE, ssh runs in batch mode
+	// and fails instead of prompting.
+	AskpassBinary string
+
 	Logger *log.Logger
 }
 
@@ -38,12 +50,12 @@ func NewShellTransportSSHBin(params ShellTransportSSHBinParams) *ShellTransportS
 }
 
 // Connect starts the local shell and sends the result to the provided channel.
-func (s *ShellTransportSSHBin) Connect(resCh chan<- ShellConnUpdate) {
-	go s.doConnect(resCh)
+func (s *ShellTransportSSHBin) Connect(resCh chan<- ShellConnUpdate, timeout time.Duration) {
+	go s.doConnect(resCh, timeout)
 }
 
 func (s *ShellTransportSSHBin) doConnect(
-	resCh chan<- ShellConnUpdate,
+	resCh chan<- ShellConnUpdate, connectTimeout time.Duration,
 ) (res ShellConnResult) {
 	logger := s.params.Logger
 
@@ -61,19 +73,45 @@ func (s *ShellTransportSSHBin) doConnect(
 		sshArgs = append(sshArgs, "-p", s.params.Port)
 	}
 
-	// We can't easily intercept any prompts for passwords etc, because ssh
-	// interacts directly with the terminal, not stdin/stdout, and so we don't
-	// even try, and instruct ssh to fail instead of prompting.
-	//
-	// We might, in theory, use a PTY like https://github.com/creack/pty, but
-	// it's not gonna be very robust and smells like it might open a can of
-	// worms, so not for now.
-	sshArgs = append(sshArgs, "-o", "BatchMode=yes")
+	if len(s.params.Jumphosts) > 0 {
+		sshArgs = append(sshArgs, "-J", strings.Join(s.params.Jumphosts, ","))
+	}
+
+	// Without keepalives, if the network goes away silently (e.g. VPN blips),
+	// we'd be waiting for the output forever.
+	sshArgs = append(
+		sshArgs,
+		"-o", fmt.Sprintf("ServerAliveInterval=%d", int(sshKeepaliveInterval.Seconds())),
+		"-o", fmt.Sprintf("ServerAliveCountMax=%d", sshKeepaliveCountMax),
+	)
 
 	dest := s.params.Host
 	if s.params.User != "" {
 		dest = fmt.Sprintf("%s@%s", s.params.User, dest)
 	}
+
+	// ssh interacts directly with the terminal for any prompts for passwords
+	// etc, not stdin/stdout, so to intercept them we make ssh run nerdlog
+	// itself as SSH_ASKPASS, which forwards the prompts back to us over a unix
+	// socket, and we show them in the UI.
+	//
+	// If that's not possible, we instruct ssh to fail instead of prompting.
+	var askpass *askpassServer
+	if s.params.AskpassBinary != "" && getSSHSupportsAskpass(logger) {
+		srv, err := newAskpassServer(dest, resCh, logger)
+		if err != nil {
+			logger.Errorf("Failed to start askpass server: %s", err.Error())
+		} else {
+			askpass = srv
+		}
+	}
+
+	if askpass != nil {
+		defer askpass.Close()
+	} else {
+		sshArgs = append(sshArgs, "-o", "BatchMode=yes")
+	}
+
 	sshArgs = append(sshArgs, dest, "/bin/sh")
 
 	var sshCmdDebugBuilder strings.Builder
@@ -92,6 +130,14 @@ func (s *ShellTransportSSHBin) doConnect(
 	logger.Infof("Executing external ssh command: %q", sshCmdDebug)
 
 	cmd := exec.Command("ssh", sshArgs...)
+	if askpass != nil {
+		cmd.Env = append(os.Environ(), askpass.env(s.params.AskpassBinary)...)
+
+		resCh <- ShellConnUpdate{
+			DebugInfo: s.makeDebugInfo("ssh prompts will be forwarded to the UI"),
+		}
+	}
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting stdin pipe")
@@ -159,30 +205,43 @@ func (s *ShellTransportSSHBin) doConnect(
 		}
 	}()
 
-	// Wait for the marker to show up in output.
-	select {
-	case err := <-connErrCh:
-		if err != nil {
-			res.Err = errors.Trace(err)
+	// Wait for the marker to show up in output. The time that the user spends
+	// answering the ssh prompts doesn't count towards the timeout.
+	timeout := time.NewTimer(connectTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case err := <-connErrCh:
+			if err != nil {
+				res.Err = errors.Trace(err)
+				return res
+			}
+
+			resCh <- ShellConnUpdate{
+				DebugInfo: s.makeDebugInfo("Got the marker, connected successfully"),
+			}
+
+			// Got the marker, so we're done.
+			res.Conn = &ShellConnSSHBin{
+				cmd:    cmd,
+				stdin:  stdin,
+				stdout: clientStdoutR,
+				stderr: stderr,
+			}
 			return res
-		}
 
-		resCh <- ShellConnUpdate{
-			DebugInfo: s.makeDebugInfo("Got the marker, connected successfully"),
-		}
+		case <-timeout.C:
+			if askpass != nil {
+				if extra := askpass.extraWaitTime(connectTimeout); extra > 0 {
+					timeout.Reset(extra)
+					continue
+				}
+			}
 
-		// Got the marker, so we're done.
-		res.Conn = &ShellConnSSHBin{
-			cmd:    cmd,
-			stdin:  stdin,
-			stdout: clientStdoutR,
-			stderr: stderr,
+			res.Err = errors.New("timeout waiting for SSH connection marker")
+			return res
 		}
-		return res
-
-	case <-time.After(connectionTimeout):
-		res.Err = errors.New("timeout waiting for SSH connection marker")
-		return res
 	}
 }
 
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -35,13 +36,26 @@ type ShellTransportSSHLibParams struct {
 	// an existing key is found.
 	SSHKeys []string
 
+	// PasswordAuth specifies whether the password and keyboard-interactive
+	// (e.g. OTP) auth methods should be tried if the public key auth fails; the
+	// user is asked for the password or for the answers. It's opt-in, since
+	// otherwise, on a fleet of hosts which don't accept the key, the user would
+	// have to dismiss the prompts for every host.
+	PasswordAuth bool
+
+	// CachePassword specifies whether the password entered by the user (for
+	// password or keyboard-interactive auth) should be remembered for the host,
+	// so that reconnecting doesn't ask for it again. It's only kept in memory,
+	// until the app exits.
+	CachePassword bool
+
 	ConnDetails ConfigLogStreamShellTransportSSHLib
 
 	Logger *log.Logger
 }
 
-func (st *ShellTransportSSHLib) Connect(resCh chan<- ShellConnUpdate) {
-	go st.doConnect(resCh)
+func (st *ShellTransportSSHLib) Connect(resCh chan<- ShellConnUpdate, timeout time.Duration) {
+	go st.doConnect(resCh, timeout)
 }
 
 func (st *ShellTransportSSHLib) makeDebugInfo(message string) *ShellConnDebugInfo {
@@ -51,7 +65,7 @@ func (st *ShellTransportSSHLib) makeDebugInfo(message string) *ShellConnDebugInf
 }
 
 func (st *ShellTransportSSHLib) doConnect(
-	resCh chan<- ShellConnUpdate,
+	resCh chan<- ShellConnUpdate, timeout time.Duration,
 ) (res ShellConnResult) {
 	logger := st.params.Logger
 
@@ -67,16 +81,23 @@ func (st *ShellTransportSSHLib) doConnect(
 
 	connDetails := st.params.ConnDetails
 
+	viaDescr := ""
+	if len(connDetails.Jumphosts) > 0 {
+		viaDescr = ", via jumphosts: " + jumphostsDescr(connDetails.Jumphosts)
+	} else if connDetails.ProxyCommand != "" {
+		viaDescr = ", via proxy command: " + connDetails.ProxyCommand
+	}
+
 	resCh <- ShellConnUpdate{
 		DebugInfo: st.makeDebugInfo(fmt.Sprintf(
-			"Trying to connect using internal ssh library to addr: %s, user: %s",
-			connDetails.Host.Addr, connDetails.Host.User,
+			"Trying to connect using internal ssh library to addr: %s, user: %s%s",
+			connDetails.Host.Addr, connDetails.Host.User, viaDescr,
 		)),
 	}
 
 	var sshClient *ssh.Client
 
-	conf, err := st.getClientConfig(resCh, logger, connDetails.Host.User)
+	conf, err := st.getClientConfig(resCh, logger, connDetails.Host, timeout)
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting ssh client for %s", connDetails.Host.User)
 		return res
@@ -86,17 +107,17 @@ func (st *ShellTransportSSHLib) doConnect(
 		DebugInfo: st.makeDebugInfo(fmt.Sprintf("Got client config: %s", conf.Descr)),
 	}
 
-	if connDetails.Jumphost != nil {
-		logger.Infof("Connecting via jumphost")
+	if len(connDetails.Jumphosts) > 0 {
+		logger.Infof("Connecting via jumphosts: %s", jumphostsDescr(connDetails.Jumphosts))
 		// Use jumphost
-		jumphost, err := st.getJumphostClient(resCh, logger, connDetails.Jumphost)
+		jumphost, err := st.getJumphostClient(resCh, logger, connDetails.Jumphosts, timeout)
 		if err != nil {
 			logger.Errorf("Jumphost connection failed: %s", err)
 			res.Err = errors.Annotatef(err, "getting jumphost client")
 			return res
 		}
 
-		conn, err := dialWithTimeout(jumphost, "tcp", connDetails.Host.Addr, connectionTimeout)
+		conn, err := dialWithTimeout(jumphost, "tcp", connDetails.Host.Addr, timeout)
 		if err != nil {
 			res.Err = errors.Annotatef(err, conf.Descr)
 			return res
@@ -108,6 +129,22 @@ func (st *ShellTransportSSHLib) doConnect(
 			return res
 		}
 
+		sshClient = ssh.NewClient(authConn, chans, reqs)
+	} else if connDetails.ProxyCommand != "" {
+		logger.Infof("Connecting via proxy command: %s", connDetails.ProxyCommand)
+		conn, err := newProxyCommandConn(connDetails.ProxyCommand)
+		if err != nil {
+			res.Err = errors.Annotatef(err, "starting proxy command")
+			return res
+		}
+
+		authConn, chans, reqs, err := ssh.NewClientConn(conn, connDetails.Host.Addr, conf.ClientConfig)
+		if err != nil {
+			conn.Close()
+			res.Err = errors.Annotatef(err, conf.Descr)
+			return res
+		}
+
 		sshClient = ssh.NewClient(authConn, chans, reqs)
 	} else {
 		logger.Infof("Connecting to %s (%+v)", connDetails.Host.Addr, conf)
@@ -156,6 +193,10 @@ func (st *ShellTransportSSHLib) doConnect(
 		return res
 	}
 
+	// Without keepalives, if the network goes away silently (e.g. VPN blips),
+	// we'd be waiting for the output forever.
+	go sshKeepalive(sshClient, logger)
+
 	res.Conn = &ShellConnSSH{
 		sshClient:  sshClient,
 		sshSession: sshSession,
@@ -168,6 +209,57 @@ func (st *ShellTransportSSHLib) doConnect(
 	return res
 }
 
+const (
+	// sshKeepaliveInterval is how often the keepalive requests are sent to the
+	// ssh server; it's used by ssh-bin as ServerAliveInterval as well.
+	sshKeepaliveInterval = 15 * time.Second
+
+	// sshKeepaliveCountMax is how many keepalive requests in a row may go
+	// unanswered before the connection is considered dead; it's used by ssh-bin
+	// as ServerAliveCountMax as well.
+	sshKeepaliveCountMax = 3
+)
+
+// sshKeepalive sends keepalive requests to the server every
+// sshKeepaliveInterval, like the ssh binary does with ServerAliveInterval, and
+// closes the client if the server doesn't respond sshKeepaliveCountMax times
+// in a row. It returns once the client is closed.
+func sshKeepalive(client *ssh.Client, logger *log.Logger) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	numMissed := 0
+	for range ticker.C {
+		errCh := make(chan error, 1)
+		go func() {
+			// The server doesn't know this request type and replies with a
+			// failure, but any reply means it's alive.
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errCh <- err
+		}()
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				// The connection is closed already.
+				return
+			}
+
+			numMissed = 0
+
+		case <-time.After(sshKeepaliveInterval):
+			numMissed++
+			logger.Warnf("ssh keepalive: no response from the server (%d)", numMissed)
+
+			if numMissed >= sshKeepaliveCountMax {
+				logger.Errorf("ssh keepalive: no response from the server, closing the connection")
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
 // dialWithTimeout is a hack needed to get a timeout for the ssh client.
 // https://stackoverflow.com/questions/31554196/ssh-connection-timeout
 //
@@ -192,7 +284,7 @@ func dialWithTimeout(client *ssh.Client, protocol, hostAddr string, timeout time
 	case err := <-errChan:
 		return nil, errors.Trace(err)
 
-	case <-time.After(connectionTimeout):
+	case <-time.After(timeout):
 		// Don't close the connection here since it's reused
 		return nil, errors.New("ssh client dial timed out")
 	}
@@ -215,37 +307,226 @@ type AuthMethodWMeta struct {
 	Descr string
 }
 
-func (st *ShellTransportSSHLib) getClientConfig(resCh chan<- ShellConnUpdate, logger *log.Logger, username string) (*ClientConfigWMeta, error) {
-	auth, err := st.getSSHAuthMethod(resCh, logger)
+func (st *ShellTransportSSHLib) getClientConfig(
+	resCh chan<- ShellConnUpdate, logger *log.Logger, host ConfigHost, timeout time.Duration,
+) (*ClientConfigWMeta, error) {
+	// The identity files from the ssh config for this particular host go first,
+	// and then the globally configured ones.
+	var keyPaths []string
+	for _, paths := range [][]string{host.IdentityFiles, st.params.SSHKeys} {
+		for _, keyPath := range paths {
+			if !containsString(keyPaths, keyPath) {
+				keyPaths = append(keyPaths, keyPath)
+			}
+		}
+	}
+
+	var authMethods []ssh.AuthMethod
+	var descr string
+
+	// If there are no usable keys, it's not fatal if the password auth is
+	// enabled: the host might accept passwords, so we'll still try that.
+	auth, err := st.getSSHAuthMethod(resCh, logger, keyPaths)
 	if err != nil {
-		return nil, errors.Trace(err)
+		if !st.params.PasswordAuth {
+			return nil, errors.Trace(err)
+		}
+
+		logger.Infof("No public key auth: %s", err.Error())
+		descr = fmt.Sprintf("no public key auth (%s)", err.Error())
+	} else {
+		authMethods = append(authMethods, auth.AuthMethod)
+		descr = auth.Descr
+	}
+
+	if st.params.PasswordAuth {
+		// Same order as ssh uses by default: public key, keyboard-interactive,
+		// password. The server only lets us try the ones it supports.
+		prompter := &sshPasswordPrompter{
+			st:    st,
+			resCh: resCh,
+			host:  host,
+		}
+
+		authMethods = append(
+			authMethods,
+			ssh.RetryableAuthMethod(ssh.KeyboardInteractive(prompter.keyboardInteractive), sshPasswordAttempts),
+			ssh.RetryableAuthMethod(ssh.PasswordCallback(prompter.password), sshPasswordAttempts),
+		)
+
+		descr += ", then password or keyboard-interactive"
 	}
 
 	return &ClientConfigWMeta{
 		ClientConfig: &ssh.ClientConfig{
-			User: username,
-			Auth: []ssh.AuthMethod{auth.AuthMethod},
+			User: host.User,
+			Auth: authMethods,
 
 			// TODO: fix it
 			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 
-			Timeout: connectionTimeout,
+			Timeout: timeout,
 		},
-		Descr: auth.Descr,
+		Descr: descr,
 	}, nil
 }
 
+// sshPasswordAttempts is how many times the user can try to enter the
+// password (or to answer the keyboard-interactive challenges) during a single
+// connection attempt.
+const sshPasswordAttempts = 3
+
+var (
+	// sshPasswordsCache contains the passwords entered by the user, keyed by
+	// ConfigHost.Key(). Only used if ShellTransportSSHLibParams.CachePassword
+	// is true.
+	sshPasswordsCache    = map[string]string{}
+	sshPasswordsCacheMtx sync.Mutex
+)
+
+// sshPasswordPrompter implements the callbacks for the password and
+// keyboard-interactive auth methods, for a single connection attempt to a
+// single host.
+type sshPasswordPrompter struct {
+	st    *ShellTransportSSHLib
+	resCh chan<- ShellConnUpdate
+	host  ConfigHost
+
+	// numPasswordAttempts is how many times we've provided the password
+	// during this connection attempt; if it's more than one, then the previous
+	// one was wrong.
+	numPasswordAttempts int
+}
+
+func (p *sshPasswordPrompter) hostDescr() string {
+	return fmt.Sprintf("%s@%s", p.host.User, p.host.Addr)
+}
+
+// getPassword returns the cached password for the host if it's available and
+// wasn't rejected already during this connection attempt; otherwise, asks the
+// user for the password using the given prompt.
+func (p *sshPasswordPrompter) getPassword(prompt string) (string, error) {
+	p.numPasswordAttempts++
+
+	key := p.host.Key()
+	if p.st.params.CachePassword {
+		if password, ok := p.getCachedPassword(key); ok {
+			return password, nil
+		}
+	}
+
+	// Not holding sshPasswordsCacheMtx while the prompt is open, so that the
+	// other connections can still use the cache meanwhile.
+	password, ok := requestData(
+		p.resCh,
+		nil,
+		"SSH password",
+		fmt.Sprintf("%s\n%s", p.hostDescr(), prompt),
+		ShellConnDataKindPassword,
+	)
+	if !ok {
+		return "", errors.Errorf("no password provided for %s", p.hostDescr())
+	}
+
+	if p.st.params.CachePassword {
+		sshPasswordsCacheMtx.Lock()
+		sshPasswordsCache[key] = password
+		sshPasswordsCacheMtx.Unlock()
+	}
+
+	return password, nil
+}
+
+// getCachedPassword returns the cached password for the given host key, unless
+// it was rejected already during this connection attempt, in which case it's
+// removed from the cache.
+func (p *sshPasswordPrompter) getCachedPassword(key string) (string, bool) {
+	sshPasswordsCacheMtx.Lock()
+	defer sshPasswordsCacheMtx.Unlock()
+
+	password, ok := sshPasswordsCache[key]
+	if !ok {
+		return "", false
+	}
+
+	if p.numPasswordAttempts == 1 {
+		return password, true
+	}
+
+	// The cached password was rejected, so forget it.
+	delete(sshPasswordsCache, key)
+
+	return "", false
+}
+
+func (p *sshPasswordPrompter) password() (string, error) {
+	return p.getPassword("Password:")
+}
+
+func (p *sshPasswordPrompter) keyboardInteractive(
+	name, instruction string, questions []string, echos []bool,
+) ([]string, error) {
+	answers := make([]string, 0, len(questions))
+
+	for i, question := range questions {
+		// If the challenge is just a password prompt, treat it as such, so that
+		// it can be cached. Everything else, like OTP codes, is never cached.
+		if len(questions) == 1 && !echos[i] && isPasswordQuestion(question) {
+			password, err := p.getPassword(question)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			answers = append(answers, password)
+			continue
+		}
+
+		kind := ShellConnDataKindPassword
+		if echos[i] {
+			kind = ShellConnDataKindText
+		}
+
+		var msg strings.Builder
+		msg.WriteString(p.hostDescr())
+		for _, s := range []string{name, instruction, question} {
+			if s != "" {
+				msg.WriteString("\n")
+				msg.WriteString(strings.TrimSpace(s))
+			}
+		}
+
+		answer, ok := requestData(p.resCh, nil, "SSH authentication", msg.String(), kind)
+		if !ok {
+			return nil, errors.Errorf("no answer provided for %s", p.hostDescr())
+		}
+
+		answers = append(answers, answer)
+	}
+
+	return answers, nil
+}
+
+// isPasswordQuestion returns whether the keyboard-interactive question is
+// just asking for the password, like "Password: " or "user@host's password:".
+func isPasswordQuestion(question string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSpace(question)), "password:")
+}
+
 var (
-	sshAuthMethodShared    *AuthMethodWMeta
+	// sshAuthMethodsShared contains the auth methods keyed by the list of ssh
+	// keys to try (joined with newlines), so that we don't parse the same keys
+	// (and ask for the same passphrases) for every host.
+	sshAuthMethodsShared   = map[string]*AuthMethodWMeta{}
 	sshAuthMethodSharedMtx sync.Mutex
 )
 
-func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, logger *log.Logger) (*AuthMethodWMeta, error) {
+func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, logger *log.Logger, keyPaths []string) (*AuthMethodWMeta, error) {
 	sshAuthMethodSharedMtx.Lock()
 	defer sshAuthMethodSharedMtx.Unlock()
 
-	if sshAuthMethodShared != nil {
-		return sshAuthMethodShared, nil
+	sharedKey := strings.Join(keyPaths, "\n")
+	if authMethod := sshAuthMethodsShared[sharedKey]; authMethod != nil {
+		return authMethod, nil
 	}
 
 	// Try ssh-agent first
@@ -258,11 +539,41 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 			logger.Infof("Failed to connect to ssh-agent: %s", err.Error())
 			sshAgentErr = errors.Annotatef(err, "using SSH_AUTH_SOCK env var")
 		} else {
-			sshAuthMethodShared = &AuthMethodWMeta{
-				AuthMethod: ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers),
-				Descr:      "using ssh-agent",
+			agentClient := agent.NewClient(sshAgent)
+			authMethod := &AuthMethodWMeta{
+				// The agent might hold certificates itself (then its signers already
+				// use them), but the certificate might also be only on disk next to
+				// the key, so we also look for those. It's done on every connection,
+				// since the certificates might be short-lived, and renewed while
+				// nerdlog is running.
+				AuthMethod: ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					signers, err := agentClient.Signers()
+					if err != nil {
+						return nil, errors.Trace(err)
+					}
+
+					var certSigners []ssh.Signer
+					for _, keyPath := range keyPaths {
+						cert := loadCert(keyPath, logger)
+						if cert == nil || agentHasKey(signers, cert) {
+							continue
+						}
+
+						for _, signer := range signers {
+							if certSigner := newCertSigner(cert, signer); certSigner != nil {
+								certSigners = append(certSigners, certSigner)
+							}
+						}
+					}
+
+					// Certificates go first, since when they're present, they're usually
+					// the only thing the server accepts.
+					return append(certSigners, signers...), nil
+				}),
+				Descr: "using ssh-agent",
 			}
-			return sshAuthMethodShared, nil
+			sshAuthMethodsShared[sharedKey] = authMethod
+			return authMethod, nil
 		}
 	} else {
 		sshAgentErr = errors.Errorf("SSH_AUTH_SOCK env var is empty")
@@ -275,7 +586,7 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 	var keyPath string
 	var keyData []byte
 	var errBuilder strings.Builder
-	for _, keyPath = range st.params.SSHKeys {
+	for _, keyPath = range keyPaths {
 		var err error
 		keyData, err = os.ReadFile(keyPath)
 		if err != nil {
@@ -293,7 +604,7 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 	if len(keyData) == 0 {
 		return nil, errors.Errorf(
 			"failed to read key data from any of the following: %s (%s)",
-			st.params.SSHKeys,
+			keyPaths,
 			errBuilder.String(),
 		)
 	}
@@ -303,24 +614,17 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 		if _, ok := err.(*ssh.PassphraseMissingError); ok {
 			// We need a passphrase to decrypt the private key. Request it from
 			// the client code.
-			passphraseCh := make(chan string, 1)
-
-			resCh <- ShellConnUpdate{
-				DataRequest: &ShellConnDataRequest{
-					Title:      "SSH key is passphrase-protected",
-					Message:    fmt.Sprintf("Unable to use ssh-agent: %s, falling back to ssh keys.\nPlease enter passphrase for %s.\nAlternatively, use ssh-agent, and make sure the SSH_AUTH_SOCK environment variable is set correctly.\nTo use a different ssh key, provide it with the --ssh-key flag.", sshAgentErr.Error(), keyPath),
-					DataKind:   ShellConnDataKindPassword,
-					ResponseCh: passphraseCh,
-				},
+			passphrase, ok := requestData(
+				resCh,
+				nil,
+				"SSH key is passphrase-protected",
+				fmt.Sprintf("Unable to use ssh-agent: %s, falling back to ssh keys.\nPlease enter passphrase for %s.\nAlternatively, use ssh-agent, and make sure the SSH_AUTH_SOCK environment variable is set correctly.\nTo use a different ssh key, provide it with the --ssh-key flag.", sshAgentErr.Error(), keyPath),
+				ShellConnDataKindPassword,
+			)
+			if !ok {
+				return nil, errors.Errorf("no passphrase provided for %s", keyPath)
 			}
 
-			// Now wait for the client code to provide the passphrase.
-			//
-			// TODO: support teardown; as of now, if the user tries to exit the app,
-			// it'll be stuck on the "Closing connections" stage, until the Ctrl+C is
-			// pressed.
-			passphrase := <-passphraseCh
-
 			var err error
 			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
 			if err != nil {
@@ -330,38 +634,179 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 				// passphrase again.
 				return nil, errors.Annotatef(err, "parsing private key from %s with the given passphrase", keyPath)
 			}
+		} else if isSecurityKey(keyPath) {
+			// The FIDO/security keys (like sk-ssh-ed25519) need the hardware to
+			// sign, and we can only use them via the ssh-agent.
+			return nil, errors.Annotatef(
+				err,
+				"%s is a security key, which can only be used via ssh-agent (add it with ssh-add, and make sure SSH_AUTH_SOCK is set)",
+				keyPath,
+			)
 		} else {
 			return nil, errors.Annotatef(err, "parsing private key from %s", keyPath)
 		}
 	}
 
 	logger.Infof("Using private key from %s", keyPath)
-	sshAuthMethodShared = &AuthMethodWMeta{
-		AuthMethod: ssh.PublicKeys(signer),
-		Descr:      fmt.Sprintf("using key %s", keyPath),
+	authMethod := &AuthMethodWMeta{
+		// If there's a certificate next to the key, it's offered first. Same as
+		// with the agent, it's loaded on every connection.
+		AuthMethod: ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if cert := loadCert(keyPath, logger); cert != nil {
+				if certSigner := newCertSigner(cert, signer); certSigner != nil {
+					return []ssh.Signer{certSigner, signer}, nil
+				}
+			}
+
+			return []ssh.Signer{signer}, nil
+		}),
+		Descr: fmt.Sprintf("using key %s", keyPath),
 	}
-	return sshAuthMethodShared, nil
+	sshAuthMethodsShared[sharedKey] = authMethod
+	return authMethod, nil
+}
+
+// loadCert loads the OpenSSH certificate for the given private key, which is
+// expected to be next to it, like "id_ed25519-cert.pub" for "id_ed25519". If
+// there's no certificate, or it's invalid or expired, returns nil.
+func loadCert(keyPath string, logger *log.Logger) *ssh.Certificate {
+	certPath := keyPath + "-cert.pub"
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Infof("Failed to read certificate %s: %s", certPath, err.Error())
+		}
+		return nil
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		logger.Infof("Failed to parse certificate %s: %s", certPath, err.Error())
+		return nil
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		logger.Infof("%s is not a certificate", certPath)
+		return nil
+	}
+
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter || (cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore) {
+		logger.Infof("Certificate %s is expired or not yet valid, ignoring it", certPath)
+		return nil
+	}
+
+	logger.Infof("Using certificate %s", certPath)
+	return cert
+}
+
+// newCertSigner returns the signer which authenticates with the given
+// certificate, if the certificate is for the signer's key; otherwise returns
+// nil.
+func newCertSigner(cert *ssh.Certificate, signer ssh.Signer) ssh.Signer {
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil
+	}
+
+	return certSigner
+}
+
+// agentHasKey returns whether the given public key (which might be a
+// certificate) is among the signers already.
+func agentHasKey(signers []ssh.Signer, pubKey ssh.PublicKey) bool {
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pubKey.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecurityKey returns whether the private key at the given path is a
+// FIDO/security key, like sk-ssh-ed25519, judging by its public key file
+// next to it.
+func isSecurityKey(keyPath string) bool {
+	pubData, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return false
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(pubKey.Type(), "sk-")
 }
 
 var (
+	// jumphostsShared contains connections to the jumphosts, keyed by the
+	// whole chain of jumphosts (see jumphostsKey), so that they're reused by
+	// all the logstreams behind the same jumphosts.
 	jumphostsShared    = map[string]*ssh.Client{}
 	jumphostsSharedMtx sync.Mutex
 )
 
-func (st *ShellTransportSSHLib) getJumphostClient(resCh chan<- ShellConnUpdate, logger *log.Logger, jhConfig *ConfigHost) (*ssh.Client, error) {
+// getJumphostClient returns the client connected to the last jumphost in the
+// chain, connecting to all the jumphosts in the chain as needed.
+func (st *ShellTransportSSHLib) getJumphostClient(
+	resCh chan<- ShellConnUpdate, logger *log.Logger, chain []ConfigHost, timeout time.Duration,
+) (*ssh.Client, error) {
 	jumphostsSharedMtx.Lock()
 	defer jumphostsSharedMtx.Unlock()
 
-	key := jhConfig.Key()
+	return st.getJumphostClientLocked(resCh, logger, chain, timeout)
+}
+
+// getJumphostClientLocked is like getJumphostClient, but expects
+// jumphostsSharedMtx to be locked already.
+func (st *ShellTransportSSHLib) getJumphostClientLocked(
+	resCh chan<- ShellConnUpdate, logger *log.Logger, chain []ConfigHost, timeout time.Duration,
+) (*ssh.Client, error) {
+	key := jumphostsKey(chain)
 	jh := jumphostsShared[key]
-	if jh == nil {
-		logger.Infof("Connecting to jumphost... %+v", jhConfig)
+	if jh != nil {
+		return jh, nil
+	}
+
+	jhConfig := chain[len(chain)-1]
 
-		parts := strings.Split(jhConfig.Addr, ":")
-		if len(parts) != 2 {
-			return nil, errors.Errorf("malformed jumphost address %q", jhConfig.Addr)
+	// If there are more jumphosts in the chain, we need to connect to this one
+	// through the previous one.
+	var prev *ssh.Client
+	if len(chain) > 1 {
+		var err error
+		prev, err = st.getJumphostClientLocked(resCh, logger, chain[:len(chain)-1], timeout)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
+	}
 
+	logger.Infof("Connecting to jumphost... %+v", jhConfig)
+	resCh <- ShellConnUpdate{
+		DebugInfo: st.makeDebugInfo(fmt.Sprintf(
+			"Connecting to jumphost addr: %s, user: %s", jhConfig.Addr, jhConfig.User,
+		)),
+	}
+
+	parts := strings.Split(jhConfig.Addr, ":")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("malformed jumphost address %q", jhConfig.Addr)
+	}
+
+	conf, err := st.getClientConfig(resCh, logger, jhConfig, timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if prev == nil {
 		addrs, err := net.LookupHost(parts[0])
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -371,24 +816,70 @@ func (st *ShellTransportSSHLib) getJumphostClient(resCh chan<- ShellConnUpdate,
 			return nil, errors.New("Address not found")
 		}
 
-		conf, err := st.getClientConfig(resCh, logger, jhConfig.User)
+		jh, err = ssh.Dial("tcp", jhConfig.Addr, conf.ClientConfig)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, errors.Annotatef(err, "jumphost %s", jhConfig.Addr)
 		}
-
-		jh, err = ssh.Dial("tcp", jhConfig.Addr, conf.ClientConfig)
+	} else {
+		// The hostname is resolved by the previous jumphost, since it might not
+		// be resolvable from here at all.
+		conn, err := dialWithTimeout(prev, "tcp", jhConfig.Addr, timeout)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, errors.Annotatef(err, "jumphost %s", jhConfig.Addr)
 		}
 
-		jumphostsShared[key] = jh
+		authConn, chans, reqs, err := ssh.NewClientConn(conn, jhConfig.Addr, conf.ClientConfig)
+		if err != nil {
+			return nil, errors.Annotatef(err, "jumphost %s", jhConfig.Addr)
+		}
 
-		logger.Infof("Jumphost ok")
+		jh = ssh.NewClient(authConn, chans, reqs)
 	}
 
+	jumphostsShared[key] = jh
+
+	// Once the jumphost connection is lost, forget about it, so that the next
+	// connection attempt connects to the jumphost again instead of reusing the
+	// dead connection.
+	go func(jh *ssh.Client) {
+		jh.Wait()
+
+		jumphostsSharedMtx.Lock()
+		defer jumphostsSharedMtx.Unlock()
+
+		if jumphostsShared[key] == jh {
+			delete(jumphostsShared, key)
+		}
+	}(jh)
+	go sshKeepalive(jh, logger)
+
+	logger.Infof("Jumphost ok")
+
 	return jh, nil
 }
 
+// jumphostsKey returns the key for jumphostsShared for the given chain of
+// jumphosts.
+func jumphostsKey(chain []ConfigHost) string {
+	keys := make([]string, 0, len(chain))
+	for _, jh := range chain {
+		keys = append(keys, jh.Key())
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// jumphostsDescr returns a human-readable description of the chain of
+// jumphosts, like "user1@host1:22 -> user2@host2:22".
+func jumphostsDescr(chain []ConfigHost) string {
+	descrs := make([]string, 0, len(chain))
+	for _, jh := range chain {
+		descrs = append(descrs, fmt.Sprintf("%s@%s", jh.User, jh.Addr))
+	}
+
+	return strings.Join(descrs, " -> ")
+}
+
 // ShellConnSSH implements ShellConn for SSH.
 type ShellConnSSH struct {
 	sshClient  *ssh.Client
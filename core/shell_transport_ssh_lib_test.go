@@ -0,0 +1,195 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHPasswordPrompter(t *testing.T) {
+	resCh := make(chan ShellConnUpdate)
+	var gotMessages []string
+
+	// Answer every data request with the next response from the list.
+	answers := []ShellConnDataResponse{
+		{Value: "wrong", OK: true},
+		{Value: "right", OK: true},
+		{Value: "123456", OK: true},
+		{Value: "", OK: true},
+		{},
+	}
+	go func() {
+		for upd := range resCh {
+			gotMessages = append(gotMessages, upd.DataRequest.Message)
+			upd.DataRequest.ResponseCh <- answers[0]
+			answers = answers[1:]
+		}
+	}()
+
+	st := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		CachePassword: true,
+		Logger:        log.NewLogger(log.Error),
+	})
+
+	host := ConfigHost{Addr: "cache-test.com:22", User: "myuser"}
+
+	// The cache is global, so make sure it doesn't have the password from the
+	// previous runs.
+	sshPasswordsCacheMtx.Lock()
+	delete(sshPasswordsCache, host.Key())
+	sshPasswordsCacheMtx.Unlock()
+	newPrompter := func() *sshPasswordPrompter {
+		return &sshPasswordPrompter{st: st, resCh: resCh, host: host}
+	}
+
+	// First connection: the first password is wrong, so it's asked again.
+	p := newPrompter()
+	password, err := p.password()
+	assert.NoError(t, err)
+	assert.Equal(t, "wrong", password)
+
+	password, err = p.password()
+	assert.NoError(t, err)
+	assert.Equal(t, "right", password)
+
+	// Second connection: the cached password is used, and a keyboard-interactive
+	// password question is treated as a password too.
+	p = newPrompter()
+	gotAnswers, err := p.keyboardInteractive("", "", []string{"Password: "}, []bool{false})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"right"}, gotAnswers)
+
+	// OTP is always asked for.
+	gotAnswers, err = p.keyboardInteractive("", "Two-factor", []string{"Code: "}, []bool{true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"123456"}, gotAnswers)
+
+	// An empty answer is a valid answer, unlike the refusal.
+	gotAnswers, err = p.keyboardInteractive("", "", []string{"Empty: "}, []bool{true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, gotAnswers)
+
+	_, err = p.keyboardInteractive("", "", []string{"Refused: "}, []bool{true})
+	assert.Error(t, err)
+
+	close(resCh)
+
+	assert.Equal(t, []string{
+		"myuser@cache-test.com:22\nPassword:",
+		"myuser@cache-test.com:22\nPassword:",
+		"myuser@cache-test.com:22\nTwo-factor\nCode:",
+		"myuser@cache-test.com:22\nEmpty:",
+		"myuser@cache-test.com:22\nRefused:",
+	}, gotMessages)
+}
+
+func TestSSHCertificates(t *testing.T) {
+	logger := log.NewLogger(log.Error)
+	dir := t.TempDir()
+
+	newSigner := func() ssh.Signer {
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signer
+	}
+
+	caSigner := newSigner()
+	userSigner := newSigner()
+	otherSigner := newSigner()
+
+	writeCert := func(keyPath string, validBefore uint64) {
+		cert := &ssh.Certificate{
+			Key:             userSigner.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"myuser"},
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatal(err)
+		}
+
+		err := os.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	validKeyPath := filepath.Join(dir, "id_valid")
+	writeCert(validKeyPath, ssh.CertTimeInfinity)
+
+	expiredKeyPath := filepath.Join(dir, "id_expired")
+	writeCert(expiredKeyPath, uint64(time.Now().Add(-time.Hour).Unix()))
+
+	assert.Nil(t, loadCert(filepath.Join(dir, "id_nonexistent"), logger))
+	assert.Nil(t, loadCert(expiredKeyPath, logger))
+
+	cert := loadCert(validKeyPath, logger)
+	if !assert.NotNil(t, cert) {
+		return
+	}
+
+	certSigner := newCertSigner(cert, userSigner)
+	if assert.NotNil(t, certSigner) {
+		assert.Equal(t, ssh.CertAlgoED25519v01, certSigner.PublicKey().Type())
+	}
+
+	// The certificate for a different key can't be used.
+	assert.Nil(t, newCertSigner(cert, otherSigner))
+
+	assert.True(t, agentHasKey([]ssh.Signer{otherSigner, certSigner}, cert))
+	assert.False(t, agentHasKey([]ssh.Signer{otherSigner, userSigner}, cert))
+}
+
+func TestIsSecurityKey(t *testing.T) {
+	dir := t.TempDir()
+
+	writePubKey := func(name string, pubKey ssh.PublicKey) string {
+		keyPath := filepath.Join(dir, name)
+		err := os.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(pubKey), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return keyPath
+	}
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKey, err := ssh.NewPublicKey(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There's no constructor for the sk keys, so build the wire format
+	// manually.
+	skPubKey, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, edPub, "ssh:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, isSecurityKey(writePubKey("id_ed25519", pubKey)))
+	assert.True(t, isSecurityKey(writePubKey("id_ed25519_sk", skPubKey)))
+	assert.False(t, isSecurityKey(filepath.Join(dir, "id_nonexistent")))
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// maxSudoPasswordAttempts is how many times the user is asked for the sudo
+// password on a single connection before giving up.
+const maxSudoPasswordAttempts = 3
+
+// sudoCheckMarker is printed by the shell, followed by the exit code of
+// "sudo -v", when checking the sudo password.
+const sudoCheckMarker = "nerdlog_sudo_check:"
+
+// ShellTransportSudoPassword is an implementation of ShellTransport which
+// wraps another transport, for the logstreams using SudoMethodSudoPassword:
+// once the inner transport is connected, it asks the user for the sudo
+// password, checks it with "sudo -S -v", and stores it in the non-exported
+// shell variable sudoPasswordVar, to be piped to sudo or to the agent later,
+// see getSudoPasswordFuncDef and getGranularSudoPasswordPipe.
+//
+// The password is remembered, so that reconnecting doesn't ask for it again,
+// unless it turns out to be wrong.
+type ShellTransportSudoPassword struct {
+	params ShellTransportSudoPasswordParams
+
+	mtx      sync.Mutex
+	password string
+}
+
+type ShellTransportSudoPasswordParams struct {
+	// Inner is the transport which actually connects to the host.
+	Inner ShellTransport
+
+	// Descr is the human-readable description of the logstream, to include in
+	// the prompts.
+	Descr string
+
+	Logger *log.Logger
+}
+
+func NewShellTransportSudoPassword(
+	params ShellTransportSudoPasswordParams,
+) *ShellTransportSudoPassword {
+	return &ShellTransportSudoPassword{
+		params: params,
+	}
+}
+
+// Connect connects using the inner transport, forwarding all its updates to
+// resCh, and once it's connected, sets up the sudo password. The timeout is
+// used for the inner transport, and then again for checking the password.
+func (s *ShellTransportSudoPassword) Connect(resCh chan<- ShellConnUpdate, timeout time.Duration) {
+	innerResCh := make(chan ShellConnUpdate, 1)
+	s.params.Inner.Connect(innerResCh, timeout)
+
+	go s.doConnect(innerResCh, resCh, timeout)
+}
+
+func (s *ShellTransportSudoPassword) doConnect(
+	innerResCh <-chan ShellConnUpdate, resCh chan<- ShellConnUpdate, timeout time.Duration,
+) {
+	for upd := range innerResCh {
+		if upd.Result == nil || upd.Result.Err != nil {
+			resCh <- upd
+			if upd.Result != nil {
+				return
+			}
+
+			continue
+		}
+
+		res := s.setupPassword(resCh, upd.Result.Conn, timeout)
+		if res.Err != nil {
+			s.params.Logger.Errorf("Sudo password setup failed: %s", res.Err)
+			upd.Result.Conn.Close()
+		}
+
+		resCh <- ShellConnUpdate{
+			Result: &res,
+		}
+
+		return
+	}
+}
+
+// setupPassword asks the user for the password (unless it's known already),
+// and checks it, until it's right or we run out of attempts.
+func (s *ShellTransportSudoPassword) setupPassword(
+	resCh chan<- ShellConnUpdate, conn ShellConn, timeout time.Duration,
+) ShellConnResult {
+	stdout := bufio.NewReader(conn.Stdout())
+
+	for attempt := 1; ; attempt++ {
+		password := s.getPassword()
+		if password == "" {
+			msg := fmt.Sprintf("%s\nSudo password:", s.params.Descr)
+			if attempt > 1 {
+				msg = fmt.Sprintf("%s\nWrong sudo password, try again:", s.params.Descr)
+			}
+
+			var ok bool
+			password, ok = requestData(resCh, nil, "sudo password", msg, ShellConnDataKindPassword)
+			if !ok || password == "" {
+				return ShellConnResult{Err: errors.Errorf("no sudo password provided")}
+			}
+		}
+
+		resCh <- ShellConnUpdate{
+			DebugInfo: &ShellConnDebugInfo{
+				Message: "Checking sudo password",
+			},
+		}
+
+		ok, err := checkSudoPassword(conn.Stdin(), stdout, password, timeout)
+		if err != nil {
+			return ShellConnResult{Err: errors.Annotatef(err, "checking sudo password")}
+		}
+
+		if ok {
+			s.setPassword(password)
+			return ShellConnResult{
+				Conn: &shellConnSudoPassword{ShellConn: conn, stdout: stdout},
+			}
+		}
+
+		s.setPassword("")
+
+		if attempt >= maxSudoPasswordAttempts {
+			return ShellConnResult{Err: errors.Errorf(
+				"sudo -v failed %d times; either the password is wrong, or sudo isn't permitted",
+				attempt,
+			)}
+		}
+	}
+}
+
+func (s *ShellTransportSudoPassword) getPassword() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.password
+}
+
+func (s *ShellTransportSudoPassword) setPassword(password string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.password = password
+}
+
+// checkSudoPassword sets the sudoPasswordVar shell variable to the given
+// password, defines the sudoPasswordFunc shell function, and checks whether
+// "sudo -S -v" accepts the password. The output preceding the result (like the
+// welcome message) is skipped.
+func checkSudoPassword(
+	stdin io.Writer, stdout *bufio.Reader, password string, timeout time.Duration,
+) (bool, error) {
+	script := fmt.Sprintf(
+		"%s=%s\n%s\n%s; echo %s$?\n",
+		sudoPasswordVar, shellQuote(password), getSudoPasswordFuncDef(),
+		getSudoPasswordCheckCmd(), sudoCheckMarker,
+	)
+
+	if _, err := stdin.Write([]byte(script)); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	type checkResult struct {
+		ok  bool
+		err error
+	}
+
+	resultCh := make(chan checkResult, 1)
+	go func() {
+		for {
+			line, err := stdout.ReadString('\n')
+			if err != nil {
+				resultCh <- checkResult{err: errors.Trace(err)}
+				return
+			}
+
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, sudoCheckMarker) {
+				resultCh <- checkResult{ok: line == sudoCheckMarker+"0"}
+				return
+			}
+		}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.ok, res.err
+	case <-time.After(timeout):
+		// The reading goroutine finishes once the caller closes the connection.
+		return false, errors.Errorf("timed out")
+	}
+}
+
+// shellConnSudoPassword is the ShellConn returned by ShellTransportSudoPassword:
+// since some of the stdout might be buffered already while checking the
+// password, it has to be read through the same buffered reader.
+type shellConnSudoPassword struct {
+	ShellConn
+	stdout io.Reader
+}
+
+func (c *shellConnSudoPassword) Stdout() io.Reader {
+	return c.stdout
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellTransportSudoPassword(t *testing.T) {
+	// Fake sudo which only accepts the password "right".
+	dir := t.TempDir()
+	err := os.WriteFile(
+		filepath.Join(dir, "sudo"),
+		[]byte("#!/bin/sh\nread pw\n[ \"$pw\" = right ]\n"),
+		0755,
+	)
+	require.NoError(t, err)
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	logger := log.NewLogger(log.Error)
+	st := NewShellTransportSudoPassword(ShellTransportSudoPasswordParams{
+		Inner:  NewShellTransportLocal(ShellTransportLocalParams{Logger: logger}),
+		Descr:  "mystream",
+		Logger: logger,
+	})
+
+	// connect connects and answers the data requests with the given answers,
+	// returning the prompt messages along with the result. An empty answer
+	// means that the user refuses to answer.
+	connect := func(answers []string) ([]string, *ShellConnResult) {
+		resCh := make(chan ShellConnUpdate)
+		st.Connect(resCh, 5*time.Second)
+
+		var messages []string
+		for upd := range resCh {
+			if req := upd.DataRequest; req != nil {
+				messages = append(messages, req.Message)
+				req.ResponseCh <- ShellConnDataResponse{Value: answers[0], OK: answers[0] != ""}
+				answers = answers[1:]
+			} else if upd.Result != nil {
+				return messages, upd.Result
+			}
+		}
+
+		return messages, nil
+	}
+
+	// The first password is wrong, so it's asked again.
+	messages, res := connect([]string{"wrong", "right"})
+	require.NoError(t, res.Err)
+	assert.Equal(t, []string{
+		"mystream\nSudo password:",
+		"mystream\nWrong sudo password, try again:",
+	}, messages)
+
+	res.Conn.Stdin().Write([]byte("echo \"pw:$NERDLOG_SUDO_PASSWORD\"\n"))
+	line, err := bufio.NewReader(res.Conn.Stdout()).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "pw:right\n", line)
+	res.Conn.Close()
+
+	// On reconnect, the remembered password is used.
+	messages, res = connect(nil)
+	require.NoError(t, res.Err)
+	assert.Nil(t, messages)
+	res.Conn.Close()
+
+	// Refusing to provide the password fails the connection.
+	st.setPassword("")
+	messages, res = connect([]string{""})
+	assert.Error(t, res.Err)
+	assert.Len(t, messages, 1)
+}
@@ -0,0 +1,297 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// EnvAskpassSocket is the env var which, when set, makes nerdlog act as the
+// SSH_ASKPASS helper: instead of starting the app, it forwards the prompt
+// (given as the first arg) to the nerdlog instance listening on the unix
+// socket at this path, and prints the answer. See RunAskpassHelper.
+const EnvAskpassSocket = "NERDLOG_ASKPASS_SOCKET"
+
+// askpassRequest is sent by the askpass helper to the askpass server, as a
+// single JSON line.
+type askpassRequest struct {
+	Prompt string `json:"prompt"`
+	// Confirm is true if ssh asks for a confirmation (like yes/no for an
+	// unknown host key) rather than for a secret.
+	Confirm bool `json:"confirm"`
+}
+
+// askpassResponse is sent back by the askpass server, as a single JSON line.
+// If OK is false, the user has refused to answer.
+type askpassResponse struct {
+	Answer string `json:"answer"`
+	OK     bool   `json:"ok"`
+}
+
+// RunAskpassHelper implements the SSH_ASKPASS helper mode: it's called by ssh
+// with the prompt as the only arg, forwards the prompt to the nerdlog instance
+// which runs the ssh (see EnvAskpassSocket), and prints the answer to stdout.
+// Returns the exit code for the process: non-zero means that the user has
+// refused to answer, or something has failed.
+func RunAskpassHelper(args []string) int {
+	prompt := ""
+	if len(args) > 0 {
+		prompt = args[0]
+	}
+
+	switch os.Getenv("SSH_ASKPASS_PROMPT") {
+	case "none":
+		// It's just a notification, like "Confirm user presence for key ...",
+		// and ssh doesn't need an answer: it'll kill the helper once it's not
+		// needed anymore. We don't show these.
+		return 0
+	}
+
+	answer, err := requestAskpassAnswer(os.Getenv(EnvAskpassSocket), prompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nerdlog askpass: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Println(answer)
+	return 0
+}
+
+// requestAskpassAnswer sends the prompt to the askpass server listening on the
+// given unix socket, and returns the answer.
+func requestAskpassAnswer(socketPath, prompt string) (string, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer conn.Close()
+
+	req := askpassRequest{
+		Prompt:  prompt,
+		Confirm: os.Getenv("SSH_ASKPASS_PROMPT") == "confirm" || strings.Contains(prompt, "(yes/no"),
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return "", errors.Annotatef(err, "sending request")
+	}
+
+	var resp askpassResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", errors.Annotatef(err, "reading response")
+	}
+
+	if !resp.OK {
+		return "", errors.Errorf("no answer provided")
+	}
+
+	return resp.Answer, nil
+}
+
+// askpassServer listens on the unix socket for the requests from the askpass
+// helpers, which are run by a single ssh process, and forwards them to the UI
+// as ShellConnDataRequest-s.
+type askpassServer struct {
+	// descr is the human-readable description of the ssh destination, to
+	// include in the prompts.
+	descr  string
+	resCh  chan<- ShellConnUpdate
+	logger *log.Logger
+
+	// mtx protects promptInProgress and lastPromptTime, which are used to
+	// extend the connection timeout while the user is typing, see
+	// extraWaitTime.
+	mtx              sync.Mutex
+	promptInProgress bool
+	lastPromptTime   time.Time
+
+	dir      string
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	// done is closed by Close, to cancel the prompt in progress (if any).
+	done chan struct{}
+}
+
+// newAskpassServer creates the askpass server and starts listening.
+func newAskpassServer(
+	descr string, resCh chan<- ShellConnUpdate, logger *log.Logger,
+) (*askpassServer, error) {
+	// Creating a separate dir which is only accessible by the current user, so
+	// that other users can't talk to the socket.
+	dir, err := os.MkdirTemp("", "nerdlog-askpass-")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Trace(err)
+	}
+
+	srv := &askpassServer{
+		descr:  descr,
+		resCh:  resCh,
+		logger: logger,
+
+		dir:      dir,
+		listener: listener,
+
+		done: make(chan struct{}),
+	}
+
+	srv.wg.Add(1)
+	go srv.serve()
+
+	return srv, nil
+}
+
+// env returns the env vars to run ssh with, so that it uses the helper.
+func (srv *askpassServer) env(askpassBinary string) []string {
+	return []string{
+		"SSH_ASKPASS=" + askpassBinary,
+		"SSH_ASKPASS_REQUIRE=force",
+		EnvAskpassSocket + "=" + srv.listener.Addr().String(),
+	}
+}
+
+func (srv *askpassServer) serve() {
+	defer srv.wg.Done()
+
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			// The listener is closed.
+			return
+		}
+
+		// The helpers are run by ssh one by one, so handling them sequentially.
+		srv.handleConn(conn)
+	}
+}
+
+func (srv *askpassServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req askpassRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		srv.logger.Errorf("Failed to read askpass request: %s", err.Error())
+		return
+	}
+
+	srv.logger.Infof("Got askpass prompt: %q", req.Prompt)
+
+	kind := ShellConnDataKindPassword
+	title := "SSH password"
+	if req.Confirm {
+		kind = ShellConnDataKindText
+		title = "SSH confirmation"
+	}
+
+	srv.setPromptInProgress(true)
+	answer, ok := requestData(
+		srv.resCh, srv.done, title, fmt.Sprintf("%s\n%s", srv.descr, strings.TrimSpace(req.Prompt)), kind,
+	)
+	srv.setPromptInProgress(false)
+
+	resp := askpassResponse{
+		Answer: answer,
+		OK:     ok,
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		srv.logger.Errorf("Failed to send askpass response: %s", err.Error())
+	}
+}
+
+func (srv *askpassServer) setPromptInProgress(inProgress bool) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	srv.promptInProgress = inProgress
+	srv.lastPromptTime = time.Now()
+}
+
+// extraWaitTime returns how much longer to wait for the connection, given
+// that the connection timeout has expired: the time spent by the user
+// answering the prompts doesn't count towards the timeout. Zero means that
+// the connection has timed out indeed.
+func (srv *askpassServer) extraWaitTime(timeout time.Duration) time.Duration {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if srv.promptInProgress {
+		return timeout
+	}
+
+	if srv.lastPromptTime.IsZero() {
+		return 0
+	}
+
+	if remaining := timeout - time.Since(srv.lastPromptTime); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// Close stops listening, cancels the current request (if any) and waits for it
+// to finish, and removes the socket.
+func (srv *askpassServer) Close() {
+	srv.listener.Close()
+	close(srv.done)
+	srv.wg.Wait()
+	os.RemoveAll(srv.dir)
+}
+
+var (
+	sshSupportsAskpassOnce sync.Once
+	sshSupportsAskpass     bool
+)
+
+var sshVersionRegexp = regexp.MustCompile(`OpenSSH_[^0-9]*([0-9]+)\.([0-9]+)`)
+
+// getSSHSupportsAskpass returns whether the external ssh binary supports
+// SSH_ASKPASS_REQUIRE, which is needed for the askpass bridge: it was added in
+// OpenSSH 8.4. Older versions would try to prompt on the terminal instead.
+func getSSHSupportsAskpass(logger *log.Logger) bool {
+	sshSupportsAskpassOnce.Do(func() {
+		// ssh prints the version to stderr.
+		out, err := exec.Command("ssh", "-V").CombinedOutput()
+		if err != nil {
+			logger.Errorf("Failed to get ssh version: %s", err.Error())
+			return
+		}
+
+		sshSupportsAskpass = sshVersionSupportsAskpass(string(out))
+		logger.Infof("ssh version: %q, supports askpass: %v", strings.TrimSpace(string(out)), sshSupportsAskpass)
+	})
+
+	return sshSupportsAskpass
+}
+
+// sshVersionSupportsAskpass parses the output of "ssh -V", and returns
+// whether it's at least OpenSSH 8.4.
+func sshVersionSupportsAskpass(versionOutput string) bool {
+	m := sshVersionRegexp.FindStringSubmatch(versionOutput)
+	if m == nil {
+		return false
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+
+	return major > 8 || (major == 8 && minor >= 4)
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHVersionSupportsAskpass(t *testing.T) {
+	testCases := []struct {
+		versionOutput string
+		want          bool
+	}{
+		{"OpenSSH_9.6p1 Ubuntu-3ubuntu13.5, OpenSSL 3.0.13 30 Jan 2024\n", true},
+		{"OpenSSH_8.4p1 Debian-5+deb11u3, OpenSSL 1.1.1w  11 Sep 2023\n", true},
+		{"OpenSSH_10.0p2, LibreSSL 3.3.6\n", true},
+		{"OpenSSH_8.2p1 Ubuntu-4ubuntu0.11, OpenSSL 1.1.1f  31 Mar 2020\n", false},
+		{"OpenSSH_7.4p1, OpenSSL 1.0.2k-fips  26 Jan 2017\n", false},
+		{"OpenSSH_for_Windows_8.1p1, LibreSSL 3.0.2\n", false},
+		{"OpenSSH_for_Windows_9.5p1, LibreSSL 3.8.2\n", true},
+		{"Dropbear v2022.83\n", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, sshVersionSupportsAskpass(tc.versionOutput), tc.versionOutput)
+	}
+}
+
+func TestAskpassServer(t *testing.T) {
+	resCh := make(chan ShellConnUpdate)
+	var gotRequests []ShellConnDataRequest
+
+	answers := []ShellConnDataResponse{
+		{Value: "secret", OK: true},
+		{Value: "yes", OK: true},
+		{Value: "", OK: true},
+		{},
+	}
+	go func() {
+		for upd := range resCh {
+			gotRequests = append(gotRequests, *upd.DataRequest)
+			upd.DataRequest.ResponseCh <- answers[0]
+			answers = answers[1:]
+		}
+	}()
+
+	srv, err := newAskpassServer("myuser@myhost", resCh, log.NewLogger(log.Error))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath := srv.listener.Addr().String()
+
+	answer, err := requestAskpassAnswer(socketPath, "Enter passphrase for key '/home/me/.ssh/id_ed25519': ")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", answer)
+
+	answer, err = requestAskpassAnswer(socketPath, "Are you sure you want to continue connecting (yes/no/[fingerprint])? ")
+	assert.NoError(t, err)
+	assert.Equal(t, "yes", answer)
+
+	// The passphrase is empty indeed.
+	answer, err = requestAskpassAnswer(socketPath, "Enter passphrase for key '/home/me/.ssh/id_rsa': ")
+	assert.NoError(t, err)
+	assert.Equal(t, "", answer)
+
+	// The user refused to answer.
+	_, err = requestAskpassAnswer(socketPath, "myuser@myhost's password: ")
+	assert.Error(t, err)
+
+	srv.Close()
+	close(resCh)
+
+	// The socket is removed once the server is closed.
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+
+	if assert.Len(t, gotRequests, 4) {
+		assert.Equal(t, ShellConnDataKindPassword, gotRequests[0].DataKind)
+		assert.Equal(t, "myuser@myhost\nEnter passphrase for key '/home/me/.ssh/id_ed25519':", gotRequests[0].Message)
+		assert.Equal(t, ShellConnDataKindText, gotRequests[1].DataKind)
+		assert.Equal(t, ShellConnDataKindPassword, gotRequests[2].DataKind)
+		assert.Equal(t, ShellConnDataKindPassword, gotRequests[3].DataKind)
+	}
+}
+
+func TestAskpassServerCloseWithPendingPrompt(t *testing.T) {
+	resCh := make(chan ShellConnUpdate, 1)
+
+	srv, err := newAskpassServer("myuser@myhost", resCh, log.NewLogger(log.Error))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := requestAskpassAnswer(srv.listener.Addr().String(), "myuser@myhost's password: ")
+		errCh <- err
+	}()
+
+	// Wait for the prompt to be shown, but never answer it.
+	upd := <-resCh
+	assert.NotNil(t, upd.DataRequest)
+
+	closedCh := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closedCh)
+	}()
+
+	select {
+	case <-closedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is stuck on the pending prompt")
+	}
+
+	// The helper gets the refusal, and the prompt can still be answered
+	// without blocking the UI.
+	assert.Error(t, <-errCh)
+	upd.DataRequest.ResponseCh <- ShellConnDataResponse{Value: "late", OK: true}
+}
@@ -0,0 +1,657 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// maxSSHConfigIncludeDepth is the max depth of nested Include directives,
+// same as in OpenSSH.
+const maxSSHConfigIncludeDepth = 16
+
+// SSHConfig is a parsed ssh config, like ~/.ssh/config, which can be queried
+// for the effective settings of a host, the same way as ssh does it: the Host
+// and Match blocks are evaluated in order, and for every option, the first
+// obtained value is used. Include directives are followed, and the included
+// files are evaluated in place.
+//
+// Only the options which nerdlog cares about are returned by Resolve, see
+// SSHHostConfig.
+type SSHConfig struct {
+	// entries contains all the options from the config and the included files,
+	// in the order of evaluation.
+	entries []sshConfigEntry
+
+	// aliases contains all the host names from the Host lines which aren't
+	// patterns, in the order of appearance.
+	aliases []string
+
+	// homeDir is used to expand "~" and "%d".
+	homeDir string
+}
+
+// sshConfigEntry is a single option line from the ssh config, like
+// "HostName foo.com".
+type sshConfigEntry struct {
+	// key is the lowercased option name, like "hostname".
+	key string
+	// args are the option args, with quotes removed. For the keywords which
+	// take the whole rest of the line (see sshConfigRestOfLineKeys), it's a
+	// single arg with the raw text after the keyword.
+	args []string
+
+	// conds are the conditions which must all be true for the entry to apply:
+	// the Host or Match block which contains the Include directive (if the
+	// entry comes from an included file), and the Host or Match block which
+	// contains the entry itself.
+	conds []*sshConfigCond
+}
+
+// sshConfigCond is the condition of a single Host or Match block.
+type sshConfigCond struct {
+	// hostPatterns is set for the Host blocks: whitespace-separated patterns,
+	// any of which must match the original host name, unless a negated
+	// pattern matches.
+	hostPatterns []string
+
+	// criteria is set for the Match blocks, all of which must match.
+	criteria []sshMatchCriterion
+}
+
+// sshMatchCriterion is a single criterion of the Match block, like
+// "host foo.com,*.bar.com" or "!user root".
+type sshMatchCriterion struct {
+	// name is the lowercased criterion name, like "host" or "all".
+	name    string
+	negated bool
+	// arg is the comma-separated list of patterns; it's empty for the criteria
+	// without args, like "all".
+	arg string
+}
+
+// SSHHostConfig contains the effective settings for a single host from the
+// ssh config. Empty values mean that the ssh config doesn't specify them.
+type SSHHostConfig struct {
+	HostName string
+	Port     string
+	User     string
+
+	// IdentityFiles contains all the IdentityFile options, with tokens like
+	// "%h" and "~" expanded.
+	IdentityFiles []string
+
+	// ProxyJump and ProxyCommand are mutually exclusive: only the first one
+	// specified is set. Tokens like "%h" are expanded in ProxyCommand.
+	ProxyJump    string
+	ProxyCommand string
+}
+
+// ParseSSHConfigFile parses the ssh config from the given file. The homeDir
+// is used to expand "~", and to resolve relative paths in the Include
+// directives, which are relative to the ~/.ssh directory, like in ssh.
+func ParseSSHConfigFile(path, homeDir string) (*SSHConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	return ParseSSHConfig(f, homeDir)
+}
+
+// ParseSSHConfig is like ParseSSHConfigFile, but reads the config from the
+// given reader.
+func ParseSSHConfig(r io.Reader, homeDir string) (*SSHConfig, error) {
+	cfg := &SSHConfig{
+		homeDir: homeDir,
+	}
+
+	if err := cfg.parse(r, nil, 0); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return cfg, nil
+}
+
+// parse parses the config from r, and appends the entries to c. The outerConds
+// are the conditions of the block containing the Include directive, if the
+// config being parsed is an included file.
+func (c *SSHConfig) parse(r io.Reader, outerConds []*sshConfigCond, depth int) error {
+	// Initially, the options apply to all hosts, until the first Host or Match
+	// block.
+	curConds := outerConds
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		key, args, err := parseSSHConfigLine(scanner.Text())
+		if err != nil {
+			return errors.Annotatef(err, "line %d", lineNum)
+		}
+
+		switch key {
+		case "":
+			// Empty line or a comment.
+
+		case "host":
+			if len(args) == 0 {
+				return errors.Errorf("line %d: Host without patterns", lineNum)
+			}
+
+			cond := &sshConfigCond{hostPatterns: args}
+			curConds = appendSSHConfigCond(outerConds, cond)
+
+			for _, pattern := range args {
+				if !strings.ContainsAny(pattern, "*?!") && !containsString(c.aliases, pattern) {
+					c.aliases = append(c.aliases, pattern)
+				}
+			}
+
+		case "match":
+			criteria, err := parseSSHMatchCriteria(args)
+			if err != nil {
+				return errors.Annotatef(err, "line %d", lineNum)
+			}
+
+			cond := &sshConfigCond{criteria: criteria}
+			curConds = appendSSHConfigCond(outerConds, cond)
+
+		case "include":
+			if depth >= maxSSHConfigIncludeDepth {
+				return errors.Errorf("line %d: too many nested includes", lineNum)
+			}
+
+			for _, arg := range args {
+				if err := c.parseInclude(arg, curConds, depth+1); err != nil {
+					return errors.Annotatef(err, "line %d: include %s", lineNum, arg)
+				}
+			}
+
+		default:
+			c.entries = append(c.entries, sshConfigEntry{
+				key:   key,
+				args:  args,
+				conds: curConds,
+			})
+		}
+	}
+
+	return errors.Trace(scanner.Err())
+}
+
+// parseInclude parses all the files matching the given Include glob.
+func (c *SSHConfig) parseInclude(pattern string, conds []*sshConfigCond, depth int) error {
+	pattern = c.expandTilde(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(c.homeDir, ".ssh", pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Glob returns sorted paths already, but it's not documented, so sort them
+	// explicitly: ssh includes them in lexical order.
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = c.parse(f, conds, depth)
+		f.Close()
+		if err != nil {
+			return errors.Annotatef(err, "%s", path)
+		}
+	}
+
+	return nil
+}
+
+// Aliases returns all the host names from the Host lines which aren't
+// patterns, in the order of appearance. It's used to expand globs.
+func (c *SSHConfig) Aliases() []string {
+	return c.aliases
+}
+
+// Resolve returns the effective settings for the given host name (as it's
+// typed by the user, i.e. it might be an alias) and user. The user might be
+// empty, if it's not specified explicitly; localUser is the current OS user.
+func (c *SSHConfig) Resolve(host, user, localUser string) SSHHostConfig {
+	ev := sshConfigEvaluator{
+		host:      host,
+		user:      user,
+		localUser: localUser,
+
+		condResults: map[*sshConfigCond]bool{},
+		values:      map[string][]string{},
+	}
+
+	for _, entry := range c.entries {
+		if !ev.condsMatch(entry.conds) {
+			continue
+		}
+
+		// ProxyJump and ProxyCommand are mutually exclusive, so whichever comes
+		// first wins.
+		key := entry.key
+		if key == "proxycommand" {
+			key = "proxyjump"
+		}
+
+		if key == "identityfile" {
+			ev.values[key] = append(ev.values[key], entry.args...)
+			continue
+		}
+
+		if _, ok := ev.values[key]; ok || len(entry.args) == 0 {
+			continue
+		}
+
+		if entry.key == "proxycommand" {
+			ev.values["proxycommand"] = entry.args
+			ev.values[key] = nil
+		} else {
+			ev.values[key] = entry.args
+		}
+	}
+
+	ret := SSHHostConfig{
+		HostName: ev.hostName(),
+		Port:     ev.value("port"),
+		User:     ev.value("user"),
+	}
+
+	tokens := c.getTokens(host, user, localUser, ret)
+
+	for _, identityFile := range ev.values["identityfile"] {
+		if strings.ToLower(identityFile) == "none" {
+			continue
+		}
+
+		ret.IdentityFiles = append(ret.IdentityFiles, tokens.Replace(c.expandTilde(identityFile)))
+	}
+
+	if proxyJump := ev.value("proxyjump"); strings.ToLower(proxyJump) != "none" {
+		ret.ProxyJump = proxyJump
+	}
+
+	if proxyCommand := ev.value("proxycommand"); strings.ToLower(proxyCommand) != "none" {
+		ret.ProxyCommand = tokens.Replace(proxyCommand)
+	}
+
+	return ret
+}
+
+// getTokens returns the replacer for the tokens like "%h" and "%r", as ssh
+// supports them in IdentityFile and ProxyCommand.
+func (c *SSHConfig) getTokens(host, user, localUser string, hc SSHHostConfig) *strings.Replacer {
+	hostname := hc.HostName
+	if hostname == "" {
+		hostname = host
+	}
+
+	port := hc.Port
+	if port == "" {
+		port = "22"
+	}
+
+	remoteUser := user
+	if remoteUser == "" {
+		remoteUser = hc.User
+	}
+	if remoteUser == "" {
+		remoteUser = localUser
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", hostname,
+		"%n", host,
+		"%p", port,
+		"%r", remoteUser,
+		"%u", localUser,
+		"%d", c.homeDir,
+	)
+}
+
+// expandTilde replaces the leading "~" in the path with the home dir.
+func (c *SSHConfig) expandTilde(path string) string {
+	if path == "~" {
+		return c.homeDir
+	}
+
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(c.homeDir, path[2:])
+	}
+
+	return path
+}
+
+// sshConfigEvaluator holds the state of evaluating the ssh config for a
+// single host, see SSHConfig.Resolve.
+type sshConfigEvaluator struct {
+	host      string
+	user      string
+	localUser string
+
+	// condResults contains the results of the conditions evaluated so far.
+	// Every condition is evaluated only once, when its first entry is reached
+	// (just like ssh evaluates every Match line once), so that e.g. HostName
+	// changed inside of a "Match host" block doesn't affect the rest of it.
+	condResults map[*sshConfigCond]bool
+
+	// values contains the values obtained so far, keyed by the lowercased
+	// option name.
+	values map[string][]string
+}
+
+func (ev *sshConfigEvaluator) value(key string) string {
+	vals := ev.values[key]
+	if len(vals) == 0 {
+		return ""
+	}
+
+	return vals[0]
+}
+
+// hostName returns the HostName obtained so far, with the tokens expanded, or
+// an empty string if there's no HostName yet.
+func (ev *sshConfigEvaluator) hostName() string {
+	hostname := ev.value("hostname")
+	if hostname == "" {
+		return ""
+	}
+
+	return strings.NewReplacer("%%", "%", "%h", ev.host).Replace(hostname)
+}
+
+func (ev *sshConfigEvaluator) condsMatch(conds []*sshConfigCond) bool {
+	for _, cond := range conds {
+		res, ok := ev.condResults[cond]
+		if !ok {
+			res = ev.condMatches(cond)
+			ev.condResults[cond] = res
+		}
+
+		if !res {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ev *sshConfigEvaluator) condMatches(cond *sshConfigCond) bool {
+	if cond.hostPatterns != nil {
+		return matchSSHPatternList(cond.hostPatterns, ev.host)
+	}
+
+	for _, crit := range cond.criteria {
+		var res bool
+
+		switch crit.name {
+		case "all", "final":
+			// We evaluate the config only once, so the "final" pass is the only
+			// one.
+			res = true
+
+		case "canonical":
+			// We don't canonicalize host names, so there's never a canonical pass.
+			res = false
+
+		case "host":
+			// Like in ssh, it's the effective host name (%h) at this point.
+			hostname := ev.hostName()
+			if hostname == "" {
+				hostname = ev.host
+			}
+			res = matchSSHPatternList(strings.Split(crit.arg, ","), hostname)
+
+		case "originalhost":
+			res = matchSSHPatternList(strings.Split(crit.arg, ","), ev.host)
+
+		case "user":
+			user := ev.user
+			if user == "" {
+				user = ev.value("user")
+			}
+			if user == "" {
+				user = ev.localUser
+			}
+			res = matchSSHPatternList(strings.Split(crit.arg, ","), user)
+
+		case "localuser":
+			res = matchSSHPatternList(strings.Split(crit.arg, ","), ev.localUser)
+
+		default:
+			// Criteria like "exec" aren't supported, so the block never matches.
+			return false
+		}
+
+		if res == crit.negated {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sshConfigRestOfLineKeys are the (lowercased) keywords whose value is the
+// whole rest of the line, passed to the shell as is, so it must not be split
+// into args and unquoted.
+var sshConfigRestOfLineKeys = map[string]struct{}{
+	"proxycommand":      {},
+	"localcommand":      {},
+	"remotecommand":     {},
+	"knownhostscommand": {},
+}
+
+// parseSSHConfigLine parses a single line of the ssh config, and returns the
+// lowercased keyword and the args. For empty lines and comments, the keyword
+// is empty.
+func parseSSHConfigLine(line string) (key string, args []string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	keyEnd := strings.IndexAny(line, " \t=")
+	if keyEnd < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+
+	key = strings.ToLower(line[:keyEnd])
+
+	rest := strings.TrimSpace(line[keyEnd:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	if _, ok := sshConfigRestOfLineKeys[key]; ok {
+		if rest == "" {
+			return key, nil, nil
+		}
+
+		return key, []string{rest}, nil
+	}
+
+	args, err = splitSSHConfigArgs(rest)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	return key, args, nil
+}
+
+// splitSSHConfigArgs splits the args by whitespace, handling the quotes.
+func splitSSHConfigArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote")
+	}
+
+	if inArg {
+		args = append(args, cur.String())
+	}
+
+	return args, nil
+}
+
+// parseSSHMatchCriteria parses the args of the Match line, like
+// ["host", "foo.com", "!user", "root"].
+func parseSSHMatchCriteria(args []string) ([]sshMatchCriterion, error) {
+	var ret []sshMatchCriterion
+
+	for i := 0; i < len(args); i++ {
+		crit := sshMatchCriterion{
+			name: strings.ToLower(args[i]),
+		}
+
+		if strings.HasPrefix(crit.name, "!") {
+			crit.negated = true
+			crit.name = crit.name[1:]
+		}
+
+		switch crit.name {
+		case "all", "canonical", "final":
+			// No args
+
+		default:
+			if i+1 >= len(args) {
+				return nil, errors.Errorf("Match criterion %q without an argument", crit.name)
+			}
+
+			i++
+			crit.arg = args[i]
+		}
+
+		ret = append(ret, crit)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.Errorf("Match without criteria")
+	}
+
+	return ret, nil
+}
+
+// matchSSHPatternList returns whether the given string matches the list of
+// ssh patterns: it must match at least one of the patterns, and none of the
+// negated ones (prefixed with "!").
+func matchSSHPatternList(patterns []string, s string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+
+		if !matchSSHPattern(pattern, s) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+// matchSSHPattern matches the string against a single ssh pattern, where "*"
+// matches zero or more characters, and "?" matches exactly one character.
+// Like in ssh, the match is case-insensitive.
+func matchSSHPattern(pattern, s string) bool {
+	pattern = strings.ToLower(pattern)
+	s = strings.ToLower(s)
+
+	// Backtracking to the last "*" is enough: a later "*" can always match
+	// whatever an earlier one would have to.
+	pi, si := 0, 0
+	starPi, starSi := -1, 0
+
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && (pattern[pi] == '?' || pattern[pi] == s[si]):
+			pi++
+			si++
+
+		case pi < len(pattern) && pattern[pi] == '*':
+			starPi, starSi = pi, si
+			pi++
+
+		case starPi >= 0:
+			// Let the last "*" match one more char.
+			starSi++
+			pi, si = starPi+1, starSi
+
+		default:
+			return false
+		}
+	}
+
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(pattern)
+}
+
+func appendSSHConfigCond(conds []*sshConfigCond, cond *sshConfigCond) []*sshConfigCond {
+	ret := make([]*sshConfigCond, 0, len(conds)+1)
+	ret = append(ret, conds...)
+	return append(ret, cond)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dimonomid/ssh_config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchSSHPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"foo.com", "foo.com", true},
+		{"foo.com", "FOO.com", true},
+		{"foo.com", "foo.co", false},
+		{"foo.com", "foo.comm", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"*.com", "foo.com", true},
+		{"*.com", "foo.org", false},
+		{"foo-*", "foo-", true},
+		{"foo-*-bar", "foo-1-2-bar", true},
+		{"foo-*-bar", "foo-1-2-baz", false},
+		{"*a*b", "xaxxbxab", true},
+		{"*a*b", "xaxxbxa", false},
+		{"foo-??", "foo-01", true},
+		{"foo-??", "foo-1", false},
+		{"foo-?*", "foo-", false},
+		// Regexp special chars are matched literally.
+		{"foo.com", "fooxcom", false},
+		{"[a-z]+", "[a-z]+", true},
+		{"[a-z]+", "a", false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, matchSSHPattern(tc.pattern, tc.s), "pattern %q, string %q", tc.pattern, tc.s)
+	}
+}
+
+// testSSHConfigParity is a config without Match blocks (which the ssh_config
+// library doesn't support), covering the rest of the syntax it does support.
+// It has no "?" patterns either, since the library matches them against zero
+// or one char, while ssh matches them against exactly one char.
+const testSSHConfigParity = `# Comment
+Host sshfoo-01 sshfoo-alias
+  HostName host-foo-01.com
+  Port 3001
+  USER user-foo-01
+
+Host sshbar-01
+  HostName=host-bar-01.com
+  Port = 3002
+  ProxyJump jhuser@bastion-01.com:2222
+
+Host sshneg-* !sshneg-02
+  User user-neg
+
+Host *.example.com
+  Port 4001
+
+# The first obtained value wins, so it doesn't override the HostName above.
+Host sshfoo-01
+  HostName ignored.com
+  IdentityFile /keys/id_foo
+
+Host *
+  User default-user
+  IdentityFile /keys/id_default
+`
+
+// TestSSHConfigParity checks that our parser resolves the same HostName, Port,
+// User, ProxyJump and IdentityFile as the ssh_config library which nerdlog
+// used before, for the configs which the library supports.
+func TestSSHConfigParity(t *testing.T) {
+	for _, configStr := range []string{testSSHConfigParity, string(testSSHConfig1Str)} {
+		libConfig, err := ssh_config.Decode(strings.NewReader(configStr), false)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		ourConfig, err := ParseSSHConfig(bytes.NewBufferString(configStr), testSSHHomeDir)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		hosts := []string{"sshneg-01", "sshneg-02", "foo.example.com", "unknown-host"}
+		for _, host := range libConfig.Hosts {
+			for _, pattern := range host.Patterns {
+				// Negated patterns are also printed without the "!", but they don't
+				// match themselves.
+				name := pattern.String()
+				if strings.ContainsAny(name, "*?") || !host.Matches(name) {
+					continue
+				}
+
+				assert.Contains(t, ourConfig.Aliases(), name)
+				hosts = append(hosts, name)
+			}
+		}
+
+		for _, host := range hosts {
+			got := ourConfig.Resolve(host, "", "osuser")
+
+			libGet := func(key string) string {
+				val, err := libConfig.Get(host, key)
+				assert.NoError(t, err, "host %s, key %s", host, key)
+				return val
+			}
+
+			assert.Equal(t, libGet("HostName"), got.HostName, "host %s", host)
+			assert.Equal(t, libGet("Port"), got.Port, "host %s", host)
+			assert.Equal(t, libGet("User"), got.User, "host %s", host)
+			assert.Equal(t, libGet("ProxyJump"), got.ProxyJump, "host %s", host)
+
+			wantIdentityFiles, err := libConfig.GetAll(host, "IdentityFile")
+			assert.NoError(t, err, "host %s", host)
+			for i, identityFile := range wantIdentityFiles {
+				wantIdentityFiles[i] = ourConfig.expandTilde(identityFile)
+			}
+
+			assert.Equal(t, wantIdentityFiles, got.IdentityFiles, "host %s", host)
+		}
+	}
+}
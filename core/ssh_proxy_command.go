@@ -0,0 +1,90 @@
+package core
+
+import (
+	"io"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// proxyCommandConn implements net.Conn on top of the stdin and stdout of a
+// locally running command, like the ProxyCommand from the ssh config, so that
+// the ssh connection can be established over it.
+type proxyCommandConn struct {
+	cmd *exec.Cmd
+
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+var _ net.Conn = &proxyCommandConn{}
+
+// newProxyCommandConn starts the given command using /bin/sh, and returns the
+// connection which talks to it. The command's stderr is discarded.
+func newProxyCommandConn(command string) (*proxyCommandConn, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotatef(err, "starting %q", command)
+	}
+
+	return &proxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+	}, nil
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *proxyCommandConn) Close() error {
+	c.stdin.Close()
+
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+
+	// The error from Wait is not interesting, since we've just killed the
+	// process.
+	c.cmd.Wait()
+
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+// Deadlines are not supported, since the pipes don't support them.
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// proxyCommandAddr is the dummy net.Addr for proxyCommandConn.
+type proxyCommandAddr struct{}
+
+func (proxyCommandAddr) Network() string { return "proxycommand" }
+func (proxyCommandAddr) String() string  { return "proxycommand" }
@@ -0,0 +1,728 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dimonomid/nerdlog/awkpattern"
+	"github.com/juju/errors"
+)
+
+// StructQueryPrefix is the prefix which makes the query a structured query
+// instead of a raw awk pattern, like this:
+//
+//	@program:nginx AND level:error AND NOT "healthcheck"
+//
+// Structured queries are parsed on the Go side and compiled into the awk
+// pattern which is then passed to the agent as usual.
+const StructQueryPrefix = "@"
+
+// IsStructQuery returns whether the given query is a structured query (as
+// opposed to a raw awk pattern).
+func IsStructQuery(query string) bool {
+	return strings.HasPrefix(strings.TrimSpace(query), StructQueryPrefix)
+}
+
+// StructQuery is a parsed structured query. The syntax is:
+//
+//   - `foo` or `"foo bar"`: the line contains the given text;
+//   - `field:value` or `field=value`: the field is equal to the value; the
+//     value can have `*` wildcards, like `program:nginx*`. For the `msg` field,
+//     it means "contains" instead of "equals";
+//   - `field!=value`: the opposite of the above;
+//   - `field~regex` or `field~/regex/`, and `field!~regex`: regex match;
+//   - `field>N`, `field>=N`, `field<N`, `field<=N`: numeric comparison;
+//   - `AND`, `OR`, `NOT` and parentheses; terms without an operator in
+//     between are ANDed, and `AND` takes precedence over `OR`.
+//
+// Supported fields are: `host` (or `hostname`), `program`, `pid`, `level`
+// (one of `error`, `warn`, `info`, `debug`, determined approximately in the
+// same way as nerdlog does for the UI), `msg` (or `message`, the whole
+// line), `$N` (awk field N), and any other name is treated as a key in the
+// `key=value` pairs in the message, e.g. `status>=500` matches
+// `... status=503 ...`.
+type StructQuery struct {
+	root sqNode
+}
+
+// ParseStructQuery parses the structured query, which must start with the
+// StructQueryPrefix. Errors contain the position in the query string (1-based,
+// in characters, including the prefix).
+func ParseStructQuery(query string) (*StructQuery, error) {
+	trimmed := strings.TrimLeftFunc(query, unicode.IsSpace)
+	if !strings.HasPrefix(trimmed, StructQueryPrefix) {
+		return nil, errors.Errorf("structured query must start with %q", StructQueryPrefix)
+	}
+
+	offset := len(query) - len(trimmed) + len(StructQueryPrefix)
+
+	p := &sqParser{
+		query: query,
+		pos:   offset,
+	}
+
+	if err := p.next(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if p.tok.kind == sqTokEOF {
+		return nil, errors.Errorf("structured query is empty")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if p.tok.kind != sqTokEOF {
+		return nil, p.errorf(p.tok.pos, "unexpected %s", p.tok.descr())
+	}
+
+	return &StructQuery{root: root}, nil
+}
+
+// CompileAWK compiles the structured query into an awk pattern, with the
+// syslog envelope fields mapped according to the given time format.
+func (sq *StructQuery) CompileAWK(timeFormat *TimeFormatDescr) string {
+	c := &sqCompiler{
+		programFieldNum: awkSyslogProgramFieldNum(timeFormat),
+	}
+
+	return sq.root.compile(c)
+}
+
+// compileQueryToAWK returns the awk pattern for the given query: if it's a
+// structured query, then it's compiled, otherwise it's returned as is.
+func compileQueryToAWK(query string, timeFormat *TimeFormatDescr) (string, error) {
+	if !IsStructQuery(query) {
+		return query, nil
+	}
+
+	sq, err := ParseStructQuery(query)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return sq.CompileAWK(timeFormat), nil
+}
+
+// ValidateQuery returns an error if the query can't be parsed: either as a
+// structured query, or as an awk pattern. Syntax errors with a known position
+// in the query are returned as *awkpattern.SyntaxError.
+func ValidateQuery(query string) error {
+	if !IsStructQuery(query) {
+		if err := awkpattern.Validate(query); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	}
+
+	if _, err := ParseStructQuery(query); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// awkSyslogProgramFieldNum returns the awk field number of the program (like
+// "myprogram[1234]:") in the syslog line which looks like
+// "<timestamp> myhost myprogram[1234]: ...": it's right after the hostname,
+// which in turn is right after the timestamp.
+func awkSyslogProgramFieldNum(timeFormat *TimeFormatDescr) int {
+	return len(strings.Fields(timeFormat.TimestampLayout)) + 2
+}
+
+type sqNode interface {
+	compile(c *sqCompiler) string
+}
+
+type sqCompiler struct {
+	programFieldNum int
+}
+
+type sqAnd struct {
+	left, right sqNode
+}
+
+func (n *sqAnd) compile(c *sqCompiler) string {
+	return "(" + n.left.compile(c) + " && " + n.right.compile(c) + ")"
+}
+
+type sqOr struct {
+	left, right sqNode
+}
+
+func (n *sqOr) compile(c *sqCompiler) string {
+	return "(" + n.left.compile(c) + " || " + n.right.compile(c) + ")"
+}
+
+type sqNot struct {
+	x sqNode
+}
+
+func (n *sqNot) compile(c *sqCompiler) string {
+	return "!" + n.x.compile(c)
+}
+
+// sqText matches lines containing the text.
+type sqText struct {
+	text string
+}
+
+func (n *sqText) compile(c *sqCompiler) string {
+	return fmt.Sprintf("(index($0, %s) > 0)", awkpattern.QuoteString(n.text))
+}
+
+// sqFieldCmp compares some field with the value.
+type sqFieldCmp struct {
+	field string
+	op    string
+	value string
+}
+
+const (
+	sqFieldHost    = "host"
+	sqFieldProgram = "program"
+	sqFieldPID     = "pid"
+	sqFieldLevel   = "level"
+	sqFieldMsg     = "msg"
+)
+
+var sqFieldAliases = map[string]string{
+	"hostname": sqFieldHost,
+	"message":  sqFieldMsg,
+}
+
+var sqLevelAliases = map[string]LogLevel{
+	"error":   LogLevelError,
+	"err":     LogLevelError,
+	"warn":    LogLevelWarn,
+	"warning": LogLevelWarn,
+	"info":    LogLevelInfo,
+	"debug":   LogLevelDebug,
+}
+
+var sqAWKFieldRegex = regexp.MustCompile(`^\$[0-9]+$`)
+var sqKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// fieldExpr returns the awk expression which evaluates to the field value.
+func (n *sqFieldCmp) fieldExpr(c *sqCompiler) string {
+	switch {
+	case n.field == sqFieldHost:
+		return fmt.Sprintf("$%d", c.programFieldNum-1)
+
+	case n.field == sqFieldProgram:
+		return fmt.Sprintf(`nlProgram($%d)`, c.programFieldNum)
+
+	case n.field == sqFieldPID:
+		return fmt.Sprintf(`nlPID($%d)`, c.programFieldNum)
+
+	case n.field == sqFieldLevel:
+		// Mimics what LStreamClient.parseLogMsgLevelDefault does, except that
+		// it's done on the whole line instead of just the message. The word
+		// boundaries are spelled out instead of using gawk-specific \y.
+		return `(tolower($0) ~ /\[[fe]\]/ ? "error" : ` +
+			`tolower($0) ~ /\[w\]/ ? "warn" : ` +
+			`tolower($0) ~ /\[i\]/ ? "info" : ` +
+			`tolower($0) ~ /\[d\]/ ? "debug" : ` +
+			`tolower($0) ~ /(^|[^a-z0-9_])(error|erro|err|crit|critical|fatal)([^a-z0-9_]|$)/ ? "error" : ` +
+			`tolower($0) ~ /(^|[^a-z0-9_])warn(ing)?([^a-z0-9_]|$)/ ? "warn" : ` +
+			`tolower($0) ~ /(^|[^a-z0-9_])info([^a-z0-9_]|$)/ ? "info" : ` +
+			`tolower($0) ~ /(^|[^a-z0-9_])debug?([^a-z0-9_]|$)/ ? "debug" : "")`
+
+	case n.field == sqFieldMsg:
+		return "$0"
+
+	case sqAWKFieldRegex.MatchString(n.field):
+		return n.field
+	}
+
+	// Key in the key=value pairs; the value can be in double quotes, in which
+	// case the quotes are stripped.
+	return fmt.Sprintf(
+		`nlKeyValue($0, %s)`, awkpattern.QuoteString(awkpattern.QuoteRegex(n.field)),
+	)
+}
+
+func (n *sqFieldCmp) compile(c *sqCompiler) string {
+	expr := n.fieldExpr(c)
+
+	switch n.op {
+	case ":", "=":
+		return n.compileEq(expr)
+
+	case "!=":
+		return "!" + n.compileEq(expr)
+
+	case "~":
+		return fmt.Sprintf("(%s ~ /%s/)", expr, awkRegexEscapeSlashes(n.value))
+
+	case "!~":
+		return fmt.Sprintf("(%s !~ /%s/)", expr, awkRegexEscapeSlashes(n.value))
+
+	case ">", ">=", "<", "<=":
+		return fmt.Sprintf(`((sqVal = %s) != "" && sqVal + 0 %s %s)`, expr, n.op, n.value)
+	}
+
+	// Parser would have returned an error.
+	panic("should never be here")
+}
+
+func (n *sqFieldCmp) compileEq(expr string) string {
+	if n.field == sqFieldMsg && n.op == ":" {
+		if strings.Contains(n.value, "*") {
+			return fmt.Sprintf("($0 ~ /%s/)", sqGlobToRegex(n.value))
+		}
+
+		return fmt.Sprintf("(index($0, %s) > 0)", awkpattern.QuoteString(n.value))
+	}
+
+	if strings.Contains(n.value, "*") {
+		return fmt.Sprintf("(%s ~ /^%s$/)", expr, sqGlobToRegex(n.value))
+	}
+
+	return fmt.Sprintf("(%s == %s)", expr, awkpattern.QuoteString(n.value))
+}
+
+// sqGlobToRegex converts the value with "*" wildcards to a regex (without
+// anchors), with slashes escaped.
+func sqGlobToRegex(value string) string {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = awkpattern.QuoteRegex(part)
+	}
+
+	return strings.Join(parts, ".*")
+}
+
+type sqTokKind int
+
+const (
+	sqTokEOF sqTokKind = iota
+	sqTokWord
+	sqTokString
+	sqTokRegex
+	sqTokOp
+	sqTokLParen
+	sqTokRParen
+	sqTokAnd
+	sqTokOr
+	sqTokNot
+)
+
+type sqToken struct {
+	kind sqTokKind
+	text string
+
+	// pos is the byte offset of the token in the query.
+	pos int
+}
+
+func (t *sqToken) descr() string {
+	switch t.kind {
+	case sqTokEOF:
+		return "end of query"
+	case sqTokString:
+		return fmt.Sprintf("string %q", t.text)
+	case sqTokRegex:
+		return fmt.Sprintf("regex /%s/", t.text)
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+type sqParser struct {
+	query string
+
+	// pos is the byte offset in the query where the lexer is at.
+	pos int
+
+	// tok is the current token.
+	tok sqToken
+}
+
+// errorf returns a *awkpattern.SyntaxError with the position in the query, as
+// a 1-based character number.
+func (p *sqParser) errorf(pos int, format string, args ...interface{}) error {
+	return errors.Trace(&awkpattern.SyntaxError{
+		Pos: utf8.RuneCountInString(p.query[:pos]) + 1,
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
+func (p *sqParser) parseOr() (sqNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for p.tok.kind == sqTokOr {
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		left = &sqOr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqParser) parseAnd() (sqNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for {
+		switch p.tok.kind {
+		case sqTokAnd:
+			if err := p.next(); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+		case sqTokNot, sqTokLParen, sqTokWord, sqTokString:
+			// Implicit AND
+
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		left = &sqAnd{left: left, right: right}
+	}
+}
+
+func (p *sqParser) parseNot() (sqNode, error) {
+	if p.tok.kind == sqTokNot {
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return &sqNot{x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *sqParser) parsePrimary() (sqNode, error) {
+	tok := p.tok
+
+	switch tok.kind {
+	case sqTokLParen:
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if p.tok.kind != sqTokRParen {
+			return nil, p.errorf(p.tok.pos, "expected \")\", got %s", p.tok.descr())
+		}
+
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return x, nil
+
+	case sqTokString:
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return &sqText{text: tok.text}, nil
+
+	case sqTokWord:
+		if err := p.next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if p.tok.kind != sqTokOp {
+			return &sqText{text: tok.text}, nil
+		}
+
+		return p.parseFieldCmp(tok)
+	}
+
+	return nil, p.errorf(tok.pos, "unexpected %s", tok.descr())
+}
+
+// parseFieldCmp parses the comparison, given that the field token was already
+// consumed, and the current token is the operator.
+func (p *sqParser) parseFieldCmp(fieldTok sqToken) (sqNode, error) {
+	opTok := p.tok
+
+	field := fieldTok.text
+	if alias, ok := sqFieldAliases[field]; ok {
+		field = alias
+	}
+
+	if !sqAWKFieldRegex.MatchString(field) && !sqKeyRegex.MatchString(field) {
+		return nil, p.errorf(fieldTok.pos, "invalid field name %q", fieldTok.text)
+	}
+
+	if err := p.nextValue(opTok.text); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	valueTok := p.tok
+
+	if err := p.next(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := &sqFieldCmp{
+		field: field,
+		op:    opTok.text,
+		value: valueTok.text,
+	}
+
+	if valueTok.kind == sqTokRegex && ret.op != "~" && ret.op != "!~" {
+		return nil, p.errorf(valueTok.pos, "regex can only be used with ~ or !~")
+	}
+
+	switch ret.op {
+	case "~", "!~":
+		if _, err := regexp.Compile(ret.value); err != nil {
+			return nil, p.errorf(valueTok.pos, "invalid regex: %s", err.Error())
+		}
+
+	case ">", ">=", "<", "<=":
+		// ParseFloat also accepts things like "Inf", "NaN" or hex floats, which
+		// awk doesn't understand, so only plain finite numbers are allowed.
+		v, err := strconv.ParseFloat(ret.value, 64)
+		if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, p.errorf(valueTok.pos, "expected a number after %q, got %s", ret.op, valueTok.descr())
+		}
+
+		// Normalize it to a plain decimal (without an exponent), so that awk can
+		// take it as is.
+		ret.value = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	if field == sqFieldLevel {
+		switch ret.op {
+		case ":", "=", "!=":
+			level, ok := sqLevelAliases[strings.ToLower(ret.value)]
+			if !ok {
+				return nil, p.errorf(valueTok.pos, "invalid level %q, expected one of: error, warn, info, debug", ret.value)
+			}
+
+			ret.value = string(level)
+
+		default:
+			return nil, p.errorf(opTok.pos, "level only supports \":\", \"=\" and \"!=\"")
+		}
+	}
+
+	return ret, nil
+}
+
+// next reads the next token into p.tok.
+func (p *sqParser) next() error {
+	p.skipSpace()
+
+	start := p.pos
+	if p.pos >= len(p.query) {
+		p.tok = sqToken{kind: sqTokEOF, pos: start}
+		return nil
+	}
+
+	c := p.query[p.pos]
+
+	switch {
+	case c == '(':
+		p.pos++
+		p.tok = sqToken{kind: sqTokLParen, text: "(", pos: start}
+		return nil
+
+	case c == ')':
+		p.pos++
+		p.tok = sqToken{kind: sqTokRParen, text: ")", pos: start}
+		return nil
+
+	case c == '"':
+		s, err := p.readString()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		p.tok = sqToken{kind: sqTokString, text: s, pos: start}
+		return nil
+	}
+
+	if op := p.readOp(); op != "" {
+		p.tok = sqToken{kind: sqTokOp, text: op, pos: start}
+		return nil
+	}
+
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		if isSQSpace(c) || strings.IndexByte(`()":=!<>~`, c) >= 0 {
+			break
+		}
+
+		p.pos++
+	}
+
+	if p.pos == start {
+		// Can only happen with a lone "!", since all the other special chars
+		// are handled above.
+		return p.errorf(start, "unexpected %q; use NOT for negation", string(c))
+	}
+
+	word := p.query[start:p.pos]
+	p.tok = sqToken{kind: sqTokWord, text: word, pos: start}
+
+	switch word {
+	case "AND":
+		p.tok.kind = sqTokAnd
+	case "OR":
+		p.tok.kind = sqTokOr
+	case "NOT":
+		p.tok.kind = sqTokNot
+	}
+
+	return nil
+}
+
+// nextValue reads the value after the operator op into p.tok: it's either a
+// quoted string, or a /regex/, or everything until the whitespace or ")".
+func (p *sqParser) nextValue(op string) error {
+	start := p.pos
+	if p.pos >= len(p.query) || isSQSpace(p.query[p.pos]) || p.query[p.pos] == ')' {
+		return p.errorf(start, "expected value after %q", op)
+	}
+
+	switch p.query[p.pos] {
+	case '"':
+		s, err := p.readString()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		p.tok = sqToken{kind: sqTokString, text: s, pos: start}
+		return nil
+
+	case '/':
+		re, err := p.readRegex()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		p.tok = sqToken{kind: sqTokRegex, text: re, pos: start}
+		return nil
+	}
+
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		if isSQSpace(c) || c == ')' {
+			break
+		}
+
+		p.pos++
+	}
+
+	p.tok = sqToken{kind: sqTokWord, text: p.query[start:p.pos], pos: start}
+
+	return nil
+}
+
+func (p *sqParser) readOp() string {
+	for _, op := range []string{"!=", "!~", ">=", "<=", ":", "=", "~", ">", "<"} {
+		if strings.HasPrefix(p.query[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+
+	return ""
+}
+
+// readString reads the double-quoted string, with \" and \\ escapes.
+func (p *sqParser) readString() (string, error) {
+	start := p.pos
+
+	// Skip the opening quote
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.query):
+			sb.WriteByte(p.query[p.pos+1])
+			p.pos += 2
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", p.errorf(start, "unterminated string")
+}
+
+// readRegex reads the /regex/, where slashes can be escaped as \/.
+func (p *sqParser) readRegex() (string, error) {
+	start := p.pos
+
+	// Skip the opening slash
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.query) {
+		c := p.query[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.query):
+			if p.query[p.pos+1] != '/' {
+				sb.WriteByte(c)
+			}
+			sb.WriteByte(p.query[p.pos+1])
+			p.pos += 2
+		case c == '/':
+			p.pos++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", p.errorf(start, "unterminated regex")
+}
+
+func (p *sqParser) skipSpace() {
+	for p.pos < len(p.query) && isSQSpace(p.query[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSQSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
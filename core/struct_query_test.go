@@ -0,0 +1,122 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type structQueryTestCase struct {
+	query string
+
+	wantAWK string
+	wantErr string
+}
+
+const sqTestLevelExpr = `(tolower($0) ~ /\[[fe]\]/ ? "error" : ` +
+	`tolower($0) ~ /\[w\]/ ? "warn" : ` +
+	`tolower($0) ~ /\[i\]/ ? "info" : ` +
+	`tolower($0) ~ /\[d\]/ ? "debug" : ` +
+	`tolower($0) ~ /(^|[^a-z0-9_])(error|erro|err|crit|critical|fatal)([^a-z0-9_]|$)/ ? "error" : ` +
+	`tolower($0) ~ /(^|[^a-z0-9_])warn(ing)?([^a-z0-9_]|$)/ ? "warn" : ` +
+	`tolower($0) ~ /(^|[^a-z0-9_])info([^a-z0-9_]|$)/ ? "info" : ` +
+	`tolower($0) ~ /(^|[^a-z0-9_])debug?([^a-z0-9_]|$)/ ? "debug" : "")`
+
+func TestStructQuery(t *testing.T) {
+	testCases := []structQueryTestCase{
+		{
+			query:   `@program:nginx AND level:error AND NOT "healthcheck"`,
+			wantAWK: `(((nlProgram($5) == "nginx") && (` + sqTestLevelExpr + ` == "error")) && !(index($0, "healthcheck") > 0))`,
+		},
+		{
+			query:   `@status>=500`,
+			wantAWK: `((sqVal = nlKeyValue($0, "status")) != "" && sqVal + 0 >= 500)`,
+		},
+		{
+			query:   `  @foo bar OR baz`,
+			wantAWK: `(((index($0, "foo") > 0) && (index($0, "bar") > 0)) || (index($0, "baz") > 0))`,
+		},
+		{
+			query:   `@foo AND (bar OR NOT baz)`,
+			wantAWK: `((index($0, "foo") > 0) && ((index($0, "bar") > 0) || !(index($0, "baz") > 0)))`,
+		},
+		{
+			query:   `@hostname:web-* pid!=123 message:"a \"b\" c" $5~/^cron\//`,
+			wantAWK: `(((($4 ~ /^web-.*$/) && !(nlPID($5) == "123")) && (index($0, "a \"b\" c") > 0)) && ($5 ~ /^cron\//))`,
+		},
+		{
+			query:   `@level:WARNING OR msg:*timed*out*`,
+			wantAWK: `((` + sqTestLevelExpr + ` == "warn") || ($0 ~ /.*timed.*out.*/))`,
+		},
+		{
+			query:   `@req.id=abc/def`,
+			wantAWK: `(nlKeyValue($0, "req\\.id") == "abc/def")`,
+		},
+		{
+			query:   `@took<1e3`,
+			wantAWK: `((sqVal = nlKeyValue($0, "took")) != "" && sqVal + 0 < 1000)`,
+		},
+		{
+			query:   `@took>=-2.5e-3`,
+			wantAWK: `((sqVal = nlKeyValue($0, "took")) != "" && sqVal + 0 >= -0.0025)`,
+		},
+		{
+			query:   `@took<0x1p4`,
+			wantAWK: `((sqVal = nlKeyValue($0, "took")) != "" && sqVal + 0 < 16)`,
+		},
+
+		{query: `@`, wantErr: `structured query is empty`},
+		{query: `@program:`, wantErr: `position 10: expected value after ":"`},
+		{query: `@(foo`, wantErr: `position 6: expected ")", got end of query`},
+		{query: `@foo)`, wantErr: `position 5: unexpected ")"`},
+		{query: `@foo AND`, wantErr: `position 9: unexpected end of query`},
+		{query: `@level>5`, wantErr: `position 7: level only supports ":", "=" and "!="`},
+		{query: `@level:foo`, wantErr: `position 8: invalid level "foo", expected one of: error, warn, info, debug`},
+		{query: `@status>abc`, wantErr: `position 9: expected a number after ">", got "abc"`},
+		{query: `@status>Inf`, wantErr: `position 9: expected a number after ">", got "Inf"`},
+		{query: `@status<=-inf`, wantErr: `position 10: expected a number after "<=", got "-inf"`},
+		{query: `@status<NaN`, wantErr: `position 9: expected a number after "<", got "NaN"`},
+		{query: `@status>1e400`, wantErr: `position 9: expected a number after ">", got "1e400"`},
+		{query: `@program:/foo/`, wantErr: `position 10: regex can only be used with ~ or !~`},
+		{query: "@x~(", wantErr: "position 4: invalid regex: error parsing regexp: missing closing ): `(`"},
+		{query: `@"abc`, wantErr: `position 2: unterminated string`},
+		{query: `@a ! b`, wantErr: `position 4: unexpected "!"; use NOT for negation`},
+		{query: `@1.2.3.4:80`, wantErr: `position 2: invalid field name "1.2.3.4"`},
+		{query: `/foo/`, wantErr: `structured query must start with "@"`},
+	}
+
+	timeFormat := &TimeFormatDescr{TimestampLayout: "Jan _2 15:04:05"}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			sq, err := ParseStructQuery(tc.query)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tc.wantAWK, sq.CompileAWK(timeFormat))
+		})
+	}
+}
+
+func TestCompileQueryToAWK(t *testing.T) {
+	timeFormat := &TimeFormatDescr{TimestampLayout: "2006-01-02T15:04:05.000000Z07:00"}
+
+	// Raw awk patterns are passed as is.
+	awk, err := compileQueryToAWK(`/foo/ && !/bar/`, timeFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, `/foo/ && !/bar/`, awk)
+
+	// Field positions depend on the time format.
+	awk, err = compileQueryToAWK(`@host:myhost`, timeFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, `($2 == "myhost")`, awk)
+
+	_, err = compileQueryToAWK(`@host:`, timeFormat)
+	assert.EqualError(t, err, `position 7: expected value after ":"`)
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Gentle mode settings: when QueryLogsParams.Gentle is true, the agent runs
+// with the lowest CPU and IO priority, doesn't use parallel workers, and its
+// read rate is limited (unless the logstream has even lower limit
+// configured), to have as little impact on the host as possible.
+const (
+	gentleNice        = 19
+	gentleIONice      = "idle"
+	gentleMaxCPUs     = 1
+	gentleMaxReadRate = 20 * 1024 * 1024
+)
+
+// ParseIONice parses the ionice option, which is one of: "idle",
+// "best-effort", or "best-effort:N" where N is the priority from 0 (highest)
+// to 7 (lowest), and returns the corresponding ionice flags. Empty string
+// results in nil flags.
+func ParseIONice(s string) ([]string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	class := parts[0]
+	hasLevel := len(parts) == 2
+
+	switch class {
+	case "":
+		return nil, nil
+
+	case "idle":
+		if hasLevel {
+			return nil, errors.Errorf("invalid ionice %q: idle class doesn't have priority levels", s)
+		}
+
+		return []string{"-c", "3"}, nil
+
+	case "best-effort":
+		if !hasLevel {
+			return []string{"-c", "2"}, nil
+		}
+
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 || n > 7 {
+			return nil, errors.Errorf("invalid ionice %q: priority level must be from 0 to 7", s)
+		}
+
+		return []string{"-c", "2", "-n", strconv.Itoa(n)}, nil
+	}
+
+	return nil, errors.Errorf("invalid ionice %q: valid options are: idle, best-effort, best-effort:N", s)
+}
+
+// ParseReadRate parses the read rate like "10M" or "512KiB", and returns it
+// in bytes per second. The suffixes K, M and G are 1024-based, and can be
+// optionally followed by "B" or "iB"; without a suffix, it's just bytes.
+// Empty string results in 0, which means no limit.
+func ParseReadRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	numStr := strings.TrimSuffix(s, "B")
+	withI := strings.HasSuffix(numStr, "i")
+	numStr = strings.TrimSuffix(numStr, "i")
+
+	var mult int64 = 1
+	if numStr != "" {
+		switch numStr[len(numStr)-1] {
+		case 'K', 'k':
+			mult = 1024
+		case 'M', 'm':
+			mult = 1024 * 1024
+		case 'G', 'g':
+			mult = 1024 * 1024 * 1024
+		}
+	}
+
+	if mult != 1 {
+		numStr = numStr[:len(numStr)-1]
+	} else if withI {
+		return 0, errors.Errorf("invalid read rate %q", s)
+	}
+
+	n, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf(
+			"invalid read rate %q: must be a positive number with an optional K, M or G suffix", s,
+		)
+	}
+
+	return n * mult, nil
+}
+
+// throttling is the effective set of the throttling settings for a single
+// agent invocation.
+type throttling struct {
+	// nice is the niceness to run the agent with; 0 means no change.
+	nice int
+	// ionice is the ionice option, see ParseIONice; empty means no change.
+	ionice string
+	// maxCPUs is passed to the agent as --max-cpus; 0 means no limit.
+	maxCPUs int
+	// maxReadRate is passed to the agent as --max-read-rate, in bytes per
+	// second; 0 means no limit.
+	maxReadRate int64
+}
+
+// getThrottling returns the throttling settings for the agent invocation,
+// considering the logstream options and the gentle mode.
+func getThrottling(opts *LogStreamOptions, gentle bool) throttling {
+	ret := throttling{
+		nice:        opts.Nice,
+		ionice:      opts.IONice,
+		maxCPUs:     opts.MaxCPUs,
+		maxReadRate: opts.MaxReadRate,
+	}
+
+	if gentle {
+		ret.nice = gentleNice
+		ret.ionice = gentleIONice
+		ret.maxCPUs = gentleMaxCPUs
+
+		if ret.maxReadRate == 0 || ret.maxReadRate > gentleMaxReadRate {
+			ret.maxReadRate = gentleMaxReadRate
+		}
+	}
+
+	return ret
+}
+
+// commandPrefix returns the shell words to put right before the command to
+// run it with the configured nice and ionice. Every tool is only used if it
+// works on the host, so if e.g. ionice is missing (like on macOS) or isn't
+// permitted, the command still runs, just without it.
+func (t throttling) commandPrefix() []string {
+	var ret []string
+
+	if t.nice != 0 {
+		ret = append(ret, fmt.Sprintf(
+			"$(nice -n %d true >/dev/null 2>&1 && echo nice -n %d)", t.nice, t.nice,
+		))
+	}
+
+	if ioniceFlags, err := ParseIONice(t.ionice); err == nil && len(ioniceFlags) > 0 {
+		flags := strings.Join(ioniceFlags, " ")
+		ret = append(ret, fmt.Sprintf(
+			"$(ionice %s true >/dev/null 2>&1 && echo ionice %s)", flags, flags,
+		))
+	}
+
+	return ret
+}
+
+// agentArgs returns the nerdlog_agent.sh args for the throttling settings
+// which the agent handles itself.
+func (t throttling) agentArgs() []string {
+	var ret []string
+
+	if t.maxCPUs > 0 {
+		ret = append(ret, "--max-cpus", strconv.Itoa(t.maxCPUs))
+	}
+
+	if t.maxReadRate > 0 {
+		ret = append(ret, "--max-read-rate", strconv.FormatInt(t.maxReadRate, 10))
+	}
+
+	return ret
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIONice(t *testing.T) {
+	type testCase struct {
+		in      string
+		want    []string
+		wantErr string
+	}
+
+	testCases := []testCase{
+		{in: "", want: nil},
+		{in: "idle", want: []string{"-c", "3"}},
+		{in: "best-effort", want: []string{"-c", "2"}},
+		{in: "best-effort:0", want: []string{"-c", "2", "-n", "0"}},
+		{in: "best-effort:7", want: []string{"-c", "2", "-n", "7"}},
+		{in: "best-effort:8", wantErr: `invalid ionice "best-effort:8": priority level must be from 0 to 7`},
+		{in: "best-effort:", wantErr: `invalid ionice "best-effort:": priority level must be from 0 to 7`},
+		{in: "idle:3", wantErr: `invalid ionice "idle:3": idle class doesn't have priority levels`},
+		{in: "realtime", wantErr: `invalid ionice "realtime": valid options are: idle, best-effort, best-effort:N`},
+	}
+
+	for i, tc := range testCases {
+		got, err := ParseIONice(tc.in)
+		if tc.wantErr != "" {
+			assert.EqualErrorf(t, err, tc.wantErr, "test case #%d (%q)", i, tc.in)
+			continue
+		}
+
+		assert.NoErrorf(t, err, "test case #%d (%q)", i, tc.in)
+		assert.Equalf(t, tc.want, got, "test case #%d (%q)", i, tc.in)
+	}
+}
+
+func TestParseReadRate(t *testing.T) {
+	type testCase struct {
+		in      string
+		want    int64
+		wantErr bool
+	}
+
+	testCases := []testCase{
+		{in: "", want: 0},
+		{in: "1000", want: 1000},
+		{in: "512K", want: 512 * 1024},
+		{in: "512KB", want: 512 * 1024},
+		{in: "512KiB", want: 512 * 1024},
+		{in: "10M", want: 10 * 1024 * 1024},
+		{in: "10m", want: 10 * 1024 * 1024},
+		{in: "2G", want: 2 * 1024 * 1024 * 1024},
+		{in: "100B", want: 100},
+
+		{in: "0", wantErr: true},
+		{in: "-5M", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "10iB", wantErr: true},
+		{in: "10T", wantErr: true},
+		{in: "fast", wantErr: true},
+	}
+
+	for i, tc := range testCases {
+		got, err := ParseReadRate(tc.in)
+		if tc.wantErr {
+			assert.Errorf(t, err, "test case #%d (%q)", i, tc.in)
+			continue
+		}
+
+		assert.NoErrorf(t, err, "test case #%d (%q)", i, tc.in)
+		assert.Equalf(t, tc.want, got, "test case #%d (%q)", i, tc.in)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	type testCase struct {
+		descr  string
+		opts   LogStreamOptions
+		gentle bool
+
+		wantPrefix    []string
+		wantAgentArgs []string
+	}
+
+	testCases := []testCase{
+		{
+			descr: "nothing configured",
+		},
+		{
+			descr: "everything configured",
+			opts: LogStreamOptions{
+				Nice:        10,
+				IONice:      "best-effort:7",
+				MaxCPUs:     2,
+				MaxReadRate: 1024,
+			},
+			wantPrefix: []string{
+				"$(nice -n 10 true >/dev/null 2>&1 && echo nice -n 10)",
+				"$(ionice -c 2 -n 7 true >/dev/null 2>&1 && echo ionice -c 2 -n 7)",
+			},
+			wantAgentArgs: []string{"--max-cpus", "2", "--max-read-rate", "1024"},
+		},
+		{
+			descr:  "gentle mode, nothing configured",
+			gentle: true,
+			wantPrefix: []string{
+				"$(nice -n 19 true >/dev/null 2>&1 && echo nice -n 19)",
+				"$(ionice -c 3 true >/dev/null 2>&1 && echo ionice -c 3)",
+			},
+			wantAgentArgs: []string{"--max-cpus", "1", "--max-read-rate", "20971520"},
+		},
+		{
+			descr: "gentle mode keeps the lower configured read rate",
+			opts: LogStreamOptions{
+				Nice:        5,
+				MaxCPUs:     4,
+				MaxReadRate: 1024,
+			},
+			gentle: true,
+			wantPrefix: []string{
+				"$(nice -n 19 true >/dev/null 2>&1 && echo nice -n 19)",
+				"$(ionice -c 3 true >/dev/null 2>&1 && echo ionice -c 3)",
+			},
+			wantAgentArgs: []string{"--max-cpus", "1", "--max-read-rate", "1024"},
+		},
+	}
+
+	for _, tc := range testCases {
+		th := getThrottling(&tc.opts, tc.gentle)
+		assert.Equal(t, tc.wantPrefix, th.commandPrefix(), tc.descr)
+		assert.Equal(t, tc.wantAgentArgs, th.agentArgs(), tc.descr)
+	}
+}